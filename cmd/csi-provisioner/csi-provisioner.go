@@ -32,25 +32,29 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	flag "github.com/spf13/pflag"
+	"google.golang.org/grpc/backoff"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	validation "k8s.io/apimachinery/pkg/util/validation"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	listersv1 "k8s.io/client-go/listers/core/v1"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/workqueue"
 	utilflag "k8s.io/component-base/cli/flag"
 	"k8s.io/component-base/metrics/legacyregistry"
 	_ "k8s.io/component-base/metrics/prometheus/clientgo/leaderelection" // register leader election in the default legacy registry
-	_ "k8s.io/component-base/metrics/prometheus/workqueue"               // register work queues in the default legacy registry
 	csitrans "k8s.io/csi-translation-lib"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
@@ -63,6 +67,7 @@ import (
 	ctrl "github.com/kubernetes-csi/external-provisioner/pkg/controller"
 	"github.com/kubernetes-csi/external-provisioner/pkg/features"
 	"github.com/kubernetes-csi/external-provisioner/pkg/owner"
+	_ "github.com/kubernetes-csi/external-provisioner/pkg/queuemetrics" // register work queues in the default legacy registry
 	snapclientset "github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned"
 	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
 	gatewayInformers "sigs.k8s.io/gateway-api/pkg/client/informers/externalversions"
@@ -78,6 +83,9 @@ var (
 	showVersion          = flag.Bool("version", false, "Show version.")
 	retryIntervalStart   = flag.Duration("retry-interval-start", time.Second, "Initial retry interval of failed provisioning or deletion. It doubles with each failure, up to retry-interval-max.")
 	retryIntervalMax     = flag.Duration("retry-interval-max", 5*time.Minute, "Maximum retry interval of failed provisioning or deletion.")
+	rateLimiterKind      = flag.String("rate-limiter", exponentialRateLimiter, "Rate limiter for retries of failed provisioning or deletion: \"exponential\" uses retry-interval-start and retry-interval-max per volume, \"bucket\" limits all retries to rate-limiter-qps with bursts of rate-limiter-burst.")
+	rateLimiterQPS       = flag.Float32("rate-limiter-qps", 10, "Retries per second allowed by the bucket rate limiter.")
+	rateLimiterBurst     = flag.Int("rate-limiter-burst", 100, "Maximum burst of retries allowed by the bucket rate limiter.")
 	workerThreads        = flag.Uint("worker-threads", 100, "Number of provisioner worker threads, in other words nr. of simultaneous CSI calls.")
 	finalizerThreads     = flag.Uint("cloning-protection-threads", 1, "Number of simultaneously running threads, handling cloning finalizer removal")
 	capacityThreads      = flag.Uint("capacity-threads", 1, "Number of simultaneously running threads, handling CSIStorageCapacity objects")
@@ -93,6 +101,7 @@ var (
 	httpEndpoint            = flag.String("http-endpoint", "", "The TCP network address where the HTTP server for diagnostics, including pprof, metrics and leader election health check, will listen (example: `:8080`). The default is empty string, which means the server is disabled. Only one of `--metrics-address` and `--http-endpoint` can be set.")
 	metricsPath             = flag.String("metrics-path", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
 	enableProfile           = flag.Bool("enable-pprof", false, "Enable pprof profiling on the TCP network address specified by --http-endpoint. The HTTP path is `/debug/pprof/`.")
+	debugEndpoints          = flag.Bool("debug-endpoints", false, "Serve debugging information on the TCP network address specified by --http-endpoint. The HTTP path `/debug/driver` returns the name, version and capabilities that the CSI driver reported at startup as JSON.")
 
 	leaderElectionLeaseDuration = flag.Duration("leader-election-lease-duration", 15*time.Second, "Duration, in seconds, that non-leader candidates will wait to force acquire leadership. Defaults to 15 seconds.")
 	leaderElectionRenewDeadline = flag.Duration("leader-election-renew-deadline", 10*time.Second, "Duration, in seconds, that the acting leader will retry refreshing leadership before giving up. Defaults to 10 seconds.")
@@ -106,19 +115,94 @@ var (
 	kubeAPICapacityQPS   = flag.Float32("kube-api-capacity-qps", 1, "QPS to use for storage capacity updates while communicating with the kubernetes apiserver. Defaults to 1.0.")
 	kubeAPICapacityBurst = flag.Int("kube-api-capacity-burst", 5, "Burst to use for storage capacity updates while communicating with the kubernetes apiserver. Defaults to 5.")
 
+	capacityWriteQPS   = flag.Float32("capacity-write-qps", 0, "QPS for creating, updating and deleting CSIStorageCapacity objects, in addition to --kube-api-capacity-qps which also covers watching them. Zero, the default, disables this separate limit.")
+	capacityWriteBurst = flag.Int("capacity-write-burst", 1, "Burst for creating, updating and deleting CSIStorageCapacity objects when --capacity-write-qps is set. Defaults to 1.")
+
 	enableCapacity           = flag.Bool("enable-capacity", false, "This enables producing CSIStorageCapacity objects with capacity information from the driver's GetCapacity call.")
 	capacityImmediateBinding = flag.Bool("capacity-for-immediate-binding", false, "Enables producing capacity information for storage classes with immediate binding. Not needed for the Kubernetes scheduler, maybe useful for other consumers or for debugging.")
 	capacityPollInterval     = flag.Duration("capacity-poll-interval", time.Minute, "How long the external-provisioner waits before checking for storage capacity changes.")
+	capacityCoalesceWindow   = flag.Duration("capacity-coalesce-window", 0, "How long the external-provisioner waits before refreshing a CSIStorageCapacity object after a change was detected. Further changes during that time are combined into a single update. Zero, the default, refreshes immediately.")
+	capacityMaxObjects       = flag.Int("max-capacity-objects", 0, "Maximum number of CSIStorageCapacity objects that get created for the driver. Objects beyond that are not created, which is logged and counted in the csistoragecapacities_over_limit metric. Zero, the default, means no limit.")
+	capacityRefreshWorkers   = flag.Uint("capacity-refresh-workers", 0, "Maximum number of GetCapacity calls that run concurrently to refresh CSIStorageCapacity objects. Must not be larger than --capacity-threads. Zero, the default, allows one per capacity thread.")
+	capacityReadinessGate    = flag.Bool("capacity-readiness-gate", false, "Report the external-provisioner as not ready on the /readyz endpoint until CSIStorageCapacity objects have been published at least once for all known topology segments and storage classes. Requires --enable-capacity.")
+	capacityFitMetric        = flag.Bool("capacity-fit-metric", false, "Count PVCs which probably don't fit into the capacity reported by the CSIStorageCapacity objects for their storage class and node in the csistoragecapacities_predicted_insufficient_total metric. Provisioning is attempted anyway.")
+	capacityAggregationKeys  = flag.StringSlice("capacity-aggregation-keys", nil, "Comma-separated list of topology keys that are used for CSIStorageCapacity objects. Nodes which only differ in other topology keys share the same CSIStorageCapacity objects. The default is to use all topology keys reported by the CSI driver.")
 	capacityOwnerrefLevel    = flag.Int("capacity-ownerref-level", 1, "The level indicates the number of objects that need to be traversed starting from the pod identified by the POD_NAME and NAMESPACE environment variables to reach the owning object for CSIStorageCapacity objects: -1 for no owner, 0 for the pod itself, 1 for a StatefulSet or DaemonSet, 2 for a Deployment, etc.")
 
 	enableNodeDeployment           = flag.Bool("node-deployment", false, "Enables deploying the external-provisioner together with a CSI driver on nodes to manage node-local volumes.")
 	nodeDeploymentImmediateBinding = flag.Bool("node-deployment-immediate-binding", true, "Determines whether immediate binding is supported when deployed on each node.")
 	nodeDeploymentBaseDelay        = flag.Duration("node-deployment-base-delay", 20*time.Second, "Determines how long the external-provisioner sleeps initially before trying to own a PVC with immediate binding.")
 	nodeDeploymentMaxDelay         = flag.Duration("node-deployment-max-delay", 60*time.Second, "Determines how long the external-provisioner sleeps at most before trying to own a PVC with immediate binding.")
+	nodeDeploymentCapacityBudget   = flag.String("node-deployment-capacity-budget", "", "Total size of all volumes that may be provisioned for the node when deployed on each node, for example 100Gi. The provisioner.k8s.io/capacity-budget annotation of the node takes precedence. The default is no limit.")
 	controllerPublishReadOnly      = flag.Bool("controller-publish-readonly", false, "This option enables PV to be marked as readonly at controller publish volume call if PVC accessmode has been set to ROX.")
 
 	preventVolumeModeConversion = flag.Bool("prevent-volume-mode-conversion", false, "Prevents an unauthorised user from modifying the volume mode when creating a PVC from an existing VolumeSnapshot.")
 
+	retryOnVolumeNameConflict = flag.Bool("retry-on-volume-name-conflict", false, "If CreateVolume fails because the volume name is already used by an incompatible volume, retry once with a suffix derived from the PVC UID appended to the name.")
+	honorForceBlockVolumeMode = flag.Bool("honor-force-block-volume-mode", false, "Provision raw block volumes for all PVCs of a StorageClass annotated with provisioner.k8s.io/force-block-volume-mode=true, regardless of the volume mode of the PVC.")
+	secretCacheTTL            = flag.Duration("secret-cache-ttl", 0, "How long secrets for CreateVolume and DeleteVolume are cached in memory. Zero disables the cache, which is the default.")
+	honorPVCFSType            = flag.Bool("honor-pvc-fstype", false, "Use the fstype from the provisioner.k8s.io/fstype annotation of a PVC if its StorageClass does not set one. An fstype in the StorageClass always takes precedence, the annotation takes precedence over --default-fstype.")
+	disableDelete             = flag.Bool("disable-delete", false, "Never delete volumes. Released PVs are left for some other controller and no finalizer gets added to PVs, even when the HonorPVReclaimPolicy feature is enabled.")
+	requireApproval           = flag.Bool("require-provisioning-approval", false, "Hold back provisioning for PVCs annotated with provisioner.k8s.io/approval-required=true and for PVCs larger than --provisioning-approval-threshold until their namespace is annotated with provisioner.k8s.io/approval-<PVC UID>=approved.")
+	approvalThreshold         = flag.String("provisioning-approval-threshold", "", "With --require-provisioning-approval, PVCs requesting more than this size, for example 1Ti, need approval. Empty means that only annotated PVCs need approval.")
+	wellKnownTopologyLabels   = flag.StringToString("well-known-topology-labels", nil, "Comma-separated list of <driver topology key>=<well-known label> pairs, for example example.com/zone=topology.kubernetes.io/zone. The node affinity of new PVs also requires the well-known labels with the values of the driver topology keys. Supported labels are topology.kubernetes.io/zone and topology.kubernetes.io/region.")
+	provisioningConditions    = flag.Bool("provisioning-conditions", false, "Publish the current stage of provisioning as Provisioning condition in the status of PVCs. The condition gets removed once the volume is provisioned.")
+	expectedDriverName        = flag.String("expected-driver-name", "", "The name that the CSI driver is expected to report. A mismatch is logged as a warning and reported by the /readyz endpoint, or is fatal with --fail-on-driver-name-mismatch. Empty disables the check.")
+	failOnDriverNameMismatch  = flag.Bool("fail-on-driver-name-mismatch", false, "Exit if the CSI driver does not report the name set with --expected-driver-name.")
+	honorPVCEncryptionKey     = flag.Bool("honor-pvc-encryption-key", false, "Pass the provisioner.k8s.io/encryption-key annotation of a PVC to CreateVolume as csi.storage.k8s.io/encryption-key parameter if the StorageClass sets csi.storage.k8s.io/encryption to \"required\" or \"optional\".")
+	allowForceRemoveFinalizer = flag.Bool("allow-force-remove-finalizer", false, "Honor the provisioner.k8s.io/force-remove-finalizer=true annotation on PVs: DeleteVolume is skipped and the PV gets released, which may leak the backend volume.")
+	enableFinalizers          = flag.Bool("enable-finalizers", true, "Add finalizers to PVs, when the HonorPVReclaimPolicy feature is enabled, and to the source PVCs of clones. Disable this when the external-provisioner is not allowed to update finalizers. PVs then get deleted by the standard deletion flow and source PVCs are not protected while cloning.")
+
+	volumeCapacityReconcileInterval = flag.Duration("volume-capacity-reconcile-interval", 0, "How often the capacity of volumes as reported by ListVolumes or ControllerGetVolume is compared with the capacity of their PVs, to update PVs of volumes that were resized directly on the storage backend. Zero disables the check, which is the default.")
+	storageClassLabelsToPV          = flag.StringSlice("storage-class-labels-to-pv", nil, "Comma-separated list of StorageClass label keys which get copied to the PVs provisioned for the StorageClass. Keys with a kubernetes.io or k8s.io prefix are not allowed.")
+	storageClassAnnotationsToPV     = flag.StringSlice("storage-class-annotations-to-pv", nil, "Comma-separated list of StorageClass annotation keys which get copied to the PVs provisioned for the StorageClass. Keys with a kubernetes.io or k8s.io prefix are not allowed.")
+	checkClaimCapabilities          = flag.Bool("check-claim-capabilities", false, "Check PVCs against the capabilities of the CSI driver before provisioning them. PVCs which need a capability that the driver lacks, like restoring snapshots or cloning, get an UnsupportedCapability event instead of a failed CreateVolume call.")
+	capabilitiesRefreshInterval     = flag.Duration("capabilities-refresh-interval", 10*time.Minute, "How often the CSI driver capabilities used by --check-claim-capabilities are retrieved again. Zero disables refreshing.")
+	maxProvisioningRetries          = flag.Int("max-provisioning-retries", 0, "How often provisioning of a PVC may fail before the external-provisioner gives up on it and sets the ProvisioningFailed condition in the PVC status. Changing the PVC spec starts counting again. Zero, the default, retries forever.")
+	enforceStorageClassParameters   = flag.Bool("enforce-immutable-storage-class-parameters", false, "Refuse to provision for a StorageClass whose parameters have changed since the external-provisioner first provisioned for it. The hash of the parameters gets recorded in the provisioner.k8s.io/recorded-parameters-hash annotation of the StorageClass. A change is accepted by setting the provisioner.k8s.io/acknowledged-parameters-hash annotation to the hash shown in the StorageClassParametersChanged event. Needs permission to update StorageClasses.")
+	maxPVCOperationTimeout          = flag.Duration("max-pvc-operation-timeout", 0, "Maximum CreateVolume timeout that PVCs may ask for with the provisioner.k8s.io/operation-timeout annotation. Zero, the default, ignores the annotation and always uses --timeout.")
+	translateErrors                 = flag.Bool("translate-errors", false, "Prepend messages that explain common CSI driver errors, like ResourceExhausted, to the errors of failed CreateVolume and DeleteVolume calls in PVC and PV events.")
+	errorMessagesConfigMap          = flag.String("error-messages-configmap", "", "<namespace>/<name> of a ConfigMap with driver specific messages for --translate-errors. Its keys are gRPC status code names like ResourceExhausted. They override the built-in messages, empty values disable them.")
+	recordCreateVolumeParameters    = flag.Bool("record-create-volume-parameters", false, "Record the parameters of the CreateVolume call in the provisioner.k8s.io/create-volume-parameters annotation of new PVs. Values of keys which are not in --recorded-parameters-allowlist are redacted.")
+	recordedParametersAllowlist     = flag.StringSlice("recorded-parameters-allowlist", nil, "Comma-separated list of CreateVolume parameter keys whose values are recorded by --record-create-volume-parameters. Keys that look like they reference secrets, passwords, tokens or credentials are always redacted.")
+	preferredTopologyStrategy       = flag.String("preferred-topology-strategy", ctrl.TopologyStrategyDefault, "Immediate binding: strategy for ordering the preferred topology segments passed to CreateVolume, one of "+strings.Join(ctrl.TopologyStrategies, ", ")+". The default orders them based on the hash of the PVC name.")
+	checkVolumeModeAccessModes      = flag.Bool("check-volume-mode-access-modes", false, "Check the access modes of PVCs against the provisioner.k8s.io/filesystem-access-modes and provisioner.k8s.io/block-access-modes annotations of the CSIDriver object before calling CreateVolume. PVCs with unsupported access modes get an UnsupportedAccessMode event.")
+	allowCapacityCheckBypass        = flag.Bool("allow-capacity-check-bypass", false, "Allow PVCs with the provisioner.k8s.io/bypass-capacity-check annotation in namespaces with the provisioner.k8s.io/allow-capacity-check-bypass annotation to exceed the --node-deployment-capacity-budget.")
+	checkPermissions                = flag.Bool("check-permissions", false, "Check at startup with SelfSubjectAccessReviews whether the external-provisioner has the RBAC permissions needed for the enabled features and log the missing ones.")
+	failOnMissingPermissions        = flag.Bool("fail-on-missing-permissions", false, "Exit if --check-permissions finds missing permissions.")
+	recordFSGroupDelegation         = flag.Bool("record-fsgroup-delegation", false, "Check once at startup whether the node service of the driver has the VOLUME_MOUNT_GROUP capability and, if it has, annotate new filesystem PVs with provisioner.k8s.io/fsgroup-delegated.")
+	provisioningStatusKind          = flag.String("provisioning-status-kind", "", "Mirror the provisioning stage and result of each PVC in a custom object of this kind, with the same name and namespace as the PVC. The kind is given as <kind>.<version>.<group>, for example ProvisioningStatus.v1alpha1.example.com. Empty disables it.")
+	parameterKeyCase                = flag.String("parameter-key-case", ctrl.ParameterKeyCasePreserve, "Case of StorageClass parameter keys passed to CreateVolume, one of "+strings.Join(ctrl.ParameterKeyCases, ", ")+". "+ctrl.ParameterKeyCaseLower+" lowercases all keys except those with the csi.storage.k8s.io/ prefix and the deprecated secret keys.")
+	renamedStorageClasses           = flag.StringToString("renamed-storage-classes", nil, "Comma-separated list of <old name>=<new name> pairs of StorageClasses that were recreated under a new name. Deleting PVs which still reference the old name then uses the new StorageClass.")
+	requireTopology                 = flag.Bool("require-topology", false, "Fail provisioning with an event when the topology of a volume cannot be determined, instead of creating it without complete accessibility requirements.")
+	volumeHandlePrefix              = flag.String("volume-handle-prefix", "", "Prefix passed to CreateVolume as the csi.storage.k8s.io/volume-handle-prefix parameter, for drivers which use it to keep the volume handles of several clusters apart. Must be a DNS-1123 label. Empty disables it.")
+	snapshotBeforeDeletion          = flag.Bool("snapshot-before-deletion", false, "Honor the provisioner.k8s.io/snapshot-before-deletion=true annotation on StorageClasses: volumes of those classes only get deleted after a snapshot of them is ready to use.")
+	pauseConfigMap                  = flag.String("pause-configmap", "", "<namespace>/<name> of a ConfigMap whose paused: \"true\" entry pauses all provisioning and deletion until it is removed. Empty disables it.")
+	projectMappingConfigMap         = flag.String("project-mapping-configmap", "", "<namespace>/<name> of a ConfigMap which maps namespaces, its keys, to backend projects, its values. The project of the PVC namespace gets passed to CreateVolume as csi.storage.k8s.io/project parameter. The provisioner.k8s.io/project annotation of a namespace takes precedence. Empty disables it.")
+	defaultProject                  = flag.String("default-project", "", "With --project-mapping-configmap: project of namespaces which are not mapped. Empty, the default, fails provisioning for them.")
+	nodeLabelTopologyKeys           = flag.StringSlice("node-label-topology-keys", nil, "Comma-separated list of node label keys whose values get added to the topology segments passed to CreateVolume, in addition to the topology keys reported by the CSI driver. Nodes without a label are skipped for that label.")
+	pvcResyncPeriod                 = flag.Duration("pvc-resync-period", controller.DefaultResyncPeriod, "How often all PVCs are checked again, in addition to the checks triggered by changes. Catches PVCs whose changes were missed. Zero disables it.")
+	pvResyncPeriod                  = flag.Duration("pv-resync-period", controller.DefaultResyncPeriod, "How often all PVs are checked again, in addition to the checks triggered by changes. Catches PVs whose changes were missed. Zero disables it.")
+	minThroughput                   = flag.Int64("min-throughput", 0, "Minimum throughput in MB/s that PVCs and StorageClasses may request with the provisioner.k8s.io/throughput annotation or the csi.storage.k8s.io/throughput parameter. Zero, the default, disables the minimum.")
+	maxThroughput                   = flag.Int64("max-throughput", 0, "Maximum throughput in MB/s that PVCs and StorageClasses may request with the provisioner.k8s.io/throughput annotation or the csi.storage.k8s.io/throughput parameter. Zero, the default, disables the maximum.")
+	terminalErrorCodes              = flag.StringSlice("terminal-error-codes", ctrl.DefaultTerminalErrorCodes, "Comma-separated list of gRPC status code names like InvalidArgument. CreateVolume and DeleteVolume are not retried after errors with these codes, the PVC or PV gets a Warning event instead. Empty retries all errors.")
+	maxImmediateTopologySegments    = flag.Int("max-immediate-topology-segments", 0, "Immediate binding: maximum number of topology segments passed to CreateVolume. The segments are the first ones chosen by --preferred-topology-strategy among the allowed topologies. Zero, the default, passes all segments.")
+	checkVolumeBindingMode          = flag.Bool("check-volume-binding-mode", false, "Check the volume binding mode of each StorageClass against the topology support of the CSI driver when the StorageClass is used for the first time. Mismatches are logged and reported with a BindingModeMismatch Warning event.")
+	maxParametersSize               = flag.Int("max-parameters-size", 0, "Maximum size in bytes of the keys and values of the CreateVolume parameters. Larger parameters are reported with a ParametersTooLarge Warning event for the PVC and the controller_create_volume_parameters_oversized_total metric. Zero, the default, disables the check.")
+	trimExtraCreateMetadata         = flag.Bool("trim-extra-create-metadata", false, "Remove parameters of --extra-create-metadata, least important first, from CreateVolume parameters which exceed --max-parameters-size, until they fit.")
+	releaseRetainedVolumes          = flag.Bool("release-retained-volumes", false, "Remove the finalizer of the external-provisioner from PVs with the Retain reclaim policy when they get deleted.")
+	passIdempotencyToken            = flag.Bool("idempotency-token", false, "Pass the csi.storage.k8s.io/idempotency-token parameter to CreateVolume. It is the same for all attempts to provision a PVC, so that drivers which choose volume names themselves can return the volume created by an earlier attempt. The token is recorded in the provisioner.k8s.io/idempotency-token annotation of the PV.")
+	csiReconnect                    = flag.Bool("csi-reconnect", false, "Reconnect to the CSI driver after the connection got lost, for example because the driver restarted, instead of exiting.")
+	csiReconnectBackoffBase         = flag.Duration("csi-reconnect-backoff-base", time.Second, "With --csi-reconnect: delay before the first reconnection attempt. It grows exponentially up to --csi-reconnect-backoff-max.")
+	csiReconnectBackoffMax          = flag.Duration("csi-reconnect-backoff-max", backoff.DefaultConfig.MaxDelay, "With --csi-reconnect: maximum delay between reconnection attempts.")
+	csiFailFast                     = flag.Bool("csi-fail-fast", false, "With --csi-reconnect: fail CSI calls with Unavailable right away while the driver is not connected, instead of waiting for it up to --timeout. The calls get retried like other failed calls.")
+	csiUserAgent                    = flag.String("csi-user-agent", "", "gRPC user agent for the connection to the CSI driver, for example to identify this provisioner instance to the storage backend, like csi-provisioner/<version> (<driver name>). Empty, the default, keeps the user agent of gRPC.")
+	suppressRoutineEvents           = flag.Bool("suppress-routine-events", false, "Don't emit the Normal events which get repeated each time a PVC is retried while it waits, like WaitingForSnapshot, ProvisioningApprovalRequired and ProvisioningPaused. Warning events are still emitted.")
+	routineEventInterval            = flag.Duration("routine-event-interval", 0, "Emit the Normal events which get repeated each time a PVC is retried while it waits at most once per interval for the same PVC and reason. Zero, the default, emits all of them. Ignored with --suppress-routine-events.")
+	indexVolumeHandles              = flag.Bool("index-volume-handles", false, "Index PVs by volume handle in memory and refuse to delete a volume while another PV which is neither being deleted nor Released or Failed still uses its volume handle.")
+	maxRetryAfter                   = flag.Duration("max-retry-after", 0, "Retry provisioning of a PVC after the delay that the CSI driver returned in a google.rpc.RetryInfo detail of a CreateVolume error, instead of the delay of the rate limiter. Longer delays are shortened to this value. Zero, the default, ignores such delays.")
+	recordTopology                  = flag.Bool("record-claim-topology", false, "Set the provisioner.k8s.io/topology annotation of PVCs to the topology requirements passed to CreateVolume, as JSON.")
+
 	featureGates        map[string]bool
 	provisionController *controller.ProvisionController
 	version             = "unknown"
@@ -157,6 +241,24 @@ func main() {
 		klog.Error("only one of `--metrics-address` and `--http-endpoint` can be set.")
 		os.Exit(1)
 	}
+	if *enableLeaderElection {
+		if err := checkLeaderElectionTiming(*leaderElectionLeaseDuration, *leaderElectionRenewDeadline, *leaderElectionRetryPeriod); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	if *csiFailFast && !*csiReconnect {
+		klog.Fatal("--csi-fail-fast requires --csi-reconnect")
+	}
+	if *csiReconnect && (*csiReconnectBackoffBase <= 0 || *csiReconnectBackoffMax < *csiReconnectBackoffBase) {
+		klog.Fatal("--csi-reconnect-backoff-base must be positive and not larger than --csi-reconnect-backoff-max")
+	}
+	connectionOptions := ctrl.ConnectionOptions{
+		Reconnect:        *csiReconnect,
+		BackoffBaseDelay: *csiReconnectBackoffBase,
+		BackoffMaxDelay:  *csiReconnectBackoffMax,
+		FailFast:         *csiFailFast,
+		UserAgent:        *csiUserAgent,
+	}
 	addr := *metricsAddress
 	if addr == "" {
 		addr = *httpEndpoint
@@ -204,13 +306,26 @@ func main() {
 		}
 	}
 
+	var provisioningStatusReporter *ctrl.ProvisioningStatusReporter
+	if *provisioningStatusKind != "" {
+		gvk, _ := schema.ParseKindArg(*provisioningStatusKind)
+		if gvk == nil || gvk.Group == "" {
+			klog.Fatalf("Invalid --provisioning-status-kind %q, must be <kind>.<version>.<group>", *provisioningStatusKind)
+		}
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			klog.Fatalf("Failed to create dynamic client: %v", err)
+		}
+		provisioningStatusReporter = ctrl.NewProvisioningStatusReporter(dynamicClient, *gvk, *operationTimeout)
+	}
+
 	metricsManager := metrics.NewCSIMetricsManagerWithOptions("", /* driverName */
 		// Will be provided via default gatherer.
 		metrics.WithProcessStartTime(false),
 		metrics.WithSubsystem(metrics.SubsystemSidecar),
 	)
 
-	grpcClient, err := ctrl.Connect(*csiEndpoint, metricsManager)
+	grpcClient, err := ctrl.ConnectWithOptions(*csiEndpoint, metricsManager, connectionOptions)
 	if err != nil {
 		klog.Error(err.Error())
 		os.Exit(1)
@@ -229,6 +344,13 @@ func main() {
 	}
 	klog.V(2).Infof("Detected CSI driver %s", provisionerName)
 	metricsManager.SetDriverName(provisionerName)
+	driverNameErr := checkDriverName(*expectedDriverName, provisionerName)
+	if driverNameErr != nil {
+		if *failOnDriverNameMismatch {
+			klog.Fatalf("Unexpected CSI driver: %v", driverNameErr)
+		}
+		klog.Warningf("UNEXPECTED CSI DRIVER: %v", driverNameErr)
+	}
 
 	translator := csitrans.New()
 	supportsMigrationFromInTreePluginName := ""
@@ -244,7 +366,7 @@ func main() {
 			// Will be provided via default gatherer.
 			metrics.WithProcessStartTime(false),
 			metrics.WithMigration())
-		migratedGrpcClient, err := ctrl.Connect(*csiEndpoint, metricsManager)
+		migratedGrpcClient, err := ctrl.ConnectWithOptions(*csiEndpoint, metricsManager, connectionOptions)
 		if err != nil {
 			klog.Error(err.Error())
 			os.Exit(1)
@@ -263,7 +385,7 @@ func main() {
 	mux := http.NewServeMux()
 	gatherers := prometheus.Gatherers{
 		// For workqueue and leader election metrics, set up via the anonymous imports of:
-		// https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/component-base/metrics/prometheus/workqueue/metrics.go
+		// github.com/kubernetes-csi/external-provisioner/pkg/queuemetrics
 		// https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/component-base/metrics/prometheus/clientgo/leaderelection/metrics.go
 		//
 		// Also to happens to include Go runtime and process metrics:
@@ -278,6 +400,113 @@ func main() {
 		klog.Fatalf("Error getting CSI driver capabilities: %s", err)
 	}
 
+	driverInfo, err := ctrl.GetDriverInfo(grpcClient, *operationTimeout, pluginCapabilities, controllerCapabilities)
+	if err != nil {
+		klog.Fatalf("Error getting CSI driver info: %s", err)
+	}
+	klog.V(2).Infof("Detected CSI driver version %q", driverInfo.VendorVersion)
+	ctrl.RecordDriverInfo(driverInfo)
+
+	var errorMessages ctrl.ErrorMessages
+	if *translateErrors {
+		errorMessages = ctrl.DefaultErrorMessages()
+		if *errorMessagesConfigMap != "" {
+			parts := strings.Split(*errorMessagesConfigMap, "/")
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				klog.Fatalf("Invalid --error-messages-configmap %q, must be <namespace>/<name>", *errorMessagesConfigMap)
+			}
+			errorMessages, err = ctrl.LoadErrorMessages(context.Background(), clientset, parts[0], parts[1])
+			if err != nil {
+				klog.Fatalf("Failed to load error messages: %v", err)
+			}
+		}
+	}
+
+	var projectMapping *ctrl.ProjectMapping
+	if *projectMappingConfigMap != "" {
+		parts := strings.Split(*projectMappingConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Fatalf("Invalid --project-mapping-configmap %q, must be <namespace>/<name>", *projectMappingConfigMap)
+		}
+		projectMapping, err = ctrl.LoadProjectMapping(context.Background(), clientset, parts[0], parts[1], *defaultProject)
+		if err != nil {
+			klog.Fatalf("Failed to load project mapping: %v", err)
+		}
+	} else if *defaultProject != "" {
+		klog.Fatal("--default-project requires --project-mapping-configmap")
+	}
+
+	var pauseFactory informers.SharedInformerFactory
+	var globalPause *ctrl.GlobalPause
+	if *pauseConfigMap != "" {
+		parts := strings.Split(*pauseConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Fatalf("Invalid --pause-configmap %q, must be <namespace>/<name>", *pauseConfigMap)
+		}
+		pauseFactory = informers.NewSharedInformerFactoryWithOptions(clientset, ctrl.ResyncPeriodOfCsiNodeInformer,
+			informers.WithNamespace(parts[0]),
+			informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
+				lo.FieldSelector = fields.OneTermEqualSelector("metadata.name", parts[1]).String()
+			}),
+		)
+		globalPause = ctrl.NewGlobalPause(pauseFactory.Core().V1().ConfigMaps(), parts[1])
+	}
+
+	var driverCapabilities *ctrl.DriverCapabilities
+	if *checkClaimCapabilities {
+		driverCapabilities = ctrl.NewDriverCapabilities(grpcClient, *operationTimeout, pluginCapabilities, controllerCapabilities)
+	}
+
+	fsGroupDelegated := false
+	if *recordFSGroupDelegation {
+		fsGroupDelegated, err = ctrl.SupportsVolumeMountGroup(grpcClient, *operationTimeout)
+		if err != nil {
+			klog.Warningf("Checking the VOLUME_MOUNT_GROUP node capability failed, not recording fsGroup delegation: %v", err)
+		}
+		klog.V(2).Infof("Recording fsGroup delegation on PVs: %v", fsGroupDelegated)
+	}
+
+	if *checkPermissions {
+		config := permissionConfig{
+			volumeAttachments:  controllerCapabilities[csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME],
+			snapshots:          controllerCapabilities[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT],
+			claimStatus:        *provisioningConditions || *requireApproval || *maxProvisioningRetries > 0,
+			storageClassUpdate: *enforceStorageClassParameters,
+			volumeUpdate:       *volumeCapacityReconcileInterval > 0 || *snapshotBeforeDeletion,
+			csiDrivers:         *checkVolumeModeAccessModes,
+			namespaces:         *allowCapacityCheckBypass || *projectMappingConfigMap != "",
+			referenceGrants:    utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource),
+		}
+		if *enableLeaderElection {
+			config.leaderElectionNamespace = *leaderElectionNamespace
+			if config.leaderElectionNamespace == "" {
+				config.leaderElectionNamespace = os.Getenv("NAMESPACE")
+			}
+		}
+		if *enableCapacity {
+			config.capacityNamespace = os.Getenv("NAMESPACE")
+		}
+		if *translateErrors && *errorMessagesConfigMap != "" {
+			config.errorMessagesNamespace = strings.Split(*errorMessagesConfigMap, "/")[0]
+		}
+		if *pauseConfigMap != "" {
+			config.pauseNamespace = strings.Split(*pauseConfigMap, "/")[0]
+		}
+		if *projectMappingConfigMap != "" {
+			config.projectsNamespace = strings.Split(*projectMappingConfigMap, "/")[0]
+		}
+		missing, err := missingPermissions(context.Background(), clientset, requiredPermissions(config))
+		if err != nil {
+			klog.Warningf("Checking permissions failed: %v", err)
+		}
+		for _, permission := range missing {
+			klog.Errorf("Missing permission: %s", permission)
+		}
+		if len(missing) > 0 && *failOnMissingPermissions {
+			klog.Fatalf("%d permissions are missing, see deploy/kubernetes/rbac.yaml", len(missing))
+		}
+	}
+
 	// Generate a unique ID for this provisioner
 	timeStamp := time.Now().UnixNano() / int64(time.Millisecond)
 	identity := strconv.FormatInt(timeStamp, 10) + "-" + strconv.Itoa(rand.Intn(10000)) + "-" + provisionerName
@@ -285,7 +514,7 @@ func main() {
 		identity = identity + "-" + node
 	}
 
-	factory := informers.NewSharedInformerFactory(clientset, ctrl.ResyncPeriodOfCsiNodeInformer)
+	factory := newInformerFactory(clientset, ctrl.ResyncPeriodOfCsiNodeInformer, *pvcResyncPeriod, *pvResyncPeriod)
 	var factoryForNamespace informers.SharedInformerFactory // usually nil, only used for CSIStorageCapacity
 
 	// -------------------------------
@@ -302,11 +531,21 @@ func main() {
 		klog.Info("CSI driver does not support PUBLISH_UNPUBLISH_VOLUME, not watching VolumeAttachments")
 	}
 
+	var volumeHandles *ctrl.VolumeHandles
+	if *indexVolumeHandles {
+		pvInformer := factory.Core().V1().PersistentVolumes().Informer()
+		if err := ctrl.AddVolumeHandleIndex(pvInformer); err != nil {
+			klog.Fatalf("Failed to index PVs by volume handle: %v", err)
+		}
+		volumeHandles = ctrl.NewVolumeHandles(pvInformer)
+	}
+
 	var nodeDeployment *ctrl.NodeDeployment
 	if *enableNodeDeployment {
 		nodeDeployment = &ctrl.NodeDeployment{
 			NodeName:         node,
 			ClaimInformer:    factory.Core().V1().PersistentVolumeClaims(),
+			VolumeInformer:   factory.Core().V1().PersistentVolumes(),
 			ImmediateBinding: *nodeDeploymentImmediateBinding,
 			BaseDelay:        *nodeDeploymentBaseDelay,
 			MaxDelay:         *nodeDeploymentMaxDelay,
@@ -316,6 +555,10 @@ func main() {
 			klog.Fatalf("Failed to get node info from CSI driver: %v", err)
 		}
 		nodeDeployment.NodeInfo = *nodeInfo
+		nodeDeployment.CapacityBudget, err = ctrl.GetNodeCapacityBudget(ctx, clientset, node, *nodeDeploymentCapacityBudget)
+		if err != nil {
+			klog.Fatalf("Failed to determine node capacity budget: %v", err)
+		}
 	}
 
 	var nodeLister listersv1.NodeLister
@@ -376,9 +619,31 @@ func main() {
 
 	// -------------------------------
 	// PersistentVolumeClaims informer
-	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax)
+	rateLimiter, err := newRateLimiter(*rateLimiterKind, *retryIntervalStart, *retryIntervalMax, *rateLimiterQPS, *rateLimiterBurst)
+	if err != nil {
+		klog.Fatalf("Failed to create rate limiter: %v", err)
+	}
+	var retryAfterRateLimiter *ctrl.RetryAfterRateLimiter
+	if *maxRetryAfter > 0 {
+		retryAfterRateLimiter = ctrl.NewRetryAfterRateLimiter(rateLimiter, *maxRetryAfter)
+		rateLimiter = retryAfterRateLimiter
+	}
 	claimQueue := workqueue.NewNamedRateLimitingQueue(rateLimiter, "claims")
-	claimInformer := factory.Core().V1().PersistentVolumeClaims().Informer()
+	claimInformer := ctrl.NewRequeueInformer(defaultResyncInformer{factory.Core().V1().PersistentVolumeClaims().Informer()})
+	volumeInformer := ctrl.NewRequeueInformer(defaultResyncInformer{factory.Core().V1().PersistentVolumes().Informer()})
+	if globalPause != nil {
+		globalPause.RequeueOnResume(claimInformer, volumeInformer)
+	}
+	var retainedVolumeController *ctrl.RetainedVolumeController
+	if *releaseRetainedVolumes {
+		retainedVolumeController = ctrl.NewRetainedVolumeController(
+			clientset,
+			provisionerName,
+			*operationTimeout,
+			volumeInformer,
+			workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "retainedvolumes"),
+		)
+	}
 
 	// Setup options
 	provisionerOptions := []func(*controller.ProvisionController) error{
@@ -389,17 +654,85 @@ func main() {
 		controller.Threadiness(int(*workerThreads)),
 		controller.CreateProvisionedPVLimiter(workqueue.DefaultControllerRateLimiter()),
 		controller.ClaimsInformer(claimInformer),
+		controller.VolumesInformer(volumeInformer),
 		controller.NodesLister(nodeLister),
 	}
 
 	if utilfeature.DefaultFeatureGate.Enabled(features.HonorPVReclaimPolicy) {
-		provisionerOptions = append(provisionerOptions, controller.AddFinalizer(true))
+		if *disableDelete {
+			// The finalizer would block the deletion of PVs forever
+			// because we never remove it.
+			klog.Info("Not adding finalizers to PVs because deletion is disabled")
+		} else if !*enableFinalizers {
+			klog.Info("Not adding finalizers to PVs because finalizers are disabled")
+		} else {
+			provisionerOptions = append(provisionerOptions, controller.AddFinalizer(true))
+		}
 	}
 
 	if supportsMigrationFromInTreePluginName != "" {
 		provisionerOptions = append(provisionerOptions, controller.AdditionalProvisionerNames([]string{supportsMigrationFromInTreePluginName}))
 	}
 
+	var approvalThresholdBytes int64
+	if *approvalThreshold != "" {
+		quantity, err := resource.ParseQuantity(*approvalThreshold)
+		if err != nil {
+			klog.Fatalf("Invalid --provisioning-approval-threshold: %v", err)
+		}
+		approvalThresholdBytes = quantity.Value()
+	}
+
+	for _, key := range append(*storageClassLabelsToPV, *storageClassAnnotationsToPV...) {
+		if ctrl.IsReservedMetadataKey(key) {
+			klog.Fatalf("Invalid --storage-class-labels-to-pv or --storage-class-annotations-to-pv: %s is reserved for Kubernetes", key)
+		}
+	}
+	for key, label := range *wellKnownTopologyLabels {
+		if label != v1.LabelTopologyZone && label != v1.LabelTopologyRegion {
+			klog.Fatalf("Invalid --well-known-topology-labels: %s is mapped to %q, supported are %s and %s", key, label, v1.LabelTopologyZone, v1.LabelTopologyRegion)
+		}
+	}
+	for _, key := range *nodeLabelTopologyKeys {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			klog.Fatalf("Invalid --node-label-topology-keys: %q is not a valid label key: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	topologyStrategy, err := ctrl.NewTopologyStrategy(*preferredTopologyStrategy)
+	if err != nil {
+		klog.Fatalf("Invalid --preferred-topology-strategy: %v", err)
+	}
+	if *parameterKeyCase != ctrl.ParameterKeyCasePreserve && *parameterKeyCase != ctrl.ParameterKeyCaseLower {
+		klog.Fatalf("Invalid --parameter-key-case %q, must be one of %s", *parameterKeyCase, strings.Join(ctrl.ParameterKeyCases, ", "))
+	}
+	if *minThroughput < 0 || *maxThroughput < 0 || (*maxThroughput > 0 && *minThroughput > *maxThroughput) {
+		klog.Fatalf("Invalid --min-throughput %d and --max-throughput %d: must not be negative and the minimum must not exceed the maximum", *minThroughput, *maxThroughput)
+	}
+	terminalCodes, err := ctrl.ParseTerminalErrorCodes(*terminalErrorCodes)
+	if err != nil {
+		klog.Fatalf("Invalid --terminal-error-codes: %v", err)
+	}
+	if *maxImmediateTopologySegments < 0 {
+		klog.Fatalf("Invalid --max-immediate-topology-segments %d: must not be negative", *maxImmediateTopologySegments)
+	}
+	if *maxParametersSize < 0 {
+		klog.Fatalf("Invalid --max-parameters-size %d: must not be negative", *maxParametersSize)
+	}
+	if *trimExtraCreateMetadata && (*maxParametersSize == 0 || !*extraCreateMetadata) {
+		klog.Fatal("--trim-extra-create-metadata requires --max-parameters-size and --extra-create-metadata")
+	}
+	if *capacityRefreshWorkers > *capacityThreads {
+		klog.Fatal("--capacity-refresh-workers must not be larger than --capacity-threads")
+	}
+	if *capacityReadinessGate && !*enableCapacity {
+		klog.Fatal("--capacity-readiness-gate requires --enable-capacity")
+	}
+	if *volumeHandlePrefix != "" {
+		if err := ctrl.ValidateVolumeHandlePrefix(*volumeHandlePrefix); err != nil {
+			klog.Fatalf("Invalid --volume-handle-prefix: %v", err)
+		}
+	}
+
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
 	csiProvisioner := ctrl.NewCSIProvisioner(
@@ -428,6 +761,49 @@ func main() {
 		nodeDeployment,
 		*controllerPublishReadOnly,
 		*preventVolumeModeConversion,
+		ctrl.ForceRemoveFinalizer(*allowForceRemoveFinalizer),
+		ctrl.DisableFinalizers(!*enableFinalizers),
+		ctrl.RetryOnVolumeNameConflict(*retryOnVolumeNameConflict),
+		ctrl.HonorForceBlockVolumeMode(*honorForceBlockVolumeMode),
+		ctrl.DisableDelete(*disableDelete),
+		ctrl.HonorPVCFSType(*honorPVCFSType),
+		ctrl.SecretCacheTTL(*secretCacheTTL),
+		ctrl.RequireProvisioningApproval(*requireApproval, approvalThresholdBytes, factory.Core().V1().Namespaces(), claimInformer),
+		ctrl.WellKnownTopologyLabels(*wellKnownTopologyLabels),
+		ctrl.ProvisioningConditions(*provisioningConditions),
+		ctrl.HonorPVCEncryptionKey(*honorPVCEncryptionKey),
+		ctrl.CopyStorageClassMetadata(*storageClassLabelsToPV, *storageClassAnnotationsToPV),
+		ctrl.MaxProvisioningRetries(*maxProvisioningRetries),
+		ctrl.CheckClaimCapabilities(driverCapabilities),
+		ctrl.EnforceStorageClassParameters(*enforceStorageClassParameters),
+		ctrl.MaxPVCOperationTimeout(*maxPVCOperationTimeout),
+		ctrl.TranslateErrors(errorMessages),
+		ctrl.RecordCreateVolumeParameters(*recordCreateVolumeParameters, *recordedParametersAllowlist),
+		ctrl.PreferredTopologyStrategy(topologyStrategy),
+		ctrl.CheckVolumeModeAccessModes(*checkVolumeModeAccessModes),
+		ctrl.AllowCapacityCheckBypass(*allowCapacityCheckBypass),
+		ctrl.FSGroupDelegated(fsGroupDelegated),
+		ctrl.ReportProvisioningStatus(provisioningStatusReporter),
+		ctrl.LowercaseParameterKeys(*parameterKeyCase == ctrl.ParameterKeyCaseLower),
+		ctrl.RenamedStorageClasses(*renamedStorageClasses),
+		ctrl.RequireTopology(*requireTopology),
+		ctrl.VolumeHandlePrefix(*volumeHandlePrefix),
+		ctrl.SnapshotBeforeDeletion(*snapshotBeforeDeletion),
+		ctrl.WithGlobalPause(globalPause),
+		ctrl.WatchStorageClassPauses(factory.Storage().V1().StorageClasses(), claimInformer, volumeInformer),
+		ctrl.NodeLabelTopologyKeys(*nodeLabelTopologyKeys),
+		ctrl.ThroughputRange(*minThroughput, *maxThroughput),
+		ctrl.WithTerminalErrorCodes(terminalCodes),
+		ctrl.MaxImmediateTopologySegments(*maxImmediateTopologySegments),
+		ctrl.DriverVersion(driverInfo.VendorVersion),
+		ctrl.CheckVolumeBindingMode(*checkVolumeBindingMode),
+		ctrl.MaxParametersSize(*maxParametersSize, *trimExtraCreateMetadata),
+		ctrl.PassIdempotencyToken(*passIdempotencyToken),
+		ctrl.RoutineEvents(*suppressRoutineEvents, *routineEventInterval),
+		ctrl.WithVolumeHandles(volumeHandles),
+		ctrl.HonorRetryAfter(retryAfterRateLimiter),
+		ctrl.RecordTopology(*recordTopology),
+		ctrl.WithProjectMapping(projectMapping),
 	)
 
 	var capacityController *capacity.Controller
@@ -472,6 +848,7 @@ func main() {
 				factory.Core().V1().Nodes(),
 				factory.Storage().V1().CSINodes(),
 				workqueue.NewNamedRateLimitingQueue(rateLimiter, "csitopology"),
+				*capacityAggregationKeys,
 			)
 		} else {
 			var segment topology.Segment
@@ -531,6 +908,10 @@ func main() {
 			klog.Fatalf("unexpected error when checking for the V1 CSIStorageCapacity API: %v", err)
 		}
 
+		if *capacityWriteQPS > 0 {
+			clientFactory = capacity.NewRateLimitedClientFactory(clientFactory, flowcontrol.NewTokenBucketRateLimiter(*capacityWriteQPS, *capacityWriteBurst))
+		}
+
 		capacityController = capacity.NewCentralCapacityController(
 			csi.NewControllerClient(grpcClient),
 			provisionerName,
@@ -546,11 +927,27 @@ func main() {
 			*capacityPollInterval,
 			*capacityImmediateBinding,
 			*operationTimeout,
+			*capacityCoalesceWindow,
+			*capacityMaxObjects,
+			int(*capacityRefreshWorkers),
 		)
 		legacyregistry.CustomMustRegister(capacityController)
 
 		// Wrap Provision and Delete to detect when it is time to refresh capacity.
-		csiProvisioner = capacity.NewProvisionWrapper(csiProvisioner, capacityController)
+		csiProvisioner = capacity.NewProvisionWrapper(csiProvisioner, capacityController, *capacityFitMetric)
+	}
+
+	var readinessChecks []func() error
+	if *capacityReadinessGate {
+		readinessChecks = append(readinessChecks, func() error {
+			if !capacityController.InitialCapacityPublished() {
+				return fmt.Errorf("initial storage capacity not published yet")
+			}
+			return nil
+		})
+	}
+	if *expectedDriverName != "" || len(readinessChecks) > 0 {
+		mux.Handle("/readyz", readinessHandler(driverNameErr, readinessChecks...))
 	}
 
 	provisionController = controller.NewProvisionController(
@@ -568,6 +965,23 @@ func main() {
 		controllerCapabilities,
 	)
 
+	var volumeCapacityReconciler *ctrl.VolumeCapacityReconciler
+	if *volumeCapacityReconcileInterval > 0 {
+		volumeCapacityReconciler = ctrl.NewVolumeCapacityReconciler(
+			clientset,
+			csi.NewControllerClient(grpcClient),
+			provisionerName,
+			factory.Core().V1().PersistentVolumes().Lister(),
+			claimLister,
+			controllerCapabilities,
+			*volumeCapacityReconcileInterval,
+			*operationTimeout,
+		)
+		if volumeCapacityReconciler == nil {
+			klog.Warning("Not reconciling volume capacity because the CSI driver supports neither ListVolumes nor ControllerGetVolume")
+		}
+	}
+
 	// Start HTTP server, regardless whether we are the leader or not.
 	if addr != "" {
 		// To collect metrics data from the metric handler itself, we
@@ -577,6 +991,11 @@ func main() {
 			libmetrics.PersistentVolumeClaimProvisionTotal,
 			libmetrics.PersistentVolumeClaimProvisionFailedTotal,
 			libmetrics.PersistentVolumeClaimProvisionDurationSeconds,
+			ctrl.PersistentVolumeClaimProvisionEndToEndDurationSeconds,
+			ctrl.CSIDriverInfo,
+			ctrl.CreateVolumeParametersOversizedTotal,
+			ctrl.OperationFailuresTotal,
+			ctrl.LastSuccessfulOperationTimestampSeconds,
 			libmetrics.PersistentVolumeDeleteTotal,
 			libmetrics.PersistentVolumeDeleteFailedTotal,
 			libmetrics.PersistentVolumeDeleteDurationSeconds,
@@ -602,6 +1021,9 @@ func main() {
 			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		}
+		if *debugEndpoints {
+			mux.Handle("/debug/driver", driverInfo)
+		}
 		go func() {
 			klog.Infof("ServeMux listening at %q", addr)
 			err := http.ListenAndServe(addr, mux)
@@ -624,6 +1046,16 @@ func main() {
 				klog.Fatalf("Failed to sync Informers!")
 			}
 		}
+		if pauseFactory != nil {
+			// Sync before starting the workers, so that they
+			// don't run while the ConfigMap pauses them.
+			pauseFactory.Start(ctx.Done())
+			for _, v := range pauseFactory.WaitForCacheSync(ctx.Done()) {
+				if !v {
+					klog.Fatalf("Failed to sync pause ConfigMap informer!")
+				}
+			}
+		}
 
 		if utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource) {
 			if gatewayFactory != nil {
@@ -643,6 +1075,18 @@ func main() {
 		if csiClaimController != nil {
 			go csiClaimController.Run(ctx, int(*finalizerThreads))
 		}
+		if retainedVolumeController != nil {
+			go retainedVolumeController.Run(ctx, 1)
+		}
+		if volumeCapacityReconciler != nil {
+			go volumeCapacityReconciler.Run(ctx)
+		}
+		if driverCapabilities != nil && *capabilitiesRefreshInterval > 0 {
+			go driverCapabilities.Run(ctx, *capabilitiesRefreshInterval)
+		}
+		if provisioningStatusReporter != nil {
+			go provisioningStatusReporter.Run(ctx)
+		}
 		provisionController.Run(ctx)
 	}
 
@@ -0,0 +1,171 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is one verb on one resource that the provisioner needs.
+type permission struct {
+	verb     string
+	group    string
+	resource string
+	// subresource is optional, for example "status".
+	subresource string
+	// namespace is empty for cluster-wide permissions.
+	namespace string
+	// reason explains in the report why the permission is needed.
+	reason string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.group != "" {
+		resource = p.group + "/" + resource
+	}
+	if p.namespace != "" {
+		return fmt.Sprintf("%s %s in namespace %s (%s)", p.verb, resource, p.namespace, p.reason)
+	}
+	return fmt.Sprintf("%s %s (%s)", p.verb, resource, p.reason)
+}
+
+// permissionConfig describes the enabled features which need additional
+// permissions. Namespaced permissions are not checked when their
+// namespace is unknown.
+type permissionConfig struct {
+	leaderElectionNamespace string
+	capacityNamespace       string
+	errorMessagesNamespace  string
+	pauseNamespace          string
+	projectsNamespace       string
+	volumeAttachments       bool
+	snapshots               bool
+	claimStatus             bool
+	storageClassUpdate      bool
+	volumeUpdate            bool
+	csiDrivers              bool
+	namespaces              bool
+	referenceGrants         bool
+}
+
+// requiredPermissions returns the permissions needed with the given
+// configuration, in the order in which they are listed in
+// deploy/kubernetes/rbac.yaml.
+func requiredPermissions(config permissionConfig) []permission {
+	var permissions []permission
+	add := func(group, resource, namespace, reason string, verbs ...string) {
+		subresource := ""
+		if i := strings.Index(resource, "/"); i >= 0 {
+			resource, subresource = resource[:i], resource[i+1:]
+		}
+		for _, verb := range verbs {
+			permissions = append(permissions, permission{
+				verb:        verb,
+				group:       group,
+				resource:    resource,
+				subresource: subresource,
+				namespace:   namespace,
+				reason:      reason,
+			})
+		}
+	}
+
+	add("", "persistentvolumes", "", "provisioning", "get", "list", "watch", "create", "delete")
+	if config.volumeUpdate {
+		add("", "persistentvolumes", "", "--volume-capacity-reconcile-interval or --snapshot-before-deletion", "update")
+	}
+	add("", "persistentvolumeclaims", "", "provisioning", "get", "list", "watch", "update")
+	if config.claimStatus {
+		add("", "persistentvolumeclaims/status", "", "PVC conditions", "update")
+	}
+	add("storage.k8s.io", "storageclasses", "", "provisioning", "get", "list", "watch")
+	if config.storageClassUpdate {
+		add("storage.k8s.io", "storageclasses", "", "--enforce-immutable-storage-class-parameters", "update")
+	}
+	add("", "events", "", "events", "create", "patch")
+	if config.snapshots {
+		add("snapshot.storage.k8s.io", "volumesnapshots", "", "restoring snapshots", "get", "list")
+		add("snapshot.storage.k8s.io", "volumesnapshotcontents", "", "restoring snapshots", "get", "list")
+	}
+	add("storage.k8s.io", "csinodes", "", "topology", "get", "list", "watch")
+	if config.csiDrivers {
+		add("storage.k8s.io", "csidrivers", "", "--check-volume-mode-access-modes", "get")
+	}
+	add("", "nodes", "", "topology", "get", "list", "watch")
+	if config.namespaces {
+		add("", "namespaces", "", "--allow-capacity-check-bypass or --project-mapping-configmap", "get")
+	}
+	if config.volumeAttachments {
+		add("storage.k8s.io", "volumeattachments", "", "PUBLISH_UNPUBLISH_VOLUME capability", "get", "list", "watch")
+	}
+	if config.referenceGrants {
+		add("gateway.networking.k8s.io", "referencegrants", "", "CrossNamespaceVolumeDataSource feature", "get", "list", "watch")
+	}
+	if config.leaderElectionNamespace != "" {
+		add("coordination.k8s.io", "leases", config.leaderElectionNamespace, "leader election", "get", "watch", "list", "delete", "update", "create")
+	}
+	if config.capacityNamespace != "" {
+		add("storage.k8s.io", "csistoragecapacities", config.capacityNamespace, "--enable-capacity", "get", "list", "watch", "create", "update", "patch", "delete")
+	}
+	if config.errorMessagesNamespace != "" {
+		add("", "configmaps", config.errorMessagesNamespace, "--error-messages-configmap", "get")
+	}
+	if config.pauseNamespace != "" {
+		add("", "configmaps", config.pauseNamespace, "--pause-configmap", "get", "list", "watch")
+	}
+	if config.projectsNamespace != "" {
+		add("", "configmaps", config.projectsNamespace, "--project-mapping-configmap", "get")
+	}
+	return permissions
+}
+
+// missingPermissions checks each permission with a SelfSubjectAccessReview
+// and returns those which are not granted.
+func missingPermissions(ctx context.Context, client kubernetes.Interface, permissions []permission) ([]permission, error) {
+	var missing []permission
+	for _, p := range permissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.namespace,
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		}
+		result, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("check permission to %s: %v", p, err)
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMissingPermissions(t *testing.T) {
+	config := permissionConfig{
+		claimStatus:             true,
+		leaderElectionNamespace: "kube-system",
+	}
+
+	testcases := map[string]struct {
+		// denied contains "<verb> <resource>[/<subresource>] <namespace>".
+		denied    []string
+		reviewErr error
+		expected  []string
+		expectErr bool
+	}{
+		"all granted": {},
+		"some denied": {
+			denied:   []string{"update persistentvolumeclaims/status ", "create leases kube-system"},
+			expected: []string{"update persistentvolumeclaims/status (PVC conditions)", "create coordination.k8s.io/leases in namespace kube-system (leader election)"},
+		},
+		"review fails": {
+			reviewErr: errors.New("fake error"),
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			client := fakeclientset.NewSimpleClientset()
+			client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if tc.reviewErr != nil {
+					return true, nil, tc.reviewErr
+				}
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+				attributes := review.Spec.ResourceAttributes
+				resource := attributes.Resource
+				if attributes.Subresource != "" {
+					resource += "/" + attributes.Subresource
+				}
+				review.Status.Allowed = true
+				for _, denied := range tc.denied {
+					if denied == attributes.Verb+" "+resource+" "+attributes.Namespace {
+						review.Status.Allowed = false
+					}
+				}
+				return true, review, nil
+			})
+
+			missing, err := missingPermissions(context.Background(), client, requiredPermissions(config))
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual []string
+			for _, p := range missing {
+				actual = append(actual, p.String())
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected missing permissions %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRequiredPermissions(t *testing.T) {
+	has := func(permissions []permission, verb, resource, namespace string) bool {
+		for _, p := range permissions {
+			if p.verb == verb && p.resource == resource && p.namespace == namespace {
+				return true
+			}
+		}
+		return false
+	}
+
+	permissions := requiredPermissions(permissionConfig{})
+	if !has(permissions, "create", "persistentvolumes", "") {
+		t.Error("expected permission to create persistentvolumes")
+	}
+	for _, resource := range []string{"volumeattachments", "leases", "csistoragecapacities", "csidrivers", "referencegrants"} {
+		if has(permissions, "get", resource, "") || has(permissions, "get", resource, "default") {
+			t.Errorf("unexpected permission for %s without the feature that needs it", resource)
+		}
+	}
+
+	permissions = requiredPermissions(permissionConfig{
+		volumeAttachments: true,
+		capacityNamespace: "default",
+		csiDrivers:        true,
+	})
+	if !has(permissions, "watch", "volumeattachments", "") {
+		t.Error("expected permission to watch volumeattachments")
+	}
+	if !has(permissions, "update", "csistoragecapacities", "default") {
+		t.Error("expected permission to update csistoragecapacities in namespace default")
+	}
+	if !has(permissions, "get", "csidrivers", "") {
+		t.Error("expected permission to get csidrivers")
+	}
+}
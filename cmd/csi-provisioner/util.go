@@ -19,8 +19,108 @@ package main
 import (
 	"fmt"
 	"hash/fnv"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// exponentialRateLimiter retries failed items with an exponentially
+	// increasing delay per item.
+	exponentialRateLimiter = "exponential"
+	// bucketRateLimiter limits the overall rate of retries with a token
+	// bucket, independently of how often an item already failed.
+	bucketRateLimiter = "bucket"
 )
 
+// newRateLimiter returns the work queue rate limiter selected with --rate-limiter.
+func newRateLimiter(kind string, retryIntervalStart, retryIntervalMax time.Duration, qps float32, burst int) (workqueue.RateLimiter, error) {
+	switch kind {
+	case exponentialRateLimiter:
+		return workqueue.NewItemExponentialFailureRateLimiter(retryIntervalStart, retryIntervalMax), nil
+	case bucketRateLimiter:
+		if qps <= 0 || burst <= 0 {
+			return nil, fmt.Errorf("the %s rate limiter needs positive QPS and burst, got %v and %d", bucketRateLimiter, qps, burst)
+		}
+		return &workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(qps), burst)}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q, must be %q or %q", kind, exponentialRateLimiter, bucketRateLimiter)
+	}
+}
+
+// checkDriverName compares the name reported by the CSI driver with the
+// name set with --expected-driver-name. Empty means "any name".
+func checkDriverName(expected, actual string) error {
+	if expected == "" || expected == actual {
+		return nil
+	}
+	return fmt.Errorf("CSI driver reports name %q, expected %q: PVCs and StorageClasses for %q will be ignored", actual, expected, expected)
+}
+
+// checkLeaderElectionTiming validates the --leader-election-* durations
+// the same way as client-go, but before connecting to anything.
+func checkLeaderElectionTiming(leaseDuration, renewDeadline, retryPeriod time.Duration) error {
+	if leaseDuration <= 0 || renewDeadline <= 0 || retryPeriod <= 0 {
+		return fmt.Errorf("leader election lease duration, renew deadline and retry period must be positive, got %v, %v and %v", leaseDuration, renewDeadline, retryPeriod)
+	}
+	if renewDeadline >= leaseDuration {
+		return fmt.Errorf("leader election renew deadline %v must be shorter than the lease duration %v", renewDeadline, leaseDuration)
+	}
+	if renewDeadline <= time.Duration(leaderelection.JitterFactor*float64(retryPeriod)) {
+		return fmt.Errorf("leader election renew deadline %v must be longer than %v times the retry period %v", renewDeadline, leaderelection.JitterFactor, retryPeriod)
+	}
+	return nil
+}
+
+// readinessHandler reports the given error as failure, otherwise the
+// first error returned by the checks, which are invoked for each request.
+// Success is reported when there is no error.
+func readinessHandler(err error, checks ...func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprint(w, "ok")
+	}
+}
+
+// newInformerFactory returns the shared informer factory for all informers of
+// the provisioner. PVC and PV informers resync with the given periods, zero
+// disables resyncing, all other informers with defaultResyncPeriod.
+func newInformerFactory(client kubernetes.Interface, defaultResyncPeriod, pvcResyncPeriod, pvResyncPeriod time.Duration) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, defaultResyncPeriod,
+		informers.WithCustomResyncConfig(map[metav1.Object]time.Duration{
+			&v1.PersistentVolumeClaim{}: pvcResyncPeriod,
+			&v1.PersistentVolume{}:      pvResyncPeriod,
+		}))
+}
+
+// defaultResyncInformer adds all event handlers with the resync period of the
+// informer. The provisioner library adds its handlers with its own resync
+// period, which would override the one configured for the informer.
+type defaultResyncInformer struct {
+	cache.SharedIndexInformer
+}
+
+func (i defaultResyncInformer) AddEventHandlerWithResyncPeriod(handler cache.ResourceEventHandler, _ time.Duration) (cache.ResourceEventHandlerRegistration, error) {
+	return i.SharedIndexInformer.AddEventHandler(handler)
+}
+
 // getNameWithMaxLength returns a name given a base ("deployment-5") and a suffix ("deploy")
 // It will first attempt to join them with a dash. If the resulting name is longer
 // than maxLength: if the suffix is too long, it will truncate the base name and add
@@ -18,8 +18,17 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
@@ -60,3 +69,235 @@ func TestGetNameWithMaxLength(t *testing.T) {
 		})
 	}
 }
+
+func TestNewRateLimiter(t *testing.T) {
+	testcases := map[string]struct {
+		kind        string
+		qps         float32
+		burst       int
+		expectError bool
+	}{
+		"exponential": {
+			kind: exponentialRateLimiter,
+		},
+		"bucket": {
+			kind:  bucketRateLimiter,
+			qps:   10,
+			burst: 100,
+		},
+		"bucket without QPS": {
+			kind:        bucketRateLimiter,
+			burst:       100,
+			expectError: true,
+		},
+		"unknown": {
+			kind:        "foobar",
+			expectError: true,
+		},
+	}
+
+	for name, c := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, err := newRateLimiter(c.kind, time.Second, time.Minute, c.qps, c.burst)
+			if c.expectError && err == nil {
+				t.Error("expected error, got none")
+			}
+			if !c.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBucketRateLimiterQPS(t *testing.T) {
+	const (
+		qps   = 10
+		burst = 5
+		items = 50
+	)
+	rateLimiter, err := newRateLimiter(bucketRateLimiter, time.Second, time.Minute, qps, burst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Under load, the first items are allowed immediately up to the burst,
+	// after that each item has to wait for another token.
+	for i := 0; i < items; i++ {
+		delay := rateLimiter.When(fmt.Sprintf("item-%d", i))
+		expected := time.Duration(0)
+		if i >= burst {
+			expected = time.Duration(i-burst+1) * time.Second / qps
+		}
+		// Some tokens get refilled while the test runs.
+		if delay > expected || delay < expected-100*time.Millisecond {
+			t.Errorf("item #%d: expected delay of about %v, got %v", i, expected, delay)
+		}
+	}
+}
+
+func TestCheckDriverName(t *testing.T) {
+	testcases := map[string]struct {
+		expected    string
+		actual      string
+		expectError bool
+	}{
+		"no expectation": {
+			actual: "example.com",
+		},
+		"match": {
+			expected: "example.com",
+			actual:   "example.com",
+		},
+		"mismatch": {
+			expected:    "example.com",
+			actual:      "new.example.com",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := checkDriverName(tc.expected, tc.actual)
+			if !tc.expectError {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil {
+				t.Fatal("expected error, got none")
+			}
+
+			recorder := httptest.NewRecorder()
+			readinessHandler(err).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			if !tc.expectError {
+				if recorder.Code != http.StatusOK {
+					t.Errorf("expected status %d, got %d", http.StatusOK, recorder.Code)
+				}
+				return
+			}
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+			}
+			body := recorder.Body.String()
+			if !strings.Contains(body, tc.expected) || !strings.Contains(body, tc.actual) {
+				t.Errorf("expected readiness message with %q and %q, got %q", tc.expected, tc.actual, body)
+			}
+		})
+	}
+}
+
+func TestReadinessHandlerChecks(t *testing.T) {
+	ready := false
+	handler := readinessHandler(nil, func() error {
+		if !ready {
+			return fmt.Errorf("not ready yet")
+		}
+		return nil
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d before check passes, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	ready = true
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected status %d after check passes, got %d", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestCheckLeaderElectionTiming(t *testing.T) {
+	testcases := map[string]struct {
+		leaseDuration, renewDeadline, retryPeriod time.Duration
+		expectError                               bool
+	}{
+		"defaults": {
+			leaseDuration: 15 * time.Second,
+			renewDeadline: 10 * time.Second,
+			retryPeriod:   5 * time.Second,
+		},
+		"high latency": {
+			leaseDuration: 137 * time.Second,
+			renewDeadline: 107 * time.Second,
+			retryPeriod:   26 * time.Second,
+		},
+		"renew equals lease": {
+			leaseDuration: 15 * time.Second,
+			renewDeadline: 15 * time.Second,
+			retryPeriod:   5 * time.Second,
+			expectError:   true,
+		},
+		"renew longer than lease": {
+			leaseDuration: 15 * time.Second,
+			renewDeadline: 20 * time.Second,
+			retryPeriod:   5 * time.Second,
+			expectError:   true,
+		},
+		"retry too long": {
+			leaseDuration: 15 * time.Second,
+			renewDeadline: 10 * time.Second,
+			retryPeriod:   9 * time.Second,
+			expectError:   true,
+		},
+		"zero": {
+			leaseDuration: 15 * time.Second,
+			renewDeadline: 10 * time.Second,
+			expectError:   true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := checkLeaderElectionTiming(tc.leaseDuration, tc.renewDeadline, tc.retryPeriod)
+			if tc.expectError && err == nil {
+				t.Error("expected error, got none")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestInformerFactoryResync(t *testing.T) {
+	client := fakeclientset.NewSimpleClientset(
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: "default"}},
+		&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}},
+	)
+	// One second is the minimum resync period. Resyncing PVs is disabled.
+	factory := newInformerFactory(client, time.Hour, time.Second, 0)
+
+	var claimResyncs, volumeResyncs int32
+	countResyncs := func(counter *int32) cache.ResourceEventHandler {
+		return cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) { atomic.AddInt32(counter, 1) },
+		}
+	}
+	// The resync periods of the handlers must be ignored.
+	claimInformer := defaultResyncInformer{factory.Core().V1().PersistentVolumeClaims().Informer()}
+	if _, err := claimInformer.AddEventHandlerWithResyncPeriod(countResyncs(&claimResyncs), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	volumeInformer := defaultResyncInformer{factory.Core().V1().PersistentVolumes().Informer()}
+	if _, err := volumeInformer.AddEventHandlerWithResyncPeriod(countResyncs(&volumeResyncs), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&claimResyncs) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected PVCs to be resynced twice, got %d resyncs", atomic.LoadInt32(&claimResyncs))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if resyncs := atomic.LoadInt32(&volumeResyncs); resyncs != 0 {
+		t.Errorf("expected no PV resyncs, got %d", resyncs)
+	}
+}
@@ -23,12 +23,16 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/external-provisioner/pkg/capacity/topology"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
@@ -47,6 +51,19 @@ import (
 const (
 	DriverNameLabel = "csi.storage.k8s.io/drivername"
 	ManagedByLabel  = "csi.storage.k8s.io/managed-by"
+
+	// GetCapacityErrorAnnotation is set on a CSIStorageCapacity object
+	// while the most recent GetCapacity call for it failed and therefore
+	// the capacity in the object may be stale. It gets removed again
+	// after the next successful refresh.
+	GetCapacityErrorAnnotation = "csi.storage.k8s.io/get-capacity-error"
+
+	// UsableCapacityMetadataKey is an optional gRPC response header of
+	// GetCapacity. Drivers which reserve part of the available capacity
+	// for overhead can use it to report the usable capacity in bytes as
+	// decimal number. It then gets published instead of the available
+	// capacity.
+	UsableCapacityMetadataKey = "csi-usable-capacity"
 )
 
 // Controller creates and updates CSIStorageCapacity objects.  It
@@ -89,6 +106,12 @@ type Controller struct {
 	pollPeriod       time.Duration
 	immediateBinding bool
 	timeout          time.Duration
+	coalesceWindow   time.Duration
+	maxObjects       int
+
+	// refreshWorkers limits the number of concurrent GetCapacity
+	// calls when not nil. Each call holds one entry while it runs.
+	refreshWorkers chan struct{}
 
 	// capacities contains one entry for each object that is
 	// supposed to exist. Entries that exist on the API server
@@ -97,6 +120,32 @@ type Controller struct {
 	// races.
 	capacities     map[workItem]*storagev1.CSIStorageCapacity
 	capacitiesLock sync.Mutex
+
+	// lastErrors contains the gRPC status code of the most recent
+	// GetCapacity error for those work items where the last refresh
+	// failed. Also protected by capacitiesLock.
+	lastErrors map[workItem]codes.Code
+
+	// predictedInsufficient counts per storage class how often a PVC
+	// probably didn't fit. Also protected by capacitiesLock.
+	predictedInsufficient map[string]int64
+
+	// prepared is set once the initial set of work items is known,
+	// publishedSegments contains the segments for which at least one
+	// object was published successfully and initiallyPublished is set
+	// once that was the case for all segments. Also protected by
+	// capacitiesLock.
+	prepared           bool
+	publishedSegments  map[*topology.Segment]bool
+	initiallyPublished bool
+
+	// creating contains the work items for which an object was
+	// created while maxObjects is set, until the informer delivers
+	// that object. overLimit contains the work items which have no
+	// object because maxObjects was reached. Both are also
+	// protected by capacitiesLock.
+	creating  map[workItem]bool
+	overLimit map[workItem]bool
 }
 
 type workItem struct {
@@ -139,6 +188,20 @@ var (
 		metrics.ALPHA,
 		"",
 	)
+	getCapacityErrorDesc = metrics.NewDesc(
+		"csistoragecapacities_get_capacity_error",
+		"Set to 1 for each storage class and topology segment where the last GetCapacity call failed, with the gRPC status code as reason. Cleared by the next successful call.",
+		[]string{"storage_class", "segment", "reason"}, nil,
+		metrics.ALPHA,
+		"",
+	)
+	objectsOverLimitDesc = metrics.NewDesc(
+		"csistoragecapacities_over_limit",
+		"Number of CSIStorageCapacity objects that are supposed to be managed automatically but were not created because the maximum number of objects was reached. Only reported when there is a maximum.",
+		nil, nil,
+		metrics.ALPHA,
+		"",
+	)
 )
 
 // CSICapacityClient is the relevant subset of csi.ControllerClient.
@@ -160,7 +223,10 @@ type CSIStorageCapacityFactory func(namespace string) CSIStorageCapacityInterfac
 
 // NewController creates a new controller for CSIStorageCapacity objects.
 // It implements metrics.StableCollector and thus can be registered in
-// a registry.
+// a registry. A positive maxObjects limits the number of objects that
+// the controller creates, zero means no limit. A positive refreshWorkers
+// limits the number of concurrent GetCapacity calls, otherwise only the
+// number of threads passed to Run limits them.
 func NewCentralCapacityController(
 	csiController CSICapacityClient,
 	driverName string,
@@ -175,6 +241,9 @@ func NewCentralCapacityController(
 	pollPeriod time.Duration,
 	immediateBinding bool,
 	timeout time.Duration,
+	coalesceWindow time.Duration,
+	maxObjects int,
+	refreshWorkers int,
 ) *Controller {
 	c := &Controller{
 		csiController:    csiController,
@@ -190,7 +259,18 @@ func NewCentralCapacityController(
 		pollPeriod:       pollPeriod,
 		immediateBinding: immediateBinding,
 		timeout:          timeout,
+		coalesceWindow:   coalesceWindow,
+		maxObjects:       maxObjects,
 		capacities:       map[workItem]*storagev1.CSIStorageCapacity{},
+		lastErrors:       map[workItem]codes.Code{},
+
+		predictedInsufficient: map[string]int64{},
+		publishedSegments:     map[*topology.Segment]bool{},
+		creating:              map[workItem]bool{},
+		overLimit:             map[workItem]bool{},
+	}
+	if refreshWorkers > 0 {
+		c.refreshWorkers = make(chan struct{}, refreshWorkers)
 	}
 
 	// Now register for changes. Depending on the implementation of the informers,
@@ -329,6 +409,10 @@ func (c *Controller) prepare(ctx context.Context) {
 		c.onCAddOrUpdate(ctx, capacity)
 	}
 
+	c.capacitiesLock.Lock()
+	c.prepared = true
+	c.capacitiesLock.Unlock()
+
 	// Now that we have seen all existing objects, we are done
 	// with the preparation and can let our caller start
 	// processing work items.
@@ -398,6 +482,24 @@ func (c *Controller) onSCDelete(sc *storagev1.StorageClass) {
 	for _, segment := range segments {
 		c.removeWorkItem(segment, sc)
 	}
+
+	// Work items only know the objects that were matched with them.
+	// Other objects for the class, for example those whose creation
+	// wasn't observed yet, would linger without an owner, so all of
+	// them get pruned.
+	capacities, err := c.cInformer.Lister().List(labels.Everything())
+	if err != nil {
+		// This shouldn't happen.
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, capacity := range capacities {
+		if capacity.StorageClassName != sc.Name || !c.isManaged(capacity) {
+			continue
+		}
+		klog.V(5).Infof("Capacity Controller: enqueuing CSIStorageCapacity %s of removed storage class %s for removal", capacity.Name, sc.Name)
+		c.queue.Add(capacity)
+	}
 }
 
 // refreshTopology identifies all work items matching the topology and schedules
@@ -420,9 +522,9 @@ func (c *Controller) refreshTopology(nodeAffinity v1.VolumeNodeAffinity) {
 			continue
 		}
 		for item := range c.capacities {
-			if item.segment.Compare(segment) == 0 {
+			if item.segment.IsSubsetOf(segment) {
 				klog.V(5).Infof("Capacity Controller: skipping refresh: enqueuing %+v because of the topology", item)
-				c.queue.Add(item)
+				c.enqueueRefresh(item)
 			}
 		}
 	}
@@ -457,7 +559,7 @@ func (c *Controller) refreshSC(storageClassName string) {
 	for item := range c.capacities {
 		if item.storageClassName == storageClassName {
 			klog.V(5).Infof("Capacity Controller: enqueuing %+v because of the storage class", item)
-			c.queue.Add(item)
+			c.enqueueRefresh(item)
 		}
 	}
 }
@@ -497,6 +599,9 @@ func (c *Controller) removeWorkItem(segment *topology.Segment, sc *storagev1.Sto
 	// Deleting the item will prevent further updates to
 	// it, in case that it is already in the queue.
 	delete(c.capacities, item)
+	delete(c.lastErrors, item)
+	delete(c.creating, item)
+	delete(c.overLimit, item)
 
 	if capacity == nil {
 		// No object to remove.
@@ -516,10 +621,22 @@ func (c *Controller) pollCapacities() {
 
 	for item := range c.capacities {
 		klog.V(5).Infof("Capacity Controller: enqueuing %+v for periodic update", item)
-		c.queue.Add(item)
+		c.enqueueRefresh(item)
 	}
 }
 
+// enqueueRefresh schedules a refresh of an existing item. With a coalescing
+// window, the refresh gets delayed by that window. Further refreshes of the
+// same item during the window are merged into the pending one, which then
+// writes the capacity reported at that time, i.e. the latest value.
+func (c *Controller) enqueueRefresh(item workItem) {
+	if c.coalesceWindow > 0 {
+		c.queue.AddAfter(item, c.coalesceWindow)
+		return
+	}
+	c.queue.Add(item)
+}
+
 func (c *Controller) runWorker(ctx context.Context) {
 	for c.processNextWorkItem(ctx) {
 	}
@@ -608,20 +725,36 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 			Segments: item.segment.GetLabelMap(),
 		}
 	}
-	syncCtx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
-	resp, err := c.csiController.GetCapacity(syncCtx, req)
+	var header metadata.MD
+	resp, err := c.getCapacity(ctx, req, &header)
 	if err != nil {
+		c.setLastError(item, err)
+		if capacity != nil && capacity.Annotations[GetCapacityErrorAnnotation] != err.Error() {
+			// Mark the existing object as stale. Failing to do so is
+			// not fatal, the item gets retried anyway.
+			capacity := capacity.DeepCopy()
+			metav1.SetMetaDataAnnotation(&capacity.ObjectMeta, GetCapacityErrorAnnotation, err.Error())
+			if _, err := c.clientFactory(capacity.Namespace).Update(ctx, capacity, metav1.UpdateOptions{}); err != nil {
+				klog.Warningf("Capacity Controller: failed to annotate %s for %+v with GetCapacity error: %v", capacity.Name, item, err)
+			}
+		}
 		return fmt.Errorf("CSI GetCapacity for %+v: %v", item, err)
 	}
+	c.clearLastError(item)
 
-	quantity := resource.NewQuantity(resp.AvailableCapacity, resource.BinarySI)
+	quantity := resource.NewQuantity(usableCapacity(header, resp.AvailableCapacity, item), resource.BinarySI)
 	var maximumVolumeSize *resource.Quantity
 	if resp.MaximumVolumeSize != nil {
 		maximumVolumeSize = resource.NewQuantity(resp.MaximumVolumeSize.Value, resource.BinarySI)
 	}
 
 	if capacity == nil {
+		if !c.reserveObject(item) {
+			// Treated like a published object, otherwise the
+			// initial publishing would never complete.
+			c.markPublished(item)
+			return nil
+		}
 		// Create new object.
 		capacity = &storagev1.CSIStorageCapacity{
 			ObjectMeta: metav1.ObjectMeta{
@@ -643,6 +776,7 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 		klog.V(5).Infof("Capacity Controller: creating new object for %+v, new capacity %v", item, quantity)
 		capacity, err = c.clientFactory(c.ownerNamespace).Create(ctx, capacity, metav1.CreateOptions{})
 		if err != nil {
+			c.releaseObject(item)
 			return fmt.Errorf("create CSIStorageCapacity for %+v: %v", item, err)
 		}
 		klog.V(5).Infof("Capacity Controller: created %s with resource version %s for %+v with capacity %v", capacity.Name, capacity.ResourceVersion, item, quantity)
@@ -652,14 +786,17 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 		// one will be recognized as duplicate and get deleted again once we receive it.
 	} else if capacity.Capacity.Value() == quantity.Value() &&
 		sizesAreEqual(capacity.MaximumVolumeSize, maximumVolumeSize) &&
-		(c.owner == nil || c.isOwnedByUs(capacity)) {
+		(c.owner == nil || c.isOwnedByUs(capacity)) &&
+		!metav1.HasAnnotation(capacity.ObjectMeta, GetCapacityErrorAnnotation) {
 		klog.V(5).Infof("Capacity Controller: no need to update %s for %+v, same capacity %v, same maximumVolumeSize %v and correct owner", capacity.Name, item, quantity, maximumVolumeSize)
+		c.markPublished(item)
 		return nil
 	} else {
 		// Update existing object. Must not modify object in the informer cache.
 		capacity := capacity.DeepCopy()
 		capacity.Capacity = quantity
 		capacity.MaximumVolumeSize = maximumVolumeSize
+		delete(capacity.Annotations, GetCapacityErrorAnnotation)
 		if c.owner != nil && !c.isOwnedByUs(capacity) {
 			capacity.OwnerReferences = append(capacity.OwnerReferences, *c.owner)
 		}
@@ -674,9 +811,128 @@ func (c *Controller) syncCapacity(ctx context.Context, item workItem) error {
 		// object to avoid races.
 	}
 
+	c.markPublished(item)
 	return nil
 }
 
+// reserveObject checks whether an object may be created for the item
+// without exceeding maxObjects. If not, the item is remembered as over the
+// limit and gets checked again during the next refresh.
+func (c *Controller) reserveObject(item workItem) bool {
+	if c.maxObjects <= 0 {
+		return true
+	}
+
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	if c.getObjectsCurrent()+int64(len(c.creating)) < int64(c.maxObjects) {
+		delete(c.overLimit, item)
+		c.creating[item] = true
+		return true
+	}
+	if _, found := c.capacities[item]; found && !c.overLimit[item] {
+		klog.Warningf("Capacity Controller: not creating CSIStorageCapacity for %+v, the maximum of %d objects is reached", item, c.maxObjects)
+		c.overLimit[item] = true
+	}
+	return false
+}
+
+// releaseObject undoes reserveObject after a failed create.
+func (c *Controller) releaseObject(item workItem) {
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	delete(c.creating, item)
+}
+
+// getCapacity calls GetCapacity with the configured timeout. The timeout
+// starts once one of the refresh workers is available.
+func (c *Controller) getCapacity(ctx context.Context, req *csi.GetCapacityRequest, header *metadata.MD) (*csi.GetCapacityResponse, error) {
+	if c.refreshWorkers != nil {
+		select {
+		case c.refreshWorkers <- struct{}{}:
+			defer func() { <-c.refreshWorkers }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.csiController.GetCapacity(ctx, req, grpc.Header(header))
+}
+
+// markPublished remembers that the capacity of the item's segment was
+// published.
+func (c *Controller) markPublished(item workItem) {
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	if !c.initiallyPublished {
+		c.publishedSegments[item.segment] = true
+	}
+}
+
+// InitialCapacityPublished returns true once capacity was published
+// successfully at least once for each topology segment with a storage
+// class of the driver. After that it always returns true, also when new
+// segments get added.
+func (c *Controller) InitialCapacityPublished() bool {
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	if c.initiallyPublished {
+		return true
+	}
+	if !c.prepared {
+		return false
+	}
+	for item := range c.capacities {
+		if !c.publishedSegments[item.segment] {
+			return false
+		}
+	}
+	klog.V(2).Info("Capacity Controller: initial capacity published for all topology segments")
+	c.initiallyPublished = true
+	c.publishedSegments = nil
+	return true
+}
+
+// usableCapacity returns the usable capacity from the GetCapacity response
+// header, if the driver reported one, otherwise the available capacity.
+func usableCapacity(header metadata.MD, available int64, item workItem) int64 {
+	values := header.Get(UsableCapacityMetadataKey)
+	if len(values) == 0 {
+		return available
+	}
+	usable, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || usable < 0 {
+		klog.Warningf("Capacity Controller: ignoring invalid %s %q in GetCapacity response for %+v, using available capacity %d", UsableCapacityMetadataKey, values[0], item, available)
+		return available
+	}
+	return usable
+}
+
+// setLastError remembers the GetCapacity error for the item.
+func (c *Controller) setLastError(item workItem, err error) {
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	if _, found := c.capacities[item]; !found {
+		// Obsolete, don't report it.
+		return
+	}
+	c.lastErrors[item] = status.Code(err)
+}
+
+// clearLastError forgets about any previous GetCapacity error for the item.
+func (c *Controller) clearLastError(item workItem) {
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	delete(c.lastErrors, item)
+}
+
 // deleteCapacity ensures that the object is gone when done.
 func (c *Controller) deleteCapacity(ctx context.Context, capacity *storagev1.CSIStorageCapacity) error {
 	klog.V(5).Infof("Capacity Controller: removing CSIStorageCapacity %s", capacity.Name)
@@ -724,6 +980,7 @@ func (c *Controller) onCAddOrUpdate(ctx context.Context, capacity *storagev1.CSI
 			// of parameters. Reuse it.
 			klog.V(5).Infof("Capacity Controller: CSIStorageCapacity %s with resource version %s matches %+v", capacity.Name, capacity.ResourceVersion, item)
 			c.capacities[item] = capacity
+			delete(c.creating, item)
 			return
 		}
 	}
@@ -752,6 +1009,9 @@ func (c *Controller) DescribeWithStability(ch chan<- *metrics.Desc) {
 	ch <- objectsGoalDesc
 	ch <- objectsCurrentDesc
 	ch <- objectsObsoleteDesc
+	ch <- getCapacityErrorDesc
+	ch <- objectsOverLimitDesc
+	ch <- predictedInsufficientDesc
 }
 
 // CollectWithStability implements the metrics.StableCollector interface.
@@ -771,6 +1031,30 @@ func (c *Controller) CollectWithStability(ch chan<- metrics.Metric) {
 		metrics.GaugeValue,
 		float64(c.getObjectsObsolete()),
 	)
+	if c.maxObjects > 0 {
+		ch <- metrics.NewLazyConstMetric(objectsOverLimitDesc,
+			metrics.GaugeValue,
+			float64(len(c.overLimit)),
+		)
+	}
+	for item, code := range c.lastErrors {
+		segment := ""
+		if item.segment != nil {
+			segment = item.segment.SimpleString()
+		}
+		ch <- metrics.NewLazyConstMetric(getCapacityErrorDesc,
+			metrics.GaugeValue,
+			1,
+			item.storageClassName, segment, code.String(),
+		)
+	}
+	for storageClassName, count := range c.predictedInsufficient {
+		ch <- metrics.NewLazyConstMetric(predictedInsufficientDesc,
+			metrics.CounterValue,
+			float64(count),
+			storageClassName,
+		)
+	}
 }
 
 // getObjectsGoal is called during metrics gathering and calculates the number
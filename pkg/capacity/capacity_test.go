@@ -33,6 +33,9 @@ import (
 	"github.com/kubernetes-csi/external-provisioner/pkg/capacity/topology"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
@@ -1186,6 +1189,490 @@ func TestCapacityController(t *testing.T) {
 	}
 }
 
+// TestGetCapacityError checks that a failing GetCapacity call gets reported
+// through a metric and an annotation and that both are cleared again once
+// the call succeeds.
+func TestGetCapacityError(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{{name: "other-sc", driverName: driverName}})...)
+	clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+	clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+	storage := &mockCapacity{
+		capacity: map[string]interface{}{
+			// This matches layer0.
+			"foo": "1Gi",
+		},
+	}
+	c, registry := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+	c.prepare(ctx)
+
+	getAnnotation := func(ctx context.Context) (string, error) {
+		capacities, err := clientSet.StorageV1().CSIStorageCapacities(ownerNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return "", err
+		}
+		if len(capacities.Items) != 1 {
+			return "", fmt.Errorf("expected one CSIStorageCapacity object, got %d", len(capacities.Items))
+		}
+		return capacities.Items[0].Annotations[GetCapacityErrorAnnotation], nil
+	}
+	errorMetric := func(reason string) string {
+		if reason == "" {
+			return ""
+		}
+		return fmt.Sprintf(`# HELP csistoragecapacities_get_capacity_error [ALPHA] Set to 1 for each storage class and topology segment where the last GetCapacity call failed, with the gRPC status code as reason. Cleared by the next successful call.
+# TYPE csistoragecapacities_get_capacity_error gauge
+csistoragecapacities_get_capacity_error{reason="%s",segment="layer0: foo",storage_class="other-sc"} 1
+`, reason)
+	}
+	validate := func(expectError bool, reason string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			annotation, err := getAnnotation(ctx)
+			if err != nil {
+				return err
+			}
+			if expectError && annotation == "" {
+				return errors.New("expected GetCapacity error annotation, got none")
+			}
+			if !expectError && annotation != "" {
+				return fmt.Errorf("expected no GetCapacity error annotation, got %q", annotation)
+			}
+			return testutil.GatherAndCompare(registry, bytes.NewBufferString(errorMetric(reason)), "csistoragecapacities_get_capacity_error")
+		}
+	}
+
+	if err := validateEventually(ctx, c, clientSet, validate(false, "")); err != nil {
+		t.Fatalf("initial state: %v", err)
+	}
+
+	storage.err = status.Error(codes.Unavailable, "backend down")
+	c.pollCapacities()
+	if err := validateEventually(ctx, c, clientSet, validate(true, codes.Unavailable.String())); err != nil {
+		t.Fatalf("after GetCapacity failure: %v", err)
+	}
+
+	storage.err = nil
+	c.pollCapacities()
+	if err := validateEventually(ctx, c, clientSet, validate(false, "")); err != nil {
+		t.Fatalf("after recovery: %v", err)
+	}
+}
+
+// TestUsableCapacity checks that the usable capacity reported by the driver
+// gets published instead of the available capacity.
+func TestUsableCapacity(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{{name: "other-sc", driverName: driverName}})...)
+	clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+	clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+	storage := &mockCapacity{
+		capacity: map[string]interface{}{
+			// This matches layer0.
+			"foo": "1Gi",
+		},
+	}
+	c, _ := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+	c.prepare(ctx)
+
+	validate := func(expected string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			capacities, err := clientSet.StorageV1().CSIStorageCapacities(ownerNamespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			if len(capacities.Items) != 1 {
+				return fmt.Errorf("expected one CSIStorageCapacity object, got %d", len(capacities.Items))
+			}
+			capacity := capacities.Items[0].Capacity
+			if capacity == nil || capacity.Cmp(resource.MustParse(expected)) != 0 {
+				return fmt.Errorf("expected capacity %s, got %v", expected, capacity)
+			}
+			return nil
+		}
+	}
+
+	if err := validateEventually(ctx, c, clientSet, validate("1Gi")); err != nil {
+		t.Fatalf("without usable capacity: %v", err)
+	}
+
+	storage.usable = "536870912"
+	c.pollCapacities()
+	if err := validateEventually(ctx, c, clientSet, validate("512Mi")); err != nil {
+		t.Fatalf("with usable capacity: %v", err)
+	}
+
+	storage.usable = "not-a-number"
+	c.pollCapacities()
+	if err := validateEventually(ctx, c, clientSet, validate("1Gi")); err != nil {
+		t.Fatalf("with invalid usable capacity: %v", err)
+	}
+}
+
+// TestInitialCapacityPublished checks that the initial publication of
+// capacity is only reported once it succeeded for all segments.
+func TestInitialCapacityPublished(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{{name: "other-sc", driverName: driverName}})...)
+	clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+	clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+	storage := &mockCapacity{
+		capacity: map[string]interface{}{
+			"foo": "1Gi",
+			// GetCapacity fails for layer0other.
+			"bar": map[string]interface{}(nil),
+		},
+	}
+	c, _ := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0, &layer0other), false /* immediate binding */)
+	if c.InitialCapacityPublished() {
+		t.Fatal("initial capacity published before preparing")
+	}
+	c.prepare(ctx)
+	if c.InitialCapacityPublished() {
+		t.Fatal("initial capacity published before processing")
+	}
+
+	if err := process(ctx, c, clientSet); err != nil {
+		t.Fatalf("unexpected processing error: %v", err)
+	}
+	if c.InitialCapacityPublished() {
+		t.Fatal("initial capacity published although GetCapacity failed for one segment")
+	}
+
+	storage.capacity["bar"] = "2Gi"
+	c.pollCapacities()
+	if err := validateEventually(ctx, c, clientSet, func(ctx context.Context) error {
+		if !c.InitialCapacityPublished() {
+			return errors.New("initial capacity not published")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later failures don't matter anymore.
+	storage.err = errors.New("GetCapacity failed")
+	c.pollCapacities()
+	if err := process(ctx, c, clientSet); err != nil {
+		t.Fatalf("unexpected processing error: %v", err)
+	}
+	if !c.InitialCapacityPublished() {
+		t.Error("initial capacity no longer published after GetCapacity failed")
+	}
+}
+
+// TestInitialCapacityPublishedNoStorageClass checks that there is nothing
+// to wait for without storage classes of the driver.
+func TestInitialCapacityPublishedNoStorageClass(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset()
+	c, _ := fakeController(ctx, clientSet, &defaultOwner, &mockCapacity{}, topology.NewMock(&layer0), false /* immediate binding */)
+	c.prepare(ctx)
+	if !c.InitialCapacityPublished() {
+		t.Error("expected initial capacity to be published without storage classes")
+	}
+}
+
+// TestCoalesceRefreshes checks that rapid refreshes of the same item during
+// the coalescing window lead to a single update with the latest capacity.
+func TestCoalesceRefreshes(t *testing.T) {
+	const window = 100 * time.Millisecond
+
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{{name: "other-sc", driverName: driverName}})...)
+	clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+	clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+	var mutex sync.Mutex
+	var updates []string
+	clientSet.PrependReactor("update", "csistoragecapacities", func(action ktesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		updates = append(updates, action.(ktesting.UpdateAction).GetObject().(*storagev1.CSIStorageCapacity).Capacity.String())
+		return false, nil, nil
+	})
+	storage := &mockCapacity{
+		capacity: map[string]interface{}{
+			// This matches layer0.
+			"foo": "1Gi",
+		},
+	}
+	c, _ := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+	c.prepare(ctx)
+	if err := validateCapacitiesEventually(ctx, c, clientSet, []testCapacity{
+		{
+			segment:          layer0,
+			storageClassName: "other-sc",
+			quantity:         "1Gi",
+		},
+	}); err != nil {
+		t.Fatalf("initial state: %v", err)
+	}
+
+	// The fake queue doesn't delay, so a real one is needed from now on.
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	c.queue = queue
+	c.coalesceWindow = window
+
+	for _, quantity := range []string{"2Gi", "3Gi", "4Gi"} {
+		storage.capacity["foo"] = quantity
+		c.refreshSC("other-sc")
+	}
+	require.Equal(t, 0, queue.Len(), "refreshes should be delayed")
+	time.Sleep(2 * window)
+	require.Equal(t, 1, queue.Len(), "refreshes should be coalesced")
+	c.processNextWorkItem(ctx)
+	time.Sleep(2 * window)
+	require.Equal(t, 0, queue.Len(), "no further refresh expected")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []string{"4Gi"}, updates)
+}
+
+// TestDeleteStorageClass checks that deleting a storage class removes all
+// of its CSIStorageCapacity objects, also those which the controller
+// doesn't know about, and keeps those of other classes.
+func TestDeleteStorageClass(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{
+		{name: "direct-sc", driverName: driverName},
+		{name: "other-sc", driverName: driverName},
+	})...)
+	clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+	clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+	storage := &mockCapacity{
+		capacity: map[string]interface{}{
+			// This matches layer0.
+			"foo": "1Gi",
+		},
+	}
+	c, _ := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+	c.prepare(ctx)
+	if err := validateCapacitiesEventually(ctx, c, clientSet, []testCapacity{
+		{
+			segment:          layer0,
+			storageClassName: "direct-sc",
+			quantity:         "1Gi",
+		},
+		{
+			segment:          layer0,
+			storageClassName: "other-sc",
+			quantity:         "1Gi",
+		},
+	}); err != nil {
+		t.Fatalf("initial state: %v", err)
+	}
+
+	// Forget the object of the class once the informer has seen it, as
+	// if its creation had been missed.
+	if err := validateEventually(ctx, c, clientSet, func(ctx context.Context) error {
+		capacities, err := c.cInformer.Lister().List(labels.Everything())
+		if err != nil {
+			return err
+		}
+		if len(capacities) != 2 {
+			return fmt.Errorf("expected 2 CSIStorageCapacity objects in informer, got %d", len(capacities))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.capacitiesLock.Lock()
+	for item := range c.capacities {
+		if item.storageClassName == "direct-sc" {
+			c.capacities[item] = nil
+		}
+	}
+	c.capacitiesLock.Unlock()
+
+	if err := clientSet.StorageV1().StorageClasses().Delete(ctx, "direct-sc", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validateCapacitiesEventually(ctx, c, clientSet, []testCapacity{
+		{
+			segment:          layer0,
+			storageClassName: "other-sc",
+			quantity:         "1Gi",
+		},
+	}); err != nil {
+		t.Fatalf("after removing storage class: %v", err)
+	}
+}
+
+// TestMaxObjects checks that no more CSIStorageCapacity objects than
+// allowed get created and that the missing ones are reported.
+func TestMaxObjects(t *testing.T) {
+	testcases := map[string]struct {
+		maxObjects      int
+		expectedObjects int
+		overLimit       int
+	}{
+		"under limit": {
+			maxObjects:      2,
+			expectedObjects: 2,
+		},
+		"over limit": {
+			maxObjects:      1,
+			expectedObjects: 1,
+			overLimit:       1,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			clientSet := fakeclientset.NewSimpleClientset(makeSCs([]testSC{
+				{name: "direct-sc", driverName: driverName},
+				{name: "other-sc", driverName: driverName},
+			})...)
+			clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+			clientSet.PrependReactor("update", "csistoragecapacities", updateCSIStorageCapacityReactor())
+			storage := &mockCapacity{
+				capacity: map[string]interface{}{
+					// This matches layer0.
+					"foo": "1Gi",
+				},
+			}
+			c, registry := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+			c.maxObjects = tc.maxObjects
+			c.prepare(ctx)
+
+			expectedMetric := fmt.Sprintf(`# HELP csistoragecapacities_over_limit [ALPHA] Number of CSIStorageCapacity objects that are supposed to be managed automatically but were not created because the maximum number of objects was reached. Only reported when there is a maximum.
+# TYPE csistoragecapacities_over_limit gauge
+csistoragecapacities_over_limit %d
+`, tc.overLimit)
+			if err := validateEventually(ctx, c, clientSet, func(ctx context.Context) error {
+				capacities, err := clientSet.StorageV1().CSIStorageCapacities(ownerNamespace).List(ctx, metav1.ListOptions{})
+				if err != nil {
+					return err
+				}
+				if len(capacities.Items) != tc.expectedObjects {
+					return fmt.Errorf("expected %d CSIStorageCapacity objects, got %d", tc.expectedObjects, len(capacities.Items))
+				}
+				return testutil.GatherAndCompare(registry, bytes.NewBufferString(expectedMetric), "csistoragecapacities_over_limit")
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Refreshing must not create more objects.
+			c.pollCapacities()
+			if err := process(ctx, c, clientSet); err != nil {
+				t.Fatalf("unexpected processing error: %v", err)
+			}
+			capacities, err := clientSet.StorageV1().CSIStorageCapacities(ownerNamespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(capacities.Items) != tc.expectedObjects {
+				t.Errorf("expected %d CSIStorageCapacity objects after refresh, got %d", tc.expectedObjects, len(capacities.Items))
+			}
+			if !c.InitialCapacityPublished() {
+				t.Error("initial capacity should be published")
+			}
+		})
+	}
+}
+
+// TestRefreshWorkers checks that no more GetCapacity calls than allowed
+// run concurrently.
+func TestRefreshWorkers(t *testing.T) {
+	const numClasses = 6
+
+	testcases := map[string]struct {
+		refreshWorkers int
+		check          func(t *testing.T, maxConcurrent int)
+	}{
+		"limited": {
+			refreshWorkers: 2,
+			check: func(t *testing.T, maxConcurrent int) {
+				if maxConcurrent > 2 {
+					t.Errorf("expected at most 2 concurrent GetCapacity calls, got %d", maxConcurrent)
+				}
+			},
+		},
+		"unlimited": {
+			check: func(t *testing.T, maxConcurrent int) {
+				if maxConcurrent <= 2 {
+					t.Errorf("expected more than 2 concurrent GetCapacity calls, got %d", maxConcurrent)
+				}
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var scs []testSC
+			for i := 0; i < numClasses; i++ {
+				scs = append(scs, testSC{name: fmt.Sprintf("sc-%d", i), driverName: driverName})
+			}
+			clientSet := fakeclientset.NewSimpleClientset(makeSCs(scs)...)
+			clientSet.PrependReactor("create", "csistoragecapacities", createCSIStorageCapacityReactor())
+			storage := &concurrentCapacity{
+				CSICapacityClient: &mockCapacity{
+					capacity: map[string]interface{}{
+						// This matches layer0.
+						"foo": "1Gi",
+					},
+				},
+				delay: 100 * time.Millisecond,
+			}
+			c, _ := fakeController(ctx, clientSet, &defaultOwner, storage, topology.NewMock(&layer0), false /* immediate binding */)
+			if tc.refreshWorkers > 0 {
+				c.refreshWorkers = make(chan struct{}, tc.refreshWorkers)
+			}
+			c.prepare(ctx)
+			require.Equal(t, numClasses, c.queue.Len(), "work items")
+
+			// One thread per work item.
+			var wg sync.WaitGroup
+			for i := 0; i < numClasses; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.processNextWorkItem(ctx)
+				}()
+			}
+			wg.Wait()
+
+			storage.mutex.Lock()
+			defer storage.mutex.Unlock()
+			require.Equal(t, numClasses, storage.calls, "GetCapacity calls")
+			tc.check(t, storage.maxConcurrent)
+		})
+	}
+}
+
+// concurrentCapacity counts how many GetCapacity calls run at the same
+// time. Each call takes at least the delay.
+type concurrentCapacity struct {
+	CSICapacityClient
+	delay time.Duration
+
+	mutex         sync.Mutex
+	calls         int
+	concurrent    int
+	maxConcurrent int
+}
+
+func (cc *concurrentCapacity) GetCapacity(ctx context.Context, in *csi.GetCapacityRequest, opts ...grpc.CallOption) (*csi.GetCapacityResponse, error) {
+	cc.mutex.Lock()
+	cc.calls++
+	cc.concurrent++
+	if cc.concurrent > cc.maxConcurrent {
+		cc.maxConcurrent = cc.concurrent
+	}
+	cc.mutex.Unlock()
+	defer func() {
+		cc.mutex.Lock()
+		defer cc.mutex.Unlock()
+		cc.concurrent--
+	}()
+
+	time.Sleep(cc.delay)
+	return cc.CSICapacityClient.GetCapacity(ctx, in, opts...)
+}
+
 func validateCapacities(ctx context.Context, clientSet *fakeclientset.Clientset, expectedCapacities []testCapacity) error {
 	actualCapacities, err := clientSet.StorageV1().CSIStorageCapacities(ownerNamespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -1363,6 +1850,9 @@ func fakeController(ctx context.Context, client *fakeclientset.Clientset, owner
 		1000*time.Hour, // Not used, but even if it was, we wouldn't want automatic capacity polling while the test runs...
 		immediateBinding,
 		timeout,
+		0,
+		0,
+		0,
 	)
 
 	// This ensures that the informers are running and up-to-date.
@@ -1530,9 +2020,16 @@ const (
 // A fake "multiplier" parameter is applied to the resulting capacity.
 type mockCapacity struct {
 	capacity map[string]interface{}
+	// err, if set, is returned by all GetCapacity calls.
+	err error
+	// usable, if set, is returned as UsableCapacityMetadataKey header.
+	usable string
 }
 
 func (mc *mockCapacity) GetCapacity(ctx context.Context, in *csi.GetCapacityRequest, opts ...grpc.CallOption) (*csi.GetCapacityResponse, error) {
+	if mc.err != nil {
+		return nil, mc.err
+	}
 	available := ""
 	if in.AccessibleTopology != nil {
 		var err error
@@ -1559,6 +2056,13 @@ func (mc *mockCapacity) GetCapacity(ctx context.Context, in *csi.GetCapacityRequ
 		}
 		resp.AvailableCapacity *= int64(multiplier)
 	}
+	if mc.usable != "" {
+		for _, opt := range opts {
+			if header, ok := opt.(grpc.HeaderCallOption); ok {
+				*header.HeaderAddr = metadata.Pairs(UsableCapacityMetadataKey, mc.usable)
+			}
+		}
+	}
 	return resp, nil
 }
 
@@ -1870,6 +2374,23 @@ func TestRefresh(t *testing.T) {
 				"triple-sc, [layer0: foo layer1: X layer2: A]",
 			},
 		},
+		"aggregated topology": {
+			topology: topology.NewMock(&layer0, &layer0other),
+			initialSCs: []testSC{
+				{
+					name:       "direct-sc",
+					driverName: driverName,
+				},
+			},
+			refreshTopology: topology.Segment{
+				{Key: "layer0", Value: "foo"},
+				{Key: "layer1", Value: "X"},
+			},
+
+			expectItems: []string{
+				"direct-sc, [layer0: foo]",
+			},
+		},
 		"no such topology": {
 			topology: topology.NewMock(&deep, &deepOther),
 			initialSCs: []testSC{
@@ -0,0 +1,105 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capacity
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/klog/v2"
+)
+
+// fitPrediction is the result of comparing the size of a PVC against the
+// CSIStorageCapacity objects for it.
+type fitPrediction int
+
+const (
+	// fitUnknown means that there is no CSIStorageCapacity object for
+	// the PVC.
+	fitUnknown fitPrediction = iota
+	fitLikely
+	fitUnlikely
+)
+
+var predictedInsufficientDesc = metrics.NewDesc(
+	"csistoragecapacities_predicted_insufficient_total",
+	"Number of provisioning attempts where the size of the PVC exceeded the capacity in all CSIStorageCapacity objects for its storage class and node.",
+	[]string{"storage_class"}, nil,
+	metrics.ALPHA,
+	"",
+)
+
+// predictFit compares the requested size of the claim against the
+// CSIStorageCapacity objects for the storage class. Only segments which
+// contain the node are considered, if there is one. As in the
+// Kubernetes scheduler, the maximum volume size takes precedence over the
+// capacity.
+func (c *Controller) predictFit(claim *v1.PersistentVolumeClaim, storageClassName string, node *v1.Node) fitPrediction {
+	size, ok := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	if !ok || size.IsZero() {
+		return fitUnknown
+	}
+
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+
+	prediction := fitUnknown
+	for item, capacity := range c.capacities {
+		if capacity == nil || item.storageClassName != storageClassName {
+			continue
+		}
+		if node != nil && !segmentContainsNode(item, node) {
+			continue
+		}
+		limit := capacity.MaximumVolumeSize
+		if limit == nil {
+			limit = capacity.Capacity
+		}
+		if limit == nil {
+			continue
+		}
+		if limit.Cmp(size) >= 0 {
+			return fitLikely
+		}
+		prediction = fitUnlikely
+	}
+	return prediction
+}
+
+func segmentContainsNode(item workItem, node *v1.Node) bool {
+	if item.segment == nil {
+		return false
+	}
+	for _, entry := range *item.segment {
+		if node.Labels[entry.Key] != entry.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// recordFitPrediction counts the claim in the metric if it probably won't
+// fit. It never prevents provisioning.
+func (c *Controller) recordFitPrediction(claim *v1.PersistentVolumeClaim, storageClassName string, node *v1.Node) {
+	if c.predictFit(claim, storageClassName, node) != fitUnlikely {
+		return
+	}
+	klog.V(3).Infof("Capacity Controller: PVC %s/%s probably does not fit into the known capacity for storage class %s", claim.Namespace, claim.Name, storageClassName)
+
+	c.capacitiesLock.Lock()
+	defer c.capacitiesLock.Unlock()
+	c.predictedInsufficient[storageClassName]++
+}
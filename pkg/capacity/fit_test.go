@@ -0,0 +1,149 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capacity
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/kubernetes-csi/external-provisioner/pkg/capacity/topology"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestPredictFit(t *testing.T) {
+	zoneA := topology.Segment{{Key: "zone", Value: "a"}}
+	zoneB := topology.Segment{{Key: "zone", Value: "b"}}
+	capacityObject := func(capacity, maxVolume string) *storagev1.CSIStorageCapacity {
+		return &storagev1.CSIStorageCapacity{
+			Capacity:          str2quantity(capacity),
+			MaximumVolumeSize: str2quantity(maxVolume),
+		}
+	}
+	nodeInZone := func(zone string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-" + zone, Labels: map[string]string{"zone": zone}},
+		}
+	}
+	capacities := map[workItem]*storagev1.CSIStorageCapacity{
+		{segment: &zoneA, storageClassName: "small"}:   capacityObject("1Gi", ""),
+		{segment: &zoneB, storageClassName: "small"}:   capacityObject("5Gi", ""),
+		{segment: &zoneA, storageClassName: "limited"}: capacityObject("100Gi", "1Gi"),
+		{segment: &zoneA, storageClassName: "pending"}: nil,
+	}
+
+	testcases := map[string]struct {
+		size             string
+		storageClassName string
+		node             *v1.Node
+		expected         fitPrediction
+	}{
+		"fits somewhere": {
+			size:             "2Gi",
+			storageClassName: "small",
+			expected:         fitLikely,
+		},
+		"fits nowhere": {
+			size:             "10Gi",
+			storageClassName: "small",
+			expected:         fitUnlikely,
+		},
+		"fits in node zone": {
+			size:             "2Gi",
+			storageClassName: "small",
+			node:             nodeInZone("b"),
+			expected:         fitLikely,
+		},
+		"doesn't fit in node zone": {
+			size:             "2Gi",
+			storageClassName: "small",
+			node:             nodeInZone("a"),
+			expected:         fitUnlikely,
+		},
+		"exceeds maximum volume size": {
+			size:             "2Gi",
+			storageClassName: "limited",
+			expected:         fitUnlikely,
+		},
+		"no capacity object yet": {
+			size:             "2Gi",
+			storageClassName: "pending",
+			expected:         fitUnknown,
+		},
+		"unknown storage class": {
+			size:             "2Gi",
+			storageClassName: "other",
+			expected:         fitUnknown,
+		},
+		"unknown zone": {
+			size:             "2Gi",
+			storageClassName: "small",
+			node:             nodeInZone("c"),
+			expected:         fitUnknown,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			c := &Controller{
+				capacities:            capacities,
+				predictedInsufficient: map[string]int64{},
+			}
+			claim := &v1.PersistentVolumeClaim{
+				Spec: v1.PersistentVolumeClaimSpec{
+					Resources: v1.ResourceRequirements{
+						Requests: v1.ResourceList{
+							v1.ResourceStorage: resource.MustParse(tc.size),
+						},
+					},
+				},
+			}
+			if actual := c.predictFit(claim, tc.storageClassName, tc.node); actual != tc.expected {
+				t.Fatalf("expected prediction %d, got %d", tc.expected, actual)
+			}
+
+			c.recordFitPrediction(claim, tc.storageClassName, tc.node)
+			expectedCount := int64(0)
+			if tc.expected == fitUnlikely {
+				expectedCount = 1
+			}
+			if count := c.predictedInsufficient[tc.storageClassName]; count != expectedCount {
+				t.Errorf("expected count %d, got %d", expectedCount, count)
+			}
+		})
+	}
+}
+
+func TestPredictedInsufficientMetric(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset()
+	c, registry := fakeController(ctx, clientSet, &defaultOwner, &mockCapacity{}, topology.NewMock(), false /* immediate binding */)
+	c.predictedInsufficient["fast-sc"] = 2
+
+	expectedMetric := `# HELP csistoragecapacities_predicted_insufficient_total [ALPHA] Number of provisioning attempts where the size of the PVC exceeded the capacity in all CSIStorageCapacity objects for its storage class and node.
+# TYPE csistoragecapacities_predicted_insufficient_total counter
+csistoragecapacities_predicted_insufficient_total{storage_class="fast-sc"} 2
+`
+	if err := testutil.GatherAndCompare(registry, bytes.NewBufferString(expectedMetric), "csistoragecapacities_predicted_insufficient_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -25,21 +25,29 @@ import (
 
 type provisionWrapper struct {
 	controller.Provisioner
-	c *Controller
+	c          *Controller
+	predictFit bool
 }
 
 var _ controller.Provisioner = &provisionWrapper{}
 var _ controller.BlockProvisioner = &provisionWrapper{}
 var _ controller.Qualifier = &provisionWrapper{}
 
-func NewProvisionWrapper(p controller.Provisioner, c *Controller) controller.Provisioner {
+// NewProvisionWrapper refreshes capacity after provisioning and deleting
+// volumes. With predictFit, it also counts PVCs which probably don't fit
+// into the known capacity before provisioning them.
+func NewProvisionWrapper(p controller.Provisioner, c *Controller, predictFit bool) controller.Provisioner {
 	return &provisionWrapper{
 		Provisioner: p,
 		c:           c,
+		predictFit:  predictFit,
 	}
 }
 
 func (p *provisionWrapper) Provision(ctx context.Context, options controller.ProvisionOptions) (pv *v1.PersistentVolume, state controller.ProvisioningState, err error) {
+	if p.predictFit && options.StorageClass != nil {
+		p.c.recordFitPrediction(options.PVC, options.StorageClass.Name, options.SelectedNode)
+	}
 	pv, state, err = p.Provisioner.Provision(ctx, options)
 	if err == nil && pv != nil {
 		if pv.Spec.NodeAffinity != nil {
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capacity
+
+import (
+	"context"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// NewRateLimitedClientFactory wraps a factory such that all of its clients
+// wait for the same rate limiter before creating, updating or deleting
+// CSIStorageCapacity objects. This smoothes out bursts of writes when many
+// objects need to be refreshed at once, without slowing down the informer.
+func NewRateLimitedClientFactory(factory CSIStorageCapacityFactory, limiter flowcontrol.RateLimiter) CSIStorageCapacityFactory {
+	return func(namespace string) CSIStorageCapacityInterface {
+		return rateLimitedClient{
+			CSIStorageCapacityInterface: factory(namespace),
+			limiter:                     limiter,
+		}
+	}
+}
+
+type rateLimitedClient struct {
+	CSIStorageCapacityInterface
+	limiter flowcontrol.RateLimiter
+}
+
+var _ CSIStorageCapacityInterface = rateLimitedClient{}
+
+func (c rateLimitedClient) Create(ctx context.Context, capacity *storagev1.CSIStorageCapacity, opts metav1.CreateOptions) (*storagev1.CSIStorageCapacity, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.CSIStorageCapacityInterface.Create(ctx, capacity, opts)
+}
+
+func (c rateLimitedClient) Update(ctx context.Context, capacity *storagev1.CSIStorageCapacity, opts metav1.UpdateOptions) (*storagev1.CSIStorageCapacity, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.CSIStorageCapacityInterface.Update(ctx, capacity, opts)
+}
+
+func (c rateLimitedClient) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return c.CSIStorageCapacityInterface.Delete(ctx, name, opts)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestRateLimitedClientFactory(t *testing.T) {
+	const (
+		qps    = 20
+		writes = 6
+	)
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset()
+	clientFactory := NewRateLimitedClientFactory(NewV1ClientFactory(clientSet), flowcontrol.NewTokenBucketRateLimiter(qps, 1))
+
+	start := time.Now()
+	for i := 0; i < writes/2; i++ {
+		capacity := &storagev1.CSIStorageCapacity{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("csisc-%d", i)},
+		}
+		// Different namespaces share the same limiter.
+		client := clientFactory(fmt.Sprintf("ns-%d", i))
+		created, err := client.Create(ctx, capacity, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := client.Update(ctx, created, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// The first write uses the burst, all others have to wait.
+	minDuration := time.Duration(writes-1) * time.Second / qps
+	if duration := time.Since(start); duration < minDuration {
+		t.Errorf("expected %d writes at %d QPS to take at least %s, took %s", writes, qps, minDuration, duration)
+	}
+	if actions := len(clientSet.Actions()); actions != writes {
+		t.Errorf("expected %d writes, got %d", writes, actions)
+	}
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := clientFactory("ns-0").Delete(canceledCtx, "csisc-0", metav1.DeleteOptions{}); err == nil {
+		t.Error("expected error for canceled context, got none")
+	}
+}
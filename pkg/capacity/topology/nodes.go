@@ -40,12 +40,17 @@ import (
 // driver node instance reports.  See
 // https://github.com/kubernetes/enhancements/tree/master/keps/sig-storage/1472-storage-capacity-tracking#with-central-controller
 // for details.
+//
+// If aggregationKeys is non-empty, only those topology keys are used
+// when building segments. Nodes which only differ in other keys then
+// end up in the same segment.
 func NewNodeTopology(
 	driverName string,
 	client kubernetes.Interface,
 	nodeInformer coreinformersv1.NodeInformer,
 	csiNodeInformer storageinformersv1.CSINodeInformer,
 	queue workqueue.RateLimitingInterface,
+	aggregationKeys []string,
 ) Informer {
 	nt := &nodeTopology{
 		driverName:      driverName,
@@ -54,6 +59,12 @@ func NewNodeTopology(
 		csiNodeInformer: csiNodeInformer,
 		queue:           queue,
 	}
+	if len(aggregationKeys) > 0 {
+		nt.aggregationKeys = map[string]bool{}
+		for _, key := range aggregationKeys {
+			nt.aggregationKeys[key] = true
+		}
+	}
 
 	// Whenever Node or CSINode objects change, we need to
 	// recalculate the new topology segments. We could do that
@@ -159,6 +170,9 @@ type nodeTopology struct {
 	nodeInformer    coreinformersv1.NodeInformer
 	csiNodeInformer storageinformersv1.CSINodeInformer
 	queue           workqueue.RateLimitingInterface
+	// aggregationKeys, if non-nil, limits the topology keys
+	// that are used for segments.
+	aggregationKeys map[string]bool
 
 	mutex sync.Mutex
 	// segments hold a list of all currently known topology segments.
@@ -271,6 +285,11 @@ node:
 		newSegment := Segment{}
 		sort.Strings(topologyKeys)
 		for _, key := range topologyKeys {
+			if nt.aggregationKeys != nil && !nt.aggregationKeys[key] {
+				// Not relevant for capacity, nodes which only
+				// differ in this key share the same segment.
+				continue
+			}
 			value, ok := node.Labels[key]
 			if !ok {
 				// The driver announced some topology key and kubelet recorded
@@ -84,6 +84,19 @@ var (
 		{networkStorageKeys[1], "NY"},
 		{networkStorageKeys[2], "2"},
 	}
+	networkStorageLabels3 = map[string]string{
+		networkStorageKeys[0]: "EU",
+		networkStorageKeys[1]: "NY",
+		networkStorageKeys[2]: "1",
+	}
+	networkStorageAggregated = &Segment{
+		{networkStorageKeys[1], "NY"},
+		{networkStorageKeys[2], "1"},
+	}
+	networkStorageAggregated2 = &Segment{
+		{networkStorageKeys[1], "NY"},
+		{networkStorageKeys[2], "2"},
+	}
 )
 
 func removeNode(t *testing.T, client *fakeclientset.Clientset, nodeName string) {
@@ -105,6 +118,7 @@ func removeCSINode(t *testing.T, client *fakeclientset.Clientset, nodeName strin
 func TestNodeTopology(t *testing.T) {
 	testcases := map[string]struct {
 		driverName              string
+		aggregationKeys         []string
 		initialNodes            []testNode
 		expectedSegments        []*Segment
 		update                  func(t *testing.T, client *fakeclientset.Clientset)
@@ -233,6 +247,46 @@ func TestNodeTopology(t *testing.T) {
 			},
 			expectedSegments: []*Segment{networkStorage},
 		},
+		"aggregated-topology": {
+			aggregationKeys: networkStorageKeys[1:],
+			initialNodes: []testNode{
+				{
+					name: node1,
+					driverKeys: map[string][]string{
+						driverName: networkStorageKeys,
+					},
+					labels: networkStorageLabels,
+				},
+				{
+					name: node2,
+					driverKeys: map[string][]string{
+						driverName: networkStorageKeys,
+					},
+					labels: networkStorageLabels3,
+				},
+			},
+			expectedSegments: []*Segment{networkStorageAggregated},
+		},
+		"aggregated-topology-different-segments": {
+			aggregationKeys: networkStorageKeys[1:],
+			initialNodes: []testNode{
+				{
+					name: node1,
+					driverKeys: map[string][]string{
+						driverName: networkStorageKeys,
+					},
+					labels: networkStorageLabels,
+				},
+				{
+					name: node2,
+					driverKeys: map[string][]string{
+						driverName: networkStorageKeys,
+					},
+					labels: networkStorageLabels2,
+				},
+			},
+			expectedSegments: []*Segment{networkStorageAggregated, networkStorageAggregated2},
+		},
 		"mixed-topology": {
 			initialNodes: []testNode{
 				{
@@ -403,7 +457,7 @@ func TestNodeTopology(t *testing.T) {
 			var objects []runtime.Object
 			objects = append(objects, makeNodes(tc.initialNodes)...)
 			clientSet := fakeclientset.NewSimpleClientset(objects...)
-			nt := fakeNodeTopology(ctx, testDriverName, clientSet)
+			nt := fakeNodeTopology(ctx, testDriverName, clientSet, tc.aggregationKeys)
 			if err := waitForInformers(ctx, nt); err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -470,7 +524,7 @@ func containsSegment(segments []*Segment, segment *Segment) bool {
 	return false
 }
 
-func fakeNodeTopology(ctx context.Context, testDriverName string, client *fakeclientset.Clientset) *nodeTopology {
+func fakeNodeTopology(ctx context.Context, testDriverName string, client *fakeclientset.Clientset, aggregationKeys []string) *nodeTopology {
 	// We don't need resyncs, they just lead to confusing log output if they get triggered while already some
 	// new test is running.
 	informerFactory := informers.NewSharedInformerFactory(client, 0*time.Second /* no resync */)
@@ -485,6 +539,7 @@ func fakeNodeTopology(ctx context.Context, testDriverName string, client *fakecl
 		nodeInformer,
 		csiNodeInformer,
 		queue,
+		aggregationKeys,
 	).(*nodeTopology)
 
 	go informerFactory.Start(ctx.Done())
@@ -66,6 +66,26 @@ func (s Segment) Compare(other Segment) int {
 	return 0
 }
 
+// IsSubsetOf returns true if all key/value pairs of s are also
+// contained in the other segment. When segments are built with a
+// subset of the topology keys, this matches volumes whose topology
+// includes keys that are not part of the segment.
+func (s Segment) IsSubsetOf(other Segment) bool {
+	for _, entry := range s {
+		found := false
+		for _, otherEntry := range other {
+			if entry == otherEntry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func (s Segment) Len() int           { return len(s) }
 func (s Segment) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
 func (s Segment) Swap(i, j int) {
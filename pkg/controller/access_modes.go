@@ -0,0 +1,86 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// annFilesystemAccessModes and annBlockAccessModes on a CSIDriver
+	// object list the access modes, separated by commas, that the driver
+	// supports for volumes of that volume mode. A missing annotation
+	// means that the driver supports all access modes.
+	annFilesystemAccessModes = "provisioner.k8s.io/filesystem-access-modes"
+	annBlockAccessModes      = "provisioner.k8s.io/block-access-modes"
+)
+
+// unsupportedAccessModeError is returned when a claim requests an access
+// mode that the driver does not support for the volume mode of the claim.
+type unsupportedAccessModeError struct {
+	message string
+}
+
+func (e *unsupportedAccessModeError) Error() string {
+	return e.message
+}
+
+// checkAccessModes compares the access modes of the claim with
+// the access modes that the CSIDriver object of the driver advertises for
+// the volume mode of the claim.
+func (p *csiProvisioner) checkAccessModes(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	volumeMode := v1.PersistentVolumeFilesystem
+	annotation := annFilesystemAccessModes
+	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock {
+		volumeMode = v1.PersistentVolumeBlock
+		annotation = annBlockAccessModes
+	}
+
+	csiDriver, err := p.client.StorageV1().CSIDrivers().Get(ctx, p.driverName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting CSIDriver %s: %v", p.driverName, err)
+	}
+	value, ok := csiDriver.Annotations[annotation]
+	if !ok {
+		return nil
+	}
+	supported := sets.NewString()
+	for _, mode := range strings.Split(value, ",") {
+		if mode = strings.TrimSpace(mode); mode != "" {
+			supported.Insert(mode)
+		}
+	}
+	for _, mode := range claim.Spec.AccessModes {
+		if !supported.Has(string(mode)) {
+			return &unsupportedAccessModeError{
+				message: fmt.Sprintf("CSI driver %s does not support access mode %s for volume mode %s, supported are: %s",
+					p.driverName, mode, volumeMode, strings.Join(supported.List(), ", ")),
+			}
+		}
+	}
+	return nil
+}
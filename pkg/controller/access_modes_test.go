@@ -0,0 +1,143 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionVolumeModeAccessModes(t *testing.T) {
+	const requestBytes = 100
+	block := v1.PersistentVolumeBlock
+	filesystem := v1.PersistentVolumeFilesystem
+	// A driver which supports ReadWriteMany only for raw block volumes.
+	blockRWX := map[string]string{
+		annFilesystemAccessModes: "ReadWriteOnce, ReadWriteOncePod",
+		annBlockAccessModes:      "ReadWriteOnce,ReadWriteOncePod,ReadWriteMany",
+	}
+
+	testcases := map[string]struct {
+		disabled       bool
+		annotations    map[string]string
+		noCSIDriver    bool
+		volumeMode     *v1.PersistentVolumeMode
+		accessModes    []v1.PersistentVolumeAccessMode
+		expectRejected bool
+	}{
+		"filesystem RWX rejected": {
+			annotations:    blockRWX,
+			volumeMode:     &filesystem,
+			accessModes:    []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			expectRejected: true,
+		},
+		"default volume mode RWX rejected": {
+			annotations:    blockRWX,
+			accessModes:    []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			expectRejected: true,
+		},
+		"filesystem RWO and RWX rejected": {
+			annotations:    blockRWX,
+			volumeMode:     &filesystem,
+			accessModes:    []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadWriteMany},
+			expectRejected: true,
+		},
+		"filesystem RWO": {
+			annotations: blockRWX,
+			volumeMode:  &filesystem,
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		},
+		"block RWX": {
+			annotations: blockRWX,
+			volumeMode:  &block,
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+		},
+		"block ROX rejected": {
+			annotations:    blockRWX,
+			volumeMode:     &block,
+			accessModes:    []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			expectRejected: true,
+		},
+		"block without annotation": {
+			annotations: map[string]string{annFilesystemAccessModes: "ReadWriteOnce"},
+			volumeMode:  &block,
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+		},
+		"no CSIDriver": {
+			noCSIDriver: true,
+			volumeMode:  &filesystem,
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+		},
+		"disabled": {
+			disabled:    true,
+			annotations: blockRWX,
+			volumeMode:  &filesystem,
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var objects []runtime.Object
+			if !tc.noCSIDriver {
+				objects = append(objects, &storagev1.CSIDriver{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        driverName,
+						Annotations: tc.annotations,
+					},
+				})
+			}
+			pluginCaps, controllerCaps := provisionWithSingleNodeMultiWriterCapabilities()
+			pt := newProvisionerTest(t, objects, withCapabilities(pluginCaps, controllerCaps), CheckVolumeModeAccessModes(!tc.disabled))
+			if !tc.expectRejected {
+				pt.expectCreateVolume(requestBytes, nil)
+			}
+
+			claim := createFakePVC(requestBytes)
+			claim.Spec.VolumeMode = tc.volumeMode
+			claim.Spec.AccessModes = tc.accessModes
+			pv, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if !tc.expectRejected {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if pv == nil {
+					t.Fatal("expected PV, got none")
+				}
+				return
+			}
+
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			if events := pt.events(); len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" UnsupportedAccessMode") {
+				t.Errorf("expected UnsupportedAccessMode event, got %q", events)
+			}
+		})
+	}
+}
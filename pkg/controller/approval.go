@@ -0,0 +1,218 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	// annApprovalRequired=true on a PVC requests approval regardless of
+	// the size of the volume.
+	annApprovalRequired = "provisioner.k8s.io/approval-required"
+	// annApprovalPrefix followed by the PVC UID is set on the namespace
+	// of the PVC by the approver, either to approvalApproved, to
+	// approvalApproved:<RFC 3339 time> for an approval which expires at
+	// that time, or to approvalDenied. Namespaces are controlled by the
+	// cluster admin, PVCs by their users, who therefore cannot approve
+	// their own PVCs.
+	annApprovalPrefix = "provisioner.k8s.io/approval-"
+	approvalApproved  = "approved"
+	approvalDenied    = "denied"
+
+	// conditionApprovalRequired is the PVC condition which is true while
+	// provisioning waits for approval.
+	conditionApprovalRequired v1.PersistentVolumeClaimConditionType = "ProvisioningApprovalRequired"
+)
+
+// approvals holds the state of RequireProvisioningApproval.
+type approvals struct {
+	threshold       int64
+	namespaceLister corelisters.NamespaceLister
+	clock           clock.Clock
+
+	mutex sync.Mutex
+	// pending maps the claims which wait for approval to the reason that
+	// was reported for them, so that each claim gets reported only once.
+	pending map[types.UID]string
+}
+
+// newApprovals reads namespaces from the informer. Claims which wait for
+// approval are not retried by the provisioner library, instead they get
+// queued again through the claim informer when their namespace changes.
+// The claim informer may be nil.
+func newApprovals(threshold int64, namespaceInformer coreinformers.NamespaceInformer, claimInformer *RequeueInformer, clock clock.Clock) *approvals {
+	a := &approvals{
+		threshold:       threshold,
+		namespaceLister: namespaceInformer.Lister(),
+		clock:           clock,
+		pending:         map[types.UID]string{},
+	}
+	if claimInformer == nil {
+		return a
+	}
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNamespace, ok := oldObj.(*v1.Namespace)
+			namespace, ok2 := newObj.(*v1.Namespace)
+			if !ok || !ok2 || reflect.DeepEqual(oldNamespace.Annotations, namespace.Annotations) {
+				return
+			}
+			claimInformer.requeue(func(obj interface{}) bool {
+				claim, ok := obj.(*v1.PersistentVolumeClaim)
+				return ok && claim.Namespace == namespace.Name && a.isPending(claim.UID)
+			})
+		},
+	})
+	claimInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+				obj = unknown.Obj
+			}
+			if claim, ok := obj.(*v1.PersistentVolumeClaim); ok {
+				a.forget(claim.UID)
+			}
+		},
+	})
+	return a
+}
+
+// setPending returns true if the claim wasn't reported with that reason
+// yet.
+func (a *approvals) setPending(uid types.UID, reason string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.pending[uid] == reason {
+		return false
+	}
+	a.pending[uid] = reason
+	return true
+}
+
+func (a *approvals) isPending(uid types.UID) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, ok := a.pending[uid]
+	return ok
+}
+
+func (a *approvals) forget(uid types.UID) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.pending, uid)
+}
+
+// approvalAnnotation returns the namespace annotation with the approval of
+// the claim.
+func approvalAnnotation(claim *v1.PersistentVolumeClaim) string {
+	return annApprovalPrefix + string(claim.UID)
+}
+
+// checkApproval returns an IgnoredError if provisioning of the claim has to
+// wait for approval or was denied. Waiting is not a failure and gets
+// reported only once. Approval is only needed for claims which ask for it
+// or which exceed the size threshold.
+func (p *csiProvisioner) checkApproval(ctx context.Context, claim *v1.PersistentVolumeClaim, volSizeBytes int64) (controller.ProvisioningState, error) {
+	a := p.approvals
+	if claim.Annotations[annApprovalRequired] != "true" &&
+		(a.threshold <= 0 || volSizeBytes <= a.threshold) {
+		return controller.ProvisioningNoChange, nil
+	}
+
+	namespace, err := a.namespaceLister.Get(claim.Namespace)
+	if err != nil {
+		return controller.ProvisioningNoChange, fmt.Errorf("get namespace %s to check approval: %v", claim.Namespace, err)
+	}
+	approval, until, _ := strings.Cut(namespace.Annotations[approvalAnnotation(claim)], ":")
+	reason := "WaitingForApproval"
+	switch approval {
+	case approvalApproved:
+		if until == "" {
+			a.forget(claim.UID)
+			p.removeApprovalCondition(ctx, claim)
+			return controller.ProvisioningNoChange, nil
+		}
+		expiry, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			reason = "InvalidApproval"
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "InvalidProvisioningApproval", "Invalid expiry time in annotation %s of namespace %s: %v", approvalAnnotation(claim), claim.Namespace, err)
+			break
+		}
+		if a.clock.Now().Before(expiry) {
+			a.forget(claim.UID)
+			p.removeApprovalCondition(ctx, claim)
+			return controller.ProvisioningNoChange, nil
+		}
+		reason = "ApprovalExpired"
+	case approvalDenied:
+		a.forget(claim.UID)
+		err := fmt.Errorf("provisioning of %d bytes was denied", volSizeBytes)
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningApprovalDenied", err.Error())
+		if err := p.updateClaimCondition(ctx, claim, conditionApprovalRequired, &v1.PersistentVolumeClaimCondition{
+			Status:  v1.ConditionFalse,
+			Reason:  "Denied",
+			Message: err.Error(),
+		}); err != nil {
+			klog.Warningf("failed to update %s condition of PVC %s/%s: %v", conditionApprovalRequired, claim.Namespace, claim.Name, err)
+		}
+		// Retrying would only repeat the denial. A PVC or namespace
+		// update triggers a new check.
+		return controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+	}
+
+	message := fmt.Sprintf("provisioning of %d bytes is waiting for the %s=%s annotation of namespace %s", volSizeBytes, approvalAnnotation(claim), approvalApproved, claim.Namespace)
+	if a.setPending(claim.UID, reason) {
+		p.eventRecorder.Event(claim, v1.EventTypeNormal, "ProvisioningApprovalRequired", message)
+		if err := p.updateClaimCondition(ctx, claim, conditionApprovalRequired, &v1.PersistentVolumeClaimCondition{
+			Status:  v1.ConditionTrue,
+			Reason:  reason,
+			Message: message,
+		}); err != nil {
+			// Report it again next time.
+			a.forget(claim.UID)
+			return controller.ProvisioningNoChange, fmt.Errorf("set %s condition: %v", conditionApprovalRequired, err)
+		}
+	}
+	// The claim gets queued again when its namespace changes.
+	return controller.ProvisioningNoChange, &controller.IgnoredError{Reason: message}
+}
+
+// removeApprovalCondition removes the approval condition of an approved
+// claim.
+func (p *csiProvisioner) removeApprovalCondition(ctx context.Context, claim *v1.PersistentVolumeClaim) {
+	if err := p.updateClaimCondition(ctx, claim, conditionApprovalRequired, nil); err != nil {
+		// Not worth blocking provisioning.
+		klog.Warningf("failed to remove %s condition from PVC %s/%s: %v", conditionApprovalRequired, claim.Namespace, claim.Name, err)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+type approvalStep struct {
+	// approval is the value of the approval annotation of the namespace,
+	// empty if not set.
+	approval string
+	// advance moves the clock forward before provisioning.
+	advance         time.Duration
+	expectCreate    bool
+	expectIgnored   bool
+	expectState     controller.ProvisioningState
+	expectCondition v1.ConditionStatus // empty if no condition
+	expectReason    string
+	// expectEvent is true if waiting for approval gets reported.
+	expectEvent bool
+}
+
+func TestProvisionApproval(t *testing.T) {
+	const threshold = 1000
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+	future := now.Add(time.Hour).Format(time.RFC3339)
+
+	testcases := map[string]struct {
+		requestBytes int64
+		annotations  map[string]string
+		steps        []approvalStep
+	}{
+		"below threshold": {
+			requestBytes: threshold,
+			steps: []approvalStep{
+				{expectCreate: true, expectState: controller.ProvisioningFinished},
+			},
+		},
+		"held then approved": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+				// Reported only once.
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval"},
+				{approval: approvalApproved, expectCreate: true, expectState: controller.ProvisioningFinished},
+			},
+		},
+		"annotated then approved": {
+			requestBytes: 1,
+			annotations:  map[string]string{annApprovalRequired: "true"},
+			steps: []approvalStep{
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+				{approval: approvalApproved, expectCreate: true, expectState: controller.ProvisioningFinished},
+			},
+		},
+		"approved by the PVC itself": {
+			requestBytes: threshold + 1,
+			annotations:  map[string]string{annApprovalPrefix + "testid": approvalApproved},
+			steps: []approvalStep{
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+			},
+		},
+		"held then denied": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+				{approval: approvalDenied, expectIgnored: true, expectState: controller.ProvisioningFinished, expectCondition: v1.ConditionFalse, expectReason: "Denied"},
+			},
+		},
+		"approval removed": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{approval: approvalDenied, expectIgnored: true, expectState: controller.ProvisioningFinished, expectCondition: v1.ConditionFalse, expectReason: "Denied"},
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+			},
+		},
+		"approval not expired": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "WaitingForApproval", expectEvent: true},
+				{approval: approvalApproved + ":" + future, expectCreate: true, expectState: controller.ProvisioningFinished},
+			},
+		},
+		"approval expired": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{approval: approvalApproved + ":" + past, expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "ApprovalExpired", expectEvent: true},
+				{approval: approvalApproved + ":" + future, expectCreate: true, expectState: controller.ProvisioningFinished},
+			},
+		},
+		"approval expires while waiting": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{approval: approvalApproved + ":" + future, advance: 2 * time.Hour, expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "ApprovalExpired", expectEvent: true},
+			},
+		},
+		"invalid expiry": {
+			requestBytes: threshold + 1,
+			steps: []approvalStep{
+				{approval: approvalApproved + ":tomorrow", expectIgnored: true, expectState: controller.ProvisioningNoChange, expectCondition: v1.ConditionTrue, expectReason: "InvalidApproval", expectEvent: true},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			claim := createFakeNamedPVC(tc.requestBytes, "fake-pvc", tc.annotations)
+			namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: claim.Namespace}}
+			clientSet := fakeclientset.NewSimpleClientset(claim, namespace)
+			namespaceInformer, claimInformer, stopCh := startApprovalInformers(clientSet)
+			defer close(stopCh)
+			pt := newProvisionerTestWithClient(t, clientSet, RequireProvisioningApproval(true, threshold, namespaceInformer, claimInformer))
+			fakeClock := testingclock.NewFakeClock(now)
+			pt.provisioner.approvals.clock = fakeClock
+
+			for i, step := range tc.steps {
+				setNamespaceApproval(ctx, t, clientSet, namespaceInformer, claim, step.approval)
+				fakeClock.Step(step.advance)
+				claim, err := clientSet.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("step #%d: unexpected error: %v", i, err)
+				}
+
+				if step.expectCreate {
+					pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: tc.requestBytes,
+							VolumeId:      "test-volume-id",
+						},
+					}, nil).Times(1)
+				}
+				_, state, err := pt.provisioner.Provision(ctx, controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{},
+					PVC:          claim,
+				})
+				if step.expectCreate && err != nil {
+					t.Errorf("step #%d: unexpected error: %v", i, err)
+				}
+				if !step.expectCreate && err == nil {
+					t.Errorf("step #%d: expected error, got none", i)
+				}
+				if _, ignored := err.(*controller.IgnoredError); ignored != step.expectIgnored {
+					t.Errorf("step #%d: expected IgnoredError %v, got %v", i, step.expectIgnored, err)
+				}
+				if state != step.expectState {
+					t.Errorf("step #%d: expected ProvisioningState %s, got %s", i, step.expectState, state)
+				}
+
+				claim, err = clientSet.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("step #%d: unexpected error: %v", i, err)
+				}
+				var status v1.ConditionStatus
+				var reason string
+				for _, condition := range claim.Status.Conditions {
+					if condition.Type == conditionApprovalRequired {
+						status = condition.Status
+						reason = condition.Reason
+					}
+				}
+				if status != step.expectCondition {
+					t.Errorf("step #%d: expected %s condition status %q, got %q", i, conditionApprovalRequired, step.expectCondition, status)
+				}
+				if reason != step.expectReason {
+					t.Errorf("step #%d: expected %s condition reason %q, got %q", i, conditionApprovalRequired, step.expectReason, reason)
+				}
+
+				var events []string
+				for _, event := range pt.events() {
+					if strings.Contains(event, "ProvisioningApprovalRequired") {
+						events = append(events, event)
+					}
+				}
+				if step.expectEvent && len(events) != 1 || !step.expectEvent && len(events) != 0 {
+					t.Errorf("step #%d: expected ProvisioningApprovalRequired event %v, got %q", i, step.expectEvent, events)
+				}
+			}
+		})
+	}
+}
+
+// TestProvisionApprovalRequeue checks that a claim which waits for approval
+// gets queued again when its namespace changes.
+func TestProvisionApprovalRequeue(t *testing.T) {
+	ctx := context.Background()
+	claim := createFakeNamedPVC(100, "fake-pvc", map[string]string{annApprovalRequired: "true"})
+	otherClaim := createFakeNamedPVC(100, "other-pvc", nil)
+	otherClaim.UID = "other-uid"
+	clientSet := fakeclientset.NewSimpleClientset(claim, otherClaim, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: claim.Namespace}})
+	namespaceInformer, claimInformer, stopCh := startApprovalInformers(clientSet)
+	defer close(stopCh)
+	queued := make(chan types.UID, 10)
+	if _, err := claimInformer.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			queued <- newObj.(*v1.PersistentVolumeClaim).UID
+		},
+	}, 0); err != nil {
+		t.Fatal(err)
+	}
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, nil, nil, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		withEventRecorder(record.NewFakeRecorder(10)), RequireProvisioningApproval(true, 0, namespaceInformer, claimInformer))
+
+	if _, err := provisioner.(*csiProvisioner).checkApproval(ctx, claim, 100); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	// Ignore the update of the claim condition.
+	time.Sleep(100 * time.Millisecond)
+	for len(queued) > 0 {
+		<-queued
+	}
+	setNamespaceApproval(ctx, t, clientSet, namespaceInformer, claim, approvalApproved)
+	select {
+	case uid := <-queued:
+		if uid != claim.UID {
+			t.Errorf("expected claim %s to be queued, got %s", claim.UID, uid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("claim not queued after approval")
+	}
+	select {
+	case uid := <-queued:
+		t.Errorf("expected only the waiting claim to be queued, got %s", uid)
+	default:
+	}
+}
+
+// startApprovalInformers returns the synced informers needed for
+// RequireProvisioningApproval.
+func startApprovalInformers(clientSet *fakeclientset.Clientset) (coreinformers.NamespaceInformer, *RequeueInformer, chan struct{}) {
+	factory := informers.NewSharedInformerFactory(clientSet, 0)
+	namespaceInformer := factory.Core().V1().Namespaces()
+	namespaceInformer.Informer()
+	claimInformer := NewRequeueInformer(factory.Core().V1().PersistentVolumeClaims().Informer())
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+	return namespaceInformer, claimInformer, stopCh
+}
+
+// setNamespaceApproval sets or, if empty, removes the approval of the claim
+// in its namespace and waits for the informer to see it.
+func setNamespaceApproval(ctx context.Context, t *testing.T, clientSet *fakeclientset.Clientset, namespaceInformer coreinformers.NamespaceInformer, claim *v1.PersistentVolumeClaim, approval string) {
+	namespace, err := clientSet.CoreV1().Namespaces().Get(ctx, claim.Namespace, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if namespace.Annotations == nil {
+		namespace.Annotations = map[string]string{}
+	}
+	if approval != "" {
+		namespace.Annotations[approvalAnnotation(claim)] = approval
+	} else {
+		delete(namespace.Annotations, approvalAnnotation(claim))
+	}
+	if _, err := clientSet.CoreV1().Namespaces().Update(ctx, namespace, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if current, err := namespaceInformer.Lister().Get(namespace.Name); err == nil && current.Annotations[approvalAnnotation(claim)] == approval {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("namespace %s not updated in informer", namespace.Name)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+// bindingModeWarning returns a warning if the volume binding mode of the
+// storage class doesn't fit the topology support of the driver, otherwise
+// an empty string.
+func bindingModeWarning(sc *storagev1.StorageClass, supportsTopology, immediateTopology bool) string {
+	waitForFirstConsumer := sc.VolumeBindingMode != nil && *sc.VolumeBindingMode == storagev1.VolumeBindingWaitForFirstConsumer
+	switch {
+	case waitForFirstConsumer && !supportsTopology:
+		return fmt.Sprintf("StorageClass %s uses WaitForFirstConsumer volume binding, but the CSI driver does not support topology: volumes are not restricted to the topology of the selected node", sc.Name)
+	case !waitForFirstConsumer && supportsTopology && len(sc.AllowedTopologies) == 0 && immediateTopology:
+		return fmt.Sprintf("StorageClass %s uses Immediate volume binding without allowed topologies: volumes may get created in any topology segment of the cluster, including those where their pods cannot run; consider WaitForFirstConsumer", sc.Name)
+	case !waitForFirstConsumer && supportsTopology && len(sc.AllowedTopologies) == 0:
+		return fmt.Sprintf("StorageClass %s uses Immediate volume binding without allowed topologies and --immediate-topology is disabled: volumes get created without topology requirements; consider WaitForFirstConsumer", sc.Name)
+	}
+	return ""
+}
+
+// checkedBindingModes remembers the storage classes whose binding mode was
+// checked, so that each mismatch gets reported only once.
+type checkedBindingModes struct {
+	mutex   sync.Mutex
+	classes map[string]bool
+}
+
+func newCheckedBindingModes() *checkedBindingModes {
+	return &checkedBindingModes{
+		classes: map[string]bool{},
+	}
+}
+
+// checkBindingMode logs a warning and emits a Warning event for the
+// storage class when it is first used and its binding mode doesn't fit
+// the topology support of the driver. Provisioning continues regardless.
+func (p *csiProvisioner) checkBindingMode(sc *storagev1.StorageClass) {
+	c := p.checkedBindingModes
+	c.mutex.Lock()
+	checked := c.classes[sc.Name]
+	c.classes[sc.Name] = true
+	c.mutex.Unlock()
+	if checked {
+		return
+	}
+
+	if warning := bindingModeWarning(sc, p.supportsTopology(), p.immediateTopology); warning != "" {
+		klog.Warning(warning)
+		p.eventRecorder.Event(sc, v1.EventTypeWarning, "BindingModeMismatch", warning)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestBindingModeWarning(t *testing.T) {
+	immediate := storagev1.VolumeBindingImmediate
+	waitForFirstConsumer := storagev1.VolumeBindingWaitForFirstConsumer
+	allowedTopologies := []v1.TopologySelectorTerm{
+		{
+			MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+				{Key: "com.example.csi/zone", Values: []string{"zone1"}},
+			},
+		},
+	}
+
+	testcases := map[string]struct {
+		bindingMode       *storagev1.VolumeBindingMode
+		allowedTopologies []v1.TopologySelectorTerm
+		supportsTopology  bool
+		immediateTopology bool
+		expectWarning     string
+	}{
+		"wait for first consumer with topology": {
+			bindingMode:      &waitForFirstConsumer,
+			supportsTopology: true,
+		},
+		"wait for first consumer without topology": {
+			bindingMode:   &waitForFirstConsumer,
+			expectWarning: "does not support topology",
+		},
+		"immediate without topology": {
+			bindingMode: &immediate,
+		},
+		"default without topology": {},
+		"immediate with allowed topologies": {
+			bindingMode:       &immediate,
+			allowedTopologies: allowedTopologies,
+			supportsTopology:  true,
+			immediateTopology: true,
+		},
+		"immediate with cluster topology": {
+			bindingMode:       &immediate,
+			supportsTopology:  true,
+			immediateTopology: true,
+			expectWarning:     "any topology segment",
+		},
+		"default with cluster topology": {
+			supportsTopology:  true,
+			immediateTopology: true,
+			expectWarning:     "any topology segment",
+		},
+		"immediate without immediate topology": {
+			bindingMode:      &immediate,
+			supportsTopology: true,
+			expectWarning:    "without topology requirements",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta:        metav1.ObjectMeta{Name: "fast"},
+				VolumeBindingMode: tc.bindingMode,
+				AllowedTopologies: tc.allowedTopologies,
+			}
+			warning := bindingModeWarning(sc, tc.supportsTopology, tc.immediateTopology)
+			switch {
+			case tc.expectWarning == "" && warning != "":
+				t.Errorf("unexpected warning: %s", warning)
+			case tc.expectWarning != "" && !strings.Contains(warning, tc.expectWarning):
+				t.Errorf("expected warning containing %q, got %q", tc.expectWarning, warning)
+			}
+		})
+	}
+}
+
+// TestProvisionBindingModeMismatch checks that a mismatch gets reported
+// once per storage class and doesn't block provisioning.
+func TestProvisionBindingModeMismatch(t *testing.T) {
+	const (
+		requestBytes = 100
+		volumes      = 2
+	)
+
+	pt := newProvisionerTest(t, nil, CheckVolumeBindingMode(true))
+	pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(volumes)
+
+	bindingMode := storagev1.VolumeBindingWaitForFirstConsumer
+	sc := &storagev1.StorageClass{
+		ObjectMeta:        metav1.ObjectMeta{Name: "fast"},
+		VolumeBindingMode: &bindingMode,
+	}
+	for i := 0; i < volumes; i++ {
+		if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+			StorageClass: sc,
+			PVName:       "test-testi",
+			PVC:          createFakePVC(requestBytes),
+		}); err != nil {
+			t.Fatalf("provisioning #%d: unexpected error: %v", i, err)
+		}
+	}
+
+	if events := pt.events(); len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" BindingModeMismatch") {
+		t.Errorf("expected one BindingModeMismatch event, got %v", events)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annBypassCapacityCheck on a PVC asks for provisioning its volume
+	// even when the capacity check of the provisioner says that it
+	// doesn't fit.
+	annBypassCapacityCheck = "provisioner.k8s.io/bypass-capacity-check"
+
+	// annAllowCapacityCheckBypass on a Namespace allows PVCs in that
+	// namespace to bypass the capacity check. Namespaces are controlled
+	// by the cluster admin, PVCs by their users.
+	annAllowCapacityCheckBypass = "provisioner.k8s.io/allow-capacity-check-bypass"
+)
+
+// capacityCheckBypassed returns true if the claim bypasses the capacity
+// check and is allowed to do so.
+func (p *csiProvisioner) capacityCheckBypassed(ctx context.Context, claim *v1.PersistentVolumeClaim) bool {
+	if !p.allowCapacityCheckBypass || claim.Annotations[annBypassCapacityCheck] != "true" {
+		return false
+	}
+	namespace, err := p.client.CoreV1().Namespaces().Get(ctx, claim.Namespace, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("PVC %s/%s asks for bypassing the capacity check, but namespace %s cannot be checked: %v", claim.Namespace, claim.Name, claim.Namespace, err)
+		return false
+	}
+	if namespace.Annotations[annAllowCapacityCheckBypass] != "true" {
+		klog.V(2).Infof("PVC %s/%s asks for bypassing the capacity check, but namespace %s is missing the %s annotation", claim.Namespace, claim.Name, claim.Namespace, annAllowCapacityCheckBypass)
+		return false
+	}
+	return true
+}
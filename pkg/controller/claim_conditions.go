@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	// conditionProvisioning is the PVC condition which reflects the
+	// current stage of provisioning. It is removed once the volume is
+	// provisioned.
+	conditionProvisioning v1.PersistentVolumeClaimConditionType = "Provisioning"
+
+	provisioningReasonTopologyResolved = "TopologyResolved"
+	provisioningReasonCreatingVolume   = "CreatingVolume"
+	provisioningReasonRescheduling     = "Rescheduling"
+	provisioningReasonFailed           = "Failed"
+)
+
+// updateClaimCondition replaces the condition of the given type in the
+// claim status, or removes it when condition is nil. The API server is
+// only updated if something changes.
+func (p *csiProvisioner) updateClaimCondition(ctx context.Context, claim *v1.PersistentVolumeClaim, conditionType v1.PersistentVolumeClaimConditionType, condition *v1.PersistentVolumeClaimCondition) error {
+	current, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var conditions []v1.PersistentVolumeClaimCondition
+	var existing *v1.PersistentVolumeClaimCondition
+	for i := range current.Status.Conditions {
+		if current.Status.Conditions[i].Type == conditionType {
+			existing = &current.Status.Conditions[i]
+			continue
+		}
+		conditions = append(conditions, current.Status.Conditions[i])
+	}
+	switch {
+	case condition == nil && existing == nil:
+		return nil
+	case condition != nil && existing != nil &&
+		existing.Status == condition.Status &&
+		existing.Reason == condition.Reason &&
+		existing.Message == condition.Message:
+		return nil
+	}
+	if condition != nil {
+		condition.Type = conditionType
+		if existing != nil && existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		} else {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		condition.LastProbeTime = metav1.Now()
+		conditions = append(conditions, *condition)
+	}
+
+	current.Status.Conditions = conditions
+	_, err = p.client.CoreV1().PersistentVolumeClaims(current.Namespace).UpdateStatus(ctx, current, metav1.UpdateOptions{})
+	return err
+}
+
+// setProvisioningCondition publishes the provisioning stage as PVC condition
+// if enabled. Failures are only logged because the condition is purely
+// informational.
+func (p *csiProvisioner) setProvisioningCondition(ctx context.Context, claim *v1.PersistentVolumeClaim, condition *v1.PersistentVolumeClaimCondition) {
+	if !p.provisioningConditions {
+		return
+	}
+	if err := p.updateClaimCondition(ctx, claim, conditionProvisioning, condition); err != nil {
+		klog.Warningf("failed to update %s condition of PVC %s/%s: %v", conditionProvisioning, claim.Namespace, claim.Name, err)
+	}
+}
+
+// provisioningResultCondition returns the provisioning condition for the
+// outcome of Provision, nil if the condition must be removed.
+func provisioningResultCondition(options controller.ProvisionOptions, state controller.ProvisioningState, err error) *v1.PersistentVolumeClaimCondition {
+	switch {
+	case err == nil:
+		return nil
+	case state == controller.ProvisioningReschedule && options.SelectedNode != nil:
+		return &v1.PersistentVolumeClaimCondition{
+			Status:  v1.ConditionTrue,
+			Reason:  provisioningReasonRescheduling,
+			Message: "waiting for the scheduler to select a different node: " + err.Error(),
+		}
+	case state == controller.ProvisioningInBackground:
+		return &v1.PersistentVolumeClaimCondition{
+			Status:  v1.ConditionTrue,
+			Reason:  provisioningReasonCreatingVolume,
+			Message: err.Error(),
+		}
+	default:
+		return &v1.PersistentVolumeClaimCondition{
+			Status:  v1.ConditionFalse,
+			Reason:  provisioningReasonFailed,
+			Message: err.Error(),
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// TestProvisioningConditions checks the Provisioning condition of a PVC
+// across several provisioning attempts which end in success.
+func TestProvisioningConditions(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const requestBytes = 100
+
+	ctx := context.Background()
+	nodes := buildNodes([]map[string]string{{"com.example.csi/zone": "zone1"}})
+	csiNodes := buildCSINodes([]map[string][]string{{driverName: {"com.example.csi/zone"}}})
+	claim := createFakePVC(requestBytes)
+	clientSet := fakeclientset.NewSimpleClientset(nodes, csiNodes, claim)
+	// reasons records each reason of the condition in the order in which
+	// it was set.
+	var reasons []string
+	clientSet.PrependReactor("update", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		for _, c := range action.(k8stesting.UpdateAction).GetObject().(*v1.PersistentVolumeClaim).Status.Conditions {
+			if c.Type == conditionProvisioning {
+				reasons = append(reasons, c.Reason)
+			}
+		}
+		return false, nil, nil
+	})
+	pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+	pt := newProvisionerTestWithClient(t, clientSet, withCapabilities(pluginCaps, controllerCaps), ProvisioningConditions(true))
+
+	condition := func() *v1.PersistentVolumeClaimCondition {
+		claim, err := clientSet.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := range claim.Status.Conditions {
+			if claim.Status.Conditions[i].Type == conditionProvisioning {
+				return &claim.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+	expectCondition := func(what string, status v1.ConditionStatus, reason string) {
+		t.Helper()
+		c := condition()
+		if reason == "" {
+			if c != nil {
+				t.Errorf("%s: expected no %s condition, got %+v", what, conditionProvisioning, *c)
+			}
+			return
+		}
+		if c == nil {
+			t.Fatalf("%s: expected %s condition with reason %s, got none", what, conditionProvisioning, reason)
+		}
+		if c.Status != status || c.Reason != reason {
+			t.Errorf("%s: expected %s condition with status %s and reason %s, got %+v", what, conditionProvisioning, status, reason, *c)
+		}
+	}
+	// Each CreateVolume call checks that the condition was set before.
+	createVolume := func(rep *csi.CreateVolumeResponse, err error) {
+		pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+				expectCondition("during CreateVolume", v1.ConditionTrue, provisioningReasonCreatingVolume)
+				return rep, err
+			}).Times(1)
+	}
+	provision := func(expectedState controller.ProvisioningState, expectedReasons ...string) {
+		t.Helper()
+		reasons = nil
+		_, state, _ := pt.provisioner.Provision(ctx, controller.ProvisionOptions{
+			StorageClass: &storagev1.StorageClass{},
+			PVC:          claim,
+			SelectedNode: &nodes.Items[0],
+		})
+		if state != expectedState {
+			t.Errorf("expected ProvisioningState %s, got %s", expectedState, state)
+		}
+		if !reflect.DeepEqual(reasons, expectedReasons) {
+			t.Errorf("expected %s condition reasons %q, got %q", conditionProvisioning, expectedReasons, reasons)
+		}
+	}
+
+	createVolume(nil, status.Error(codes.ResourceExhausted, "no space left in zone1"))
+	provision(controller.ProvisioningReschedule,
+		provisioningReasonTopologyResolved, provisioningReasonCreatingVolume, provisioningReasonRescheduling)
+	expectCondition("after reschedule", v1.ConditionTrue, provisioningReasonRescheduling)
+
+	createVolume(nil, status.Error(codes.DeadlineExceeded, "timeout"))
+	provision(controller.ProvisioningInBackground,
+		provisioningReasonTopologyResolved, provisioningReasonCreatingVolume, provisioningReasonCreatingVolume)
+	expectCondition("after timeout", v1.ConditionTrue, provisioningReasonCreatingVolume)
+
+	createVolume(nil, status.Error(codes.InvalidArgument, "invalid parameters"))
+	provision(controller.ProvisioningFinished,
+		provisioningReasonTopologyResolved, provisioningReasonCreatingVolume, provisioningReasonFailed)
+	expectCondition("after final error", v1.ConditionFalse, provisioningReasonFailed)
+
+	createVolume(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil)
+	provision(controller.ProvisioningFinished,
+		provisioningReasonTopologyResolved, provisioningReasonCreatingVolume)
+	expectCondition("after success", "", "")
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// annTopology on a PVC shows the accessibility requirements that were
+// passed to CreateVolume for it, as JSON. It is kept after the volume got
+// provisioned.
+const annTopology = "provisioner.k8s.io/topology"
+
+// claimTopology is the value of annTopology.
+type claimTopology struct {
+	Requisite []map[string]string `json:"requisite,omitempty"`
+	Preferred []map[string]string `json:"preferred,omitempty"`
+}
+
+func topologySegments(topologies []*csi.Topology) []map[string]string {
+	var segments []map[string]string
+	for _, topology := range topologies {
+		segments = append(segments, topology.Segments)
+	}
+	return segments
+}
+
+// recordClaimTopology sets annTopology on the claim. Failures are only
+// logged because the annotation is purely informational.
+func (p *csiProvisioner) recordClaimTopology(ctx context.Context, claim *v1.PersistentVolumeClaim, requirements *csi.TopologyRequirement) {
+	if err := p.updateClaimTopology(ctx, claim, requirements); err != nil {
+		klog.Warningf("failed to set %s annotation of PVC %s/%s: %v", annTopology, claim.Namespace, claim.Name, err)
+	}
+}
+
+// updateClaimTopology updates annTopology of the current claim if its
+// value changes.
+func (p *csiProvisioner) updateClaimTopology(ctx context.Context, claim *v1.PersistentVolumeClaim, requirements *csi.TopologyRequirement) error {
+	value, err := json.Marshal(claimTopology{
+		Requisite: topologySegments(requirements.GetRequisite()),
+		Preferred: topologySegments(requirements.GetPreferred()),
+	})
+	if err != nil {
+		return err
+	}
+	current, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if current.Annotations[annTopology] == string(value) {
+		return nil
+	}
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	current.Annotations[annTopology] = string(value)
+	_, err = p.client.CoreV1().PersistentVolumeClaims(current.Namespace).Update(ctx, current, metav1.UpdateOptions{})
+	return err
+}
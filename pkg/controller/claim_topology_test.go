@@ -0,0 +1,162 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionRecordTopology(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+	)
+	var objects []runtime.Object
+	var nodes []*v1.Node
+	for i, zone := range []string{"zone1", "zone2"} {
+		name := fmt.Sprintf("node-%d", i)
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{zoneKey: zone}}}
+		nodes = append(nodes, node)
+		objects = append(objects, node, &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{
+					{Name: driverName, NodeID: name, TopologyKeys: []string{zoneKey}},
+				},
+			},
+		})
+	}
+
+	testcases := map[string]struct {
+		enabled  bool
+		strict   bool
+		expected *claimTopology
+	}{
+		"disabled": {},
+		"selected node": {
+			enabled: true,
+			expected: &claimTopology{
+				Requisite: []map[string]string{{zoneKey: "zone2"}, {zoneKey: "zone1"}},
+				Preferred: []map[string]string{{zoneKey: "zone2"}, {zoneKey: "zone1"}},
+			},
+		},
+		"strict topology": {
+			enabled: true,
+			strict:  true,
+			expected: &claimTopology{
+				Requisite: []map[string]string{{zoneKey: "zone2"}},
+				Preferred: []map[string]string{{zoneKey: "zone2"}},
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			var requirement *csi.TopologyRequirement
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					requirement = req.AccessibilityRequirements
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: requestBytes,
+							VolumeId:      "test-volume-id",
+						},
+					}, nil
+				}).Times(1)
+
+			claim := createFakePVC(requestBytes)
+			clientSet := fakeclientset.NewSimpleClientset(append(objects, claim)...)
+			scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+			defer close(stopChan)
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", tc.strict, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+				RecordTopology(tc.enabled))
+
+			if _, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+				SelectedNode: nodes[1],
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			updated, err := clientSet.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(context.Background(), claim.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, ok := updated.Annotations[annTopology]
+			if tc.expected == nil {
+				if ok {
+					t.Errorf("unexpected %s annotation: %s", annTopology, value)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s annotation, got none", annTopology)
+			}
+			var recorded claimTopology
+			if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+				t.Fatalf("invalid %s annotation %q: %v", annTopology, value, err)
+			}
+			if !reflect.DeepEqual(recorded.Preferred[0], tc.expected.Preferred[0]) {
+				t.Errorf("expected %v to be preferred first, got %v", tc.expected.Preferred[0], recorded.Preferred)
+			}
+			if len(recorded.Requisite) != len(tc.expected.Requisite) || len(recorded.Preferred) != len(tc.expected.Preferred) {
+				t.Errorf("expected %+v, got %+v", *tc.expected, recorded)
+			}
+			sent := claimTopology{
+				Requisite: topologySegments(requirement.GetRequisite()),
+				Preferred: topologySegments(requirement.GetPreferred()),
+			}
+			if !reflect.DeepEqual(recorded, sent) {
+				t.Errorf("annotation %+v doesn't match the CreateVolume request %+v", recorded, sent)
+			}
+		})
+	}
+}
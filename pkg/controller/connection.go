@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubernetes-csi/csi-lib-utils/connection"
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// ConnectionOptions change what happens when the connection to the CSI
+// driver gets lost, for example because the driver restarted.
+type ConnectionOptions struct {
+	// Reconnect keeps the provisioner running and reconnects to the
+	// driver once it is back. Without it, the provisioner exits.
+	Reconnect bool
+	// BackoffBaseDelay and BackoffMaxDelay bound the delay between
+	// reconnection attempts.
+	BackoffBaseDelay time.Duration
+	BackoffMaxDelay  time.Duration
+	// FailFast makes calls fail immediately with codes.Unavailable while
+	// the connection is not ready, instead of waiting for the driver up
+	// to the call timeout.
+	FailFast bool
+	// UserAgent replaces the gRPC user agent of the connection, for
+	// example to identify the provisioner instance to the storage
+	// backend.
+	UserAgent string
+}
+
+// ConnectWithOptions connects to the CSI driver like Connect, except that
+// the connection survives a driver restart when opts.Reconnect is set.
+func ConnectWithOptions(address string, metricsManager metrics.CSIMetricsManager, opts ConnectionOptions) (*grpc.ClientConn, error) {
+	if !opts.Reconnect && opts.UserAgent == "" {
+		return Connect(address, metricsManager)
+	}
+
+	interceptors := []grpc.UnaryClientInterceptor{
+		connection.LogGRPC,
+		connection.ExtendedCSIMetricsManager{CSIMetricsManager: metricsManager}.RecordMetricsClientInterceptor,
+	}
+	if opts.FailFast {
+		interceptors = append(interceptors, failFastInterceptor)
+	}
+	backoffConfig := backoff.DefaultConfig
+	if opts.BackoffBaseDelay > 0 {
+		backoffConfig.BaseDelay = opts.BackoffBaseDelay
+	}
+	if opts.BackoffMaxDelay > 0 {
+		backoffConfig.MaxDelay = opts.BackoffMaxDelay
+	}
+	if backoffConfig.MaxDelay < backoffConfig.BaseDelay {
+		backoffConfig.MaxDelay = backoffConfig.BaseDelay
+	}
+
+	if strings.HasPrefix(address, "/") {
+		// It looks like a filesystem path.
+		address = "unix://" + address
+	}
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()), // Don't use TLS, it's usually local Unix domain socket in a container.
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+		grpc.WithBlock(), // Block until the first connection succeeds.
+		grpc.WithChainUnaryInterceptor(interceptors...),
+	}
+	if opts.UserAgent != "" {
+		dialOptions = append(dialOptions, grpc.WithUserAgent(opts.UserAgent))
+	}
+	if !opts.Reconnect {
+		dialer, err := exitOnConnectionLoss(address)
+		if err != nil {
+			return nil, err
+		}
+		dialOptions = append(dialOptions, dialer)
+		klog.V(5).Infof("Connecting to %s", address)
+	} else {
+		klog.V(5).Infof("Connecting to %s, reconnecting with backoff %v..%v", address, backoffConfig.BaseDelay, backoffConfig.MaxDelay)
+	}
+	return grpc.Dial(address, dialOptions...)
+}
+
+// exitOnConnectionLoss returns a dialer which exits once the connection
+// needs to be established again after it was lost, like Connect does.
+// As with Connect, only unix:// addresses are supported.
+func exitOnConnectionLoss(address string) (grpc.DialOption, error) {
+	path, ok := strings.CutPrefix(address, "unix://")
+	if !ok {
+		return nil, fmt.Errorf("exiting on connection loss is only supported for unix:// addresses, got %s", address)
+	}
+	var connected atomic.Bool
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		if connected.Load() {
+			klog.Errorf("Lost connection to %s.", address)
+			connection.ExitOnConnectionLoss()()
+		}
+		conn, err := (&net.Dialer{}).DialContext(ctx, "unix", path)
+		if err == nil {
+			connected.Store(true)
+		}
+		return conn, err
+	}), nil
+}
+
+// failFastInterceptor rejects calls while the connection is (re)connecting
+// or waiting for the next attempt. codes.Unavailable makes the caller retry
+// the operation later.
+func failFastInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if state := cc.GetState(); state != connectivity.Ready && state != connectivity.Idle {
+		return status.Errorf(codes.Unavailable, "connection to CSI driver is %s", state)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"github.com/kubernetes-csi/csi-test/v5/driver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestConnectWithOptionsDriverRestart(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	socket := filepath.Join(tmpdir, "csi.sock")
+
+	mockController := gomock.NewController(t)
+	defer mockController.Finish()
+	identityServer := driver.NewMockIdentityServer(mockController)
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{Name: driverName}, nil).AnyTimes()
+	startDriver := func() *driver.MockCSIDriver {
+		drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{Identity: identityServer})
+		if err := drv.StartOnAddress("unix", socket); err != nil {
+			t.Fatal(err)
+		}
+		return drv
+	}
+
+	drv := startDriver()
+	conn, err := ConnectWithOptions(socket, metrics.NewCSIMetricsManager(driverName), ConnectionOptions{
+		Reconnect:        true,
+		BackoffBaseDelay: 10 * time.Millisecond,
+		BackoffMaxDelay:  100 * time.Millisecond,
+		FailFast:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := csi.NewIdentityClient(conn)
+	getPluginInfo := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := client.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		return err
+	}
+	if err := getPluginInfo(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Calls while the driver is gone fail quickly with a retriable error.
+	drv.Stop()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		err := getPluginInfo()
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected Unavailable while the driver is down, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("call took %v while the driver is down", elapsed)
+		}
+	}
+
+	// Once the driver is back, the same connection works again.
+	drv = startDriver()
+	defer drv.Stop()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := getPluginInfo()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no reconnect after driver restart: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectWithOptionsUserAgent(t *testing.T) {
+	userAgent := "csi-provisioner/v1.2.3 (" + driverName + ")"
+
+	for name, reconnect := range map[string]bool{
+		"exit on connection loss": false,
+		"reconnect":               true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			socket := filepath.Join(tmpdir, "csi.sock")
+
+			mockController := gomock.NewController(t)
+			defer mockController.Finish()
+			identityServer := driver.NewMockIdentityServer(mockController)
+			identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{Name: driverName}, nil).Times(1)
+
+			var userAgents []string
+			server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				userAgents = md.Get("user-agent")
+				return handler(ctx, req)
+			}))
+			csi.RegisterIdentityServer(server, identityServer)
+			listener, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(listener)
+			defer server.Stop()
+
+			conn, err := ConnectWithOptions(socket, metrics.NewCSIMetricsManager(driverName), ConnectionOptions{
+				Reconnect: reconnect,
+				UserAgent: userAgent,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// gRPC appends its own version.
+			if len(userAgents) != 1 || !strings.HasPrefix(userAgents[0], userAgent+" ") {
+				t.Errorf("expected user agent %q, got %q", userAgent, userAgents)
+			}
+		})
+	}
+}
@@ -18,9 +18,12 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -79,6 +82,10 @@ const (
 	csiParameterPrefix = "csi.storage.k8s.io/"
 
 	prefixedFsTypeKey = csiParameterPrefix + "fstype"
+	// prefixedAccessModeFsTypeKey followed by an access mode, for example
+	// csi.storage.k8s.io/fstype.ReadWriteMany, selects the fstype for
+	// that access mode only.
+	prefixedAccessModeFsTypeKey = prefixedFsTypeKey + "."
 
 	prefixedDefaultSecretNameKey      = csiParameterPrefix + "secret-name"
 	prefixedDefaultSecretNamespaceKey = csiParameterPrefix + "secret-namespace"
@@ -101,6 +108,48 @@ const (
 	prefixedNodeExpandSecretNameKey      = csiParameterPrefix + "node-expand-secret-name"
 	prefixedNodeExpandSecretNamespaceKey = csiParameterPrefix + "node-expand-secret-namespace"
 
+	// prefixedEncryptionKey in a StorageClass is either "required" or
+	// "optional" and enables passing the encryption key reference from
+	// the PVC to the driver.
+	prefixedEncryptionKey = csiParameterPrefix + "encryption"
+	encryptionRequired    = "required"
+	encryptionOptional    = "optional"
+
+	// prefixedTopologySpread in a StorageClass is the number of distinct
+	// topology segments that get passed to CreateVolume as requisite
+	// topology. prefixedTopologySpreadKey optionally names the topology
+	// key whose values must differ, for example topology.kubernetes.io/zone.
+	prefixedTopologySpread    = csiParameterPrefix + "topology-spread"
+	prefixedTopologySpreadKey = csiParameterPrefix + "topology-spread-key"
+
+	// prefixedFSBlockSizeKey in a StorageClass is the block size in bytes
+	// for filesystems created on new volumes. It gets validated and then
+	// passed to CreateVolume as fsBlockSizeKey.
+	prefixedFSBlockSizeKey = csiParameterPrefix + "fs-block-size"
+	fsBlockSizeKey         = "csi.storage.k8s.io/fs-block-size"
+	minFSBlockSize         = 512
+	maxFSBlockSize         = 64 * 1024
+
+	// prefixedFormatOwnerKey in a StorageClass selects who formats new
+	// filesystem volumes, one of formatOwners. It gets validated and then
+	// passed to CreateVolume as formatOwnerKey.
+	prefixedFormatOwnerKey = csiParameterPrefix + "format-owner"
+	formatOwnerKey         = "csi.storage.k8s.io/format-owner"
+	// formatOwnerNode, the default, leaves formatting to the node during
+	// NodeStageVolume.
+	formatOwnerNode = "node"
+	// formatOwnerController asks the controller to format the volume
+	// during CreateVolume.
+	formatOwnerController = "controller"
+
+	// prefixedDefaultSizeKey in a StorageClass is the size of volumes
+	// for PVCs which request no storage, for example 1Gi.
+	prefixedDefaultSizeKey = csiParameterPrefix + "default-size"
+	// prefixedMinimumSizeKey in a StorageClass is the smallest volume
+	// that the storage backend can create, for example 1Gi. Smaller
+	// requests get rounded up to it.
+	prefixedMinimumSizeKey = csiParameterPrefix + "minimum-size"
+
 	// [Deprecated] CSI Parameters that are put into fields but
 	// NOT stripped from the parameters passed to CreateVolume
 	provisionerSecretNameKey      = "csiProvisionerSecretName"
@@ -120,6 +169,10 @@ const (
 	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
 	pvNameKey       = "csi.storage.k8s.io/pv/name"
 
+	// encryptionKeyKey is the CreateVolume parameter with the encryption
+	// key reference from the PVC.
+	encryptionKeyKey = "csi.storage.k8s.io/encryption-key"
+
 	snapshotKind     = "VolumeSnapshot"
 	snapshotAPIGroup = snapapi.GroupName       // "snapshot.storage.k8s.io"
 	pvcKind          = "PersistentVolumeClaim" // Native types don't require an API group
@@ -149,6 +202,49 @@ const (
 	pvcCloneFinalizer = "provisioner.storage.kubernetes.io/cloning-protection"
 
 	annAllowVolumeModeChange = "snapshot.storage.kubernetes.io/allow-volume-mode-change"
+
+	// annForceRemoveFinalizer on a PV asks for the PV to be released without
+	// deleting the backend volume. Only honored with --allow-force-remove-finalizer.
+	annForceRemoveFinalizer = "provisioner.k8s.io/force-remove-finalizer"
+
+	// pvFinalizer is the finalizer added by sig-storage-lib-external-provisioner
+	// when the HonorPVReclaimPolicy feature is enabled.
+	pvFinalizer = "external-provisioner.volume.kubernetes.io/finalizer"
+
+	// annCSIVolumeName records the name that was used in CreateVolume
+	// when it differs from the PV name.
+	annCSIVolumeName = "provisioner.k8s.io/csi-volume-name"
+
+	// annForceBlockVolumeMode on a StorageClass causes all volumes of that
+	// class to be provisioned as raw block volumes. Only honored with
+	// --honor-force-block-volume-mode.
+	annForceBlockVolumeMode = "provisioner.k8s.io/force-block-volume-mode"
+
+	// annStorageClassResourceVersion and annStorageClassParametersHash
+	// record which revision of the storage class a PV was provisioned
+	// with. Storage classes don't have a generation, therefore the
+	// resource version is used instead.
+	annStorageClassResourceVersion = "provisioner.k8s.io/storage-class-resource-version"
+	annStorageClassParametersHash  = "provisioner.k8s.io/storage-class-parameters-hash"
+
+	// annEncryptionKey on a PVC references the key for encrypting the
+	// volume. Only honored with --honor-pvc-encryption-key.
+	annEncryptionKey = "provisioner.k8s.io/encryption-key"
+
+	// annFSType on a PVC selects the fstype of the volume when the storage
+	// class doesn't specify one. Only honored with --honor-pvc-fstype.
+	annFSType = "provisioner.k8s.io/fstype"
+	// annAccessModeFSType followed by an access mode is the PVC
+	// counterpart of prefixedAccessModeFsTypeKey.
+	annAccessModeFSType = annFSType + "."
+
+	// annOperationTimeout on a PVC overrides the timeout of CreateVolume
+	// for that PVC. Only honored with --max-pvc-operation-timeout.
+	annOperationTimeout = "provisioner.k8s.io/operation-timeout"
+
+	// volumeNameConflictSuffixLength is the length of the suffix that gets
+	// appended to the volume name after a name conflict.
+	volumeNameConflictSuffixLength = 5
 )
 
 var (
@@ -230,6 +326,9 @@ type NodeDeployment struct {
 	// became the owner of a PVC while the local one is still waiting before
 	// trying to become the owner itself.
 	ClaimInformer coreinformers.PersistentVolumeClaimInformer
+	// VolumeInformer provides the existing PVs of the node, which count
+	// against the CapacityBudget.
+	VolumeInformer coreinformers.PersistentVolumeInformer
 	// NodeInfo is the result of NodeGetInfo. It is need to determine which
 	// PVs were created for the node.
 	NodeInfo csi.NodeGetInfoResponse
@@ -240,11 +339,15 @@ type NodeDeployment struct {
 	BaseDelay time.Duration
 	// MaxDelay is the maximum for the initial wait time.
 	MaxDelay time.Duration
+	// CapacityBudget is the total size in bytes of all volumes that may
+	// be provisioned for the node. Zero means unlimited.
+	CapacityBudget int64
 }
 
 type internalNodeDeployment struct {
 	NodeDeployment
 	rateLimiter workqueue.RateLimiter
+	budget      *nodeBudget
 }
 
 type csiProvisioner struct {
@@ -275,12 +378,62 @@ type csiProvisioner struct {
 	nodeDeployment                        *internalNodeDeployment
 	controllerPublishReadOnly             bool
 	preventVolumeModeConversion           bool
+	forceRemoveFinalizer                  bool
+	retryOnVolumeNameConflict             bool
+	honorForceBlockVolumeMode             bool
+	disableDelete                         bool
+	honorPVCFSType                        bool
+	secretCache                           *secretCache
+	approvals                             *approvals
+	wellKnownTopologyLabels               map[string]string
+	provisioningConditions                bool
+	honorPVCEncryptionKey                 bool
+	storageClassLabels                    []string
+	storageClassAnnotations               []string
+	maxProvisioningRetries                int
+	provisioningFailures                  *provisioningFailures
+	driverCapabilities                    *DriverCapabilities
+	postProvisionVerification             *postProvisionVerification
+	enforceStorageClassParameters         bool
+	maxPVCOperationTimeout                time.Duration
+	pausedClaims                          *pausedClaims
+	errorMessages                         ErrorMessages
+	disableFinalizers                     bool
+	recordedParameters                    sets.String
+	topologyStrategy                      TopologyStrategy
+	checkVolumeModeAccessModes            bool
+	allowCapacityCheckBypass              bool
+	fsGroupDelegated                      bool
+	provisioningStatusReporter            *ProvisioningStatusReporter
+	lowercaseParameterKeys                bool
+	renamedStorageClasses                 map[string]string
+	requireTopology                       bool
+	volumeHandlePrefix                    string
+	snapshotBeforeDeletion                bool
+	globalPause                           *GlobalPause
+	nodeLabelTopologyKeys                 []string
+	minThroughput                         int64
+	maxThroughput                         int64
+	terminalErrorCodes                    TerminalErrorCodes
+	maxImmediateTopologySegments          int
+	driverVersion                         string
+	snapshotCalls                         *snapshotCalls
+	checkedBindingModes                   *checkedBindingModes
+	maxParametersSize                     int
+	trimExtraCreateMetadata               bool
+	passIdempotencyToken                  bool
+	routineEvents                         *routineEventFilter
+	volumeHandles                         *VolumeHandles
+	retryAfter                            *RetryAfterRateLimiter
+	recordTopology                        bool
+	projectMapping                        *ProjectMapping
 }
 
 var (
 	_ controller.Provisioner      = &csiProvisioner{}
 	_ controller.BlockProvisioner = &csiProvisioner{}
 	_ controller.Qualifier        = &csiProvisioner{}
+	_ controller.DeletionGuard    = &csiProvisioner{}
 )
 
 // Each provisioner have a identify string to distinguish with others. This
@@ -356,6 +509,7 @@ func NewCSIProvisioner(client kubernetes.Interface,
 	nodeDeployment *NodeDeployment,
 	controllerPublishReadOnly bool,
 	preventVolumeModeConversion bool,
+	options ...ProvisionerOption,
 ) controller.Provisioner {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartLogging(klog.Infof)
@@ -391,12 +545,28 @@ func NewCSIProvisioner(client kubernetes.Interface,
 		eventRecorder:                         eventRecorder,
 		controllerPublishReadOnly:             controllerPublishReadOnly,
 		preventVolumeModeConversion:           preventVolumeModeConversion,
+		pausedClaims:                          newPausedClaims(),
+		snapshotCalls:                         newSnapshotCalls(),
+	}
+	for _, option := range options {
+		option(provisioner)
+	}
+	if provisioner.routineEvents != nil {
+		provisioner.routineEvents.EventRecorder = provisioner.eventRecorder
+		provisioner.eventRecorder = provisioner.routineEvents
 	}
 	if nodeDeployment != nil {
 		provisioner.nodeDeployment = &internalNodeDeployment{
 			NodeDeployment: *nodeDeployment,
 			rateLimiter:    newItemExponentialFailureRateLimiterWithJitter(nodeDeployment.BaseDelay, nodeDeployment.MaxDelay),
 		}
+		if nodeDeployment.CapacityBudget > 0 {
+			provisioner.nodeDeployment.budget = newNodeBudget(nodeDeployment.CapacityBudget, provisioner.localVolumeSizes)
+			if nodeDeployment.VolumeInformer != nil {
+				// Ensure that the informer gets started.
+				nodeDeployment.VolumeInformer.Informer()
+			}
+		}
 		// Remove deleted PVCs from rate limiter.
 		claimHandler := cache.ResourceEventHandlerFuncs{
 			DeleteFunc: func(obj interface{}) {
@@ -476,6 +646,33 @@ func getAccessTypeMount(fsType string, mountFlags []string) *csi.VolumeCapabilit
 	}
 }
 
+// getAccessModeFSTypes returns the fstypes which were selected for
+// individual access modes, either in the storage class or, if it doesn't
+// specify any fstype and annotations are honored, in the PVC.
+func (p *csiProvisioner) getAccessModeFSTypes(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, classFSType string) (map[v1.PersistentVolumeAccessMode]string, error) {
+	fsTypes := map[v1.PersistentVolumeAccessMode]string{}
+	for k, v := range sc.Parameters {
+		if strings.HasPrefix(k, prefixedAccessModeFsTypeKey) {
+			fsTypes[v1.PersistentVolumeAccessMode(strings.TrimPrefix(k, prefixedAccessModeFsTypeKey))] = v
+		}
+	}
+	if classFSType == "" && len(fsTypes) == 0 && p.honorPVCFSType {
+		for k, v := range claim.Annotations {
+			if strings.HasPrefix(k, annAccessModeFSType) {
+				fsTypes[v1.PersistentVolumeAccessMode(strings.TrimPrefix(k, annAccessModeFSType))] = v
+			}
+		}
+	}
+	for accessMode := range fsTypes {
+		switch accessMode {
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany, v1.ReadWriteOncePod:
+		default:
+			return nil, fmt.Errorf("fstype specified for unknown access mode %q", accessMode)
+		}
+	}
+	return fsTypes, nil
+}
+
 func getVolumeCapability(
 	claim *v1.PersistentVolumeClaim,
 	sc *storagev1.StorageClass,
@@ -504,10 +701,14 @@ func getVolumeCapability(
 	}, nil
 }
 
+// getVolumeCapabilities returns one capability per access mode of the claim.
+// Filesystem capabilities use the fstype from accessModeFSTypes if there is
+// one for their access mode, fsType otherwise.
 func (p *csiProvisioner) getVolumeCapabilities(
 	claim *v1.PersistentVolumeClaim,
 	sc *storagev1.StorageClass,
 	fsType string,
+	accessModeFSTypes map[v1.PersistentVolumeAccessMode]string,
 ) ([]*csi.VolumeCapability, error) {
 	supportsSingleNodeMultiWriter := false
 	if p.controllerCapabilities[csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER] {
@@ -516,7 +717,11 @@ func (p *csiProvisioner) getVolumeCapabilities(
 
 	volumeCaps := make([]*csi.VolumeCapability, 0)
 	for _, pvcAccessMode := range claim.Spec.AccessModes {
-		volumeCap, err := getVolumeCapability(claim, sc, pvcAccessMode, fsType, supportsSingleNodeMultiWriter)
+		accessModeFSType := fsType
+		if t, ok := accessModeFSTypes[pvcAccessMode]; ok {
+			accessModeFSType = t
+		}
+		volumeCap, err := getVolumeCapability(claim, sc, pvcAccessMode, accessModeFSType, supportsSingleNodeMultiWriter)
 		if err != nil {
 			return []*csi.VolumeCapability{}, err
 		}
@@ -525,6 +730,34 @@ func (p *csiProvisioner) getVolumeCapabilities(
 	return volumeCaps, nil
 }
 
+// resolveVolumeMode returns the volume mode of the claim, Filesystem if it
+// has none, like the API server does for PVs.
+func resolveVolumeMode(claim *v1.PersistentVolumeClaim) (v1.PersistentVolumeMode, error) {
+	if claim.Spec.VolumeMode == nil {
+		return v1.PersistentVolumeFilesystem, nil
+	}
+	switch mode := *claim.Spec.VolumeMode; mode {
+	case v1.PersistentVolumeFilesystem, v1.PersistentVolumeBlock:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported volume mode %q", mode)
+	}
+}
+
+// checkVolumeCapabilities returns an error if any of the capabilities has
+// an access type which doesn't match the volume mode.
+func checkVolumeCapabilities(volumeMode v1.PersistentVolumeMode, volumeCaps []*csi.VolumeCapability) error {
+	for _, volumeCap := range volumeCaps {
+		switch {
+		case volumeMode == v1.PersistentVolumeBlock && volumeCap.GetBlock() == nil:
+			return fmt.Errorf("volume capability %v doesn't match volume mode %s", volumeCap, volumeMode)
+		case volumeMode == v1.PersistentVolumeFilesystem && volumeCap.GetMount() == nil:
+			return fmt.Errorf("volume capability %v doesn't match volume mode %s", volumeCap, volumeMode)
+		}
+	}
+	return nil
+}
+
 type deletionSecretParams struct {
 	name      string
 	namespace string
@@ -532,10 +765,13 @@ type deletionSecretParams struct {
 
 type prepareProvisionResult struct {
 	fsType              string
+	mountOptions        []string
+	volumeMode          v1.PersistentVolumeMode
 	migratedVolume      bool
 	req                 *csi.CreateVolumeRequest
 	csiPVSource         *v1.CSIPersistentVolumeSource
 	provDeletionSecrets *deletionSecretParams
+	transfer            *transferSource
 }
 
 // prepareProvision does non-destructive parameter checking and preparations for provisioning a volume.
@@ -543,6 +779,9 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	if sc == nil {
 		return nil, controller.ProvisioningFinished, errors.New("storage class was nil")
 	}
+	if p.checkedBindingModes != nil {
+		p.checkBindingMode(sc)
+	}
 
 	// normalize dataSource and dataSourceRef.
 	dataSource, err := p.dataSource(ctx, claim)
@@ -577,22 +816,27 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 			return nil, controller.ProvisioningFinished, fmt.Errorf("the PVC source not found for PVC %s", claim.Name)
 		}
 
+		if isPopulatorDataSource(dataSource) {
+			// DataSource is neither a VolumeSnapshot nor a PVC.
+			// Assume external data populator to create the volume, and there is no more work for us to do.
+			// The populator provisions its own temporary PVC without a data source through
+			// us and then rebinds the resulting PV to this claim.
+			source := dataSource.Kind
+			if dataSource.APIVersion != "" {
+				source = dataSource.Kind + "." + dataSource.APIVersion
+			}
+			p.eventRecorder.Event(claim, v1.EventTypeNormal, "Provisioning", fmt.Sprintf("Assuming an external populator will provision the volume from %s %s", source, dataSource.Name))
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+				Reason: fmt.Sprintf("data source (%s) is not handled by the provisioner, assuming an external populator will provision it",
+					source),
+			}
+		}
+
 		switch dataSource.Kind {
 		case snapshotKind:
-			if dataSource.APIVersion != snapshotAPIGroup {
-				return nil, controller.ProvisioningFinished, fmt.Errorf("the PVC source does not belong to the right APIGroup. Expected %s, Got %s", snapshotAPIGroup, dataSource.APIVersion)
-			}
 			rc.snapshot = true
 		case pvcKind:
 			rc.clone = true
-		default:
-			// DataSource is not VolumeSnapshot and PVC
-			// Assume external data populator to create the volume, and there is no more work for us to do
-			p.eventRecorder.Event(claim, v1.EventTypeNormal, "Provisioning", fmt.Sprintf("Assuming an external populator will provision the volume"))
-			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
-				Reason: fmt.Sprintf("data source (%s) is not handled by the provisioner, assuming an external populator will provision it",
-					dataSource.Kind),
-			}
 		}
 	}
 
@@ -623,17 +867,69 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	if fsTypesFound > 1 {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("fstype specified in parameters with both \"fstype\" and \"%s\" keys", prefixedFsTypeKey)
 	}
+	accessModeFSTypes, err := p.getAccessModeFSTypes(claim, sc, fsType)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	if fsType == "" && p.honorPVCFSType && claim.Annotations[annFSType] != "" {
+		fsType = claim.Annotations[annFSType]
+		klog.V(4).Infof("using fstype %q from annotation of PVC %s/%s", fsType, claim.Namespace, claim.Name)
+	}
 	if fsType == "" && p.defaultFSType != "" {
 		fsType = p.defaultFSType
 	}
 
 	capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	volSizeBytes := capacity.Value()
+	if value, ok := sc.Parameters[prefixedDefaultSizeKey]; ok && volSizeBytes == 0 {
+		defaultSize, err := resource.ParseQuantity(value)
+		if err != nil || defaultSize.Sign() <= 0 {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("invalid %s parameter %q in StorageClass %s: must be a positive quantity", prefixedDefaultSizeKey, value, sc.Name)
+		}
+		volSizeBytes = defaultSize.Value()
+		klog.V(4).Infof("PVC %s/%s requests no storage, using the default size of %d bytes from StorageClass %s", claim.Namespace, claim.Name, volSizeBytes, sc.Name)
+	}
+	if value, ok := sc.Parameters[prefixedMinimumSizeKey]; ok {
+		minimumSize, err := resource.ParseQuantity(value)
+		if err != nil || minimumSize.Sign() <= 0 {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("invalid %s parameter %q in StorageClass %s: must be a positive quantity", prefixedMinimumSizeKey, value, sc.Name)
+		}
+		if volSizeBytes < minimumSize.Value() {
+			p.eventRecorder.Eventf(claim, v1.EventTypeNormal, "VolumeSizeIncreased", "Requested size of %d bytes is less than the minimum size %s of StorageClass %s, provisioning %d bytes", volSizeBytes, value, sc.Name, minimumSize.Value())
+			volSizeBytes = minimumSize.Value()
+		}
+	}
 
-	volumeCaps, err := p.getVolumeCapabilities(claim, sc, fsType)
+	if _, ok := claim.Annotations[annMountOptions]; ok {
+		// The volume capabilities and the PV only get the selected
+		// subset of the mount options.
+		mountOptions := p.selectMountOptions(claim, sc)
+		sc = sc.DeepCopy()
+		sc.MountOptions = mountOptions
+	}
+
+	volumeMode, err := resolveVolumeMode(claim)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
+	volumeCaps, err := p.getVolumeCapabilities(claim, sc, fsType, accessModeFSTypes)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	if err := checkVolumeCapabilities(volumeMode, volumeCaps); err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	if p.checkVolumeModeAccessModes {
+		if err := p.checkAccessModes(ctx, claim); err != nil {
+			if unsupported, ok := err.(*unsupportedAccessModeError); ok {
+				p.eventRecorder.Event(claim, v1.EventTypeWarning, "UnsupportedAccessMode", unsupported.Error())
+				return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+					Reason: unsupported.Error(),
+				}
+			}
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
 
 	// Create a CSI CreateVolumeRequest and Response
 	req := csi.CreateVolumeRequest{
@@ -645,15 +941,33 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		},
 	}
 
+	var transfer *transferSource
 	if dataSource != nil && (rc.clone || rc.snapshot) {
-		volumeContentSource, err := p.getVolumeContentSource(ctx, claim, sc, dataSource)
+		volumeContentSource, transferSource, err := p.getVolumeContentSource(ctx, claim, sc, dataSource)
 		if err != nil {
-			return nil, controller.ProvisioningNoChange, fmt.Errorf("error getting handle for DataSource Type %s by Name %s: %v", dataSource.Kind, dataSource.Name, err)
+			err = fmt.Errorf("error getting handle for DataSource Type %s by Name %s: %w", dataSource.Kind, dataSource.Name, err)
+			var notReady *snapshotNotReadyError
+			var failed *snapshotFailedError
+			var noTransfer *noTransferProtocolError
+			switch {
+			case errors.As(err, &failed):
+				// Retrying won't help.
+				return nil, controller.ProvisioningFinished, err
+			case errors.As(err, &noTransfer):
+				p.eventRecorder.Event(claim, v1.EventTypeWarning, "NoCommonTransferProtocol", noTransfer.Error())
+				return nil, controller.ProvisioningFinished, err
+			case errors.As(err, &notReady):
+				// The snapshot may still be in the process of being created.
+				// Provisioning is retried with exponential backoff.
+				p.eventRecorder.Event(claim, v1.EventTypeNormal, "WaitingForSnapshot", notReady.Error())
+			}
+			return nil, controller.ProvisioningNoChange, err
 		}
 		req.VolumeContentSource = volumeContentSource
+		transfer = transferSource
 	}
 
-	if dataSource != nil && rc.clone {
+	if dataSource != nil && rc.clone && !p.disableFinalizers {
 		err = p.setCloneFinalizer(ctx, claim, dataSource)
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, err
@@ -671,11 +985,63 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 			p.immediateTopology,
 			p.csiNodeLister,
 			p.nodeLister)
+		var nodeTopology *nodeTopologyError
+		if err != nil && p.requireTopology && errors.As(err, &nodeTopology) {
+			err = fmt.Errorf("cannot determine the topology of selected node %s: %v", selectedNode.Name, err)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "TopologyUnavailable", err.Error())
+			return nil, controller.ProvisioningReschedule, err
+		}
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, fmt.Errorf("error generating accessibility requirements: %v", err)
+		}
+		if requirements == nil && p.requireTopology {
+			err := fmt.Errorf("cannot determine the topology of the volume: StorageClass %s has no allowed topologies and --immediate-topology is disabled", sc.Name)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "TopologyUnavailable", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+		}
+		requirements, err = p.addNodeLabelTopology(requirements, selectedNode)
 		if err != nil {
 			return nil, controller.ProvisioningNoChange, fmt.Errorf("error generating accessibility requirements: %v", err)
 		}
+		if requirements != nil && selectedNode == nil && p.topologyStrategy != nil {
+			requirements.Preferred = p.topologyStrategy.Order(requirements.Preferred)
+		}
+		req.AccessibilityRequirements = requirements
+	}
+	spread := 0
+	if value, ok := sc.Parameters[prefixedTopologySpread]; ok {
+		spread, err = strconv.Atoi(value)
+		if err != nil || spread < 1 {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("invalid %s parameter %q: must be a positive number", prefixedTopologySpread, value)
+		}
+		requirements, err := applyTopologySpread(req.AccessibilityRequirements, spread, sc.Parameters[prefixedTopologySpreadKey])
+		if err != nil {
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InsufficientTopologySpread", err.Error())
+			return nil, controller.ProvisioningFinished, err
+		}
 		req.AccessibilityRequirements = requirements
 	}
+	if req.AccessibilityRequirements != nil && selectedNode == nil {
+		// The limit comes after the spread, which chooses among all
+		// segments, and never drops segments chosen by the spread.
+		max := p.maxImmediateTopologySegments
+		if max > 0 && max < spread {
+			max = spread
+		}
+		req.AccessibilityRequirements = limitTopologySegments(req.AccessibilityRequirements, max)
+	}
+	if p.recordTopology && req.AccessibilityRequirements != nil {
+		p.recordClaimTopology(ctx, claim, req.AccessibilityRequirements)
+	}
+	if req.AccessibilityRequirements != nil {
+		p.setProvisioningCondition(ctx, claim, &v1.PersistentVolumeClaimCondition{
+			Status: v1.ConditionTrue,
+			Reason: provisioningReasonTopologyResolved,
+			Message: fmt.Sprintf("requisite topology %v, preferred topology %v",
+				topologySegments(req.AccessibilityRequirements.Requisite),
+				topologySegments(req.AccessibilityRequirements.Preferred)),
+		})
+	}
 
 	// Resolve provision secret credentials.
 	provisionerSecretRef, err := getSecretReference(provisionerSecretParams, sc.Parameters, pvName, &v1.PersistentVolumeClaim{
@@ -687,7 +1053,7 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, err
 	}
-	provisionerCredentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+	provisionerCredentials, err := getCredentials(ctx, p.client, p.secretCache, provisionerSecretRef)
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, err
 	}
@@ -728,6 +1094,32 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 	if err != nil {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("failed to strip CSI Parameters of prefixed keys: %v", err)
 	}
+	if req.VolumeContentSource.GetSnapshot() != nil {
+		overrides, err := restoreParameters(sc, claim)
+		if err != nil {
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidRestoreParameters", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+		}
+		if len(overrides) > 0 {
+			if err := p.checkRestoreParametersSupported(ctx); err != nil {
+				var notSupported *restoreParametersNotSupportedError
+				if !errors.As(err, &notSupported) {
+					return nil, controller.ProvisioningNoChange, err
+				}
+				p.eventRecorder.Event(claim, v1.EventTypeWarning, "RestoreParametersNotSupported", err.Error())
+				return nil, controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+			}
+			for key, value := range overrides {
+				req.Parameters[key] = value
+			}
+		}
+	}
+	if p.lowercaseParameterKeys {
+		req.Parameters, err = lowercaseParameterKeys(req.Parameters)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("invalid parameters in StorageClass %s: %v", sc.Name, err)
+		}
+	}
 
 	if p.extraCreateMetadata {
 		// add pvc and pv metadata to request for use by the plugin
@@ -735,6 +1127,101 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 		req.Parameters[pvcNamespaceKey] = claim.GetNamespace()
 		req.Parameters[pvNameKey] = pvName
 	}
+	if p.volumeHandlePrefix != "" {
+		req.Parameters[volumeHandlePrefixKey] = p.volumeHandlePrefix
+	}
+	if p.passIdempotencyToken {
+		req.Parameters[idempotencyTokenKey] = idempotencyToken(claim)
+	}
+
+	if value, ok := sc.Parameters[prefixedFSBlockSizeKey]; ok && !(claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock) {
+		if err := validateFSBlockSize(value); err != nil {
+			err = fmt.Errorf("invalid %s parameter in StorageClass %s: %v", prefixedFSBlockSizeKey, sc.Name, err)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidFSBlockSize", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+				Reason: err.Error(),
+			}
+		}
+		req.Parameters[fsBlockSizeKey] = value
+	}
+
+	if value, ok := sc.Parameters[prefixedFormatOwnerKey]; ok && !(claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock) {
+		if value != formatOwnerNode && value != formatOwnerController {
+			err := fmt.Errorf("invalid %s parameter in StorageClass %s: %q must be one of %s, %s", prefixedFormatOwnerKey, sc.Name, value, formatOwnerNode, formatOwnerController)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidFormatOwner", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+				Reason: err.Error(),
+			}
+		}
+		req.Parameters[formatOwnerKey] = value
+	}
+
+	if value, ok := sc.Parameters[prefixedLazyAllocationKey]; ok {
+		if value != "true" && value != "false" {
+			err := fmt.Errorf("invalid %s parameter in StorageClass %s: %q must be true or false", prefixedLazyAllocationKey, sc.Name, value)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidLazyAllocation", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+				Reason: err.Error(),
+			}
+		}
+		req.Parameters[lazyAllocationKey] = value
+	}
+
+	if value, source := getThroughput(claim, sc); source != "" {
+		if err := p.validateThroughput(value); err != nil {
+			err = fmt.Errorf("invalid throughput in %s: %v", source, err)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidThroughput", err.Error())
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+				Reason: err.Error(),
+			}
+		}
+		req.Parameters[throughputKey] = value
+	}
+
+	targetController, err := getTargetController(sc)
+	if err != nil {
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidTargetController", err.Error())
+		return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+			Reason: err.Error(),
+		}
+	}
+	if targetController != "" {
+		req.Parameters[targetControllerKey] = targetController
+	}
+
+	if p.projectMapping != nil {
+		project, err := p.getProject(ctx, claim)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+		req.Parameters[projectKey] = project
+	}
+
+	if transfer != nil {
+		for key, value := range transfer.parameters() {
+			req.Parameters[key] = value
+		}
+	}
+
+	if value, ok := sc.Parameters[prefixedStoragePoolsKey]; ok {
+		pools := parseStoragePools(value)
+		if len(pools) == 0 {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("invalid %s parameter in StorageClass %s: no storage pool listed", prefixedStoragePoolsKey, sc.Name)
+		}
+		pool, err := p.claimStoragePool(ctx, claim, pools, &req)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("failed to record storage pool of PVC %s/%s: %v", claim.Namespace, claim.Name, err)
+		}
+		klog.V(4).Infof("using storage pool %s for PVC %s/%s", pool, claim.Namespace, claim.Name)
+		req.Parameters[storagePoolKey] = pool
+	}
+
+	if p.honorPVCEncryptionKey {
+		if err := p.setEncryptionKey(claim, sc, req.Parameters); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+	p.checkParametersSize(claim, sc, req.Parameters)
 	deletionAnnSecrets := new(deletionSecretParams)
 
 	if provisionerSecretRef != nil {
@@ -744,15 +1231,41 @@ func (p *csiProvisioner) prepareProvision(ctx context.Context, claim *v1.Persist
 
 	return &prepareProvisionResult{
 		fsType:              fsType,
+		mountOptions:        sc.MountOptions,
+		volumeMode:          volumeMode,
 		migratedVolume:      migratedVolume,
 		req:                 &req,
 		csiPVSource:         csiPVSource,
 		provDeletionSecrets: deletionAnnSecrets,
+		transfer:            transfer,
 	}, controller.ProvisioningNoChange, nil
 
 }
 
 func (p *csiProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	if p.maxProvisioningRetries > 0 {
+		if err := p.checkProvisioningRetries(ctx, options.PVC); err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+	pv, state, err := p.provision(ctx, options)
+	if err == nil && pv != nil {
+		observeEndToEndDuration(options.PVC, time.Now())
+	}
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		if err != nil {
+			observeFailure(operationProvision, err)
+		}
+		p.setProvisioningCondition(ctx, options.PVC, provisioningResultCondition(options, state, err))
+		p.reportProvisioningResult(options, pv, state, err)
+		if p.maxProvisioningRetries > 0 {
+			err = p.countProvisioningFailure(ctx, options.PVC, state, err)
+		}
+	}
+	return pv, state, err
+}
+
+func (p *csiProvisioner) provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	claim := options.PVC
 	provisioner, ok := claim.Annotations[annStorageProvisioner]
 	if !ok {
@@ -782,6 +1295,27 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		}
 	}
 
+	if p.honorForceBlockVolumeMode {
+		claim = p.forceBlockVolumeMode(claim, options.StorageClass)
+		options.PVC = claim
+	}
+
+	if sc := options.StorageClass; sc != nil && sc.ReclaimPolicy != nil && *sc.ReclaimPolicy == v1.PersistentVolumeReclaimRecycle {
+		// Fail early instead of creating a volume that can never be
+		// recycled.
+		message := fmt.Sprintf("StorageClass %s uses the deprecated reclaim policy %s, which is not supported for CSI volumes. Use %s or %s instead.", sc.Name, v1.PersistentVolumeReclaimRecycle, v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain)
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "UnsupportedReclaimPolicy", message)
+		return nil, controller.ProvisioningFinished, &controller.IgnoredError{
+			Reason: message,
+		}
+	}
+
+	if p.enforceStorageClassParameters && options.StorageClass != nil {
+		if state, err := p.checkStorageClassParameters(ctx, claim, options.StorageClass); err != nil {
+			return nil, state, err
+		}
+	}
+
 	result, state, err := p.prepareProvision(ctx, claim, options.StorageClass, options.SelectedNode)
 	if result == nil {
 		return nil, state, err
@@ -791,11 +1325,79 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 	pvName := req.Name
 	provisionerCredentials := req.Secrets
 
+	if size := p.currentRequestedBytes(claim, volSizeBytes); size > volSizeBytes {
+		volSizeBytes = size
+		req.CapacityRange.RequiredBytes = size
+	}
+
+	if p.approvals != nil {
+		if state, err := p.checkApproval(ctx, claim, volSizeBytes); err != nil {
+			return nil, state, err
+		}
+	}
+
+	var budget *nodeBudget
+	if p.nodeDeployment != nil {
+		budget = p.nodeDeployment.budget
+	}
+	if budget != nil {
+		fits, err := budget.reserve(pvName, volSizeBytes)
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, err
+		}
+		if !fits && p.capacityCheckBypassed(ctx, claim) {
+			klog.Warningf("PVC %s/%s bypasses the capacity budget of node %s with a volume of %d bytes", claim.Namespace, claim.Name, p.nodeDeployment.NodeName, volSizeBytes)
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "CapacityCheckBypassed", "Provisioning volume of %d bytes despite exceeding the remaining capacity budget of node %s because of the %s annotation", volSizeBytes, p.nodeDeployment.NodeName, annBypassCapacityCheck)
+			budget.update(pvName, volSizeBytes)
+			fits = true
+		}
+		if !fits {
+			err := fmt.Errorf("volume of %d bytes exceeds the remaining capacity budget of node %s", volSizeBytes, p.nodeDeployment.NodeName)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "NodeCapacityBudgetExceeded", err.Error())
+			if options.SelectedNode != nil {
+				// Let the scheduler pick some other node.
+				return nil, controller.ProvisioningReschedule, err
+			}
+			// Nothing to reschedule. Not a failure either, the event
+			// explains it and the PVC gets tried again after the next
+			// resync, when some volumes may have been deleted.
+			return nil, controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+		}
+	}
+
+	creatingMessage := fmt.Sprintf("creating volume %s", pvName)
+	p.setProvisioningCondition(ctx, claim, &v1.PersistentVolumeClaimCondition{
+		Status:  v1.ConditionTrue,
+		Reason:  provisioningReasonCreatingVolume,
+		Message: creatingMessage,
+	})
+	p.reportProvisioningStatus(claim, provisioningReasonCreatingVolume, creatingMessage, "")
+
 	createCtx := markAsMigrated(ctx, result.migratedVolume)
-	createCtx, cancel := context.WithTimeout(createCtx, p.timeout)
+	createCtx, cancel := context.WithTimeout(createCtx, p.operationTimeout(claim))
 	defer cancel()
 	rep, err := p.csiClient.CreateVolume(createCtx, req)
+	if err != nil && p.retryOnVolumeNameConflict && status.Code(err) == codes.AlreadyExists {
+		// Some unrelated volume already uses the name, for example one
+		// left behind by a different cluster. Try once more with a
+		// different name. The suffix is derived from the PVC so that a
+		// later attempt retries with the same name instead of creating
+		// yet another volume.
+		conflictingName := req.Name
+		req.Name = fmt.Sprintf("%s-%s", conflictingName, volumeNameConflictSuffix(claim))
+		klog.Warningf("CreateVolume for PVC %s/%s failed with a name conflict, retrying with volume name %s: %v", claim.Namespace, claim.Name, req.Name, err)
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "VolumeNameConflict", "Volume name %s is already in use, retrying with volume name %s", conflictingName, req.Name)
+		retryCtx, retryCancel := context.WithTimeout(markAsMigrated(ctx, result.migratedVolume), p.operationTimeout(claim))
+		defer retryCancel()
+		rep, err = p.csiClient.CreateVolume(retryCtx, req)
+	}
 	if err != nil {
+		if p.retryAfter != nil {
+			if delay := retryAfter(err); delay > 0 {
+				klog.V(3).Infof("CreateVolume for PVC %s/%s asked to retry after %v", claim.Namespace, claim.Name, delay)
+				p.retryAfter.set(claim.UID, delay)
+			}
+		}
 		// Giving up after an error and telling the pod scheduler to retry with a different node
 		// only makes sense if:
 		// - The CSI driver supports topology: without that, the next CreateVolume call after
@@ -819,12 +1421,43 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 			mayReschedule,
 			state,
 			err)
+		if budget != nil && state != controller.ProvisioningInBackground {
+			// The volume was not created.
+			budget.release(pvName)
+		}
+		if isAuthenticationError(err) && result.provDeletionSecrets != nil && result.provDeletionSecrets.name != "" {
+			// Get the secret again for the next attempt, it may have
+			// been rotated since it was cached.
+			klog.V(2).Infof("CreateVolume for PVC %s/%s was rejected with %s, refreshing secret %s/%s", claim.Namespace, claim.Name, status.Code(err), result.provDeletionSecrets.namespace, result.provDeletionSecrets.name)
+			p.secretCache.forget(result.provDeletionSecrets.namespace, result.provDeletionSecrets.name)
+		}
+		err = p.errorMessages.translate(err)
+		if state == controller.ProvisioningFinished {
+			err = p.terminalError(claim, "TerminalProvisioningFailure", err)
+		}
 		return nil, state, err
 	}
 
 	if rep.Volume != nil {
 		klog.V(3).Infof("create volume rep: %+v", *rep.Volume)
 	}
+	if err := validateCreateVolumeResponse(rep); err != nil {
+		// Without a valid response we cannot create a PV that could be
+		// deleted again. The driver hopefully returns a valid response
+		// for the same (idempotent) request next time.
+		err = fmt.Errorf("invalid CreateVolume response from driver %s: %v", p.driverName, err)
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "InvalidCreateVolumeResponse", err.Error())
+		if volumeID := rep.GetVolume().GetVolumeId(); volumeID != "" {
+			delReq := &csi.DeleteVolumeRequest{
+				VolumeId: volumeID,
+			}
+			if cleanupErr := cleanupVolume(ctx, p, delReq, provisionerCredentials); cleanupErr != nil {
+				err = fmt.Errorf("%v. Cleanup of volume %s failed, volume is orphaned: %v", err, pvName, cleanupErr)
+			}
+		}
+		return nil, controller.ProvisioningInBackground, err
+	}
+	observeSuccess(operationProvision, time.Now())
 	volumeAttributes := map[string]string{provisionerIDKey: p.identity}
 	for k, v := range rep.Volume.VolumeContext {
 		volumeAttributes[k] = v
@@ -848,10 +1481,11 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		return nil, controller.ProvisioningInBackground, capErr
 	}
 
-	if options.PVC.Spec.DataSource != nil ||
+	// A volume copied from a different driver has no content source.
+	if result.transfer == nil && (options.PVC.Spec.DataSource != nil ||
 		(utilfeature.DefaultFeatureGate.Enabled(features.CrossNamespaceVolumeDataSource) &&
 			options.PVC.Spec.DataSourceRef != nil && options.PVC.Spec.DataSourceRef.Namespace != nil &&
-			len(*options.PVC.Spec.DataSourceRef.Namespace) > 0) {
+			len(*options.PVC.Spec.DataSourceRef.Namespace) > 0)) {
 		contentSource := rep.GetVolume().ContentSource
 		if contentSource == nil {
 			sourceErr := fmt.Errorf("volume content source missing")
@@ -865,6 +1499,15 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 			return nil, controller.ProvisioningInBackground, sourceErr
 		}
 	}
+	if p.postProvisionVerification != nil {
+		if state, err := p.verifyVolume(ctx, claim, rep.Volume, pvName, provisionerCredentials); err != nil {
+			if budget != nil && state == controller.ProvisioningFinished {
+				// The volume was deleted.
+				budget.release(pvName)
+			}
+			return nil, state, err
+		}
+	}
 	pvReadOnly := false
 	volCaps := req.GetVolumeCapabilities()
 	// if the request only has one accessmode and if its ROX, set readonly to true
@@ -873,6 +1516,10 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		pvReadOnly = true
 	}
 
+	if budget != nil {
+		budget.update(pvName, respCap)
+	}
+
 	result.csiPVSource.VolumeHandle = p.volumeIdToHandle(rep.Volume.VolumeId)
 	result.csiPVSource.VolumeAttributes = volumeAttributes
 	result.csiPVSource.ReadOnly = pvReadOnly
@@ -882,7 +1529,7 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		},
 		Spec: v1.PersistentVolumeSpec{
 			AccessModes:  options.PVC.Spec.AccessModes,
-			MountOptions: options.StorageClass.MountOptions,
+			MountOptions: result.mountOptions,
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): bytesToQuantity(respCap),
 			},
@@ -903,20 +1550,39 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDeletionProvisionerSecretRefNamespace, "")
 	}
 
+	if req.Name != pvName {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annCSIVolumeName, req.Name)
+	}
+
+	setStorageClassAnnotations(pv, options.StorageClass)
+	p.copyStorageClassMetadata(pv, options.StorageClass)
+	if p.recordedParameters != nil {
+		p.recordCreateVolumeParameters(pv, req.Parameters)
+	}
+	p.recordFSGroupDelegation(pv, options.PVC)
+	recordLazyAllocation(pv, req.Parameters)
+	p.recordDriverVersion(pv)
+	recordIdempotencyToken(pv, req.Parameters)
+
 	if options.StorageClass.ReclaimPolicy != nil {
 		pv.Spec.PersistentVolumeReclaimPolicy = *options.StorageClass.ReclaimPolicy
 	}
 
 	if p.supportsTopology() {
-		pv.Spec.NodeAffinity = GenerateVolumeNodeAffinity(rep.Volume.AccessibleTopology)
+		accessibleTopology := rep.Volume.AccessibleTopology
+		if len(p.wellKnownTopologyLabels) > 0 {
+			accessibleTopology = make([]*csi.Topology, 0, len(rep.Volume.AccessibleTopology))
+			for _, topology := range rep.Volume.AccessibleTopology {
+				accessibleTopology = append(accessibleTopology, addWellKnownTopology(topology, p.wellKnownTopologyLabels))
+			}
+		}
+		pv.Spec.NodeAffinity = GenerateVolumeNodeAffinity(accessibleTopology)
 	}
 
-	// Set VolumeMode to PV if it is passed via PVC spec when Block feature is enabled
-	if options.PVC.Spec.VolumeMode != nil {
-		pv.Spec.VolumeMode = options.PVC.Spec.VolumeMode
-	}
+	// The PV always gets the resolved volume mode of the PVC.
+	pv.Spec.VolumeMode = &result.volumeMode
 	// Set FSType if PV is not Block Volume
-	if !util.CheckPersistentVolumeClaimModeBlock(options.PVC) {
+	if result.volumeMode != v1.PersistentVolumeBlock {
 		pv.Spec.PersistentVolumeSource.CSI.FSType = result.fsType
 	}
 
@@ -940,6 +1606,132 @@ func (p *csiProvisioner) Provision(ctx context.Context, options controller.Provi
 	return pv, controller.ProvisioningFinished, nil
 }
 
+// validateCreateVolumeResponse checks the parts of a successful CreateVolume
+// response that are needed for creating a PV.
+func validateCreateVolumeResponse(rep *csi.CreateVolumeResponse) error {
+	volume := rep.GetVolume()
+	if volume == nil {
+		return errors.New("volume is missing")
+	}
+	if volume.VolumeId == "" {
+		return errors.New("volume ID is empty")
+	}
+	if volume.CapacityBytes < 0 {
+		return fmt.Errorf("volume %s has negative capacity %d", volume.VolumeId, volume.CapacityBytes)
+	}
+	return nil
+}
+
+// operationTimeout returns the timeout for CreateVolume. It is the timeout
+// from the PVC annotation, limited to the configured maximum, or the default
+// timeout.
+func (p *csiProvisioner) operationTimeout(claim *v1.PersistentVolumeClaim) time.Duration {
+	value, ok := claim.Annotations[annOperationTimeout]
+	if !ok || p.maxPVCOperationTimeout <= 0 {
+		return p.timeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "InvalidOperationTimeout", "Ignoring invalid %s annotation %q, using the default timeout %s", annOperationTimeout, value, p.timeout)
+		return p.timeout
+	}
+	if timeout > p.maxPVCOperationTimeout {
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "InvalidOperationTimeout", "Timeout %s from the %s annotation exceeds the maximum, using %s", timeout, annOperationTimeout, p.maxPVCOperationTimeout)
+		return p.maxPVCOperationTimeout
+	}
+	return timeout
+}
+
+// setStorageClassAnnotations records the resource version and a hash of the
+// parameters of the storage class in the PV.
+func setStorageClassAnnotations(pv *v1.PersistentVolume, sc *storagev1.StorageClass) {
+	if sc.ResourceVersion != "" {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annStorageClassResourceVersion, sc.ResourceVersion)
+	}
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annStorageClassParametersHash, storageClassParametersHash(sc.Parameters))
+}
+
+// copyStorageClassMetadata copies the allowlisted labels and annotations of
+// the storage class to the PV. Keys which are already set on the PV or
+// which belong to the Kubernetes namespaces are never copied.
+func (p *csiProvisioner) copyStorageClassMetadata(pv *v1.PersistentVolume, sc *storagev1.StorageClass) {
+	for _, key := range p.storageClassLabels {
+		value, ok := sc.Labels[key]
+		if !ok || IsReservedMetadataKey(key) {
+			continue
+		}
+		if _, ok := pv.Labels[key]; ok {
+			continue
+		}
+		metav1.SetMetaDataLabel(&pv.ObjectMeta, key, value)
+	}
+	for _, key := range p.storageClassAnnotations {
+		value, ok := sc.Annotations[key]
+		if !ok || IsReservedMetadataKey(key) {
+			continue
+		}
+		if _, ok := pv.Annotations[key]; ok {
+			continue
+		}
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, key, value)
+	}
+}
+
+// IsReservedMetadataKey checks whether a label or annotation key has a
+// kubernetes.io or k8s.io prefix. Those are managed by Kubernetes
+// components, including this provisioner.
+func IsReservedMetadataKey(key string) bool {
+	prefix, _, found := strings.Cut(key, "/")
+	if !found {
+		return false
+	}
+	for _, domain := range []string{"kubernetes.io", "k8s.io"} {
+		if prefix == domain || strings.HasSuffix(prefix, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageClassParametersHash returns the hex-encoded SHA-256 hash of the
+// storage class parameters, independent of the map iteration order.
+func storageClassParametersHash(parameters map[string]string) string {
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%q=%q\n", key, parameters[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// volumeNameConflictSuffix returns the suffix that gets appended to the
+// volume name after a name conflict. It only depends on the PVC UID.
+func volumeNameConflictSuffix(claim *v1.PersistentVolumeClaim) string {
+	hash := sha256.Sum256([]byte(claim.UID))
+	return hex.EncodeToString(hash[:])[:volumeNameConflictSuffixLength]
+}
+
+// forceBlockVolumeMode returns a claim with volume mode Block if the storage class
+// asks for that, otherwise the original claim.
+func (p *csiProvisioner) forceBlockVolumeMode(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) *v1.PersistentVolumeClaim {
+	if sc == nil || sc.Annotations[annForceBlockVolumeMode] != "true" || util.CheckPersistentVolumeClaimModeBlock(claim) {
+		return claim
+	}
+	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeFilesystem {
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "VolumeModeOverridden",
+			"PVC requested volume mode %s, but storage class %s forces volume mode %s", v1.PersistentVolumeFilesystem, sc.Name, v1.PersistentVolumeBlock)
+	}
+	klog.V(2).Infof("storage class %s forces volume mode %s for PVC %s/%s", sc.Name, v1.PersistentVolumeBlock, claim.Namespace, claim.Name)
+	claim = claim.DeepCopy()
+	volumeMode := v1.PersistentVolumeBlock
+	claim.Spec.VolumeMode = &volumeMode
+	return claim
+}
+
 func (p *csiProvisioner) setCloneFinalizer(ctx context.Context, pvc *v1.PersistentVolumeClaim, dataSource *v1.ObjectReference) error {
 	claim, err := p.claimLister.PersistentVolumeClaims(dataSource.Namespace).Get(dataSource.Name)
 	if err != nil {
@@ -962,6 +1754,10 @@ func (p *csiProvisioner) supportsTopology() bool {
 func removePrefixedParameters(param map[string]string) (map[string]string, error) {
 	newParam := map[string]string{}
 	for k, v := range param {
+		if strings.HasPrefix(k, prefixedAccessModeFsTypeKey) {
+			// Already validated by getAccessModeFSTypes.
+			continue
+		}
 		if strings.HasPrefix(k, csiParameterPrefix) {
 			// Check if its well known
 			switch k {
@@ -980,6 +1776,19 @@ func removePrefixedParameters(param map[string]string) (map[string]string, error
 			case prefixedDefaultSecretNamespaceKey:
 			case prefixedNodeExpandSecretNameKey:
 			case prefixedNodeExpandSecretNamespaceKey:
+			case prefixedEncryptionKey:
+			case prefixedTopologySpread:
+			case prefixedTopologySpreadKey:
+			case prefixedFSBlockSizeKey:
+			case prefixedFormatOwnerKey:
+			case prefixedThroughputKey:
+			case prefixedLazyAllocationKey:
+			case prefixedStoragePoolsKey:
+			case prefixedDefaultSizeKey:
+			case prefixedMinimumSizeKey:
+			case prefixedTargetControllerKey:
+			case prefixedTargetControllerRequiredKey:
+			case prefixedRestoreParametersKey:
 			default:
 				return map[string]string{}, fmt.Errorf("found unknown parameter key \"%s\" with reserved namespace %s", k, csiParameterPrefix)
 			}
@@ -992,43 +1801,87 @@ func removePrefixedParameters(param map[string]string) (map[string]string, error
 	return newParam, nil
 }
 
+// validateFSBlockSize checks that the filesystem block size is a power of
+// two between minFSBlockSize and maxFSBlockSize bytes.
+func validateFSBlockSize(value string) error {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number of bytes", value)
+	}
+	if size < minFSBlockSize || size > maxFSBlockSize {
+		return fmt.Errorf("%d must be between %d and %d bytes", size, minFSBlockSize, maxFSBlockSize)
+	}
+	if size&(size-1) != 0 {
+		return fmt.Errorf("%d is not a power of two", size)
+	}
+	return nil
+}
+
+// setEncryptionKey adds the encryption key reference from the PVC to the
+// CreateVolume parameters if the storage class supports encryption.
+func (p *csiProvisioner) setEncryptionKey(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, parameters map[string]string) error {
+	key := claim.Annotations[annEncryptionKey]
+	switch encryption := sc.Parameters[prefixedEncryptionKey]; encryption {
+	case encryptionRequired, encryptionOptional:
+		if key != "" {
+			parameters[encryptionKeyKey] = key
+			return nil
+		}
+		if encryption == encryptionRequired {
+			err := fmt.Errorf("storage class %s requires an encryption key, set the %s annotation", sc.Name, annEncryptionKey)
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "EncryptionKeyMissing", err.Error())
+			return err
+		}
+		return nil
+	case "":
+		if key != "" {
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "EncryptionKeyIgnored", "storage class %s does not support encryption, ignoring the %s annotation", sc.Name, annEncryptionKey)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid value %q for %s in storage class %s, must be %q or %q", encryption, prefixedEncryptionKey, sc.Name, encryptionRequired, encryptionOptional)
+	}
+}
+
 // getVolumeContentSource is a helper function to process provisioning requests that include a DataSource
 // currently we provide Snapshot and PVC, the default case allows the provisioner to still create a volume
 // so that an external controller can act upon it.   Additional DataSource types can be added here with
 // an appropriate implementation function
-func (p *csiProvisioner) getVolumeContentSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, error) {
+func (p *csiProvisioner) getVolumeContentSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, *transferSource, error) {
 	switch dataSource.Kind {
 	case snapshotKind:
-		return p.getSnapshotSource(ctx, claim, sc, dataSource)
+		source, err := p.getSnapshotSource(ctx, claim, sc, dataSource)
+		return source, nil, err
 	case pvcKind:
 		return p.getPVCSource(ctx, claim, sc, dataSource)
 	default:
 		// For now we shouldn't pass other things to this function, but treat it as a noop and extend as needed
-		return nil, nil
+		return nil, nil, nil
 	}
 }
 
 // getPVCSource verifies DataSource.Kind of type PersistentVolumeClaim, making sure that the requested PVC is available/ready
-// returns the VolumeContentSource for the requested PVC
-func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, error) {
+// returns the VolumeContentSource for the requested PVC. If the PVC belongs to a different CSI driver,
+// a transfer source gets returned instead.
+func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, dataSource *v1.ObjectReference) (*csi.VolumeContentSource, *transferSource, error) {
 
 	sourcePVC, err := p.claimLister.PersistentVolumeClaims(dataSource.Namespace).Get(dataSource.Name)
 	if err != nil {
-		return nil, fmt.Errorf("error getting PVC %s (namespace %q) from api server: %v", dataSource.Name, claim.Namespace, err)
+		return nil, nil, fmt.Errorf("error getting PVC %s (namespace %q) from api server: %v", dataSource.Name, claim.Namespace, err)
 	}
 	if string(sourcePVC.Status.Phase) != "Bound" {
-		return nil, fmt.Errorf("the PVC DataSource %s must have a status of Bound.  Got %v", dataSource.Name, sourcePVC.Status)
+		return nil, nil, fmt.Errorf("the PVC DataSource %s must have a status of Bound.  Got %v", dataSource.Name, sourcePVC.Status)
 	}
 	if sourcePVC.ObjectMeta.DeletionTimestamp != nil {
-		return nil, fmt.Errorf("the PVC DataSource %s is currently being deleted", dataSource.Name)
+		return nil, nil, fmt.Errorf("the PVC DataSource %s is currently being deleted", dataSource.Name)
 	}
 
 	if sourcePVC.Spec.StorageClassName == nil {
-		return nil, fmt.Errorf("the source PVC (%s) storageclass cannot be empty", sourcePVC.Name)
+		return nil, nil, fmt.Errorf("the source PVC (%s) storageclass cannot be empty", sourcePVC.Name)
 	}
 
 	if claim.Spec.StorageClassName == nil {
-		return nil, fmt.Errorf("the requested PVC (%s) storageclass cannot be empty", claim.Name)
+		return nil, nil, fmt.Errorf("the requested PVC (%s) storageclass cannot be empty", claim.Name)
 	}
 
 	capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
@@ -1036,56 +1889,60 @@ func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentV
 	srcCapacity := sourcePVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	srcPVCSize := srcCapacity.Value()
 	if requestedSize < srcPVCSize {
-		return nil, fmt.Errorf("error, new PVC request must be greater than or equal in size to the specified PVC data source, requested %v but source is %v", requestedSize, srcPVCSize)
+		return nil, nil, fmt.Errorf("error, new PVC request must be greater than or equal in size to the specified PVC data source, requested %v but source is %v", requestedSize, srcPVCSize)
 	}
 
 	if sourcePVC.Spec.VolumeName == "" {
-		return nil, fmt.Errorf("volume name is empty in source PVC %s", sourcePVC.Name)
+		return nil, nil, fmt.Errorf("volume name is empty in source PVC %s", sourcePVC.Name)
 	}
 
 	sourcePV, err := p.client.CoreV1().PersistentVolumes().Get(ctx, sourcePVC.Spec.VolumeName, metav1.GetOptions{})
 	if err != nil {
 		klog.Warningf("error getting volume %s for PVC %s/%s: %s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, err)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, nil, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.CSI == nil {
 		klog.Warningf("error getting volume source from %s for PVC %s/%s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
-	}
-
-	if sourcePV.Spec.CSI.Driver != sc.Provisioner {
-		klog.Warningf("the source volume %s for PVC %s/%s is handled by a different CSI driver than requested by StorageClass %s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, *claim.Spec.StorageClassName)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, nil, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.ClaimRef == nil {
 		klog.Warningf("the source volume %s for PVC %s/%s is not bound", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, nil, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Spec.ClaimRef.UID != sourcePVC.UID || sourcePV.Spec.ClaimRef.Namespace != sourcePVC.Namespace || sourcePV.Spec.ClaimRef.Name != sourcePVC.Name {
 		klog.Warningf("the source volume %s for PVC %s/%s is bound to a different PVC than requested", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, nil, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if sourcePV.Status.Phase != v1.VolumeBound {
 		klog.Warningf("the source volume %s for PVC %s/%s status is \"%s\", should instead be \"%s\"", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, sourcePV.Status.Phase, v1.VolumeBound)
-		return nil, fmt.Errorf("claim in dataSource not bound or invalid")
+		return nil, nil, fmt.Errorf("claim in dataSource not bound or invalid")
 	}
 
 	if claim.Spec.VolumeMode == nil || *claim.Spec.VolumeMode == v1.PersistentVolumeFilesystem {
 		if sourcePV.Spec.VolumeMode != nil && *sourcePV.Spec.VolumeMode != v1.PersistentVolumeFilesystem {
-			return nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Block, but new PVC requested Filesystem")
+			return nil, nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Block, but new PVC requested Filesystem")
 		}
 	}
 
 	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock {
 		if sourcePV.Spec.VolumeMode == nil || *sourcePV.Spec.VolumeMode != v1.PersistentVolumeBlock {
-			return nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Filesystem, but new PVC requested Block")
+			return nil, nil, fmt.Errorf("the source PVC and destination PVCs must have the same volume mode for cloning.  Source is Filesystem, but new PVC requested Block")
 		}
 	}
 
+	if sourcePV.Spec.CSI.Driver != sc.Provisioner {
+		klog.V(4).Infof("the source volume %s for PVC %s/%s is handled by a different CSI driver than requested by StorageClass %s", sourcePVC.Spec.VolumeName, sourcePVC.Namespace, sourcePVC.Name, *claim.Spec.StorageClassName)
+		transfer, err := p.getTransferSource(ctx, sourcePV.Spec.CSI.Driver, sourcePV.Spec.CSI.VolumeHandle)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, transfer, nil
+	}
+
 	volumeSource := csi.VolumeContentSource_Volume{
 		Volume: &csi.VolumeContentSource_VolumeSource{
 			VolumeId: sourcePV.Spec.CSI.VolumeHandle,
@@ -1096,7 +1953,28 @@ func (p *csiProvisioner) getPVCSource(ctx context.Context, claim *v1.PersistentV
 	volumeContentSource := &csi.VolumeContentSource{
 		Type: &volumeSource,
 	}
-	return volumeContentSource, nil
+	return volumeContentSource, nil, nil
+}
+
+// snapshotNotReadyError is returned by getSnapshotSource for a snapshot
+// which is not ReadyToUse yet.
+type snapshotNotReadyError struct {
+	name string
+}
+
+func (e *snapshotNotReadyError) Error() string {
+	return fmt.Sprintf("snapshot %s is not Ready", e.name)
+}
+
+// snapshotFailedError is returned by getSnapshotSource for a snapshot
+// which reports an error instead of becoming ReadyToUse.
+type snapshotFailedError struct {
+	name    string
+	message string
+}
+
+func (e *snapshotFailedError) Error() string {
+	return fmt.Sprintf("snapshot %s failed: %s", e.name, e.message)
 }
 
 // getSnapshotSource verifies DataSource.Kind of type VolumeSnapshot, making sure that the requested Snapshot is available/ready
@@ -1112,6 +1990,15 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 	}
 	klog.V(5).Infof("VolumeSnapshot %+v", snapshotObj)
 
+	if snapshotObj.Status != nil && snapshotObj.Status.Error != nil &&
+		(snapshotObj.Status.ReadyToUse == nil || !*snapshotObj.Status.ReadyToUse) {
+		failed := &snapshotFailedError{name: dataSource.Name}
+		if snapshotObj.Status.Error.Message != nil {
+			failed.message = *snapshotObj.Status.Error.Message
+		}
+		return nil, failed
+	}
+
 	if snapshotObj.Status == nil || snapshotObj.Status.BoundVolumeSnapshotContentName == nil {
 		return nil, fmt.Errorf(snapshotNotBound, dataSource.Name)
 	}
@@ -1133,7 +2020,7 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 	}
 
 	if snapshotObj.Status.ReadyToUse == nil || *snapshotObj.Status.ReadyToUse == false {
-		return nil, fmt.Errorf("snapshot %s is not Ready", dataSource.Name)
+		return nil, &snapshotNotReadyError{name: dataSource.Name}
 	}
 
 	klog.V(5).Infof("VolumeSnapshotContent %+v", snapContentObj)
@@ -1195,10 +2082,25 @@ func (p *csiProvisioner) getSnapshotSource(ctx context.Context, claim *v1.Persis
 }
 
 func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	err := p.delete(ctx, volume)
+	if _, ok := err.(*controller.IgnoredError); err != nil && !ok {
+		observeFailure(operationDelete, err)
+	}
+	return err
+}
+
+func (p *csiProvisioner) delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	if volume == nil {
 		return fmt.Errorf("invalid CSI PV")
 	}
 
+	if p.disableDelete {
+		// Some other controller is responsible for deleting released volumes.
+		return &controller.IgnoredError{
+			Reason: "deletion is disabled",
+		}
+	}
+
 	var err error
 	var migratedVolume bool
 	if p.translator.IsPVMigratable(volume) {
@@ -1221,7 +2123,7 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 	// that we didn't create. In practice, that means that the volume
 	// is accessible (only!) on this node.
 	if p.nodeDeployment != nil {
-		accessible, err := VolumeIsAccessible(volume.Spec.NodeAffinity, p.nodeDeployment.NodeInfo.AccessibleTopology)
+		accessible, err := VolumeIsAccessible(volume.Spec.NodeAffinity, p.localTopology())
 		if err != nil {
 			return fmt.Errorf("checking volume affinity failed: %v", err)
 		}
@@ -1232,6 +2134,10 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 		}
 	}
 
+	if p.forceRemoveFinalizer && volume.Annotations[annForceRemoveFinalizer] == "true" {
+		return p.forceRemoveVolumeFinalizer(volume)
+	}
+
 	volumeId := p.volumeHandleToId(volume.Spec.CSI.VolumeHandle)
 
 	rc := &requiredCapabilities{}
@@ -1255,9 +2161,31 @@ func (p *csiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 		return err
 	}
 
+	if err := p.ensureDeletionSnapshot(ctx, volume, volumeId, req.Secrets); err != nil {
+		return err
+	}
+
 	_, err = p.csiClient.DeleteVolume(deleteCtx, &req)
+	if err == nil {
+		observeSuccess(operationDelete, time.Now())
+		if p.nodeDeployment != nil && p.nodeDeployment.budget != nil {
+			p.nodeDeployment.budget.release(volume.Name)
+		}
+	}
 
-	return err
+	return p.terminalError(volume, "TerminalDeletionFailure", p.errorMessages.translate(err))
+}
+
+// forceRemoveVolumeFinalizer releases a PV without calling DeleteVolume. The
+// backend volume, if it still exists, is leaked.
+func (p *csiProvisioner) forceRemoveVolumeFinalizer(volume *v1.PersistentVolume) error {
+	klog.Warningf("PV %s is annotated with %s, skipping DeleteVolume for volume %s", volume.Name, annForceRemoveFinalizer, volume.Spec.CSI.VolumeHandle)
+	p.eventRecorder.Event(volume, v1.EventTypeWarning, "ForceRemovedFinalizer",
+		fmt.Sprintf("Skipped DeleteVolume because of annotation %s, backend volume %s may be leaked", annForceRemoveFinalizer, volume.Spec.CSI.VolumeHandle))
+
+	// Like after DeleteVolume, the provisioner library removes its
+	// finalizer once Delete succeeded.
+	return nil
 }
 
 func (p *csiProvisioner) handleSecretsForDeletion(ctx context.Context, volume *v1.PersistentVolume, req *csi.DeleteVolumeRequest, migratedVolume bool) error {
@@ -1269,7 +2197,7 @@ func (p *csiProvisioner) handleSecretsForDeletion(ctx context.Context, volume *v
 			provisionerSecretRef := &v1.SecretReference{}
 			provisionerSecretRef.Name = annDeletionSecretName
 			provisionerSecretRef.Namespace = annDeletionSecretNamespace
-			credentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+			credentials, err := getCredentials(ctx, p.client, p.secretCache, provisionerSecretRef)
 			if err != nil {
 				// Continue with deletion, as the secret may have already been deleted.
 				klog.Errorf("failed to get credentials for volume %s: %s", volume.Name, err.Error())
@@ -1289,7 +2217,7 @@ func (p *csiProvisioner) handleSecretsForDeletion(ctx context.Context, volume *v
 
 func (p *csiProvisioner) getSecretsFromSC(ctx context.Context, volume *v1.PersistentVolume, migratedVolume bool, req *csi.DeleteVolumeRequest) error {
 	// get secrets if StorageClass specifies it
-	storageClassName := util.GetPersistentVolumeClass(volume)
+	storageClassName := p.storageClassOfVolume(volume)
 	if len(storageClassName) != 0 {
 		if storageClass, err := p.scLister.Get(storageClassName); err == nil {
 			if migratedVolume && storageClass.Provisioner == p.supportsMigrationFromInTreePluginName {
@@ -1315,7 +2243,7 @@ func (p *csiProvisioner) getSecretsFromSC(ctx context.Context, volume *v1.Persis
 				return fmt.Errorf("failed to get secretreference for volume %s: %v", volume.Name, err)
 			}
 
-			credentials, err := getCredentials(ctx, p.client, provisionerSecretRef)
+			credentials, err := getCredentials(ctx, p.client, p.secretCache, provisionerSecretRef)
 			if err != nil {
 				// Continue with deletion, as the secret may have already been deleted.
 				klog.Errorf("Failed to get credentials for volume %s: %s", volume.Name, err.Error())
@@ -1329,6 +2257,11 @@ func (p *csiProvisioner) getSecretsFromSC(ctx context.Context, volume *v1.Persis
 }
 
 func (p *csiProvisioner) canDeleteVolume(volume *v1.PersistentVolume) error {
+	if p.volumeHandles != nil && volume.Spec.CSI != nil {
+		if err := p.checkVolumeHandleUnshared(volume); err != nil {
+			return err
+		}
+	}
 	if p.vaLister == nil {
 		// Nothing to check.
 		return nil
@@ -1358,6 +2291,17 @@ func (p *csiProvisioner) SupportsBlock(ctx context.Context) bool {
 }
 
 func (p *csiProvisioner) ShouldProvision(ctx context.Context, claim *v1.PersistentVolumeClaim) bool {
+	if p.globalPause.isPaused() {
+		// The claim gets queued again when the pause ends.
+		klog.V(4).Infof("not provisioning PVC %s/%s: provisioning is paused", claim.Namespace, claim.Name)
+		return false
+	}
+	// An explicitly empty storage class disables dynamic provisioning,
+	// unlike a nil one which gets replaced by the default class.
+	if claim.Spec.StorageClassName != nil && *claim.Spec.StorageClassName == "" {
+		klog.V(5).Infof("not provisioning PVC %s/%s: storage class is empty", claim.Namespace, claim.Name)
+		return false
+	}
 	provisioner, ok := claim.Annotations[annStorageProvisioner]
 	if !ok {
 		provisioner = claim.Annotations[annBetaStorageProvisioner]
@@ -1389,6 +2333,14 @@ func (p *csiProvisioner) ShouldProvision(ctx context.Context, claim *v1.Persiste
 			claim.Namespace, claim.Name, err)
 	}
 
+	if p.driverCapabilities != nil && !p.checkClaimCapabilities(claim) {
+		return false
+	}
+
+	if p.isProvisioningPaused(claim) {
+		return false
+	}
+
 	// Start provisioning.
 	return true
 }
@@ -1402,6 +2354,12 @@ func (p *csiProvisioner) volumeHandleToId(handle string) string {
 	return handle
 }
 
+// localTopology returns the topology of the node in a node deployment,
+// including the well-known labels that are also added to PVs.
+func (p *csiProvisioner) localTopology() *csi.Topology {
+	return addWellKnownTopology(p.nodeDeployment.NodeInfo.AccessibleTopology, p.wellKnownTopologyLabels)
+}
+
 // checkNode optionally checks whether the PVC is assigned to the current node.
 // If the PVC uses immediate binding, it will try to take the PVC for provisioning
 // on the current node. Returns true if provisioning can proceed, an error
@@ -1805,12 +2763,12 @@ func resolveTemplate(template string, params map[string]string) (string, error)
 	return resolved, nil
 }
 
-func getCredentials(ctx context.Context, k8s kubernetes.Interface, ref *v1.SecretReference) (map[string]string, error) {
+func getCredentials(ctx context.Context, k8s kubernetes.Interface, secretCache *secretCache, ref *v1.SecretReference) (map[string]string, error) {
 	if ref == nil {
 		return nil, nil
 	}
 
-	secret, err := k8s.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	secret, err := secretCache.get(ctx, k8s, ref.Namespace, ref.Name)
 	if err != nil {
 		return nil, fmt.Errorf("error getting secret %s in namespace %s: %v", ref.Name, ref.Namespace, err)
 	}
@@ -1898,6 +2856,22 @@ func checkFinalizer(obj metav1.Object, finalizer string) bool {
 	return false
 }
 
+// isPopulatorDataSource returns true if the data source is handled by a
+// volume populator (AnyVolumeDataSource) instead of the CSI driver. Only
+// VolumeSnapshots from the snapshot API group and PVCs from the core API
+// group are native data sources, everything else is assumed to be a
+// populator, even when the kind happens to match.
+func isPopulatorDataSource(dataSource *v1.ObjectReference) bool {
+	switch {
+	case dataSource.Kind == snapshotKind && dataSource.APIVersion == snapshotAPIGroup:
+		return false
+	case dataSource.Kind == pvcKind && dataSource.APIVersion == "":
+		return false
+	default:
+		return true
+	}
+}
+
 func markAsMigrated(parent context.Context, hasMigrated bool) context.Context {
 	return context.WithValue(parent, connection.AdditionalInfoKey, connection.AdditionalInfo{Migrated: strconv.FormatBool(hasMigrated)})
 }
@@ -1905,6 +2879,14 @@ func markAsMigrated(parent context.Context, hasMigrated bool) context.Context {
 func (p *csiProvisioner) dataSource(ctx context.Context, claim *v1.PersistentVolumeClaim) (*v1.ObjectReference, error) {
 	var dataSource v1.ObjectReference
 
+	if err := checkDataSourceConflict(claim); err != nil {
+		// Both fields are immutable, retrying cannot help.
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "ContradictoryDataSource", err.Error())
+		return nil, &controller.IgnoredError{
+			Reason: err.Error(),
+		}
+	}
+
 	if claim.Spec.DataSource != nil {
 		dataSource.Kind = claim.Spec.DataSource.Kind
 		dataSource.Name = claim.Spec.DataSource.Name
@@ -1943,9 +2925,53 @@ func (p *csiProvisioner) dataSource(ctx context.Context, claim *v1.PersistentVol
 			return nil, fmt.Errorf("error getting ReferenceGrants in %s namespace from api server: %v", dataSource.Namespace, err)
 		}
 		if allowed, err := IsGranted(ctx, claim, referenceGrants); err != nil || !allowed {
-			return nil, err
+			// Nothing changes until a ReferenceGrant gets created or the
+			// claim gets updated, so don't retry with backoff.
+			p.eventRecorder.Event(claim, v1.EventTypeWarning, "ReferenceGrantMissing", err.Error())
+			return nil, &controller.IgnoredError{
+				Reason: err.Error(),
+			}
 		}
 	}
 
 	return &dataSource, nil
 }
+
+// checkDataSourceConflict returns an error when the claim has both a
+// dataSource and a dataSourceRef and they refer to different objects. The
+// API server sets both to the same object when only one of them is
+// specified, so they normally agree.
+func checkDataSourceConflict(claim *v1.PersistentVolumeClaim) error {
+	dataSource, dataSourceRef := claim.Spec.DataSource, claim.Spec.DataSourceRef
+	if dataSource == nil || dataSourceRef == nil {
+		return nil
+	}
+	refNamespace := claim.Namespace
+	if dataSourceRef.Namespace != nil && *dataSourceRef.Namespace != "" {
+		refNamespace = *dataSourceRef.Namespace
+	}
+	if dataSource.Kind == dataSourceRef.Kind &&
+		dataSource.Name == dataSourceRef.Name &&
+		apiGroup(dataSource.APIGroup) == apiGroup(dataSourceRef.APIGroup) &&
+		refNamespace == claim.Namespace {
+		return nil
+	}
+	return fmt.Errorf("dataSource %s and dataSourceRef %s of the PVC refer to different objects",
+		formatDataSource(dataSource.APIGroup, dataSource.Kind, claim.Namespace, dataSource.Name),
+		formatDataSource(dataSourceRef.APIGroup, dataSourceRef.Kind, refNamespace, dataSourceRef.Name))
+}
+
+func formatDataSource(group *string, kind, namespace, name string) string {
+	if apiGroup(group) != "" {
+		kind = kind + "." + *group
+	}
+	return fmt.Sprintf("%s %s/%s", kind, namespace, name)
+}
+
+// apiGroup returns the API group, empty for the core group.
+func apiGroup(group *string) string {
+	if group == nil {
+		return ""
+	}
+	return *group
+}
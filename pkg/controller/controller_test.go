@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,11 +39,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
 	csitrans "k8s.io/csi-translation-lib"
 	"k8s.io/klog/v2"
@@ -209,6 +212,11 @@ func TestStripPrefixedCSIParams(t *testing.T) {
 			params:         map[string]string{prefixedControllerPublishSecretNameKey: "bar", "bim": "baz"},
 			expectedParams: map[string]string{"bim": "baz"},
 		},
+		{
+			name:           "access mode fstype",
+			params:         map[string]string{prefixedAccessModeFsTypeKey + "ReadWriteMany": "nfs4", "bim": "baz"},
+			expectedParams: map[string]string{"bim": "baz"},
+		},
 		{
 			name:           "prefix in value",
 			params:         map[string]string{"foo": prefixedFsTypeKey, "bim": "baz"},
@@ -296,6 +304,93 @@ func TestStripPrefixedCSIParams(t *testing.T) {
 	}
 }
 
+func TestGetVolumeCapabilitiesAccessModeFSTypes(t *testing.T) {
+	block := v1.PersistentVolumeBlock
+	testcases := map[string]struct {
+		claimAnnotations map[string]string
+		volumeMode       *v1.PersistentVolumeMode
+		parameters       map[string]string
+		honorPVCFSType   bool
+		expectedFSTypes  []string // one entry per access mode, "-" for block
+		expectErr        bool
+	}{
+		"no access mode fstypes": {
+			expectedFSTypes: []string{"ext4", "ext4"},
+		},
+		"fstype for one access mode": {
+			parameters:      map[string]string{prefixedAccessModeFsTypeKey + "ReadWriteMany": "nfs4"},
+			expectedFSTypes: []string{"ext4", "nfs4"},
+		},
+		"fstypes for all access modes": {
+			parameters: map[string]string{
+				prefixedAccessModeFsTypeKey + "ReadWriteOnce": "xfs",
+				prefixedAccessModeFsTypeKey + "ReadWriteMany": "nfs4",
+			},
+			expectedFSTypes: []string{"xfs", "nfs4"},
+		},
+		"block": {
+			parameters:      map[string]string{prefixedAccessModeFsTypeKey + "ReadWriteMany": "nfs4"},
+			volumeMode:      &block,
+			expectedFSTypes: []string{"-", "-"},
+		},
+		"unknown access mode": {
+			parameters: map[string]string{prefixedAccessModeFsTypeKey + "ReadWriteSometimes": "nfs4"},
+			expectErr:  true,
+		},
+		"PVC annotation": {
+			claimAnnotations: map[string]string{annAccessModeFSType + "ReadWriteMany": "nfs4"},
+			honorPVCFSType:   true,
+			expectedFSTypes:  []string{"ext4", "nfs4"},
+		},
+		"PVC annotation not honored": {
+			claimAnnotations: map[string]string{annAccessModeFSType + "ReadWriteMany": "nfs4"},
+			expectedFSTypes:  []string{"ext4", "ext4"},
+		},
+		"StorageClass wins over PVC annotation": {
+			claimAnnotations: map[string]string{annAccessModeFSType + "ReadWriteMany": "nfs4"},
+			parameters:       map[string]string{prefixedAccessModeFsTypeKey + "ReadWriteOnce": "xfs"},
+			honorPVCFSType:   true,
+			expectedFSTypes:  []string{"xfs", "ext4"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			claim := createFakeNamedPVC(100, "fake-pvc", tc.claimAnnotations)
+			claim.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadWriteMany}
+			claim.Spec.VolumeMode = tc.volumeMode
+			sc := &storagev1.StorageClass{Parameters: tc.parameters}
+			p := &csiProvisioner{honorPVCFSType: tc.honorPVCFSType}
+
+			fsTypes, err := p.getAccessModeFSTypes(claim, sc, "")
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			volumeCaps, err := p.getVolumeCapabilities(claim, sc, "ext4", fsTypes)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actualFSTypes []string
+			for _, volumeCap := range volumeCaps {
+				if mount := volumeCap.GetMount(); mount != nil {
+					actualFSTypes = append(actualFSTypes, mount.FsType)
+				} else {
+					actualFSTypes = append(actualFSTypes, "-")
+				}
+			}
+			if !reflect.DeepEqual(actualFSTypes, tc.expectedFSTypes) {
+				t.Errorf("expected fstypes %v, got %v", tc.expectedFSTypes, actualFSTypes)
+			}
+		})
+	}
+}
+
 func TestGetDriverName(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -406,6 +501,44 @@ func TestBytesToQuantity(t *testing.T) {
 	}
 }
 
+func TestIsPopulatorDataSource(t *testing.T) {
+	tests := map[string]struct {
+		dataSource v1.ObjectReference
+		populator  bool
+	}{
+		"snapshot": {
+			dataSource: v1.ObjectReference{Kind: snapshotKind, APIVersion: snapshotAPIGroup, Name: "snap"},
+		},
+		"clone": {
+			dataSource: v1.ObjectReference{Kind: pvcKind, Name: "pvc"},
+		},
+		"populator": {
+			dataSource: v1.ObjectReference{Kind: "MyPopulator", APIVersion: "my.example.io", Name: "pop"},
+			populator:  true,
+		},
+		"populator without API group": {
+			dataSource: v1.ObjectReference{Kind: "MyPopulator", Name: "pop"},
+			populator:  true,
+		},
+		"snapshot kind from other API group": {
+			dataSource: v1.ObjectReference{Kind: snapshotKind, APIVersion: "my.example.io", Name: "pop"},
+			populator:  true,
+		},
+		"PVC kind from other API group": {
+			dataSource: v1.ObjectReference{Kind: pvcKind, APIVersion: "my.example.io", Name: "pop"},
+			populator:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if populator := isPopulatorDataSource(&test.dataSource); populator != test.populator {
+				t.Errorf("expected populator %v, got %v", test.populator, populator)
+			}
+		})
+	}
+}
+
 func TestCreateDriverReturnsInvalidCapacityDuringProvision(t *testing.T) {
 	// Set up mocks
 	var requestedBytes int64 = 100
@@ -544,6 +677,15 @@ func createFakePVCWithVolumeMode(requestBytes int64, volumeMode v1.PersistentVol
 	return claim
 }
 
+// createFakePVCWithFSType returns PVC with the fstype annotation, if not empty
+func createFakePVCWithFSType(requestBytes int64, fsType string) *v1.PersistentVolumeClaim {
+	claim := createFakePVC(requestBytes)
+	if fsType != "" {
+		metav1.SetMetaDataAnnotation(&claim.ObjectMeta, annFSType, fsType)
+	}
+	return claim
+}
+
 // fakeClaim returns a valid PVC with the requested settings
 func fakeClaim(name, namespace, claimUID string, capacity int64, boundToVolume string, phase v1.PersistentVolumeClaimPhase, class *string, mode string) *v1.PersistentVolumeClaim {
 	claim := v1.PersistentVolumeClaim{
@@ -855,6 +997,10 @@ type provisioningFSTypeTestcase struct {
 	expectState       controller.ProvisioningState
 
 	skipDefaultFSType bool
+	honorPVCFSType    bool
+	// expectedMountFSType, if set, is the fstype expected in the
+	// mount capabilities of the CreateVolume request.
+	expectedMountFSType string
 }
 
 type pvSpec struct {
@@ -1045,6 +1191,119 @@ func TestFSTypeProvision(t *testing.T) {
 			},
 			expectState: controller.ProvisioningFinished,
 		},
+		"fstype set in SC wins over PVC annotation": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters: map[string]string{
+						"fstype": "ext3",
+					},
+				},
+				PVName: "test-name",
+				PVC:    createFakePVCWithFSType(requestedBytes, "xfs"),
+			},
+			honorPVCFSType: true,
+			expectedPVSpec: &pvSpec{
+				Name:          "test-testi",
+				ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+				CSIPVS: &v1.CSIPersistentVolumeSource{
+					Driver:       "test-driver",
+					VolumeHandle: "test-volume-id",
+					FSType:       "ext3",
+					VolumeAttributes: map[string]string{
+						"storage.kubernetes.io/csiProvisionerIdentity": "test-provisioner",
+					},
+				},
+			},
+			expectedMountFSType: "ext3",
+			expectState:         controller.ProvisioningFinished,
+		},
+		"fstype from PVC annotation when not set in SC": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+				},
+				PVName: "test-name",
+				PVC:    createFakePVCWithFSType(requestedBytes, "xfs"),
+			},
+			honorPVCFSType: true,
+			expectedPVSpec: &pvSpec{
+				Name:          "test-testi",
+				ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+				CSIPVS: &v1.CSIPersistentVolumeSource{
+					Driver:       "test-driver",
+					VolumeHandle: "test-volume-id",
+					FSType:       "xfs",
+					VolumeAttributes: map[string]string{
+						"storage.kubernetes.io/csiProvisionerIdentity": "test-provisioner",
+					},
+				},
+			},
+			expectedMountFSType: "xfs",
+			expectState:         controller.ProvisioningFinished,
+		},
+		"fstype from PVC annotation ignored when disabled": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+				},
+				PVName: "test-name",
+				PVC:    createFakePVCWithFSType(requestedBytes, "xfs"),
+			},
+			expectedPVSpec: &pvSpec{
+				Name:          "test-testi",
+				ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+				CSIPVS: &v1.CSIPersistentVolumeSource{
+					Driver:       "test-driver",
+					VolumeHandle: "test-volume-id",
+					FSType:       "ext4",
+					VolumeAttributes: map[string]string{
+						"storage.kubernetes.io/csiProvisionerIdentity": "test-provisioner",
+					},
+				},
+			},
+			expectedMountFSType: "ext4",
+			expectState:         controller.ProvisioningFinished,
+		},
+		"fstype neither set in SC nor in PVC annotation": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+				},
+				PVName: "test-name",
+				PVC:    createFakePVCWithFSType(requestedBytes, ""),
+			},
+			honorPVCFSType: true,
+			expectedPVSpec: &pvSpec{
+				Name:          "test-testi",
+				ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+				CSIPVS: &v1.CSIPersistentVolumeSource{
+					Driver:       "test-driver",
+					VolumeHandle: "test-volume-id",
+					FSType:       "ext4",
+					VolumeAttributes: map[string]string{
+						"storage.kubernetes.io/csiProvisionerIdentity": "test-provisioner",
+					},
+				},
+			},
+			expectedMountFSType: "ext4",
+			expectState:         controller.ProvisioningFinished,
+		},
 	}
 
 	for k, tc := range testcases {
@@ -2049,6 +2308,99 @@ func provisionTestcases() (int64, map[string]provisioningTestcase) {
 			expectErr:        true,
 			skipCreateVolume: true,
 		},
+		"provision with populator data source ref": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+					Provisioner:   "test-driver",
+				},
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:         "testid",
+						Annotations: driverNameAnnotation,
+					},
+					Spec: v1.PersistentVolumeClaimSpec{
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceName(v1.ResourceStorage): resource.MustParse(strconv.FormatInt(requestedBytes, 10)),
+							},
+						},
+						AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						DataSourceRef: &v1.TypedObjectReference{
+							Name:     "testPopulator",
+							Kind:     "MyPopulator",
+							APIGroup: &apiGrp,
+						},
+					},
+				},
+			},
+			expectState:      controller.ProvisioningFinished,
+			expectErr:        true,
+			skipCreateVolume: true,
+		},
+		"provision with populator using the PersistentVolumeClaim kind": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+					Provisioner:   "test-driver",
+				},
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:         "testid",
+						Annotations: driverNameAnnotation,
+					},
+					Spec: v1.PersistentVolumeClaimSpec{
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceName(v1.ResourceStorage): resource.MustParse(strconv.FormatInt(requestedBytes, 10)),
+							},
+						},
+						AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						DataSourceRef: &v1.TypedObjectReference{
+							Name:     "testPopulator",
+							Kind:     "PersistentVolumeClaim",
+							APIGroup: &apiGrp,
+						},
+					},
+				},
+			},
+			expectState:      controller.ProvisioningFinished,
+			expectErr:        true,
+			skipCreateVolume: true,
+		},
+		"provision with populator using the VolumeSnapshot kind": {
+			volOpts: controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ReclaimPolicy: &deletePolicy,
+					Parameters:    map[string]string{},
+					Provisioner:   "test-driver",
+				},
+				PVC: &v1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:         "testid",
+						Annotations: driverNameAnnotation,
+					},
+					Spec: v1.PersistentVolumeClaimSpec{
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{
+								v1.ResourceName(v1.ResourceStorage): resource.MustParse(strconv.FormatInt(requestedBytes, 10)),
+							},
+						},
+						AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+						DataSourceRef: &v1.TypedObjectReference{
+							Name:     "testPopulator",
+							Kind:     "VolumeSnapshot",
+							APIGroup: &apiGrp,
+						},
+					},
+				},
+			},
+			expectState:      controller.ProvisioningFinished,
+			expectErr:        true,
+			skipCreateVolume: true,
+		},
 		"distributed, right node selected": {
 			deploymentNode: "foo",
 			volOpts: controller.ProvisionOptions{
@@ -2304,6 +2656,40 @@ func TestShouldProvision(t *testing.T) {
 	}
 }
 
+func TestShouldProvisionStorageClassName(t *testing.T) {
+	empty := ""
+	testcases := map[string]struct {
+		storageClassName *string
+		expectProvision  bool
+	}{
+		"empty": {
+			storageClassName: &empty,
+		},
+		"nil": {
+			expectProvision: true,
+		},
+		"named": {
+			storageClassName: &fakeSCName,
+			expectProvision:  true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+
+			claim := createFakePVC(100)
+			claim.Spec.StorageClassName = tc.storageClassName
+			provision := csiProvisioner.(controller.Qualifier).ShouldProvision(context.Background(), claim)
+			if provision != tc.expectProvision {
+				t.Errorf("expected ShouldProvision result %v, got %v", tc.expectProvision, provision)
+			}
+		})
+	}
+}
+
 // newSnapshot returns a new snapshot object
 func newSnapshot(name, namespace, className, boundToContent, snapshotUID, claimName string, ready bool, err *crdv1.VolumeSnapshotError, creationTime *metav1.Time, size *resource.Quantity) *crdv1.VolumeSnapshot {
 	snapshot := crdv1.VolumeSnapshot{
@@ -2352,7 +2738,8 @@ func runFSTypeProvisionTest(t *testing.T, k string, tc provisioningFSTypeTestcas
 		myDefaultfsType = ""
 	}
 	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5, csiConn.conn,
-		nil, provisionDriverName, pluginCaps, controllerCaps, supportsMigrationFromInTreePluginName, false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, myDefaultfsType, nil, false, false)
+		nil, provisionDriverName, pluginCaps, controllerCaps, supportsMigrationFromInTreePluginName, false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, myDefaultfsType, nil, false, false,
+		HonorPVCFSType(tc.honorPVCFSType))
 	out := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			CapacityBytes: requestedBytes,
@@ -2362,8 +2749,17 @@ func runFSTypeProvisionTest(t *testing.T, k string, tc provisioningFSTypeTestcas
 
 	// Setup regular mock call expectations.
 	if !tc.expectErr {
-		controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(out, tc.createVolumeError).Times(1)
-	}
+		controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+			if tc.expectedMountFSType == "" {
+				return
+			}
+			for _, volumeCap := range req.VolumeCapabilities {
+				if fsType := volumeCap.GetMount().GetFsType(); fsType != tc.expectedMountFSType {
+					t.Errorf("test %q: expected mount fstype %q, got %q", k, tc.expectedMountFSType, fsType)
+				}
+			}
+		}).Return(out, tc.createVolumeError).Times(1)
+	}
 
 	pv, state, err := csiProvisioner.Provision(context.Background(), tc.volOpts)
 	if tc.expectErr && err == nil {
@@ -2393,8 +2789,13 @@ func runFSTypeProvisionTest(t *testing.T, k string, tc provisioningFSTypeTestcas
 			t.Errorf("test %q: expected access modes: %v, got: %v", k, tc.expectedPVSpec.AccessModes, pv.Spec.AccessModes)
 		}
 
-		if !reflect.DeepEqual(pv.Spec.VolumeMode, tc.expectedPVSpec.VolumeMode) {
-			t.Errorf("test %q: expected volumeMode: %v, got: %v", k, tc.expectedPVSpec.VolumeMode, pv.Spec.VolumeMode)
+		// PVs always get a volume mode, Filesystem for PVCs without one.
+		expectedVolumeMode := tc.expectedPVSpec.VolumeMode
+		if expectedVolumeMode == nil {
+			expectedVolumeMode = &volumeModeFileSystem
+		}
+		if !reflect.DeepEqual(pv.Spec.VolumeMode, expectedVolumeMode) {
+			t.Errorf("test %q: expected volumeMode: %v, got: %v", k, *expectedVolumeMode, pv.Spec.VolumeMode)
 		}
 
 		if !reflect.DeepEqual(pv.Spec.Capacity, tc.expectedPVSpec.Capacity) {
@@ -2568,8 +2969,15 @@ func runProvisionTest(t *testing.T, tc provisioningTestcase, requestedBytes int6
 				t.Errorf("expected PV name: %q, got: %q", tc.expectedPVSpec.Name, pv.Name)
 			}
 
-			if tc.expectedPVSpec.Annotations != nil && !reflect.DeepEqual(pv.Annotations, tc.expectedPVSpec.Annotations) {
-				t.Errorf("expected PV annotations: %v, got: %v", tc.expectedPVSpec.Annotations, pv.Annotations)
+			// The storage class annotations are covered by TestProvisionStorageClassAnnotations.
+			annotations := make(map[string]string, len(pv.Annotations))
+			for key, value := range pv.Annotations {
+				if key != annStorageClassResourceVersion && key != annStorageClassParametersHash {
+					annotations[key] = value
+				}
+			}
+			if tc.expectedPVSpec.Annotations != nil && !reflect.DeepEqual(annotations, tc.expectedPVSpec.Annotations) {
+				t.Errorf("expected PV annotations: %v, got: %v", tc.expectedPVSpec.Annotations, annotations)
 			}
 
 			if pv.Spec.PersistentVolumeReclaimPolicy != tc.expectedPVSpec.ReclaimPolicy {
@@ -2580,8 +2988,13 @@ func runProvisionTest(t *testing.T, tc provisioningTestcase, requestedBytes int6
 				t.Errorf("expected access modes: %v, got: %v", tc.expectedPVSpec.AccessModes, pv.Spec.AccessModes)
 			}
 
-			if !reflect.DeepEqual(pv.Spec.VolumeMode, tc.expectedPVSpec.VolumeMode) {
-				t.Errorf("expected volumeMode: %v, got: %v", tc.expectedPVSpec.VolumeMode, pv.Spec.VolumeMode)
+			// PVs always get a volume mode, Filesystem for PVCs without one.
+			expectedVolumeMode := tc.expectedPVSpec.VolumeMode
+			if expectedVolumeMode == nil {
+				expectedVolumeMode = &volumeModeFileSystem
+			}
+			if !reflect.DeepEqual(pv.Spec.VolumeMode, expectedVolumeMode) {
+				t.Errorf("expected volumeMode: %v, got: %v", *expectedVolumeMode, pv.Spec.VolumeMode)
 			}
 
 			if !reflect.DeepEqual(pv.Spec.Capacity, tc.expectedPVSpec.Capacity) {
@@ -4387,6 +4800,223 @@ func TestProvisionFromSnapshot(t *testing.T) {
 	}
 }
 
+// TestDataSourceReferenceGrant checks that a cross-namespace data source
+// is only accepted with a matching ReferenceGrant and that a missing grant
+// is reported once as event instead of being retried.
+func TestDataSourceReferenceGrant(t *testing.T) {
+	const (
+		snapNamespace = "ns1"
+		pvcNamespace  = "ns2"
+	)
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.CrossNamespaceVolumeDataSource, true)()
+
+	apiGrp := snapshotAPIGroup
+	namespace := snapNamespace
+	from := []gatewayv1beta1.ReferenceGrantFrom{
+		{
+			Group:     gatewayv1beta1.Group(""),
+			Kind:      gatewayv1beta1.Kind(pvcKind),
+			Namespace: gatewayv1beta1.Namespace(pvcNamespace),
+		},
+	}
+	testcases := map[string]struct {
+		grant       *gatewayv1beta1.ReferenceGrant
+		expectEvent bool
+	}{
+		"granted": {
+			grant: generateReferenceGrant(snapNamespace, from, []gatewayv1beta1.ReferenceGrantTo{
+				{
+					Group: gatewayv1beta1.Group(snapshotAPIGroup),
+					Kind:  gatewayv1beta1.Kind(snapshotKind),
+					Name:  ObjectNamePtr("snap"),
+				},
+			}),
+		},
+		"no grant": {
+			expectEvent: true,
+		},
+		"grant for other snapshot": {
+			grant: generateReferenceGrant(snapNamespace, from, []gatewayv1beta1.ReferenceGrantTo{
+				{
+					Group: gatewayv1beta1.Group(snapshotAPIGroup),
+					Kind:  gatewayv1beta1.Kind(snapshotKind),
+					Name:  ObjectNamePtr("other-snap"),
+				},
+			}),
+			expectEvent: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			referenceGrants := gatewayInformers.NewSharedInformerFactory(fakegateway.NewSimpleClientset(), ResyncPeriodOfReferenceGrantInformer).Gateway().V1beta1().ReferenceGrants()
+			if tc.grant != nil {
+				if err := referenceGrants.Informer().GetIndexer().Add(tc.grant); err != nil {
+					t.Fatal(err)
+				}
+			}
+			recorder := record.NewFakeRecorder(1)
+			p := &csiProvisioner{
+				referenceGrantLister: referenceGrants.Lister(),
+				eventRecorder:        recorder,
+			}
+			claim := generatePVCForFromXnsdataSource(pvcNamespace, &v1.TypedObjectReference{
+				APIGroup:  &apiGrp,
+				Kind:      snapshotKind,
+				Name:      "snap",
+				Namespace: &namespace,
+			}, 100)
+
+			dataSource, err := p.dataSource(context.Background(), claim)
+			if !tc.expectEvent {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if dataSource == nil || dataSource.Namespace != snapNamespace {
+					t.Fatalf("expected data source in namespace %s, got %+v", snapNamespace, dataSource)
+				}
+				if len(recorder.Events) != 0 {
+					t.Errorf("unexpected event: %s", <-recorder.Events)
+				}
+				return
+			}
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			if len(recorder.Events) != 1 {
+				t.Fatalf("expected one event, got %d", len(recorder.Events))
+			}
+			if event := <-recorder.Events; !strings.HasPrefix(event, "Warning ReferenceGrantMissing") {
+				t.Errorf("unexpected event: %s", event)
+			}
+		})
+	}
+}
+
+// TestProvisionFromSnapshotNotReady checks that provisioning waits for a
+// snapshot which is still being created and gives up when the snapshot fails.
+func TestProvisionFromSnapshotNotReady(t *testing.T) {
+	const (
+		requestedBytes = 1000
+		snapName       = "test-snapshot"
+		snapClassName  = "test-snapclass"
+	)
+	apiGrp := "snapshot.storage.k8s.io"
+	failure := "fake snapshot failure"
+
+	type snapshotState struct {
+		ready bool
+		err   *crdv1.VolumeSnapshotError
+	}
+	testcases := map[string]struct {
+		states         []snapshotState
+		expectStates   []controller.ProvisioningState
+		expectCreate   bool
+		expectedEvents []string
+	}{
+		"pending then ready": {
+			states: []snapshotState{{}, {}, {ready: true}},
+			expectStates: []controller.ProvisioningState{
+				controller.ProvisioningNoChange,
+				controller.ProvisioningNoChange,
+				controller.ProvisioningFinished,
+			},
+			expectCreate:   true,
+			expectedEvents: []string{"Normal WaitingForSnapshot", "Normal WaitingForSnapshot"},
+		},
+		"pending then error": {
+			states: []snapshotState{{}, {err: &crdv1.VolumeSnapshotError{Message: &failure}}},
+			expectStates: []controller.ProvisioningState{
+				controller.ProvisioningNoChange,
+				controller.ProvisioningFinished,
+			},
+			expectedEvents: []string{"Normal WaitingForSnapshot"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			var state snapshotState
+			client := &fake.Clientset{}
+			client.AddReactor("get", "volumesnapshots", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				return true, newSnapshot(snapName, "default", snapClassName, "snapcontent-snapuid", "snapuid", "claim", state.ready, state.err, nil, resource.NewQuantity(requestedBytes, resource.BinarySI)), nil
+			})
+			client.AddReactor("get", "volumesnapshotcontents", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				size := int64(requestedBytes)
+				return true, newContent("snapcontent-snapuid", "default", snapClassName, "sid", "pv-uid", "volume", "snapuid", snapName, &size, nil), nil
+			})
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionFromSnapshotCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5, csiConn.conn,
+				client, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+			if tc.expectCreate {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+					Volume: &csi.Volume{
+						CapacityBytes: requestedBytes,
+						VolumeId:      "test-volume-id",
+						ContentSource: &csi.VolumeContentSource{
+							Type: &csi.VolumeContentSource_Snapshot{
+								Snapshot: &csi.VolumeContentSource_SnapshotSource{
+									SnapshotId: "sid",
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+			}
+
+			claim := createFakePVC(requestedBytes)
+			claim.Spec.DataSource = &v1.TypedLocalObjectReference{
+				Name:     snapName,
+				Kind:     "VolumeSnapshot",
+				APIGroup: &apiGrp,
+			}
+			for i := range tc.states {
+				state = tc.states[i]
+				_, provisioningState, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{
+						Parameters:  map[string]string{},
+						Provisioner: "test-driver",
+					},
+					PVC: claim,
+				})
+				last := i == len(tc.states)-1
+				if last && tc.expectCreate {
+					if err != nil {
+						t.Errorf("attempt #%d: unexpected error: %v", i, err)
+					}
+				} else if err == nil {
+					t.Errorf("attempt #%d: expected error, got none", i)
+				}
+				if provisioningState != tc.expectStates[i] {
+					t.Errorf("attempt #%d: expected ProvisioningState %s, got %s", i, tc.expectStates[i], provisioningState)
+				}
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				fields := strings.SplitN(event, " ", 3)
+				events = append(events, fields[0]+" "+fields[1])
+			}
+			if !reflect.DeepEqual(events, tc.expectedEvents) {
+				t.Errorf("expected events %v, got %v", tc.expectedEvents, events)
+			}
+		})
+	}
+}
+
 // TestProvisionWithTopology is a basic test of provisioner integration with topology functions.
 func TestProvisionWithTopologyEnabled(t *testing.T) {
 	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
@@ -4394,11 +5024,12 @@ func TestProvisionWithTopologyEnabled(t *testing.T) {
 	const requestBytes = 100
 
 	testcases := map[string]struct {
-		driverSupportsTopology bool
-		nodeLabels             []map[string]string
-		topologyKeys           []map[string][]string
-		expectedNodeAffinity   *v1.VolumeNodeAffinity
-		expectError            bool
+		driverSupportsTopology  bool
+		nodeLabels              []map[string]string
+		topologyKeys            []map[string][]string
+		wellKnownTopologyLabels map[string]string
+		expectedNodeAffinity    *v1.VolumeNodeAffinity
+		expectError             bool
 	}{
 		"topology success": {
 			driverSupportsTopology: true,
@@ -4431,6 +5062,46 @@ func TestProvisionWithTopologyEnabled(t *testing.T) {
 				},
 			},
 		},
+		"topology with well-known labels": {
+			driverSupportsTopology: true,
+			nodeLabels: []map[string]string{
+				{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack1"},
+				{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack2"},
+			},
+			topologyKeys: []map[string][]string{
+				{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
+				{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
+			},
+			wellKnownTopologyLabels: map[string]string{
+				"com.example.csi/zone":   v1.LabelTopologyZone,
+				"com.example.csi/region": v1.LabelTopologyRegion,
+			},
+			expectedNodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      "com.example.csi/zone",
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{"zone1"},
+								},
+								{
+									Key:      "com.example.csi/rack",
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{"rack2"},
+								},
+								{
+									Key:      v1.LabelTopologyZone,
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{"zone1"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		"topology fail": {
 			driverSupportsTopology: true,
 			topologyKeys: []map[string][]string{
@@ -4497,7 +5168,8 @@ func TestProvisionWithTopologyEnabled(t *testing.T) {
 			defer close(stopChan)
 
 			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
-				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false)
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+				WellKnownTopologyLabels(tc.wellKnownTopologyLabels))
 
 			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
 				StorageClass: &storagev1.StorageClass{},
@@ -4524,86 +5196,663 @@ func TestProvisionWithTopologyEnabled(t *testing.T) {
 	}
 }
 
-// TestProvisionErrorHandling checks how different errors are handled by the provisioner.
-func TestProvisionErrorHandling(t *testing.T) {
+// TestProvisionTopologySpread checks that the csi.storage.k8s.io/topology-spread
+// parameter results in distinct requisite topology segments.
+func TestProvisionFSBlockSize(t *testing.T) {
 	const requestBytes = 100
+	block := v1.PersistentVolumeBlock
 
-	testcases := map[codes.Code]controller.ProvisioningState{
-		codes.Canceled:         controller.ProvisioningInBackground,
-		codes.DeadlineExceeded: controller.ProvisioningInBackground,
-		codes.Unavailable:      controller.ProvisioningInBackground,
-		codes.Aborted:          controller.ProvisioningInBackground,
-
-		codes.ResourceExhausted:  controller.ProvisioningFinished,
-		codes.Unknown:            controller.ProvisioningFinished,
-		codes.InvalidArgument:    controller.ProvisioningFinished,
-		codes.NotFound:           controller.ProvisioningFinished,
-		codes.AlreadyExists:      controller.ProvisioningFinished,
-		codes.PermissionDenied:   controller.ProvisioningFinished,
-		codes.FailedPrecondition: controller.ProvisioningFinished,
-		codes.OutOfRange:         controller.ProvisioningFinished,
-		codes.Unimplemented:      controller.ProvisioningFinished,
-		codes.Internal:           controller.ProvisioningFinished,
-		codes.DataLoss:           controller.ProvisioningFinished,
-		codes.Unauthenticated:    controller.ProvisioningFinished,
-	}
-	nodeLabels := []map[string]string{
-		{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack1"},
-		{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack2"},
-	}
-	topologyKeys := []map[string][]string{
-		{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
-		{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
+	testcases := map[string]struct {
+		blockSize         string
+		volumeMode        *v1.PersistentVolumeMode
+		expectedParameter string
+		expectError       bool
+	}{
+		"valid": {
+			blockSize:         "4096",
+			expectedParameter: "4096",
+		},
+		"minimum": {
+			blockSize:         "512",
+			expectedParameter: "512",
+		},
+		"maximum": {
+			blockSize:         "65536",
+			expectedParameter: "65536",
+		},
+		"not a power of two": {
+			blockSize:   "3000",
+			expectError: true,
+		},
+		"too small": {
+			blockSize:   "256",
+			expectError: true,
+		},
+		"too large": {
+			blockSize:   "131072",
+			expectError: true,
+		},
+		"not a number": {
+			blockSize:   "4k",
+			expectError: true,
+		},
+		"ignored for block volumes": {
+			blockSize:  "3000",
+			volumeMode: &block,
+		},
 	}
 
-	test := func(driverSupportsTopology, nodeSelected bool) {
-		t.Run(fmt.Sprintf("topology=%v node=%v", driverSupportsTopology, nodeSelected), func(t *testing.T) {
-			for code, expectedState := range testcases {
-				t.Run(code.String(), func(t *testing.T) {
-					var (
-						pluginCaps     rpc.PluginCapabilitySet
-						controllerCaps rpc.ControllerCapabilitySet
-					)
-					if driverSupportsTopology {
-						defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
-						pluginCaps, controllerCaps = provisionWithTopologyCapabilities()
-					} else {
-						pluginCaps, controllerCaps = provisionCapabilities()
-					}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
 
-					tmpdir := tempDir(t)
-					defer os.RemoveAll(tmpdir)
-					mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
-					if err != nil {
-						t.Fatal(err)
-					}
-					defer mockController.Finish()
-					defer driver.Stop()
+			if !tc.expectError {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if value := req.Parameters[fsBlockSizeKey]; value != tc.expectedParameter {
+							t.Errorf("expected %s parameter %q, got %q", fsBlockSizeKey, tc.expectedParameter, value)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
 
-					// Always return some error.
-					errOut := status.Error(code, "fake error")
-					controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(nil, errOut).Times(1)
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
 
-					nodes := buildNodes(nodeLabels)
-					csiNodes := buildCSINodes(topologyKeys)
-					clientSet := fakeclientset.NewSimpleClientset(nodes, csiNodes)
-					scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
-					defer close(stopChan)
+			claim := createFakePVC(requestBytes)
+			claim.Spec.VolumeMode = tc.volumeMode
+			_, _, err = csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "fast"},
+					Parameters: map[string]string{prefixedFSBlockSizeKey: tc.blockSize},
+				},
+				PVC: claim,
+			})
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectError {
+				if _, ok := err.(*controller.IgnoredError); !ok {
+					t.Errorf("expected IgnoredError, got %T: %v", err, err)
+				}
+				if !strings.Contains(event, "InvalidFSBlockSize") {
+					t.Errorf("expected InvalidFSBlockSize event, got %q", event)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if event != "" {
+					t.Errorf("expected no event, got %q", event)
+				}
+			}
+		})
+	}
+}
 
-					csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
-						csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false)
+func TestProvisionFormatOwner(t *testing.T) {
+	const requestBytes = 100
+	block := v1.PersistentVolumeBlock
 
-					options := controller.ProvisionOptions{
-						StorageClass: &storagev1.StorageClass{},
-						PVC:          createFakePVC(requestBytes),
-					}
-					if nodeSelected {
-						options.SelectedNode = &nodes.Items[0]
-					}
-					pv, state, err := csiProvisioner.Provision(context.Background(), options)
+	testcases := map[string]struct {
+		parameters        map[string]string
+		volumeMode        *v1.PersistentVolumeMode
+		expectedParameter string
+		expectError       bool
+	}{
+		"not set": {},
+		"node": {
+			parameters:        map[string]string{prefixedFormatOwnerKey: "node"},
+			expectedParameter: "node",
+		},
+		"controller": {
+			parameters:        map[string]string{prefixedFormatOwnerKey: "controller"},
+			expectedParameter: "controller",
+		},
+		"unknown": {
+			parameters:  map[string]string{prefixedFormatOwnerKey: "kubelet"},
+			expectError: true,
+		},
+		"wrong case": {
+			parameters:  map[string]string{prefixedFormatOwnerKey: "Controller"},
+			expectError: true,
+		},
+		"empty": {
+			parameters:  map[string]string{prefixedFormatOwnerKey: ""},
+			expectError: true,
+		},
+		"ignored for block volumes": {
+			parameters: map[string]string{prefixedFormatOwnerKey: "kubelet"},
+			volumeMode: &block,
+		},
+	}
 
-					if pv != nil {
-						t.Errorf("expected no PV, got %v", pv)
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			if !tc.expectError {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						value, ok := req.Parameters[formatOwnerKey]
+						if tc.expectedParameter == "" && ok {
+							t.Errorf("expected no %s parameter, got %q", formatOwnerKey, value)
+						}
+						if value != tc.expectedParameter {
+							t.Errorf("expected %s parameter %q, got %q", formatOwnerKey, tc.expectedParameter, value)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+
+			claim := createFakePVC(requestBytes)
+			claim.Spec.VolumeMode = tc.volumeMode
+			_, _, err = csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "fast"},
+					Parameters: tc.parameters,
+				},
+				PVC: claim,
+			})
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectError {
+				if _, ok := err.(*controller.IgnoredError); !ok {
+					t.Errorf("expected IgnoredError, got %T: %v", err, err)
+				}
+				if !strings.Contains(event, "InvalidFormatOwner") {
+					t.Errorf("expected InvalidFormatOwner event, got %q", event)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if event != "" {
+					t.Errorf("expected no event, got %q", event)
+				}
+			}
+		})
+	}
+}
+
+// TestProvisionDefaultSize checks that the csi.storage.k8s.io/default-size
+// parameter is used for PVCs which request no storage.
+func TestProvisionDefaultSize(t *testing.T) {
+	const (
+		requestBytes = 100
+		defaultBytes = 1024 * 1024 * 1024
+	)
+
+	testcases := map[string]struct {
+		defaultSize   string
+		requestBytes  int64
+		noRequest     bool
+		expectedBytes int64
+		expectError   bool
+	}{
+		"zero request with default": {
+			defaultSize:   "1Gi",
+			expectedBytes: defaultBytes,
+		},
+		"no request with default": {
+			defaultSize:   "1Gi",
+			noRequest:     true,
+			expectedBytes: defaultBytes,
+		},
+		"zero request without default": {
+			expectedBytes: 0,
+		},
+		"request with default": {
+			defaultSize:   "1Gi",
+			requestBytes:  requestBytes,
+			expectedBytes: requestBytes,
+		},
+		"invalid default": {
+			defaultSize: "-1Gi",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			if !tc.expectError {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if required := req.GetCapacityRange().GetRequiredBytes(); required != tc.expectedBytes {
+							t.Errorf("expected %d required bytes, got %d", tc.expectedBytes, required)
+						}
+						if _, ok := req.Parameters[prefixedDefaultSizeKey]; ok {
+							t.Errorf("%s was passed to the driver", prefixedDefaultSizeKey)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								// Unknown capacity, the PV gets the requested size.
+								CapacityBytes: 0,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+
+			claim := createFakePVC(tc.requestBytes)
+			if tc.noRequest {
+				claim.Spec.Resources.Requests = nil
+			}
+			parameters := map[string]string{}
+			if tc.defaultSize != "" {
+				parameters[prefixedDefaultSizeKey] = tc.defaultSize
+			}
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "fast"},
+					Parameters: parameters,
+				},
+				PVName: "test-testi",
+				PVC:    claim,
+			})
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != tc.expectedBytes {
+				t.Errorf("expected PV capacity of %d bytes, got %s", tc.expectedBytes, capacity.String())
+			}
+		})
+	}
+}
+
+// TestProvisionMinimumSize checks that the csi.storage.k8s.io/minimum-size
+// parameter rounds up smaller requests.
+func TestProvisionMinimumSize(t *testing.T) {
+	const minimumBytes = 1024 * 1024 * 1024
+
+	testcases := map[string]struct {
+		minimumSize   string
+		requestBytes  int64
+		expectedBytes int64
+		expectEvent   bool
+		expectError   bool
+	}{
+		"below minimum": {
+			minimumSize:   "1Gi",
+			requestBytes:  100,
+			expectedBytes: minimumBytes,
+			expectEvent:   true,
+		},
+		"at minimum": {
+			minimumSize:   "1Gi",
+			requestBytes:  minimumBytes,
+			expectedBytes: minimumBytes,
+		},
+		"above minimum": {
+			minimumSize:   "1Gi",
+			requestBytes:  2 * minimumBytes,
+			expectedBytes: 2 * minimumBytes,
+		},
+		"without minimum": {
+			requestBytes:  100,
+			expectedBytes: 100,
+		},
+		"invalid minimum": {
+			minimumSize:  "0",
+			requestBytes: 100,
+			expectError:  true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			if !tc.expectError {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if required := req.GetCapacityRange().GetRequiredBytes(); required != tc.expectedBytes {
+							t.Errorf("expected %d required bytes, got %d", tc.expectedBytes, required)
+						}
+						if _, ok := req.Parameters[prefixedMinimumSizeKey]; ok {
+							t.Errorf("%s was passed to the driver", prefixedMinimumSizeKey)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+
+			parameters := map[string]string{}
+			if tc.minimumSize != "" {
+				parameters[prefixedMinimumSizeKey] = tc.minimumSize
+			}
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "fast"},
+					Parameters: parameters,
+				},
+				PVName: "test-testi",
+				PVC:    createFakePVC(tc.requestBytes),
+			})
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != tc.expectedBytes {
+				t.Errorf("expected PV capacity of %d bytes, got %s", tc.expectedBytes, capacity.String())
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !tc.expectEvent {
+					t.Errorf("unexpected event: %s", event)
+				} else if !strings.HasPrefix(event, v1.EventTypeNormal+" VolumeSizeIncreased") {
+					t.Errorf("unexpected event: %s", event)
+				}
+			default:
+				if tc.expectEvent {
+					t.Error("expected VolumeSizeIncreased event, got none")
+				}
+			}
+		})
+	}
+}
+
+func TestProvisionTopologySpread(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		parameters        map[string]string
+		expectedRequisite int
+		expectedState     controller.ProvisioningState
+		expectEvent       bool
+	}{
+		"no spread": {
+			parameters:        map[string]string{},
+			expectedRequisite: 3,
+			expectedState:     controller.ProvisioningFinished,
+		},
+		"distinct segments": {
+			parameters:        map[string]string{prefixedTopologySpread: "3"},
+			expectedRequisite: 3,
+			expectedState:     controller.ProvisioningFinished,
+		},
+		"distinct zones": {
+			parameters: map[string]string{
+				prefixedTopologySpread:    "2",
+				prefixedTopologySpreadKey: "com.example.csi/zone",
+			},
+			expectedRequisite: 2,
+			expectedState:     controller.ProvisioningFinished,
+		},
+		"not enough zones": {
+			parameters: map[string]string{
+				prefixedTopologySpread:    "3",
+				prefixedTopologySpreadKey: "com.example.csi/zone",
+			},
+			expectedState: controller.ProvisioningFinished,
+			expectEvent:   true,
+		},
+		"not enough segments": {
+			parameters:    map[string]string{prefixedTopologySpread: "4"},
+			expectedState: controller.ProvisioningFinished,
+			expectEvent:   true,
+		},
+		"invalid spread": {
+			parameters:    map[string]string{prefixedTopologySpread: "0"},
+			expectedState: controller.ProvisioningFinished,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			if tc.expectedRequisite > 0 {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						requisite := req.GetAccessibilityRequirements().GetRequisite()
+						if len(requisite) != tc.expectedRequisite {
+							t.Errorf("expected %d requisite topologies, got %v", tc.expectedRequisite, requisite)
+						}
+						if key := tc.parameters[prefixedTopologySpreadKey]; key != "" {
+							values := sets.NewString()
+							for _, topology := range requisite {
+								values.Insert(topology.Segments[key])
+							}
+							if values.Len() != len(requisite) {
+								t.Errorf("expected distinct values for %s, got %v", key, requisite)
+							}
+						}
+						if _, ok := req.Parameters[prefixedTopologySpread]; ok {
+							t.Errorf("%s was passed to the driver", prefixedTopologySpread)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes:      requestBytes,
+								VolumeId:           "test-volume-id",
+								AccessibleTopology: requisite,
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			nodes := buildNodes([]map[string]string{
+				{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack1"},
+				{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack2"},
+				{"com.example.csi/zone": "zone2", "com.example.csi/rack": "rack1"},
+			})
+			topologyKeys := []string{"com.example.csi/zone", "com.example.csi/rack"}
+			csiNodes := buildCSINodes([]map[string][]string{
+				{driverName: topologyKeys},
+				{driverName: topologyKeys},
+				{driverName: topologyKeys},
+			})
+			clientSet := fakeclientset.NewSimpleClientset(nodes, csiNodes)
+			scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+			defer close(stopChan)
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+
+			pv, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: tc.parameters},
+				PVC:          createFakePVC(requestBytes),
+			})
+			if tc.expectedRequisite > 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(pv.Spec.NodeAffinity.Required.NodeSelectorTerms) != tc.expectedRequisite {
+					t.Errorf("expected %d node selector terms, got %+v", tc.expectedRequisite, pv.Spec.NodeAffinity)
+				}
+			} else if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if state != tc.expectedState {
+				t.Errorf("expected ProvisioningState %s, got %s", tc.expectedState, state)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectEvent != strings.Contains(event, "InsufficientTopologySpread") {
+				t.Errorf("expected InsufficientTopologySpread event %v, got %q", tc.expectEvent, event)
+			}
+		})
+	}
+}
+
+// TestProvisionErrorHandling checks how different errors are handled by the provisioner.
+func TestProvisionErrorHandling(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[codes.Code]controller.ProvisioningState{
+		codes.Canceled:         controller.ProvisioningInBackground,
+		codes.DeadlineExceeded: controller.ProvisioningInBackground,
+		codes.Unavailable:      controller.ProvisioningInBackground,
+		codes.Aborted:          controller.ProvisioningInBackground,
+
+		codes.ResourceExhausted:  controller.ProvisioningFinished,
+		codes.Unknown:            controller.ProvisioningFinished,
+		codes.InvalidArgument:    controller.ProvisioningFinished,
+		codes.NotFound:           controller.ProvisioningFinished,
+		codes.AlreadyExists:      controller.ProvisioningFinished,
+		codes.PermissionDenied:   controller.ProvisioningFinished,
+		codes.FailedPrecondition: controller.ProvisioningFinished,
+		codes.OutOfRange:         controller.ProvisioningFinished,
+		codes.Unimplemented:      controller.ProvisioningFinished,
+		codes.Internal:           controller.ProvisioningFinished,
+		codes.DataLoss:           controller.ProvisioningFinished,
+		codes.Unauthenticated:    controller.ProvisioningFinished,
+	}
+	nodeLabels := []map[string]string{
+		{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack1"},
+		{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rack2"},
+	}
+	topologyKeys := []map[string][]string{
+		{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
+		{driverName: []string{"com.example.csi/zone", "com.example.csi/rack"}},
+	}
+
+	test := func(driverSupportsTopology, nodeSelected bool) {
+		t.Run(fmt.Sprintf("topology=%v node=%v", driverSupportsTopology, nodeSelected), func(t *testing.T) {
+			for code, expectedState := range testcases {
+				t.Run(code.String(), func(t *testing.T) {
+					var (
+						pluginCaps     rpc.PluginCapabilitySet
+						controllerCaps rpc.ControllerCapabilitySet
+					)
+					if driverSupportsTopology {
+						defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+						pluginCaps, controllerCaps = provisionWithTopologyCapabilities()
+					} else {
+						pluginCaps, controllerCaps = provisionCapabilities()
+					}
+
+					tmpdir := tempDir(t)
+					defer os.RemoveAll(tmpdir)
+					mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer mockController.Finish()
+					defer driver.Stop()
+
+					// Always return some error.
+					errOut := status.Error(code, "fake error")
+					controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(nil, errOut).Times(1)
+
+					nodes := buildNodes(nodeLabels)
+					csiNodes := buildCSINodes(topologyKeys)
+					clientSet := fakeclientset.NewSimpleClientset(nodes, csiNodes)
+					scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+					defer close(stopChan)
+
+					csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+						csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false)
+
+					options := controller.ProvisionOptions{
+						StorageClass: &storagev1.StorageClass{},
+						PVC:          createFakePVC(requestBytes),
+					}
+					if nodeSelected {
+						options.SelectedNode = &nodes.Items[0]
+					}
+					pv, state, err := csiProvisioner.Provision(context.Background(), options)
+
+					if pv != nil {
+						t.Errorf("expected no PV, got %v", pv)
 					}
 					if err == nil {
 						t.Fatal("expected error, got nil")
@@ -4615,90 +5864,952 @@ func TestProvisionErrorHandling(t *testing.T) {
 						t.Errorf("expected status %s, got %s", code, st.Code())
 					}
 
-					// This is the only situation where we request rescheduling.
-					if driverSupportsTopology && nodeSelected && code == codes.ResourceExhausted {
-						expectedState = controller.ProvisioningReschedule
-					}
+					// This is the only situation where we request rescheduling.
+					if driverSupportsTopology && nodeSelected && code == codes.ResourceExhausted {
+						expectedState = controller.ProvisioningReschedule
+					}
+
+					if expectedState != state {
+						t.Errorf("expected provisioning state %s, got %s", expectedState, state)
+					}
+				})
+			}
+		})
+	}
+
+	// Try all four combinations. For most of them there's no
+	// difference, but better check...
+	test(false, false)
+	test(false, true)
+	test(true, false)
+	test(true, true)
+}
+
+// TestProvisionWithTopologyDisabled checks that missing Node and CSINode objects, selectedNode
+// are ignored and topology is not set on the PV
+func TestProvisionWithTopologyDisabled(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, false)()
+
+	accessibleTopology := []*csi.Topology{
+		{
+			Segments: map[string]string{
+				"com.example.csi/zone": "zone1",
+				"com.example.csi/rack": "rack2",
+			},
+		},
+	}
+
+	const requestBytes = 100
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+
+	out := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes:      requestBytes,
+			VolumeId:           "test-volume-id",
+			AccessibleTopology: accessibleTopology,
+		},
+	}
+
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+
+	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          createFakePVC(requestBytes),
+		SelectedNode: &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "some-node",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error from Provision call: %v", err)
+	}
+
+	if pv.Spec.NodeAffinity != nil {
+		t.Errorf("expected nil PV node affinity; got: %v", pv.Spec.NodeAffinity)
+	}
+}
+
+type expectedSecret struct {
+	exist   bool
+	secrets map[string]string
+}
+
+// TestProvisionVolumeNameConflict checks that CreateVolume is retried with a
+// different volume name after an AlreadyExists error only if enabled.
+func TestProvisionVolumeNameConflict(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		retryOnVolumeNameConflict bool
+		expectErr                 bool
+	}{
+		"retry disabled": {
+			expectErr: true,
+		},
+		"retry enabled": {
+			retryOnVolumeNameConflict: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			clientSet := fakeclientset.NewSimpleClientset()
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				RetryOnVolumeNameConflict(tc.retryOnVolumeNameConflict))
+
+			pvc := createFakePVC(requestBytes)
+			pvName := "test-testi"
+			var retriedName string
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+				if req.Name != pvName {
+					t.Errorf("expected first CreateVolume with name %q, got %q", pvName, req.Name)
+				}
+			}).Return(nil, status.Error(codes.AlreadyExists, "volume exists with different parameters")).Times(1)
+			if tc.retryOnVolumeNameConflict {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+					retriedName = req.Name
+				}).Return(&csi.CreateVolumeResponse{
+					Volume: &csi.Volume{
+						CapacityBytes: requestBytes,
+						VolumeId:      "test-volume-id",
+					},
+				}, nil).Times(1)
+			}
+
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVC:          pvc,
+			})
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if expectedName := pvName + "-" + volumeNameConflictSuffix(pvc); retriedName != expectedName {
+				t.Errorf("expected retry with volume name %q, got %q", expectedName, retriedName)
+			}
+			if len(retriedName) != len(pvName)+1+volumeNameConflictSuffixLength {
+				t.Errorf("expected retry with volume name %s-<suffix>, got %q", pvName, retriedName)
+			}
+			if pv.Name != pvName {
+				t.Errorf("expected PV name %q, got %q", pvName, pv.Name)
+			}
+			if pv.Annotations[annCSIVolumeName] != retriedName {
+				t.Errorf("expected annotation %s=%q, got %q", annCSIVolumeName, retriedName, pv.Annotations[annCSIVolumeName])
+			}
+		})
+	}
+}
+
+// TestProvisionVolumeNameConflictRepeated checks that a failed retry after a
+// name conflict is repeated with the same volume name by the next attempt and
+// that the retry gets a timeout of its own.
+func TestProvisionVolumeNameConflictRepeated(t *testing.T) {
+	const requestBytes = 100
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		RetryOnVolumeNameConflict(true))
+
+	pvc := createFakePVC(requestBytes)
+	var retriedNames []string
+	for i := 0; i < 2; i++ {
+		var conflictDeadline time.Time
+		controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+			conflictDeadline, _ = ctx.Deadline()
+			// Use up part of the timeout of the first call.
+			time.Sleep(100 * time.Millisecond)
+		}).Return(nil, status.Error(codes.AlreadyExists, "volume exists with different parameters")).Times(1)
+		controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+			retriedNames = append(retriedNames, req.Name)
+			if deadline, _ := ctx.Deadline(); !deadline.After(conflictDeadline) {
+				t.Errorf("expected retry deadline after %v, got %v", conflictDeadline, deadline)
+			}
+		}).Return(nil, status.Error(codes.DeadlineExceeded, "timed out")).Times(1)
+
+		if _, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+			StorageClass: &storagev1.StorageClass{},
+			PVC:          pvc,
+		}); err == nil {
+			t.Fatal("expected error, got none")
+		}
+	}
+	if len(retriedNames) != 2 || retriedNames[0] != retriedNames[1] {
+		t.Errorf("expected both attempts to retry with the same volume name, got %v", retriedNames)
+	}
+}
+
+// TestProvisionStorageClassAnnotations checks that PVs record the revision
+// and parameters of the storage class they were provisioned with.
+func TestProvisionStorageClassAnnotations(t *testing.T) {
+	const requestBytes = 100
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(3)
+
+	provision := func(resourceVersion string, parameters map[string]string) *v1.PersistentVolume {
+		pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+			StorageClass: &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "sc",
+					ResourceVersion: resourceVersion,
+				},
+				Parameters: parameters,
+			},
+			PVC: createFakePVC(requestBytes),
+		})
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if pv.Annotations[annStorageClassResourceVersion] != resourceVersion {
+			t.Errorf("expected annotation %s=%q, got %q", annStorageClassResourceVersion, resourceVersion, pv.Annotations[annStorageClassResourceVersion])
+		}
+		if hash := pv.Annotations[annStorageClassParametersHash]; len(hash) != 64 {
+			t.Errorf("expected SHA-256 hash in annotation %s, got %q", annStorageClassParametersHash, hash)
+		}
+		return pv
+	}
+
+	original := provision("1", map[string]string{"type": "fast", "replicas": "3"})
+	recreated := provision("2", map[string]string{"replicas": "3", "type": "fast"})
+	changed := provision("3", map[string]string{"type": "slow", "replicas": "3"})
+
+	if original.Annotations[annStorageClassParametersHash] != recreated.Annotations[annStorageClassParametersHash] {
+		t.Errorf("expected same parameters hash for same parameters, got %q and %q",
+			original.Annotations[annStorageClassParametersHash], recreated.Annotations[annStorageClassParametersHash])
+	}
+	if original.Annotations[annStorageClassParametersHash] == changed.Annotations[annStorageClassParametersHash] {
+		t.Errorf("expected different parameters hash for different parameters, got %q for both",
+			original.Annotations[annStorageClassParametersHash])
+	}
+}
+
+// TestProvisionCopyStorageClassMetadata checks that only allowlisted labels
+// and annotations of the storage class end up in the PV.
+func TestProvisionCopyStorageClassMetadata(t *testing.T) {
+	const requestBytes = 100
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		CopyStorageClassMetadata(
+			[]string{"example.com/tier", "example.com/missing", "topology.kubernetes.io/zone"},
+			[]string{"example.com/owner", annStorageClassParametersHash},
+		))
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(1)
 
-					if expectedState != state {
-						t.Errorf("expected provisioning state %s, got %s", expectedState, state)
-					}
-				})
+	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "sc",
+				Labels: map[string]string{
+					"example.com/tier":            "gold",
+					"example.com/unlisted":        "x",
+					"topology.kubernetes.io/zone": "zone1",
+				},
+				Annotations: map[string]string{
+					"example.com/owner":           "team-a",
+					"example.com/unlisted":        "x",
+					annStorageClassParametersHash: "overwritten",
+				},
+			},
+		},
+		PVC: createFakePVC(requestBytes),
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+
+	expectedLabels := map[string]string{"example.com/tier": "gold"}
+	if !reflect.DeepEqual(pv.Labels, expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, pv.Labels)
+	}
+	if pv.Annotations["example.com/owner"] != "team-a" {
+		t.Errorf("expected annotation example.com/owner=team-a, got %q", pv.Annotations["example.com/owner"])
+	}
+	if _, ok := pv.Annotations["example.com/unlisted"]; ok {
+		t.Error("annotation example.com/unlisted was copied")
+	}
+	if pv.Annotations[annStorageClassParametersHash] == "overwritten" {
+		t.Errorf("annotation %s was overwritten", annStorageClassParametersHash)
+	}
+}
+
+func TestIsReservedMetadataKey(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"tier":                           false,
+		"example.com/tier":               false,
+		"kubernetes.io/hostname":         true,
+		"topology.kubernetes.io/zone":    true,
+		"k8s.io/key":                     true,
+		"provisioner.k8s.io/fstype":      true,
+		"notkubernetes.io/key":           false,
+		"example.com/kubernetes.io/zone": false,
+	} {
+		if actual := IsReservedMetadataKey(key); actual != expected {
+			t.Errorf("%s: expected reserved %v, got %v", key, expected, actual)
+		}
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	const (
+		defaultTimeout = 10 * time.Second
+		maxTimeout     = time.Hour
+	)
+
+	testcases := map[string]struct {
+		annotation      string
+		maxTimeout      time.Duration
+		expectedTimeout time.Duration
+		expectEvent     bool
+	}{
+		"no annotation": {
+			maxTimeout:      maxTimeout,
+			expectedTimeout: defaultTimeout,
+		},
+		"valid": {
+			annotation:      "30m",
+			maxTimeout:      maxTimeout,
+			expectedTimeout: 30 * time.Minute,
+		},
+		"over max": {
+			annotation:      "2h",
+			maxTimeout:      maxTimeout,
+			expectedTimeout: maxTimeout,
+			expectEvent:     true,
+		},
+		"malformed": {
+			annotation:      "soon",
+			maxTimeout:      maxTimeout,
+			expectedTimeout: defaultTimeout,
+			expectEvent:     true,
+		},
+		"negative": {
+			annotation:      "-1m",
+			maxTimeout:      maxTimeout,
+			expectedTimeout: defaultTimeout,
+			expectEvent:     true,
+		},
+		"disabled": {
+			annotation:      "30m",
+			expectedTimeout: defaultTimeout,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var annotations map[string]string
+			if tc.annotation != "" {
+				annotations = map[string]string{annOperationTimeout: tc.annotation}
+			}
+			claim := createFakeNamedPVC(100, "fake-pvc", annotations)
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			provisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), defaultTimeout, "test-provisioner", "test", 5,
+				nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder), MaxPVCOperationTimeout(tc.maxTimeout))
+
+			timeout := provisioner.(*csiProvisioner).operationTimeout(claim)
+			if timeout != tc.expectedTimeout {
+				t.Errorf("expected timeout %s, got %s", tc.expectedTimeout, timeout)
+			}
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectEvent && !strings.Contains(event, "InvalidOperationTimeout") {
+				t.Errorf("expected InvalidOperationTimeout event, got %q", event)
+			}
+			if !tc.expectEvent && event != "" {
+				t.Errorf("expected no event, got %q", event)
 			}
 		})
 	}
+}
 
-	// Try all four combinations. For most of them there's no
-	// difference, but better check...
-	test(false, false)
-	test(false, true)
-	test(true, false)
-	test(true, true)
+// TestProvisionRecycleReclaimPolicy checks that a storage class with the
+// Recycle reclaim policy is rejected without calling CreateVolume.
+func TestProvisionRecycleReclaimPolicy(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		withEventRecorder(recorder))
+
+	recycle := v1.PersistentVolumeReclaimRecycle
+	pv, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "recycle"},
+			ReclaimPolicy: &recycle,
+		},
+		PVC: createFakePVC(100),
+	})
+	if pv != nil {
+		t.Errorf("expected no PV, got %v", pv)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		t.Errorf("expected IgnoredError, got %T: %v", err, err)
+	}
+	expectedEvent := "Warning UnsupportedReclaimPolicy StorageClass recycle uses the deprecated reclaim policy Recycle, which is not supported for CSI volumes. Use Delete or Retain instead."
+	select {
+	case event := <-recorder.Events:
+		if event != expectedEvent {
+			t.Errorf("expected event %q, got %q", expectedEvent, event)
+		}
+	default:
+		t.Errorf("expected event %q, got none", expectedEvent)
+	}
 }
 
-// TestProvisionWithTopologyDisabled checks that missing Node and CSINode objects, selectedNode
-// are ignored and topology is not set on the PV
-func TestProvisionWithTopologyDisabled(t *testing.T) {
-	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, false)()
+// TestProvisionWithDeleteDisabled checks that disabling deletion doesn't
+// affect provisioning.
+func TestProvisionWithDeleteDisabled(t *testing.T) {
+	const requestBytes = 100
 
-	accessibleTopology := []*csi.Topology{
-		{
-			Segments: map[string]string{
-				"com.example.csi/zone": "zone1",
-				"com.example.csi/rack": "rack2",
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		DisableDelete(true))
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(1)
+
+	pv, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+	if pv.Spec.CSI.VolumeHandle != "test-volume-id" {
+		t.Errorf("expected volume handle %q, got %q", "test-volume-id", pv.Spec.CSI.VolumeHandle)
+	}
+	if len(pv.Finalizers) != 0 {
+		t.Errorf("expected no finalizers, got %v", pv.Finalizers)
+	}
+}
+
+// TestProvisionEncryptionKey checks how the encryption key annotation of a
+// PVC is passed to CreateVolume.
+func TestProvisionEncryptionKey(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		disabled      bool
+		encryption    string
+		key           string
+		expectKey     string
+		expectErr     bool
+		expectedEvent string
+	}{
+		"required with key": {
+			encryption: encryptionRequired,
+			key:        "tenant-a",
+			expectKey:  "tenant-a",
+		},
+		"required without key": {
+			encryption:    encryptionRequired,
+			expectErr:     true,
+			expectedEvent: "EncryptionKeyMissing",
+		},
+		"optional with key": {
+			encryption: encryptionOptional,
+			key:        "tenant-a",
+			expectKey:  "tenant-a",
+		},
+		"optional without key": {
+			encryption: encryptionOptional,
+		},
+		"unsupported with key": {
+			key:           "tenant-a",
+			expectedEvent: "EncryptionKeyIgnored",
+		},
+		"unsupported without key": {},
+		"invalid": {
+			encryption: "always",
+			key:        "tenant-a",
+			expectErr:  true,
+		},
+		"disabled": {
+			disabled:   true,
+			encryption: encryptionRequired,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder), HonorPVCEncryptionKey(!tc.disabled))
+
+			var parameters map[string]string
+			if !tc.expectErr {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						parameters = req.Parameters
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "encrypted"},
+				Parameters: map[string]string{},
+			}
+			if tc.encryption != "" {
+				sc.Parameters[prefixedEncryptionKey] = tc.encryption
+			}
+			var annotations map[string]string
+			if tc.key != "" {
+				annotations = map[string]string{annEncryptionKey: tc.key}
+			}
+			_, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: sc,
+				PVC:          createFakeNamedPVC(requestBytes, "fake-pvc", annotations),
+			})
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				if state != controller.ProvisioningFinished {
+					t.Errorf("expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if parameters[encryptionKeyKey] != tc.expectKey {
+				t.Errorf("expected encryption key parameter %q, got %q", tc.expectKey, parameters[encryptionKeyKey])
+			}
+			if _, ok := parameters[prefixedEncryptionKey]; ok {
+				t.Errorf("%s was passed to CreateVolume", prefixedEncryptionKey)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if !strings.Contains(event, tc.expectedEvent) || (tc.expectedEvent == "") != (event == "") {
+				t.Errorf("expected event %q, got %q", tc.expectedEvent, event)
+			}
+		})
+	}
+}
+
+// TestProvisionInvalidCreateVolumeResponse checks that no PV gets created
+// for a CreateVolume response which lacks essential information.
+func TestProvisionInvalidCreateVolumeResponse(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		response     *csi.CreateVolumeResponse
+		expectDelete bool
+	}{
+		"missing volume": {
+			response: &csi.CreateVolumeResponse{},
+		},
+		"empty volume ID": {
+			response: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: requestBytes,
+				},
 			},
 		},
+		"negative capacity": {
+			response: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: -1,
+					VolumeId:      "test-volume-id",
+				},
+			},
+			expectDelete: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			clientSet := fakeclientset.NewSimpleClientset()
+			pluginCaps, controllerCaps := provisionCapabilities()
+			recorder := record.NewFakeRecorder(10)
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(tc.response, nil).Times(1)
+			if tc.expectDelete {
+				controllerServer.EXPECT().DeleteVolume(gomock.Any(), &csi.DeleteVolumeRequest{
+					VolumeId: "test-volume-id",
+				}).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+			}
+
+			pv, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVC:          createFakePVC(requestBytes),
+			})
+			if err == nil {
+				t.Fatalf("expected error, got PV %+v", pv)
+			}
+			if pv != nil {
+				t.Errorf("expected no PV, got %+v", pv)
+			}
+			if state != controller.ProvisioningInBackground {
+				t.Errorf("expected ProvisioningState %s, got %s", controller.ProvisioningInBackground, state)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, v1.EventTypeWarning+" InvalidCreateVolumeResponse") {
+					t.Errorf("unexpected event: %s", event)
+				}
+			default:
+				t.Error("expected InvalidCreateVolumeResponse event, got none")
+			}
+		})
+	}
+}
+
+// TestProvisionForceBlockVolumeMode checks that a storage class annotation
+// forces raw block volumes when enabled.
+func TestProvisionForceBlockVolumeMode(t *testing.T) {
+	const requestBytes = 100
+	filesystem := v1.PersistentVolumeFilesystem
+
+	testcases := map[string]struct {
+		honorForceBlockVolumeMode bool
+		scAnnotations             map[string]string
+		volumeMode                *v1.PersistentVolumeMode
+		expectBlock               bool
+		expectEvent               bool
+	}{
+		"forced block": {
+			honorForceBlockVolumeMode: true,
+			scAnnotations:             map[string]string{annForceBlockVolumeMode: "true"},
+			expectBlock:               true,
+		},
+		"forced block, PVC requested filesystem": {
+			honorForceBlockVolumeMode: true,
+			scAnnotations:             map[string]string{annForceBlockVolumeMode: "true"},
+			volumeMode:                &filesystem,
+			expectBlock:               true,
+			expectEvent:               true,
+		},
+		"annotation ignored when disabled": {
+			scAnnotations: map[string]string{annForceBlockVolumeMode: "true"},
+			volumeMode:    &filesystem,
+		},
+		"no annotation": {
+			honorForceBlockVolumeMode: true,
+			volumeMode:                &filesystem,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			clientSet := fakeclientset.NewSimpleClientset()
+			pluginCaps, controllerCaps := provisionCapabilities()
+			recorder := record.NewFakeRecorder(10)
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				HonorForceBlockVolumeMode(tc.honorForceBlockVolumeMode), withEventRecorder(recorder))
+
+			pvc := createFakePVC(requestBytes)
+			pvc.Spec.VolumeMode = tc.volumeMode
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, req *csi.CreateVolumeRequest) {
+				for _, volumeCap := range req.VolumeCapabilities {
+					if isBlock := volumeCap.GetBlock() != nil; isBlock != tc.expectBlock {
+						t.Errorf("expected block access type %v, got %+v", tc.expectBlock, volumeCap.AccessType)
+					}
+				}
+			}).Return(&csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: requestBytes,
+					VolumeId:      "test-volume-id",
+				},
+			}, nil).Times(1)
+
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "sc",
+						Annotations: tc.scAnnotations,
+					},
+				},
+				PVC: pvc,
+			})
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if isBlock := pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == v1.PersistentVolumeBlock; isBlock != tc.expectBlock {
+				t.Errorf("expected block volume mode %v, got %v", tc.expectBlock, pv.Spec.VolumeMode)
+			}
+			if tc.expectBlock && pv.Spec.CSI.FSType != "" {
+				t.Errorf("expected no fstype for block volume, got %q", pv.Spec.CSI.FSType)
+			}
+			if tc.volumeMode != nil && *pvc.Spec.VolumeMode != *tc.volumeMode {
+				t.Errorf("PVC must not be modified, got volume mode %v", *pvc.Spec.VolumeMode)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !tc.expectEvent {
+					t.Errorf("unexpected event: %s", event)
+				} else if !strings.Contains(event, "VolumeModeOverridden") {
+					t.Errorf("expected VolumeModeOverridden event, got: %s", event)
+				}
+			default:
+				if tc.expectEvent {
+					t.Error("expected VolumeModeOverridden event, got none")
+				}
+			}
+		})
+	}
+}
+
+// TestProvisionVolumeMode checks that the PV gets the resolved volume mode
+// of the PVC and that the volume capabilities match it.
+func TestProvisionVolumeMode(t *testing.T) {
+	const requestBytes = 100
+	filesystem := v1.PersistentVolumeFilesystem
+	block := v1.PersistentVolumeBlock
+	unknown := v1.PersistentVolumeMode("Unknown")
+
+	testcases := map[string]struct {
+		volumeMode         *v1.PersistentVolumeMode
+		expectedVolumeMode v1.PersistentVolumeMode
+		expectErr          bool
+	}{
+		"nil": {
+			expectedVolumeMode: v1.PersistentVolumeFilesystem,
+		},
+		"filesystem": {
+			volumeMode:         &filesystem,
+			expectedVolumeMode: v1.PersistentVolumeFilesystem,
+		},
+		"block": {
+			volumeMode:         &block,
+			expectedVolumeMode: v1.PersistentVolumeBlock,
+		},
+		"unknown": {
+			volumeMode: &unknown,
+			expectErr:  true,
+		},
 	}
 
-	const requestBytes = 100
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
 
-	tmpdir := tempDir(t)
-	defer os.RemoveAll(tmpdir)
-	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer mockController.Finish()
-	defer driver.Stop()
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
 
-	clientSet := fakeclientset.NewSimpleClientset()
-	pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
-	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
-		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false)
+			pvc := createFakePVC(requestBytes)
+			pvc.Spec.VolumeMode = tc.volumeMode
+			if !tc.expectErr {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+					Volume: &csi.Volume{
+						CapacityBytes: requestBytes,
+						VolumeId:      "test-volume-id",
+					},
+				}, nil).Times(1)
+			}
 
-	out := &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			CapacityBytes:      requestBytes,
-			VolumeId:           "test-volume-id",
-			AccessibleTopology: accessibleTopology,
-		},
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVC:          pvc,
+			})
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if pv.Spec.VolumeMode == nil || *pv.Spec.VolumeMode != tc.expectedVolumeMode {
+				t.Errorf("expected volume mode %s, got %v", tc.expectedVolumeMode, pv.Spec.VolumeMode)
+			}
+			if tc.volumeMode == nil && pvc.Spec.VolumeMode != nil {
+				t.Errorf("PVC must not be modified, got volume mode %v", *pvc.Spec.VolumeMode)
+			}
+		})
 	}
+}
 
-	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+func TestCheckVolumeCapabilities(t *testing.T) {
+	mount := &csi.VolumeCapability{AccessType: getAccessTypeMount("ext4", nil)}
+	block := &csi.VolumeCapability{AccessType: getAccessTypeBlock()}
 
-	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
-		StorageClass: &storagev1.StorageClass{},
-		PVC:          createFakePVC(requestBytes),
-		SelectedNode: &v1.Node{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: "some-node",
-			},
+	testcases := map[string]struct {
+		volumeMode v1.PersistentVolumeMode
+		volumeCaps []*csi.VolumeCapability
+		expectErr  bool
+	}{
+		"filesystem": {
+			volumeMode: v1.PersistentVolumeFilesystem,
+			volumeCaps: []*csi.VolumeCapability{mount, mount},
+		},
+		"block": {
+			volumeMode: v1.PersistentVolumeBlock,
+			volumeCaps: []*csi.VolumeCapability{block},
+		},
+		"filesystem with block capability": {
+			volumeMode: v1.PersistentVolumeFilesystem,
+			volumeCaps: []*csi.VolumeCapability{mount, block},
+			expectErr:  true,
+		},
+		"block with mount capability": {
+			volumeMode: v1.PersistentVolumeBlock,
+			volumeCaps: []*csi.VolumeCapability{mount},
+			expectErr:  true,
 		},
-	})
-	if err != nil {
-		t.Fatalf("got error from Provision call: %v", err)
 	}
 
-	if pv.Spec.NodeAffinity != nil {
-		t.Errorf("expected nil PV node affinity; got: %v", pv.Spec.NodeAffinity)
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := checkVolumeCapabilities(tc.volumeMode, tc.volumeCaps)
+			if tc.expectErr && err == nil {
+				t.Error("expected error, got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	}
 }
 
-type expectedSecret struct {
-	exist   bool
-	secrets map[string]string
-}
-
 type deleteTestcase struct {
 	persistentVolume          *v1.PersistentVolume
 	storageClass              *storagev1.StorageClass
@@ -4707,6 +6818,9 @@ type deleteTestcase struct {
 	mockDelete                bool
 	expectedProvisionerSecret *expectedSecret
 	deploymentNode            string // fake distributed provisioning with this node as host
+	forceRemoveFinalizer      bool
+	disableDelete             bool
+	renamedStorageClasses     map[string]string
 	expectErr                 bool
 }
 
@@ -5069,6 +7183,72 @@ func TestDelete(t *testing.T) {
 				secrets: map[string]string{"provisionersecret-key": "provisionersecret-val"},
 			},
 		},
+		"secrets from renamed StorageClass": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+					ClaimRef: &v1.ObjectReference{
+						Name:      "pvc",
+						Namespace: "default",
+					},
+					StorageClassName: "old-sc-name",
+				},
+			},
+			storageClass: &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "sc-name",
+				},
+				Parameters: map[string]string{
+					prefixedProvisionerSecretNameKey:      "provisionersecret",
+					prefixedProvisionerSecretNamespaceKey: defaultSecretNsName,
+				},
+			},
+			secrets:               getDefaultProvisinerSecrets(),
+			renamedStorageClasses: map[string]string{"old-sc-name": "sc-name"},
+			mockDelete:            true,
+			expectedProvisionerSecret: &expectedSecret{
+				exist:   true,
+				secrets: map[string]string{"provisionersecret-key": "provisionersecret-val"},
+			},
+		},
+		"no secrets from renamed StorageClass without mapping": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pv",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+					ClaimRef: &v1.ObjectReference{
+						Name:      "pvc",
+						Namespace: "default",
+					},
+					StorageClassName: "old-sc-name",
+				},
+			},
+			storageClass: &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "sc-name",
+				},
+				Parameters: map[string]string{
+					prefixedProvisionerSecretNameKey:      "provisionersecret",
+					prefixedProvisionerSecretNamespaceKey: defaultSecretNsName,
+				},
+			},
+			secrets:                   getDefaultProvisinerSecrets(),
+			mockDelete:                true,
+			expectedProvisionerSecret: &expectedSecret{exist: false},
+		},
 		"Non-empty provisioner secret is set as PV annotation and StorageClass doesn't exist": {
 			persistentVolume: &v1.PersistentVolume{
 				ObjectMeta: metav1.ObjectMeta{
@@ -5276,6 +7456,95 @@ func TestDelete(t *testing.T) {
 			expectErr:  false,
 			mockDelete: true,
 		},
+		"force remove finalizer": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        pvName,
+					Annotations: map[string]string{annForceRemoveFinalizer: "true"},
+					Finalizers:  []string{pvFinalizer, "other-finalizer"},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			forceRemoveFinalizer: true,
+			mockDelete:           false,
+		},
+		"force remove finalizer annotation ignored when disabled": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        pvName,
+					Annotations: map[string]string{annForceRemoveFinalizer: "true"},
+					Finalizers:  []string{pvFinalizer},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			mockDelete: true,
+		},
+		"force remove finalizer enabled without annotation": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       pvName,
+					Finalizers: []string{pvFinalizer},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			forceRemoveFinalizer: true,
+			mockDelete:           true,
+		},
+		"delete disabled": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: pvName,
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			disableDelete: true,
+			mockDelete:    false,
+			expectErr:     true,
+		},
+		"delete disabled takes precedence over force remove finalizer": {
+			persistentVolume: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        pvName,
+					Annotations: map[string]string{annForceRemoveFinalizer: "true"},
+					Finalizers:  []string{pvFinalizer},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							VolumeHandle: "vol-id-1",
+						},
+					},
+				},
+			},
+			forceRemoveFinalizer: true,
+			disableDelete:        true,
+			mockDelete:           false,
+			expectErr:            true,
+		},
 	}
 
 	for k, tc := range tt {
@@ -5304,6 +7573,9 @@ func runDeleteTest(t *testing.T, k string, tc deleteTestcase) {
 	if tc.storageClass != nil {
 		clientSetObjects = append(clientSetObjects, tc.storageClass)
 	}
+	if tc.persistentVolume != nil {
+		clientSetObjects = append(clientSetObjects, tc.persistentVolume)
+	}
 	if tc.secrets != nil {
 		for _, secret := range tc.secrets {
 			clientSetObjects = append(clientSetObjects, secret)
@@ -5362,7 +7634,8 @@ func runDeleteTest(t *testing.T, k string, tc deleteTestcase) {
 	pluginCaps, controllerCaps := provisionCapabilities()
 	scLister, _, _, _, vaLister, _ := listers(clientSet)
 	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
-		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, vaLister, nil, false, defaultfsType, nodeDeployment, true, false)
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, vaLister, nil, false, defaultfsType, nodeDeployment, true, false,
+		ForceRemoveFinalizer(tc.forceRemoveFinalizer), DisableDelete(tc.disableDelete), RenamedStorageClasses(tc.renamedStorageClasses))
 
 	err = csiProvisioner.Delete(context.Background(), tc.persistentVolume)
 	if tc.expectErr && err == nil {
@@ -5371,6 +7644,20 @@ func runDeleteTest(t *testing.T, k string, tc deleteTestcase) {
 	if !tc.expectErr && err != nil {
 		t.Errorf("test %q: got error: %v", k, err)
 	}
+	if _, ignored := err.(*controller.IgnoredError); tc.disableDelete && !ignored {
+		t.Errorf("test %q: expected deletion to be ignored, got: %v", k, err)
+	}
+	// The provisioner library removes the finalizer after a successful
+	// Delete, never the provisioner itself.
+	if (tc.disableDelete || tc.forceRemoveFinalizer) && tc.persistentVolume != nil {
+		pv, err := clientSet.CoreV1().PersistentVolumes().Get(context.Background(), tc.persistentVolume.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("test %q: PV not found: %v", k, err)
+		}
+		if !reflect.DeepEqual(pv.Finalizers, tc.persistentVolume.Finalizers) {
+			t.Errorf("test %q: expected finalizers %v to be kept, got %v", k, tc.persistentVolume.Finalizers, pv.Finalizers)
+		}
+	}
 }
 
 // generatePVCForProvisionFromPVC returns a ProvisionOptions with the requested settings
@@ -5509,6 +7796,7 @@ func TestProvisionFromPVC(t *testing.T) {
 		expectedPVSpec       *pvSpec                  // set to expected PVSpec on success, for deep comparison, default nil
 		cloneUnsupported     bool                     // set to state clone feature not supported in capabilities, default false
 		expectFinalizers     bool                     // while set, expects clone protection finalizers to be set on a PVC
+		disableFinalizers    bool                     // set to disable finalizers, default false
 		sourcePVStatusPhase  v1.PersistentVolumePhase // set to change source PV Status.Phase, default "Bound"
 		expectErr            bool                     // set to state, test is expected to return errors, default false
 		xnsEnabled           bool                     // set to use CrossNamespaceVolumeDataSource feature, default false
@@ -5538,6 +7826,19 @@ func TestProvisionFromPVC(t *testing.T) {
 				},
 			},
 		},
+		"provision with pvc data source and finalizers disabled": {
+			clonePVName:       pvName,
+			volOpts:           generatePVCForProvisionFromPVC(srcNamespace, srcName, fakeSc1, requestedBytes, ""),
+			disableFinalizers: true,
+			expectedPVSpec: &pvSpec{
+				Name:          pvName,
+				ReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				AccessModes:   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): bytesToQuantity(requestedBytes),
+				},
+			},
+		},
 		"provision with pvc data source no clone capability": {
 			clonePVName:      pvName,
 			volOpts:          generatePVCForProvisionFromPVC(srcNamespace, srcName, fakeSc1, requestedBytes, ""),
@@ -6452,9 +8753,17 @@ func TestProvisionFromPVC(t *testing.T) {
 
 			// Phase: execute the test
 			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5, csiConn.conn,
-				nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, claimLister, nil, refGrantLister, false, defaultfsType, nil, true, false)
+				nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, claimLister, nil, refGrantLister, false, defaultfsType, nil, true, false,
+				DisableFinalizers(tc.disableFinalizers))
 
 			pv, _, err = csiProvisioner.Provision(context.Background(), tc.volOpts)
+			if tc.disableFinalizers {
+				for _, action := range clientSet.Actions() {
+					if action.Matches("update", "persistentvolumeclaims") {
+						t.Errorf("test %q: expected no PVC updates with finalizers disabled, got %v", k, action)
+					}
+				}
+			}
 			if tc.expectErr && err == nil {
 				t.Errorf("test %q: Expected error, got none", k)
 			}
@@ -6814,6 +9123,104 @@ func TestMarkAsMigrated(t *testing.T) {
 	})
 }
 
+// withEventRecorder replaces the event recorder so that tests can check
+// emitted events.
+func withEventRecorder(recorder record.EventRecorder) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.eventRecorder = recorder
+	}
+}
+
+// withExtraCreateMetadata passes the PVC and PV metadata to the driver,
+// like --extra-create-metadata.
+func withExtraCreateMetadata() ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.extraCreateMetadata = true
+	}
+}
+
+// withCapabilities replaces the capabilities which the provisioner
+// assumes for the driver.
+func withCapabilities(pluginCaps rpc.PluginCapabilitySet, controllerCaps rpc.ControllerCapabilitySet) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.pluginCapabilities = pluginCaps
+		p.controllerCapabilities = controllerCaps
+	}
+}
+
+// provisionerTest is a CSI provisioner backed by a mock CSI driver and a
+// fake client, for tests which only vary the ProvisionerOptions.
+type provisionerTest struct {
+	provisioner      *csiProvisioner
+	clientSet        *fakeclientset.Clientset
+	controllerServer *driver.MockControllerServer
+	recorder         *record.FakeRecorder
+}
+
+// newProvisionerTest starts a mock CSI driver and creates a provisioner for
+// it whose client contains the objects. The driver has the
+// provisionCapabilities unless withCapabilities overrides them. Events get
+// recorded. Everything is stopped at the end of the test.
+func newProvisionerTest(t *testing.T, objects []runtime.Object, options ...ProvisionerOption) *provisionerTest {
+	t.Helper()
+	return newProvisionerTestWithClient(t, fakeclientset.NewSimpleClientset(objects...), options...)
+}
+
+// newProvisionerTestWithClient is newProvisionerTest for options which
+// need informers of the client.
+func newProvisionerTestWithClient(t *testing.T, clientSet *fakeclientset.Clientset, options ...ProvisionerOption) *provisionerTest {
+	t.Helper()
+	tmpdir := tempDir(t)
+	t.Cleanup(func() { os.RemoveAll(tmpdir) })
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mockController.Finish)
+	t.Cleanup(driver.Stop)
+
+	scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+	t.Cleanup(func() { close(stopChan) })
+	recorder := record.NewFakeRecorder(100)
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+		append([]ProvisionerOption{withEventRecorder(recorder)}, options...)...)
+	return &provisionerTest{
+		provisioner:      provisioner.(*csiProvisioner),
+		clientSet:        clientSet,
+		controllerServer: controllerServer,
+		recorder:         recorder,
+	}
+}
+
+// expectCreateVolume expects one CreateVolume call, which gets checked
+// by check, if not nil, and returns a volume of the given size.
+func (pt *provisionerTest) expectCreateVolume(capacityBytes int64, check func(req *csi.CreateVolumeRequest)) {
+	pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+			if check != nil {
+				check(req)
+			}
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: capacityBytes,
+					VolumeId:      "test-volume-id",
+				},
+			}, nil
+		}).Times(1)
+}
+
+// events returns the events emitted so far, each as
+// "<type> <reason> <message>".
+func (pt *provisionerTest) events() []string {
+	var events []string
+	for len(pt.recorder.Events) > 0 {
+		events = append(events, <-pt.recorder.Events)
+	}
+	return events
+}
+
 func createFakeCSIPV(volumeHandle string) *v1.PersistentVolume {
 	return &v1.PersistentVolume{
 		Spec: v1.PersistentVolumeSpec{
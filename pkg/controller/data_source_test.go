@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionContradictoryDataSource(t *testing.T) {
+	const requestBytes = 100
+	populatorGroup := "populator.example.com"
+	otherGroup := "other.example.com"
+	claimNamespace := "fake-ns"
+	otherNamespace := "other-ns"
+
+	// An external populator data source makes Provision stop early with
+	// a Normal event, which is enough to tell whether the data source was
+	// accepted.
+	populator := &v1.TypedLocalObjectReference{APIGroup: &populatorGroup, Kind: "Foo", Name: "source"}
+	populatorRef := func(apiGroup *string, kind, name string, namespace *string) *v1.TypedObjectReference {
+		return &v1.TypedObjectReference{APIGroup: apiGroup, Kind: kind, Name: name, Namespace: namespace}
+	}
+
+	testcases := map[string]struct {
+		dataSource     *v1.TypedLocalObjectReference
+		dataSourceRef  *v1.TypedObjectReference
+		expectConflict bool
+	}{
+		"data source only": {
+			dataSource: populator,
+		},
+		"data source ref only": {
+			dataSourceRef: populatorRef(&populatorGroup, "Foo", "source", nil),
+		},
+		"agreeing": {
+			dataSource:    populator,
+			dataSourceRef: populatorRef(&populatorGroup, "Foo", "source", nil),
+		},
+		"agreeing with namespace": {
+			dataSource:    populator,
+			dataSourceRef: populatorRef(&populatorGroup, "Foo", "source", &claimNamespace),
+		},
+		"different name": {
+			dataSource:     populator,
+			dataSourceRef:  populatorRef(&populatorGroup, "Foo", "other", nil),
+			expectConflict: true,
+		},
+		"different kind": {
+			dataSource:     populator,
+			dataSourceRef:  populatorRef(&populatorGroup, "Bar", "source", nil),
+			expectConflict: true,
+		},
+		"different API group": {
+			dataSource:     populator,
+			dataSourceRef:  populatorRef(&otherGroup, "Foo", "source", nil),
+			expectConflict: true,
+		},
+		"core API group": {
+			dataSource:     populator,
+			dataSourceRef:  populatorRef(nil, "Foo", "source", nil),
+			expectConflict: true,
+		},
+		"different namespace": {
+			dataSource:     populator,
+			dataSourceRef:  populatorRef(&populatorGroup, "Foo", "source", &otherNamespace),
+			expectConflict: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil)
+
+			claim := createFakePVC(requestBytes)
+			claim.Spec.DataSource = tc.dataSource
+			claim.Spec.DataSourceRef = tc.dataSourceRef
+			_, state, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			if state != controller.ProvisioningFinished {
+				t.Errorf("expected ProvisioningFinished, got %s", state)
+			}
+
+			expectedEvent := v1.EventTypeNormal + " Provisioning"
+			if tc.expectConflict {
+				expectedEvent = v1.EventTypeWarning + " ContradictoryDataSource"
+			}
+			if events := pt.events(); len(events) != 1 || !strings.HasPrefix(events[0], expectedEvent) {
+				t.Errorf("expected %s event, got %q", expectedEvent, events)
+			}
+		})
+	}
+}
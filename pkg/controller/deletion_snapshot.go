@@ -0,0 +1,206 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annSnapshotBeforeDeletion on a StorageClass with value "true"
+	// protects the PVs of that class: with SnapshotBeforeDeletion, their
+	// volumes only get deleted once a snapshot of them is ready to use.
+	annSnapshotBeforeDeletion = "provisioner.k8s.io/snapshot-before-deletion"
+
+	// annDeletionSnapshot on a PV records the ID of the snapshot which
+	// was taken before deleting its volume.
+	annDeletionSnapshot = "provisioner.k8s.io/deletion-snapshot"
+)
+
+// deletionSnapshotName is the name of the snapshot of a volume before its
+// deletion. It is the same for all attempts, so that retries pick up the
+// snapshot that was created before.
+func deletionSnapshotName(volume *v1.PersistentVolume) string {
+	return "deletion-" + string(volume.UID)
+}
+
+// isProtectedFromDeletion checks whether the storage class of the volume
+// requires a snapshot before deletion. Volumes whose class no longer
+// exists are not protected.
+func (p *csiProvisioner) isProtectedFromDeletion(volume *v1.PersistentVolume) (bool, error) {
+	className := p.storageClassOfVolume(volume)
+	if p.scLister == nil || className == "" {
+		return false, nil
+	}
+	sc, err := p.scLister.Get(className)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get StorageClass %s: %v", className, err)
+	}
+	return sc.Annotations[annSnapshotBeforeDeletion] == "true", nil
+}
+
+// ensureDeletionSnapshot creates a snapshot of the volume of a protected
+// PV and returns an error, which blocks the deletion, until the snapshot
+// is ready to use. The snapshot ID then gets recorded on the PV. The
+// secrets are the ones of DeleteVolume.
+func (p *csiProvisioner) ensureDeletionSnapshot(ctx context.Context, volume *v1.PersistentVolume, volumeID string, secrets map[string]string) error {
+	if !p.snapshotBeforeDeletion {
+		return nil
+	}
+	if volume.Annotations[annDeletionSnapshot] != "" {
+		// An earlier attempt already took the snapshot.
+		return nil
+	}
+	protected, err := p.isProtectedFromDeletion(volume)
+	if err != nil || !protected {
+		return err
+	}
+
+	snapshotID, err := p.createDeletionSnapshot(ctx, volume, volumeID, secrets)
+	if err != nil {
+		err = fmt.Errorf("deletion of volume %s is blocked until a snapshot of it exists: %v", volume.Spec.CSI.VolumeHandle, err)
+		p.eventRecorder.Event(volume, v1.EventTypeWarning, "DeletionSnapshotFailed", err.Error())
+		return err
+	}
+	if snapshotID == "" {
+		return fmt.Errorf("snapshot %s of volume %s is not ready to use yet", deletionSnapshotName(volume), volume.Spec.CSI.VolumeHandle)
+	}
+
+	klog.V(2).Infof("took snapshot %s of volume %s before deleting PV %s", snapshotID, volume.Spec.CSI.VolumeHandle, volume.Name)
+	p.eventRecorder.Eventf(volume, v1.EventTypeNormal, "DeletionSnapshotCreated", "Took snapshot %s of volume %s before deleting it", snapshotID, volume.Spec.CSI.VolumeHandle)
+	return p.recordDeletionSnapshot(ctx, volume, snapshotID)
+}
+
+// snapshotCalls makes sure that only one CreateSnapshot call runs per
+// snapshot, identified by the source volume and the PV UID in the snapshot
+// name. Concurrent callers for the same snapshot wait for the result of the
+// running call instead of taking another snapshot.
+type snapshotCalls struct {
+	mutex sync.Mutex
+	calls map[string]*snapshotCall
+}
+
+type snapshotCall struct {
+	done       chan struct{}
+	waiters    int
+	snapshotID string
+	err        error
+}
+
+func newSnapshotCalls() *snapshotCalls {
+	return &snapshotCalls{
+		calls: map[string]*snapshotCall{},
+	}
+}
+
+// do starts create unless a call with the same key is already running and
+// waits for the result. create does not belong to any one caller, so a
+// caller whose ctx ends only stops waiting for it.
+func (s *snapshotCalls) do(ctx context.Context, key string, create func() (string, error)) (string, error) {
+	s.mutex.Lock()
+	call, ok := s.calls[key]
+	if ok {
+		call.waiters++
+		klog.V(4).Infof("waiting for the running snapshot %s", key)
+	} else {
+		call = &snapshotCall{done: make(chan struct{})}
+		s.calls[key] = call
+		go s.run(key, call, create)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.snapshotID, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *snapshotCalls) run(key string, call *snapshotCall, create func() (string, error)) {
+	call.snapshotID, call.err = create()
+
+	s.mutex.Lock()
+	delete(s.calls, key)
+	if call.waiters > 0 {
+		klog.V(4).Infof("snapshot %s is shared with %d other callers", key, call.waiters)
+	}
+	s.mutex.Unlock()
+	close(call.done)
+}
+
+// createDeletionSnapshot returns the ID of the snapshot once it is ready
+// to use and an empty ID before that.
+func (p *csiProvisioner) createDeletionSnapshot(ctx context.Context, volume *v1.PersistentVolume, volumeID string, secrets map[string]string) (string, error) {
+	if !p.controllerCapabilities[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT] {
+		return "", fmt.Errorf("the driver does not support CreateSnapshot")
+	}
+	key := volumeID + "/" + deletionSnapshotName(volume)
+	return p.snapshotCalls.do(ctx, key, func() (string, error) {
+		return p.callCreateSnapshot(context.Background(), volume, volumeID, secrets)
+	})
+}
+
+// callCreateSnapshot takes the snapshot of the volume before its deletion.
+func (p *csiProvisioner) callCreateSnapshot(ctx context.Context, volume *v1.PersistentVolume, volumeID string, secrets map[string]string) (string, error) {
+	snapshotCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	resp, err := p.csiClient.CreateSnapshot(snapshotCtx, &csi.CreateSnapshotRequest{
+		SourceVolumeId: volumeID,
+		Name:           deletionSnapshotName(volume),
+		Secrets:        secrets,
+	})
+	if err != nil {
+		return "", fmt.Errorf("CreateSnapshot failed: %v", err)
+	}
+	snapshot := resp.GetSnapshot()
+	if snapshot == nil || snapshot.SnapshotId == "" {
+		return "", fmt.Errorf("CreateSnapshot returned no snapshot ID")
+	}
+	if !snapshot.ReadyToUse {
+		return "", nil
+	}
+	return snapshot.SnapshotId, nil
+}
+
+// recordDeletionSnapshot stores the snapshot ID in the annotations of the
+// current PV object.
+func (p *csiProvisioner) recordDeletionSnapshot(ctx context.Context, volume *v1.PersistentVolume, snapshotID string) error {
+	current, err := p.client.CoreV1().PersistentVolumes().Get(ctx, volume.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get PV %s: %v", volume.Name, err)
+	}
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	current.Annotations[annDeletionSnapshot] = snapshotID
+	if _, err := p.client.CoreV1().PersistentVolumes().Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to record snapshot %s on PV %s: %v", snapshotID, volume.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestDeleteSnapshotBeforeDeletion(t *testing.T) {
+	const volumeHandle = "test-volume-id"
+
+	testcases := map[string]struct {
+		disabled        bool
+		notProtected    bool
+		noSnapshotCap   bool
+		recorded        string
+		snapshot        *csi.Snapshot
+		snapshotErr     error
+		expectSnapshot  bool
+		expectDelete    bool
+		expectEvent     string
+		expectAnnotated string
+	}{
+		"snapshot succeeds": {
+			snapshot:        &csi.Snapshot{SnapshotId: "snap-1", SourceVolumeId: volumeHandle, ReadyToUse: true},
+			expectSnapshot:  true,
+			expectDelete:    true,
+			expectEvent:     v1.EventTypeNormal + " DeletionSnapshotCreated",
+			expectAnnotated: "snap-1",
+		},
+		"snapshot fails": {
+			snapshotErr:    errors.New("backend unavailable"),
+			expectSnapshot: true,
+			expectEvent:    v1.EventTypeWarning + " DeletionSnapshotFailed",
+		},
+		"snapshot not ready": {
+			snapshot:       &csi.Snapshot{SnapshotId: "snap-1", SourceVolumeId: volumeHandle},
+			expectSnapshot: true,
+		},
+		"no snapshot capability": {
+			noSnapshotCap: true,
+			expectEvent:   v1.EventTypeWarning + " DeletionSnapshotFailed",
+		},
+		"snapshot recorded earlier": {
+			recorded:        "snap-0",
+			expectDelete:    true,
+			expectAnnotated: "snap-0",
+		},
+		"class not protected": {
+			notProtected: true,
+			expectDelete: true,
+		},
+		"disabled": {
+			disabled:     true,
+			expectDelete: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "protected"},
+			}
+			if !tc.notProtected {
+				sc.Annotations = map[string]string{annSnapshotBeforeDeletion: "true"}
+			}
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test-pv",
+					UID:  "test-uid",
+				},
+				Spec: v1.PersistentVolumeSpec{
+					StorageClassName: sc.Name,
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							Driver:       driverName,
+							VolumeHandle: volumeHandle,
+						},
+					},
+				},
+			}
+			if tc.recorded != "" {
+				pv.Annotations = map[string]string{annDeletionSnapshot: tc.recorded}
+			}
+
+			pluginCaps, controllerCaps := provisionFromSnapshotCapabilities()
+			controllerCaps[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT] = !tc.noSnapshotCap
+			pt := newProvisionerTest(t, []runtime.Object{sc, pv}, withCapabilities(pluginCaps, controllerCaps), SnapshotBeforeDeletion(!tc.disabled))
+			if tc.expectSnapshot {
+				pt.controllerServer.EXPECT().CreateSnapshot(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+						if req.SourceVolumeId != volumeHandle {
+							t.Errorf("expected source volume %s, got %s", volumeHandle, req.SourceVolumeId)
+						}
+						if req.Name != "deletion-test-uid" {
+							t.Errorf("expected snapshot name deletion-test-uid, got %s", req.Name)
+						}
+						if tc.snapshotErr != nil {
+							return nil, tc.snapshotErr
+						}
+						return &csi.CreateSnapshotResponse{Snapshot: tc.snapshot}, nil
+					}).Times(1)
+			}
+			if tc.expectDelete {
+				pt.controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+			}
+
+			err := pt.provisioner.Delete(context.Background(), pv)
+			if tc.expectDelete && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.expectDelete && err == nil {
+				t.Fatal("expected deletion to be blocked, got no error")
+			}
+
+			events := pt.events()
+			if tc.expectEvent == "" && len(events) != 0 {
+				t.Errorf("expected no events, got %q", events)
+			}
+			if tc.expectEvent != "" && (len(events) != 1 || !strings.HasPrefix(events[0], tc.expectEvent)) {
+				t.Errorf("expected %s event, got %q", tc.expectEvent, events)
+			}
+
+			current, err := pt.clientSet.CoreV1().PersistentVolumes().Get(context.Background(), pv.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot := current.Annotations[annDeletionSnapshot]; snapshot != tc.expectAnnotated {
+				t.Errorf("expected %s annotation %q, got %q", annDeletionSnapshot, tc.expectAnnotated, snapshot)
+			}
+		})
+	}
+}
+
+// TestConcurrentDeletionSnapshots checks that concurrent snapshots of the
+// same PV result in a single CreateSnapshot call whose result all callers
+// get.
+func TestConcurrentDeletionSnapshots(t *testing.T) {
+	const (
+		volumeHandle = "test-volume-id"
+		callers      = 5
+	)
+
+	pluginCaps, controllerCaps := provisionFromSnapshotCapabilities()
+	controllerCaps[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT] = true
+	pt := newProvisionerTest(t, nil, withCapabilities(pluginCaps, controllerCaps), SnapshotBeforeDeletion(true))
+	p := pt.provisioner
+	release := make(chan struct{})
+	pt.controllerServer.EXPECT().CreateSnapshot(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+			<-release
+			return &csi.CreateSnapshotResponse{
+				Snapshot: &csi.Snapshot{SnapshotId: "snap-1", SourceVolumeId: volumeHandle, ReadyToUse: true},
+			}, nil
+		}).Times(1)
+
+	var wg sync.WaitGroup
+	snapshotIDs := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{UID: "test-uid"},
+			}
+			snapshotIDs[i], errs[i] = p.createDeletionSnapshot(context.Background(), pv, volumeHandle, nil)
+		}(i)
+	}
+
+	// Release the snapshot once all other callers wait for it.
+	if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		p.snapshotCalls.mutex.Lock()
+		defer p.snapshotCalls.mutex.Unlock()
+		call, ok := p.snapshotCalls.calls[volumeHandle+"/deletion-test-uid"]
+		return ok && call.waiters == callers-1, nil
+	}); err != nil {
+		t.Fatalf("waiting for concurrent snapshots: %v", err)
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Errorf("caller #%d: unexpected error: %v", i, errs[i])
+		}
+		if snapshotIDs[i] != "snap-1" {
+			t.Errorf("caller #%d: expected snapshot snap-1, got %q", i, snapshotIDs[i])
+		}
+	}
+	if len(p.snapshotCalls.calls) != 0 {
+		t.Errorf("expected no running snapshots, got %v", p.snapshotCalls.calls)
+	}
+}
+
+// TestDeletionSnapshotOutlivesCaller checks that a shared CreateSnapshot
+// call continues for the other callers when the caller which started it
+// gives up, and that PVs with the same volume handle do not share a call.
+func TestDeletionSnapshotOutlivesCaller(t *testing.T) {
+	const volumeHandle = "test-volume-id"
+
+	pluginCaps, controllerCaps := provisionFromSnapshotCapabilities()
+	controllerCaps[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT] = true
+	pt := newProvisionerTest(t, nil, withCapabilities(pluginCaps, controllerCaps), SnapshotBeforeDeletion(true))
+	p := pt.provisioner
+	release := make(chan struct{})
+	pt.controllerServer.EXPECT().CreateSnapshot(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+			<-release
+			if err := ctx.Err(); err != nil {
+				t.Errorf("CreateSnapshot %s: unexpected end of context: %v", req.Name, err)
+			}
+			return &csi.CreateSnapshotResponse{
+				Snapshot: &csi.Snapshot{SnapshotId: "snap-" + req.Name, SourceVolumeId: volumeHandle, ReadyToUse: true},
+			}, nil
+		}).Times(2)
+
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{UID: "test-uid"}}
+	otherPV := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{UID: "other-uid"}}
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := p.createDeletionSnapshot(firstCtx, pv, volumeHandle, nil)
+		firstErr <- err
+	}()
+	// The other callers only start once the first call runs.
+	waitForCall := func(key string, waiters int) {
+		t.Helper()
+		if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+			p.snapshotCalls.mutex.Lock()
+			defer p.snapshotCalls.mutex.Unlock()
+			call, ok := p.snapshotCalls.calls[key]
+			return ok && call.waiters == waiters, nil
+		}); err != nil {
+			t.Fatalf("waiting for snapshot %s with %d waiters: %v", key, waiters, err)
+		}
+	}
+	waitForCall(volumeHandle+"/deletion-test-uid", 0)
+	var snapshotID, otherSnapshotID string
+	var err, otherErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		snapshotID, err = p.createDeletionSnapshot(context.Background(), pv, volumeHandle, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		otherSnapshotID, otherErr = p.createDeletionSnapshot(context.Background(), otherPV, volumeHandle, nil)
+	}()
+
+	waitForCall(volumeHandle+"/deletion-test-uid", 1)
+	waitForCall(volumeHandle+"/deletion-other-uid", 0)
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("expected the first caller to give up with %v, got %v", context.Canceled, err)
+	}
+	close(release)
+	wg.Wait()
+
+	if err != nil || snapshotID != "snap-deletion-test-uid" {
+		t.Errorf("expected snapshot snap-deletion-test-uid, got %q and error %v", snapshotID, err)
+	}
+	if otherErr != nil || otherSnapshotID != "snap-deletion-other-uid" {
+		t.Errorf("expected snapshot snap-deletion-other-uid, got %q and error %v", otherSnapshotID, otherErr)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DriverCapabilities caches the plugin and controller capabilities of the
+// CSI driver. ShouldProvision uses them to reject claims which the driver
+// cannot provision without calling CreateVolume.
+type DriverCapabilities struct {
+	conn    *grpc.ClientConn
+	timeout time.Duration
+
+	mutex      sync.RWMutex
+	plugin     rpc.PluginCapabilitySet
+	controller rpc.ControllerCapabilitySet
+}
+
+// NewDriverCapabilities creates a cache with the capabilities that were
+// retrieved at startup.
+func NewDriverCapabilities(conn *grpc.ClientConn, timeout time.Duration, pluginCapabilities rpc.PluginCapabilitySet, controllerCapabilities rpc.ControllerCapabilitySet) *DriverCapabilities {
+	return &DriverCapabilities{
+		conn:       conn,
+		timeout:    timeout,
+		plugin:     pluginCapabilities,
+		controller: controllerCapabilities,
+	}
+}
+
+// Run refreshes the capabilities at the given interval until the context is
+// canceled.
+func (c *DriverCapabilities) Run(ctx context.Context, interval time.Duration) {
+	klog.Infof("Refreshing driver capabilities every %s", interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.refresh(); err != nil {
+			klog.Warningf("Refreshing driver capabilities failed, keeping the old ones: %v", err)
+		}
+	}, interval)
+}
+
+func (c *DriverCapabilities) refresh() error {
+	pluginCapabilities, controllerCapabilities, err := GetDriverCapabilities(c.conn, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.set(pluginCapabilities, controllerCapabilities)
+	return nil
+}
+
+func (c *DriverCapabilities) set(pluginCapabilities rpc.PluginCapabilitySet, controllerCapabilities rpc.ControllerCapabilitySet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.plugin = pluginCapabilities
+	c.controller = controllerCapabilities
+}
+
+// checkClaim returns an error if the claim asks for something that the
+// driver doesn't support. The storage class is optional.
+func (c *DriverCapabilities) checkClaim(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if !c.controller[csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME] {
+		return errors.New("the driver does not support dynamic provisioning")
+	}
+	kind, apiGroup := claimDataSource(claim)
+	switch {
+	case kind == snapshotKind && apiGroup == snapshotAPIGroup:
+		if !c.controller[csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT] {
+			return errors.New("the driver does not support restoring snapshots")
+		}
+	case kind == pvcKind && apiGroup == "":
+		if !c.controller[csi.ControllerServiceCapability_RPC_CLONE_VOLUME] {
+			return errors.New("the driver does not support cloning volumes")
+		}
+	}
+	if sc != nil && len(sc.AllowedTopologies) > 0 && !SupportsTopology(c.plugin) {
+		return fmt.Errorf("the driver does not support topology, but StorageClass %s has allowed topologies", sc.Name)
+	}
+	return nil
+}
+
+// claimDataSource returns kind and API group of the data source of the
+// claim, if any.
+func claimDataSource(claim *v1.PersistentVolumeClaim) (kind, apiGroup string) {
+	switch {
+	case claim.Spec.DataSourceRef != nil:
+		kind = claim.Spec.DataSourceRef.Kind
+		if claim.Spec.DataSourceRef.APIGroup != nil {
+			apiGroup = *claim.Spec.DataSourceRef.APIGroup
+		}
+	case claim.Spec.DataSource != nil:
+		kind = claim.Spec.DataSource.Kind
+		if claim.Spec.DataSource.APIGroup != nil {
+			apiGroup = *claim.Spec.DataSource.APIGroup
+		}
+	}
+	return kind, apiGroup
+}
+
+// checkClaimCapabilities checks the claim against the cached driver
+// capabilities and emits an event if the driver cannot provision it.
+func (p *csiProvisioner) checkClaimCapabilities(claim *v1.PersistentVolumeClaim) bool {
+	var sc *storagev1.StorageClass
+	if p.scLister != nil && claim.Spec.StorageClassName != nil {
+		// Without the class, only the claim itself gets checked.
+		sc, _ = p.scLister.Get(*claim.Spec.StorageClassName)
+	}
+	if err := p.driverCapabilities.checkClaim(claim, sc); err != nil {
+		klog.V(2).Infof("not provisioning PVC %s/%s: %v", claim.Namespace, claim.Name, err)
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "UnsupportedCapability", err.Error())
+		return false
+	}
+	return true
+}
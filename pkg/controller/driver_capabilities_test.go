@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+func TestShouldProvisionCheckClaimCapabilities(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	snapshotAPIGroup := snapshotAPIGroup
+	topologyClass := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "topology"},
+		AllowedTopologies: []v1.TopologySelectorTerm{{
+			MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{{
+				Key:    "com.example.csi/zone",
+				Values: []string{"zone1"},
+			}},
+		}},
+	}
+
+	testcases := map[string]struct {
+		dataSource             *v1.TypedLocalObjectReference
+		storageClassName       string
+		pluginCapabilities     rpc.PluginCapabilitySet
+		controllerCapabilities rpc.ControllerCapabilitySet
+		expectProvision        bool
+	}{
+		"plain volume": {
+			expectProvision: true,
+		},
+		"no dynamic provisioning": {
+			controllerCapabilities: rpc.ControllerCapabilitySet{},
+		},
+		"snapshot supported": {
+			dataSource: &v1.TypedLocalObjectReference{Kind: snapshotKind, APIGroup: &snapshotAPIGroup, Name: "snapshot"},
+			controllerCapabilities: rpc.ControllerCapabilitySet{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:   true,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT: true,
+			},
+			expectProvision: true,
+		},
+		"snapshot unsupported": {
+			dataSource: &v1.TypedLocalObjectReference{Kind: snapshotKind, APIGroup: &snapshotAPIGroup, Name: "snapshot"},
+		},
+		"clone supported": {
+			dataSource: &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "source"},
+			controllerCapabilities: rpc.ControllerCapabilitySet{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: true,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME:         true,
+			},
+			expectProvision: true,
+		},
+		"clone unsupported": {
+			dataSource: &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "source"},
+		},
+		"populator": {
+			dataSource:      &v1.TypedLocalObjectReference{Kind: "Populator", Name: "source"},
+			expectProvision: true,
+		},
+		"topology supported": {
+			storageClassName: topologyClass.Name,
+			pluginCapabilities: rpc.PluginCapabilitySet{
+				csi.PluginCapability_Service_CONTROLLER_SERVICE:               true,
+				csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS: true,
+			},
+			expectProvision: true,
+		},
+		"topology unsupported": {
+			storageClassName: topologyClass.Name,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			claim := createFakePVC(100)
+			claim.Spec.DataSource = tc.dataSource
+			if tc.storageClassName != "" {
+				claim.Spec.StorageClassName = &tc.storageClassName
+			}
+			pluginCaps, controllerCaps := provisionCapabilities()
+			if tc.pluginCapabilities != nil {
+				pluginCaps = tc.pluginCapabilities
+			}
+			if tc.controllerCapabilities != nil {
+				controllerCaps = tc.controllerCapabilities
+			}
+
+			clientSet := fakeclientset.NewSimpleClientset(topologyClass)
+			scLister, _, _, _, _, stopChan := listers(clientSet)
+			defer close(stopChan)
+			recorder := record.NewFakeRecorder(10)
+			// The provisioner itself always gets the default capabilities,
+			// only the cache differs.
+			defaultPluginCaps, defaultControllerCaps := provisionCapabilities()
+			provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				nil, nil, driverName, defaultPluginCaps, defaultControllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder),
+				CheckClaimCapabilities(NewDriverCapabilities(nil, time.Second, pluginCaps, controllerCaps)))
+
+			provision := provisioner.(*csiProvisioner).ShouldProvision(context.Background(), claim)
+			if provision != tc.expectProvision {
+				t.Fatalf("expected ShouldProvision %v, got %v", tc.expectProvision, provision)
+			}
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectProvision && event != "" {
+				t.Errorf("expected no event, got %q", event)
+			}
+			if !tc.expectProvision && !strings.Contains(event, "UnsupportedCapability") {
+				t.Errorf("expected UnsupportedCapability event, got %q", event)
+			}
+		})
+	}
+}
+
+func TestDriverCapabilitiesRefresh(t *testing.T) {
+	claim := createFakePVC(100)
+	claim.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: pvcKind, Name: "source"}
+	pluginCaps, controllerCaps := provisionCapabilities()
+	capabilities := NewDriverCapabilities(nil, time.Second, pluginCaps, controllerCaps)
+	if err := capabilities.checkClaim(claim, nil); err == nil {
+		t.Fatal("expected error for cloning without CLONE_VOLUME, got none")
+	}
+
+	capabilities.set(pluginCaps, rpc.ControllerCapabilitySet{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: true,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME:         true,
+	})
+	if err := capabilities.checkClaim(claim, nil); err != nil {
+		t.Errorf("unexpected error after refresh: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annDriverVersion on a PV records the vendor version of the CSI driver
+// which created the volume, as reported by GetPluginInfo at startup.
+const annDriverVersion = "provisioner.k8s.io/driver-version"
+
+// DriverInfo is what the CSI driver reported about itself at startup. It
+// gets served as JSON for debugging.
+type DriverInfo struct {
+	Name                   string            `json:"name"`
+	VendorVersion          string            `json:"vendorVersion"`
+	Manifest               map[string]string `json:"manifest,omitempty"`
+	PluginCapabilities     []string          `json:"pluginCapabilities"`
+	ControllerCapabilities []string          `json:"controllerCapabilities"`
+}
+
+// GetDriverInfo calls GetPluginInfo and combines the result with the
+// capabilities which were retrieved before.
+func GetDriverInfo(conn *grpc.ClientConn, timeout time.Duration, pluginCapabilities rpc.PluginCapabilitySet, controllerCapabilities rpc.ControllerCapabilitySet) (*DriverInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rsp, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DriverInfo{
+		Name:                   rsp.GetName(),
+		VendorVersion:          rsp.GetVendorVersion(),
+		Manifest:               rsp.GetManifest(),
+		PluginCapabilities:     []string{},
+		ControllerCapabilities: []string{},
+	}
+	for capability, supported := range pluginCapabilities {
+		if supported {
+			info.PluginCapabilities = append(info.PluginCapabilities, capability.String())
+		}
+	}
+	for capability, supported := range controllerCapabilities {
+		if supported {
+			info.ControllerCapabilities = append(info.ControllerCapabilities, capability.String())
+		}
+	}
+	sort.Strings(info.PluginCapabilities)
+	sort.Strings(info.ControllerCapabilities)
+	return info, nil
+}
+
+// ServeHTTP responds with the driver information as JSON.
+func (i *DriverInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(i)
+}
+
+// recordDriverVersion stamps the vendor version of the driver onto the
+// PV. Drivers which report no version leave the PV unchanged.
+func (p *csiProvisioner) recordDriverVersion(pv *v1.PersistentVolume) {
+	if p.driverVersion == "" {
+		return
+	}
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annDriverVersion, p.driverVersion)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	storagev1 "k8s.io/api/storage/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestDriverInfoHandler(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, identityServer, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{
+		Name:          driverName,
+		VendorVersion: "1.2.3",
+		Manifest:      map[string]string{"build": "abc"},
+	}, nil).Times(1)
+	identityServer.EXPECT().GetPluginCapabilities(gomock.Any(), gomock.Any()).Return(&csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS}}},
+			{Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE}}},
+		},
+	}, nil).Times(1)
+	controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).Return(&csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			{Type: &csi.ControllerServiceCapability_Rpc{Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME}}},
+			{Type: &csi.ControllerServiceCapability_Rpc{Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME}}},
+		},
+	}, nil).Times(1)
+
+	pluginCapabilities, controllerCapabilities, err := GetDriverCapabilities(csiConn.conn, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetDriverInfo(csiConn.conn, timeout, pluginCapabilities, controllerCapabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	info.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/driver", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected JSON content type, got %q", contentType)
+	}
+
+	var actual DriverInfo
+	if err := json.Unmarshal(recorder.Body.Bytes(), &actual); err != nil {
+		t.Fatalf("invalid JSON %q: %v", recorder.Body.String(), err)
+	}
+	expected := DriverInfo{
+		Name:                   driverName,
+		VendorVersion:          "1.2.3",
+		Manifest:               map[string]string{"build": "abc"},
+		PluginCapabilities:     []string{"CONTROLLER_SERVICE", "VOLUME_ACCESSIBILITY_CONSTRAINTS"},
+		ControllerCapabilities: []string{"CLONE_VOLUME", "CREATE_DELETE_VOLUME"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+// TestDriverVersion checks that the version reported by the driver ends
+// up in the info metric and in the annotation of provisioned PVs.
+func TestDriverVersion(t *testing.T) {
+	const requestBytes = 100
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, identityServer, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).Return(&csi.GetPluginInfoResponse{
+		Name:          driverName,
+		VendorVersion: "1.2.3",
+	}, nil).Times(1)
+	controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(1)
+
+	info, err := GetDriverInfo(csiConn.conn, timeout, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RecordDriverInfo(info)
+	expectedMetric := `
+# HELP controller_csi_driver_info Information about the CSI driver that volumes get provisioned with, as reported by GetPluginInfo. The value is always 1.
+# TYPE controller_csi_driver_info gauge
+controller_csi_driver_info{driver_name="` + driverName + `",vendor_version="1.2.3"} 1
+`
+	if err := testutil.CollectAndCompare(CSIDriverInfo, strings.NewReader(expectedMetric)); err != nil {
+		t.Errorf("unexpected metric: %v", err)
+	}
+
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		DriverVersion(info.VendorVersion))
+	pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVName:       "test-testi",
+		PVC:          createFakePVC(requestBytes),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version := pv.Annotations[annDriverVersion]; version != "1.2.3" {
+		t.Errorf("expected driver version annotation 1.2.3, got %q", version)
+	}
+}
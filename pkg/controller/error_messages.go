@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrorMessages maps gRPC status codes of failed CreateVolume and
+// DeleteVolume calls to messages that explain the failure to users. The
+// messages get prepended to the error of the CSI driver and thus end up in
+// the ProvisioningFailed and VolumeFailedDelete events.
+type ErrorMessages map[codes.Code]string
+
+// DefaultErrorMessages returns the built-in messages for the most common
+// errors.
+func DefaultErrorMessages() ErrorMessages {
+	return ErrorMessages{
+		codes.InvalidArgument:    "the CSI driver rejected the StorageClass parameters or the PVC",
+		codes.AlreadyExists:      "a volume with the same name but different parameters already exists",
+		codes.PermissionDenied:   "the CSI driver rejected the credentials, check the provisioner secrets of the StorageClass",
+		codes.Unauthenticated:    "the CSI driver rejected the credentials, check the provisioner secrets of the StorageClass",
+		codes.ResourceExhausted:  "insufficient capacity in the selected topology",
+		codes.FailedPrecondition: "the volume is not in a state that allows this operation, for example because it still has snapshots",
+		codes.OutOfRange:         "the requested size is not supported by the CSI driver",
+		codes.Unimplemented:      "the CSI driver does not support this operation",
+	}
+}
+
+// LoadErrorMessages returns the default messages, overridden by the
+// messages in the ConfigMap. The keys of the ConfigMap are status code
+// names like ResourceExhausted. An empty message disables the translation
+// of that code.
+func LoadErrorMessages(ctx context.Context, client kubernetes.Interface, namespace, name string) (ErrorMessages, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	return parseErrorMessages(configMap.Data)
+}
+
+func parseErrorMessages(data map[string]string) (ErrorMessages, error) {
+	names := map[string]codes.Code{}
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		names[code.String()] = code
+	}
+
+	messages := DefaultErrorMessages()
+	for key, message := range data {
+		code, ok := names[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown status code %q", key)
+		}
+		if message == "" {
+			delete(messages, code)
+			continue
+		}
+		messages[code] = message
+	}
+	return messages, nil
+}
+
+// translate prepends the message for the status code of the error, if
+// there is one. Other errors are returned unchanged.
+func (m ErrorMessages) translate(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	message, ok := m[st.Code()]
+	if !ok {
+		return err
+	}
+	return &translatedError{message: message, err: err}
+}
+
+// translatedError keeps the original error, so status.FromError still
+// works for it.
+type translatedError struct {
+	message string
+	err     error
+}
+
+func (e *translatedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *translatedError) Unwrap() error {
+	return e.err
+}
+
+func (e *translatedError) GRPCStatus() *status.Status {
+	st, _ := status.FromError(e.err)
+	return st
+}
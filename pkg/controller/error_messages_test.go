@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTranslateErrors(t *testing.T) {
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "error-messages"},
+		Data: map[string]string{
+			"InvalidArgument": "unsupported disk type, see the driver documentation",
+			"Unimplemented":   "",
+		},
+	}
+	messages, err := LoadErrorMessages(context.Background(), fakeclientset.NewSimpleClientset(configMap), configMap.Namespace, configMap.Name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := map[string]struct {
+		messages      ErrorMessages
+		err           error
+		expectedError string
+	}{
+		"no messages": {
+			err:           status.Error(codes.ResourceExhausted, "no space"),
+			expectedError: "rpc error: code = ResourceExhausted desc = no space",
+		},
+		"resource exhausted": {
+			messages:      DefaultErrorMessages(),
+			err:           status.Error(codes.ResourceExhausted, "no space"),
+			expectedError: "insufficient capacity in the selected topology: rpc error: code = ResourceExhausted desc = no space",
+		},
+		"permission denied": {
+			messages:      DefaultErrorMessages(),
+			err:           status.Error(codes.PermissionDenied, "bad token"),
+			expectedError: "the CSI driver rejected the credentials, check the provisioner secrets of the StorageClass: rpc error: code = PermissionDenied desc = bad token",
+		},
+		"pass-through code": {
+			messages:      DefaultErrorMessages(),
+			err:           status.Error(codes.Internal, "driver bug"),
+			expectedError: "rpc error: code = Internal desc = driver bug",
+		},
+		"pass-through non-gRPC error": {
+			messages:      DefaultErrorMessages(),
+			err:           errors.New("invalid CSI PV"),
+			expectedError: "invalid CSI PV",
+		},
+		"overridden": {
+			messages:      messages,
+			err:           status.Error(codes.InvalidArgument, "type=foo"),
+			expectedError: "unsupported disk type, see the driver documentation: rpc error: code = InvalidArgument desc = type=foo",
+		},
+		"disabled": {
+			messages:      messages,
+			err:           status.Error(codes.Unimplemented, "no clones"),
+			expectedError: "rpc error: code = Unimplemented desc = no clones",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.messages.translate(tc.err)
+			if err.Error() != tc.expectedError {
+				t.Errorf("expected error %q, got %q", tc.expectedError, err.Error())
+			}
+			if status.Code(err) != status.Code(tc.err) {
+				t.Errorf("expected status code %s, got %s", status.Code(tc.err), status.Code(err))
+			}
+		})
+	}
+
+	if err := DefaultErrorMessages().translate(nil); err != nil {
+		t.Errorf("expected nil error to stay nil, got %v", err)
+	}
+}
+
+func TestParseErrorMessagesUnknownCode(t *testing.T) {
+	if _, err := parseErrorMessages(map[string]string{"NoSpace": "out of space"}); err == nil {
+		t.Error("expected error for unknown status code, got none")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	operationProvision = "provision"
+	operationDelete    = "delete"
+
+	// The reasons of OperationFailuresTotal.
+	failureReasonCapacity          = "capacity"
+	failureReasonAuth              = "auth"
+	failureReasonInvalidParameters = "invalid-params"
+	failureReasonTimeout           = "timeout"
+	failureReasonTopology          = "topology"
+	failureReasonUnknown           = "unknown"
+)
+
+// grpcCodePattern finds the status code of gRPC errors which were turned
+// into plain errors by formatting them with %v.
+var grpcCodePattern = regexp.MustCompile(`rpc error: code = (\w+) desc`)
+
+// codeReasons maps gRPC status codes to failure reasons. Other codes are
+// unknown.
+var codeReasons = map[codes.Code]string{
+	codes.ResourceExhausted:  failureReasonCapacity,
+	codes.OutOfRange:         failureReasonCapacity,
+	codes.Unauthenticated:    failureReasonAuth,
+	codes.PermissionDenied:   failureReasonAuth,
+	codes.InvalidArgument:    failureReasonInvalidParameters,
+	codes.FailedPrecondition: failureReasonInvalidParameters,
+	codes.DeadlineExceeded:   failureReasonTimeout,
+	codes.Canceled:           failureReasonTimeout,
+}
+
+// errorCode returns the gRPC status code of the error, also if it was
+// wrapped, and false for other errors.
+func errorCode(err error) (codes.Code, bool) {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code(), true
+	}
+	if match := grpcCodePattern.FindStringSubmatch(err.Error()); match != nil {
+		for code := codes.OK; code <= codes.Unauthenticated; code++ {
+			if code.String() == match[1] {
+				return code, true
+			}
+		}
+	}
+	return codes.Unknown, false
+}
+
+// classifyFailure maps an error of Provision or Delete to one of a
+// bounded set of reasons, based on the gRPC status code or, for other
+// errors, on the type and message of the error.
+func classifyFailure(err error) string {
+	var topologyErr *nodeTopologyError
+	switch {
+	case errors.As(err, &topologyErr):
+		return failureReasonTopology
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return failureReasonTimeout
+	case apierrors.IsUnauthorized(err), apierrors.IsForbidden(err):
+		return failureReasonAuth
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return failureReasonTimeout
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return failureReasonInvalidParameters
+	}
+	if code, ok := errorCode(err); ok {
+		if reason, ok := codeReasons[code]; ok {
+			return reason
+		}
+		return failureReasonUnknown
+	}
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "topology") || strings.Contains(message, "accessibility requirements"):
+		return failureReasonTopology
+	case strings.Contains(message, "capacity"):
+		return failureReasonCapacity
+	case strings.Contains(message, "invalid") || strings.Contains(message, "not supported") || strings.Contains(message, "unknown parameter"):
+		return failureReasonInvalidParameters
+	case strings.Contains(message, "timed out") || strings.Contains(message, "timeout"):
+		return failureReasonTimeout
+	}
+	return failureReasonUnknown
+}
+
+// observeFailure counts the failed operation in OperationFailuresTotal.
+func observeFailure(operation string, err error) {
+	OperationFailuresTotal.WithLabelValues(operation, classifyFailure(err)).Inc()
+}
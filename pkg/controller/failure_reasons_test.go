@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	secrets := schema.GroupResource{Resource: "secrets"}
+
+	testcases := map[string]struct {
+		err            error
+		expectedReason string
+	}{
+		"resource exhausted": {
+			err:            status.Error(codes.ResourceExhausted, "pool is full"),
+			expectedReason: failureReasonCapacity,
+		},
+		"out of range": {
+			err:            status.Error(codes.OutOfRange, "too large"),
+			expectedReason: failureReasonCapacity,
+		},
+		"permission denied": {
+			err:            status.Error(codes.PermissionDenied, "no access"),
+			expectedReason: failureReasonAuth,
+		},
+		"unauthenticated": {
+			err:            status.Error(codes.Unauthenticated, "bad credentials"),
+			expectedReason: failureReasonAuth,
+		},
+		"invalid argument": {
+			err:            status.Error(codes.InvalidArgument, "bad parameter"),
+			expectedReason: failureReasonInvalidParameters,
+		},
+		"deadline exceeded": {
+			err:            status.Error(codes.DeadlineExceeded, "too slow"),
+			expectedReason: failureReasonTimeout,
+		},
+		"unavailable": {
+			err:            status.Error(codes.Unavailable, "connection refused"),
+			expectedReason: failureReasonUnknown,
+		},
+		"wrapped status": {
+			err:            fmt.Errorf("rpc failed: %w", status.Error(codes.ResourceExhausted, "pool is full")),
+			expectedReason: failureReasonCapacity,
+		},
+		"formatted status": {
+			err:            fmt.Errorf("rpc failed: %v", status.Error(codes.PermissionDenied, "no access")),
+			expectedReason: failureReasonAuth,
+		},
+		"formatted status mentioning topology": {
+			err:            fmt.Errorf("rpc failed: %v", status.Error(codes.Internal, "topology agent crashed")),
+			expectedReason: failureReasonUnknown,
+		},
+		"context deadline": {
+			err:            fmt.Errorf("waiting: %w", context.DeadlineExceeded),
+			expectedReason: failureReasonTimeout,
+		},
+		"node topology": {
+			err:            fmt.Errorf("cannot determine the topology of selected node: %w", &nodeTopologyError{message: "no CSINode"}),
+			expectedReason: failureReasonTopology,
+		},
+		"topology message": {
+			err:            errors.New("error generating accessibility requirements: no available topology found"),
+			expectedReason: failureReasonTopology,
+		},
+		"forbidden secret": {
+			err:            apierrors.NewForbidden(secrets, "credentials", errors.New("RBAC")),
+			expectedReason: failureReasonAuth,
+		},
+		"API server timeout": {
+			err:            apierrors.NewServerTimeout(secrets, "get", 1),
+			expectedReason: failureReasonTimeout,
+		},
+		"capacity message": {
+			err:            errors.New("created volume capacity 10 less than requested capacity 100"),
+			expectedReason: failureReasonCapacity,
+		},
+		"invalid parameter message": {
+			err:            errors.New(`invalid csi.storage.k8s.io/default-size parameter "-1Gi" in StorageClass fast: must be a positive quantity`),
+			expectedReason: failureReasonInvalidParameters,
+		},
+		"other": {
+			err:            errors.New("something went wrong"),
+			expectedReason: failureReasonUnknown,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if reason := classifyFailure(tc.err); reason != tc.expectedReason {
+				t.Errorf("expected reason %s, got %s", tc.expectedReason, reason)
+			}
+		})
+	}
+}
+
+func TestObserveFailure(t *testing.T) {
+	OperationFailuresTotal.Reset()
+	observeFailure(operationProvision, status.Error(codes.ResourceExhausted, "pool is full"))
+	observeFailure(operationProvision, status.Error(codes.ResourceExhausted, "pool is full"))
+	observeFailure(operationDelete, status.Error(codes.DeadlineExceeded, "too slow"))
+
+	if count := testutil.ToFloat64(OperationFailuresTotal.WithLabelValues(operationProvision, failureReasonCapacity)); count != 2 {
+		t.Errorf("expected 2 provisioning failures because of capacity, got %v", count)
+	}
+	if count := testutil.ToFloat64(OperationFailuresTotal.WithLabelValues(operationDelete, failureReasonTimeout)); count != 1 {
+		t.Errorf("expected 1 deletion failure because of a timeout, got %v", count)
+	}
+}
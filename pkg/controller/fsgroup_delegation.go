@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annFSGroupDelegated on a filesystem PV records that the driver applies
+// the fsGroup of the pod itself while mounting the volume, so the
+// recursive change of ownership by kubelet is not needed.
+const annFSGroupDelegated = "provisioner.k8s.io/fsgroup-delegated"
+
+// SupportsVolumeMountGroup checks whether the node service of the driver
+// has the VOLUME_MOUNT_GROUP capability. Drivers without a node service
+// don't have it.
+func SupportsVolumeMountGroup(conn *grpc.ClientConn, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := csi.NewNodeClient(conn)
+	rsp, err := client.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, capability := range rsp.GetCapabilities() {
+		if capability.GetRpc().GetType() == csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordFSGroupDelegation marks filesystem PVs as having fsGroup delegated
+// to the driver.
+func (p *csiProvisioner) recordFSGroupDelegation(pv *v1.PersistentVolume, claim *v1.PersistentVolumeClaim) {
+	if !p.fsGroupDelegated || (claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock) {
+		return
+	}
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annFSGroupDelegated, "true")
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-test/v5/driver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestFSGroupDelegation(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		// noNodeService simulates a driver without node service, which
+		// doesn't implement NodeGetCapabilities.
+		noNodeService    bool
+		nodeCapabilities []csi.NodeServiceCapability_RPC_Type
+		volumeMode       v1.PersistentVolumeMode
+		expectDelegated  bool
+	}{
+		"VOLUME_MOUNT_GROUP": {
+			nodeCapabilities: []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME, csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP},
+			volumeMode:       v1.PersistentVolumeFilesystem,
+			expectDelegated:  true,
+		},
+		"VOLUME_MOUNT_GROUP, block": {
+			nodeCapabilities: []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP},
+			volumeMode:       v1.PersistentVolumeBlock,
+		},
+		"no VOLUME_MOUNT_GROUP": {
+			nodeCapabilities: []csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME},
+			volumeMode:       v1.PersistentVolumeFilesystem,
+		},
+		"no node service": {
+			noNodeService: true,
+			volumeMode:    v1.PersistentVolumeFilesystem,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController := gomock.NewController(t)
+			defer mockController.Finish()
+			controllerServer := driver.NewMockControllerServer(mockController)
+			nodeServer := driver.NewMockNodeServer(mockController)
+			if tc.noNodeService {
+				nodeServer.EXPECT().NodeGetCapabilities(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Unimplemented, "no node service")).Times(1)
+			} else {
+				var capabilities []*csi.NodeServiceCapability
+				for _, capability := range tc.nodeCapabilities {
+					capabilities = append(capabilities, &csi.NodeServiceCapability{
+						Type: &csi.NodeServiceCapability_Rpc{
+							Rpc: &csi.NodeServiceCapability_RPC{Type: capability},
+						},
+					})
+				}
+				nodeServer.EXPECT().NodeGetCapabilities(gomock.Any(), gomock.Any()).Return(&csi.NodeGetCapabilitiesResponse{
+					Capabilities: capabilities,
+				}, nil).Times(1)
+			}
+			drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+				Identity:   driver.NewMockIdentityServer(mockController),
+				Controller: controllerServer,
+				Node:       nodeServer,
+			})
+			if err := drv.StartOnAddress("unix", filepath.Join(tmpdir, "csi.sock")); err != nil {
+				t.Fatal(err)
+			}
+			defer drv.Stop()
+			csiConn, err := New(drv.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			delegated, err := SupportsVolumeMountGroup(csiConn.conn, 5*time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: requestBytes,
+					VolumeId:      "test-volume-id",
+				},
+			}, nil).Times(1)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(), 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				FSGroupDelegated(delegated))
+
+			pv, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVCWithVolumeMode(requestBytes, tc.volumeMode),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := pv.Annotations[annFSGroupDelegated]; ok != tc.expectDelegated {
+				t.Errorf("expected %s annotation: %v, got annotations %v", annFSGroupDelegated, tc.expectDelegated, pv.Annotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// GlobalPauseKey is the key in the pause ConfigMap which, with value
+// "true", pauses all provisioning and deletion.
+const GlobalPauseKey = "paused"
+
+// GlobalPause tracks the pause switch in a ConfigMap. While it is on,
+// ShouldProvision and ShouldDelete skip all PVCs and PVs without counting
+// that as failure. When it ends, the PVCs and PVs of the informers given to
+// RequeueOnResume get queued again.
+type GlobalPause struct {
+	mutex     sync.Mutex
+	paused    bool
+	informers []*RequeueInformer
+}
+
+// NewGlobalPause watches the ConfigMap with the given name. The informer
+// should only list the namespace of that ConfigMap and has to be started
+// by the caller. Without the ConfigMap, nothing is paused.
+func NewGlobalPause(informer coreinformers.ConfigMapInformer, name string) *GlobalPause {
+	g := &GlobalPause{}
+	update := func(obj interface{}) {
+		configMap, ok := obj.(*v1.ConfigMap)
+		if !ok || configMap.Name != name {
+			return
+		}
+		g.set(configMap.Data[GlobalPauseKey] == "true")
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			update(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+				obj = unknown.Obj
+			}
+			if configMap, ok := obj.(*v1.ConfigMap); ok && configMap.Name == name {
+				g.set(false)
+			}
+		},
+	}
+	informer.Informer().AddEventHandler(handler)
+	return g
+}
+
+// RequeueOnResume queues all objects of the informers again when the pause
+// ends.
+func (g *GlobalPause) RequeueOnResume(informers ...*RequeueInformer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.informers = append(g.informers, informers...)
+}
+
+func (g *GlobalPause) set(paused bool) {
+	g.mutex.Lock()
+	resumed := !paused && g.paused
+	switch {
+	case paused && !g.paused:
+		klog.Warning("provisioning and deletion are paused by the pause ConfigMap")
+	case resumed:
+		klog.Info("provisioning and deletion are resumed by the pause ConfigMap")
+	}
+	g.paused = paused
+	informers := g.informers
+	g.mutex.Unlock()
+
+	if resumed {
+		for _, informer := range informers {
+			informer.requeue(nil)
+		}
+	}
+}
+
+// isPaused returns true while provisioning and deletion are paused.
+func (g *GlobalPause) isPaused() bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+func TestGlobalPause(t *testing.T) {
+	const (
+		namespace = "kube-system"
+		name      = "provisioner-pause"
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data:       map[string]string{GlobalPauseKey: "true"},
+	}
+	claim := createFakePVC(100)
+	clientSet := fakeclientset.NewSimpleClientset(configMap, claim)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientSet, 0, informers.WithNamespace(namespace))
+	pause := NewGlobalPause(factory.Core().V1().ConfigMaps(), name)
+	claimFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	claimInformer := NewRequeueInformer(claimFactory.Core().V1().PersistentVolumeClaims().Informer())
+	pause.RequeueOnResume(claimInformer)
+
+	// Stands in for the work queue of the provisioner library, which
+	// only gets the claims handed over by the informer.
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	if _, err := claimInformer.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			queue.Add(newObj.(*v1.PersistentVolumeClaim).UID)
+		},
+	}, 0); err != nil {
+		t.Fatal(err)
+	}
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	claimFactory.Start(ctx.Done())
+	claimFactory.WaitForCacheSync(ctx.Done())
+
+	// The CSI driver must not be called while paused, so there is none.
+	recorder := record.NewFakeRecorder(10)
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, nil, nil, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		WithGlobalPause(pause), withEventRecorder(recorder))
+	volume := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "test-pv"}}
+
+	// Paused PVCs and PVs are skipped like the library does for
+	// ShouldProvision and ShouldDelete returning false: no event, no
+	// failure and no backoff.
+	expectPaused := func(what string) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			queue.AddRateLimited(claim.UID)
+			item, _ := queue.Get()
+			if provisioner.(*csiProvisioner).ShouldProvision(ctx, claim) {
+				t.Errorf("%s: expected ShouldProvision to return false", what)
+				queue.AddRateLimited(item)
+			} else {
+				queue.Forget(item)
+			}
+			queue.Done(item)
+			if requeues := queue.NumRequeues(claim.UID); requeues != 0 {
+				t.Errorf("%s: expected no backoff, got %d requeues", what, requeues)
+			}
+		}
+		if provisioner.(*csiProvisioner).ShouldDelete(ctx, volume) {
+			t.Errorf("%s: expected ShouldDelete to return false", what)
+		}
+		select {
+		case event := <-recorder.Events:
+			t.Errorf("%s: expected no event, got %q", what, event)
+		default:
+		}
+	}
+	expectPaused("paused")
+
+	// Other unrelated ConfigMaps and keys don't resume.
+	other := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "other"},
+	}
+	if _, err := clientSet.CoreV1().ConfigMaps(namespace).Create(ctx, other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	expectPaused("after creating another ConfigMap")
+	if queue.Len() != 0 {
+		t.Fatalf("expected no queued claims while paused, got %d", queue.Len())
+	}
+
+	// Unpausing resumes and queues the claims again.
+	configMap.Data[GlobalPauseKey] = "false"
+	if _, err := clientSet.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPause(t, pause, false)
+	if !provisioner.(*csiProvisioner).ShouldProvision(ctx, claim) {
+		t.Error("expected ShouldProvision to return true after resuming")
+	}
+	item, _ := queue.Get()
+	if item != claim.UID {
+		t.Errorf("expected claim %s to be queued again after resuming, got %v", claim.UID, item)
+	}
+	queue.Forget(item)
+	queue.Done(item)
+
+	// Pausing again.
+	configMap.Data[GlobalPauseKey] = "true"
+	if _, err := clientSet.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPause(t, pause, true)
+	expectPaused("paused again")
+
+	// Deleting the ConfigMap resumes.
+	if err := clientSet.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPause(t, pause, false)
+}
+
+func TestGlobalPauseNil(t *testing.T) {
+	var pause *GlobalPause
+	if pause.isPaused() {
+		t.Error("expected no pause without ConfigMap")
+	}
+}
+
+func waitForPause(t *testing.T, pause *GlobalPause, paused bool) {
+	for i := 0; i < 100; i++ {
+		if pause.isPaused() == paused {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected paused to become %v", paused)
+}
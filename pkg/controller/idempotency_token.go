@@ -0,0 +1,49 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// idempotencyTokenKey is the CreateVolume parameter with the
+	// idempotency token of the volume. Drivers which choose the names of
+	// their volumes themselves must return the volume that was created
+	// for a token before instead of creating another one.
+	idempotencyTokenKey = "csi.storage.k8s.io/idempotency-token"
+
+	// annIdempotencyToken on a PV records the idempotency token which was
+	// passed to CreateVolume.
+	annIdempotencyToken = "provisioner.k8s.io/idempotency-token"
+)
+
+// idempotencyToken returns the token for the volume of the claim. It is
+// the UID of the claim, so all attempts to provision the claim use the
+// same token, even if the volume name changes after a name conflict.
+func idempotencyToken(claim *v1.PersistentVolumeClaim) string {
+	return string(claim.UID)
+}
+
+// recordIdempotencyToken stores the token that was passed to CreateVolume
+// in the PV.
+func recordIdempotencyToken(pv *v1.PersistentVolume, parameters map[string]string) {
+	if token, ok := parameters[idempotencyTokenKey]; ok {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annIdempotencyToken, token)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// tokenDriver creates volumes with names of its own choosing and returns
+// the volume of an earlier call with the same idempotency token.
+type tokenDriver struct {
+	mutex   sync.Mutex
+	volumes map[string]string
+	calls   []*csi.CreateVolumeRequest
+}
+
+func (d *tokenDriver) createVolume(req *csi.CreateVolumeRequest) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.calls = append(d.calls, req)
+	token := req.Parameters[idempotencyTokenKey]
+	if id, ok := d.volumes[token]; ok {
+		return id
+	}
+	id := fmt.Sprintf("backend-volume-%d", len(d.volumes)+1)
+	d.volumes[token] = id
+	return id
+}
+
+func TestProvisionIdempotencyToken(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		// firstErr is returned by the first CreateVolume call after the
+		// driver already created the volume.
+		firstErr          error
+		retryOnConflict   bool
+		expectedProvision int
+	}{
+		"timeout": {
+			firstErr:          status.Error(codes.DeadlineExceeded, "timed out"),
+			expectedProvision: 2,
+		},
+		"name conflict": {
+			firstErr:          status.Error(codes.AlreadyExists, "name in use"),
+			retryOnConflict:   true,
+			expectedProvision: 1,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			opts := []ProvisionerOption{PassIdempotencyToken(true)}
+			if tc.retryOnConflict {
+				opts = append(opts, RetryOnVolumeNameConflict(true))
+			}
+			pt := newProvisionerTest(t, nil, opts...)
+			backend := &tokenDriver{volumes: map[string]string{}}
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					id := backend.createVolume(req)
+					if len(backend.calls) == 1 {
+						return nil, tc.firstErr
+					}
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: requestBytes,
+							VolumeId:      id,
+						},
+					}, nil
+				}).Times(2)
+
+			claim := createFakePVC(requestBytes)
+			options := controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+			}
+			pv, _, err := pt.provisioner.Provision(context.Background(), options)
+			for i := 1; i < tc.expectedProvision; i++ {
+				if err == nil {
+					t.Fatalf("provisioning attempt #%d: expected error, got none", i)
+				}
+				pv, _, err = pt.provisioner.Provision(context.Background(), options)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(backend.volumes) != 1 {
+				t.Errorf("expected one backend volume, got %v", backend.volumes)
+			}
+			for i, req := range backend.calls {
+				if token := req.Parameters[idempotencyTokenKey]; token != string(claim.UID) {
+					t.Errorf("CreateVolume call #%d: expected token %q, got %q", i, claim.UID, token)
+				}
+			}
+			if handle := pv.Spec.CSI.VolumeHandle; handle != "backend-volume-1" {
+				t.Errorf("expected volume handle backend-volume-1, got %s", handle)
+			}
+			if token := pv.Annotations[annIdempotencyToken]; token != string(claim.UID) {
+				t.Errorf("expected %s annotation %q, got %q", annIdempotencyToken, claim.UID, token)
+			}
+		})
+	}
+}
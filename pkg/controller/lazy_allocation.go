@@ -0,0 +1,43 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// prefixedLazyAllocationKey=true in a StorageClass asks the driver to
+	// create volumes without allocating their storage, which then gets
+	// allocated when it is written. It gets validated and then passed to
+	// CreateVolume as lazyAllocationKey.
+	prefixedLazyAllocationKey = csiParameterPrefix + "lazy-allocation"
+	lazyAllocationKey         = "csi.storage.k8s.io/lazy-allocation"
+
+	// annLazyAllocation=true on a PV records that lazy allocation was
+	// requested for the volume.
+	annLazyAllocation = "provisioner.k8s.io/lazy-allocation"
+)
+
+// recordLazyAllocation marks PVs for which CreateVolume was asked to
+// allocate lazily. Whether the driver did so is unknown.
+func recordLazyAllocation(pv *v1.PersistentVolume, parameters map[string]string) {
+	if parameters[lazyAllocationKey] == "true" {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annLazyAllocation, "true")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionLazyAllocation(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		parameters      map[string]string
+		expectParameter string
+		expectPVAnn     bool
+		expectErr       bool
+	}{
+		"no parameter": {},
+		"lazy": {
+			parameters:      map[string]string{prefixedLazyAllocationKey: "true"},
+			expectParameter: "true",
+			expectPVAnn:     true,
+		},
+		"not lazy": {
+			parameters:      map[string]string{prefixedLazyAllocationKey: "false"},
+			expectParameter: "false",
+		},
+		"invalid": {
+			parameters: map[string]string{prefixedLazyAllocationKey: "yes"},
+			expectErr:  true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil)
+			if !tc.expectErr {
+				pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+					value, ok := req.Parameters[lazyAllocationKey]
+					if ok != (tc.expectParameter != "") || value != tc.expectParameter {
+						t.Errorf("expected %s parameter %q, got %q", lazyAllocationKey, tc.expectParameter, value)
+					}
+				})
+			}
+
+			pv, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: tc.parameters},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if tc.expectErr {
+				if _, ok := err.(*controller.IgnoredError); !ok {
+					t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := pv.Annotations[annLazyAllocation]; ok != tc.expectPVAnn {
+				t.Errorf("expected %s annotation %v, got annotations %v", annLazyAllocation, tc.expectPVAnn, pv.Annotations)
+			}
+		})
+	}
+}
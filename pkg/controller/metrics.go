@@ -0,0 +1,115 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	libmetrics "sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller/metrics"
+)
+
+// PersistentVolumeClaimProvisionEndToEndDurationSeconds complements the
+// persistentvolumeclaim_provision_duration_seconds metric of the
+// provisioner library, which only covers the last, successful attempt.
+// It has the same labels and must be registered the same way.
+var PersistentVolumeClaimProvisionEndToEndDurationSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Subsystem: libmetrics.ControllerSubsystem,
+		Name:      "persistentvolumeclaim_provision_end_to_end_duration_seconds",
+		Help:      "Latency in seconds from creation of a PVC until its volume got provisioned, including the time spent waiting in the queue and in failed attempts. Broken down by storage class name and source of the claim.",
+		// From half a second to about an hour.
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 14),
+	},
+	[]string{"class", "source"},
+)
+
+// OperationFailuresTotal counts failed provisioning and deletion attempts
+// by the reason of the failure.
+var OperationFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: libmetrics.ControllerSubsystem,
+		Name:      "operation_failures_total",
+		Help:      "Total number of failed provisioning and deletion attempts. Broken down by operation and by reason, one of capacity, auth, invalid-params, timeout, topology and unknown.",
+	},
+	[]string{"operation", "reason"},
+)
+
+// CreateVolumeParametersOversizedTotal counts the CreateVolume calls whose
+// parameters exceeded the maximum size.
+var CreateVolumeParametersOversizedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: libmetrics.ControllerSubsystem,
+		Name:      "create_volume_parameters_oversized_total",
+		Help:      "Total number of CreateVolume calls whose parameters exceeded --max-parameters-size before trimming. Broken down by storage class name.",
+	},
+	[]string{"class"},
+)
+
+// CSIDriverInfo always has the value 1. Its labels identify the CSI
+// driver that the provisioner is connected to and its vendor version.
+var CSIDriverInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: libmetrics.ControllerSubsystem,
+		Name:      "csi_driver_info",
+		Help:      "Information about the CSI driver that volumes get provisioned with, as reported by GetPluginInfo. The value is always 1.",
+	},
+	[]string{"driver_name", "vendor_version"},
+)
+
+// LastSuccessfulOperationTimestampSeconds is the time of the last
+// successful CreateVolume and DeleteVolume call. A provisioner which keeps
+// running without errors but doesn't make progress can be detected with it.
+var LastSuccessfulOperationTimestampSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: libmetrics.ControllerSubsystem,
+		Name:      "last_successful_operation_timestamp_seconds",
+		Help:      "Unix time of the last successful CreateVolume or DeleteVolume call. Broken down by operation, provision or delete. Not set until the first operation succeeded.",
+	},
+	[]string{"operation"},
+)
+
+// observeSuccess records in LastSuccessfulOperationTimestampSeconds that
+// the operation succeeded now.
+func observeSuccess(operation string, now time.Time) {
+	LastSuccessfulOperationTimestampSeconds.WithLabelValues(operation).Set(float64(now.UnixNano()) / float64(time.Second))
+}
+
+// RecordDriverInfo sets CSIDriverInfo for the driver, replacing any
+// driver that was recorded before.
+func RecordDriverInfo(info *DriverInfo) {
+	CSIDriverInfo.Reset()
+	CSIDriverInfo.WithLabelValues(info.Name, info.VendorVersion).Set(1)
+}
+
+// observeEndToEndDuration records how long it took from creating the
+// claim until now, when its volume was provisioned.
+func observeEndToEndDuration(claim *v1.PersistentVolumeClaim, now time.Time) {
+	if claim.CreationTimestamp.IsZero() {
+		return
+	}
+	class := ""
+	source := ""
+	if claim.Spec.StorageClassName != nil {
+		class = *claim.Spec.StorageClassName
+	}
+	if claim.Spec.DataSource != nil {
+		source = claim.Spec.DataSource.Kind
+	}
+	PersistentVolumeClaimProvisionEndToEndDurationSeconds.WithLabelValues(class, source).Observe(now.Sub(claim.CreationTimestamp.Time).Seconds())
+}
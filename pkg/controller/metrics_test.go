@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+	libmetrics "sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller/metrics"
+)
+
+// TestProvisionDurationMetrics runs the provisioner library with the
+// CSI provisioner and checks that both the duration of the provisioning
+// call and the end-to-end duration since creation of the PVC get
+// recorded.
+func TestProvisionDurationMetrics(t *testing.T) {
+	const (
+		requestBytes = 100
+		age          = time.Minute
+	)
+
+	claim := createFakePVC(requestBytes)
+	claim.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+	deletePolicy := v1.PersistentVolumeReclaimDelete
+	class := &storagev1.StorageClass{
+		ObjectMeta:    metav1.ObjectMeta{Name: fakeSCName},
+		Provisioner:   driverName,
+		ReclaimPolicy: &deletePolicy,
+	}
+	pt := newProvisionerTest(t, []runtime.Object{claim, class})
+	pt.expectCreateVolume(requestBytes, nil)
+
+	PersistentVolumeClaimProvisionEndToEndDurationSeconds.Reset()
+	m := libmetrics.New("test")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.PersistentVolumeClaimProvisionDurationSeconds, PersistentVolumeClaimProvisionEndToEndDurationSeconds)
+	provisionController := controller.NewProvisionController(pt.clientSet, driverName, pt.provisioner,
+		controller.LeaderElection(false),
+		controller.MetricsInstance(m),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provisionController.Run(ctx)
+
+	// The library records the call duration after creating the PV.
+	histograms := map[string]*dto.Histogram{}
+	if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		families, err := registry.Gather()
+		if err != nil {
+			return false, err
+		}
+		for _, family := range families {
+			for _, metric := range family.Metric {
+				histograms[family.GetName()] = metric.GetHistogram()
+			}
+		}
+		return len(histograms) == 2, nil
+	}); err != nil {
+		t.Fatalf("waiting for metrics: %v", err)
+	}
+	callDuration := histograms["test_persistentvolumeclaim_provision_duration_seconds"]
+	if callDuration.GetSampleCount() != 1 {
+		t.Errorf("expected one provisioning call duration, got %v", callDuration)
+	}
+	endToEnd := histograms["controller_persistentvolumeclaim_provision_end_to_end_duration_seconds"]
+	if endToEnd.GetSampleCount() != 1 {
+		t.Fatalf("expected one end-to-end duration, got %v", endToEnd)
+	}
+	if sum := endToEnd.GetSampleSum(); sum < age.Seconds() || sum <= callDuration.GetSampleSum() {
+		t.Errorf("expected end-to-end duration of at least %v and longer than the call duration %fs, got %fs", age, callDuration.GetSampleSum(), sum)
+	}
+}
+
+// TestLastSuccessfulOperationTimestamp checks that successful CreateVolume
+// and DeleteVolume calls, and only those, update the timestamp gauge.
+func TestLastSuccessfulOperationTimestamp(t *testing.T) {
+	const requestBytes = 100
+
+	pt := newProvisionerTest(t, nil)
+
+	LastSuccessfulOperationTimestampSeconds.Reset()
+	timestamp := func(operation string) float64 {
+		return testutil.ToFloat64(LastSuccessfulOperationTimestampSeconds.WithLabelValues(operation))
+	}
+	options := controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVName:       "test-testi",
+		PVC:          createFakePVC(requestBytes),
+	}
+
+	pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Internal, "backend failure")).Times(1)
+	if _, _, err := pt.provisioner.Provision(context.Background(), options); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if value := timestamp(operationProvision); value != 0 {
+		t.Errorf("expected no timestamp after failed CreateVolume, got %v", value)
+	}
+
+	start := float64(time.Now().Unix())
+	pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes: requestBytes,
+			VolumeId:      "test-volume-id",
+		},
+	}, nil).Times(1)
+	pv, _, err := pt.provisioner.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := timestamp(operationProvision); value < start {
+		t.Errorf("expected provisioning timestamp of at least %v, got %v", start, value)
+	}
+	if value := timestamp(operationDelete); value != 0 {
+		t.Errorf("expected no deletion timestamp before DeleteVolume, got %v", value)
+	}
+
+	pt.controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+	if err := pt.provisioner.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := timestamp(operationDelete); value < start {
+		t.Errorf("expected deletion timestamp of at least %v, got %v", start, value)
+	}
+}
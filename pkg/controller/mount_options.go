@@ -0,0 +1,71 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+// annMountOptions on a PVC lists, separated by commas, which of the mount
+// options of the storage class are used for the volume. All of them are
+// used when the annotation is missing or empty.
+const annMountOptions = "provisioner.k8s.io/mount-options"
+
+// selectMountOptions returns the mount options of the storage class which
+// were selected by the claim, in the order of the storage class. Selected
+// options which the storage class doesn't have are ignored with a warning
+// event, users cannot add mount options this way.
+func (p *csiProvisioner) selectMountOptions(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) []string {
+	value := strings.TrimSpace(claim.Annotations[annMountOptions])
+	if value == "" {
+		return sc.MountOptions
+	}
+
+	classOptions := make(map[string]bool, len(sc.MountOptions))
+	for _, option := range sc.MountOptions {
+		classOptions[option] = true
+	}
+	selected := map[string]bool{}
+	var unknown []string
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if !classOptions[option] {
+			unknown = append(unknown, option)
+			continue
+		}
+		selected[option] = true
+	}
+	if len(unknown) > 0 {
+		p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "UnknownMountOptions", "Ignoring mount options %s from the %s annotation, StorageClass %s doesn't have them", strings.Join(unknown, ","), annMountOptions, sc.Name)
+	}
+
+	var mountOptions []string
+	for _, option := range sc.MountOptions {
+		if selected[option] {
+			mountOptions = append(mountOptions, option)
+		}
+	}
+	klog.V(4).Infof("using mount options %v of StorageClass %s selected by PVC %s/%s", mountOptions, sc.Name, claim.Namespace, claim.Name)
+	return mountOptions
+}
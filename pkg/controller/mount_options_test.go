@@ -0,0 +1,102 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionMountOptions(t *testing.T) {
+	const requestBytes = 100
+	classOptions := []string{"noatime", "nodiratime", "vers=4.1"}
+
+	testcases := map[string]struct {
+		annotations     map[string]string
+		expectedOptions []string
+		expectEvent     bool
+	}{
+		"no annotation": {
+			expectedOptions: classOptions,
+		},
+		"empty selection": {
+			annotations:     map[string]string{annMountOptions: " "},
+			expectedOptions: classOptions,
+		},
+		"subset": {
+			annotations:     map[string]string{annMountOptions: "vers=4.1, noatime"},
+			expectedOptions: []string{"noatime", "vers=4.1"},
+		},
+		"unknown option": {
+			annotations:     map[string]string{annMountOptions: "noatime,sync"},
+			expectedOptions: []string{"noatime"},
+			expectEvent:     true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil)
+			pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+				for _, volCap := range req.VolumeCapabilities {
+					if flags := volCap.GetMount().GetMountFlags(); !reflect.DeepEqual(flags, tc.expectedOptions) {
+						t.Errorf("expected mount flags %v, got %v", tc.expectedOptions, flags)
+					}
+				}
+			})
+
+			claim := createFakePVC(requestBytes)
+			for key, value := range tc.annotations {
+				claim.Annotations[key] = value
+			}
+			sc := &storagev1.StorageClass{
+				ObjectMeta:   metav1.ObjectMeta{Name: "fast"},
+				MountOptions: classOptions,
+			}
+			pv, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: sc,
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(pv.Spec.MountOptions, tc.expectedOptions) {
+				t.Errorf("expected PV mount options %v, got %v", tc.expectedOptions, pv.Spec.MountOptions)
+			}
+			if !reflect.DeepEqual(sc.MountOptions, classOptions) {
+				t.Errorf("storage class was modified: %v", sc.MountOptions)
+			}
+
+			events := pt.events()
+			switch {
+			case !tc.expectEvent && len(events) > 0:
+				t.Errorf("unexpected events: %q", events)
+			case tc.expectEvent && (len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" UnknownMountOptions") || !strings.Contains(events[0], "sync")):
+				t.Errorf("expected UnknownMountOptions event, got %q", events)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// annNodeCapacityBudget on a Node overrides the capacity budget that is
+// configured for distributed provisioning on that node.
+const annNodeCapacityBudget = "provisioner.k8s.io/capacity-budget"
+
+// GetNodeCapacityBudget returns the total size in bytes of all volumes that
+// may get provisioned for the node in distributed provisioning. The
+// provisioner.k8s.io/capacity-budget annotation of the node takes precedence
+// over the default. An empty budget means "unlimited" and is returned as zero.
+func GetNodeCapacityBudget(ctx context.Context, client kubernetes.Interface, nodeName, defaultBudget string) (int64, error) {
+	budget := defaultBudget
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		if value, ok := node.Annotations[annNodeCapacityBudget]; ok {
+			budget = value
+		}
+	case apierrors.IsNotFound(err):
+		// Fall back to the default.
+	default:
+		return 0, fmt.Errorf("get node %s: %v", nodeName, err)
+	}
+	if budget == "" {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(budget)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capacity budget %q for node %s: %v", budget, nodeName, err)
+	}
+	if quantity.Sign() < 0 {
+		return 0, fmt.Errorf("invalid capacity budget %q for node %s: must not be negative", budget, nodeName)
+	}
+	return quantity.Value(), nil
+}
+
+// nodeBudget keeps track of the size of the volumes provisioned for the
+// local node. Volumes are identified by their PV name. Existing volumes are
+// taken from the PV informer, so PVs deleted by anyone free up the budget.
+// Volumes which are being provisioned and don't have a PV yet get reserved.
+type nodeBudget struct {
+	limit int64
+	// volumes returns the size of the existing PVs of the node.
+	volumes func() (map[string]int64, error)
+
+	mutex    sync.Mutex
+	reserved map[string]int64
+}
+
+func newNodeBudget(limit int64, volumes func() (map[string]int64, error)) *nodeBudget {
+	return &nodeBudget{
+		limit:    limit,
+		volumes:  volumes,
+		reserved: map[string]int64{},
+	}
+}
+
+// reserve accounts for a new volume. It returns false if the volume doesn't
+// fit into the budget. Reserving the same volume again is a no-op.
+func (b *nodeBudget) reserve(pvName string, bytes int64) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	volumes, err := b.volumes()
+	if err != nil {
+		return false, fmt.Errorf("determine size of existing volumes: %v", err)
+	}
+	if _, ok := volumes[pvName]; ok {
+		return true, nil
+	}
+	if _, ok := b.reserved[pvName]; ok {
+		return true, nil
+	}
+	if used := b.usedLocked(volumes); used+bytes > b.limit {
+		klog.V(3).Infof("volume %s with %d bytes does not fit into node capacity budget %d, %d bytes already used", pvName, bytes, b.limit, used)
+		return false, nil
+	}
+	b.reserved[pvName] = bytes
+	return true, nil
+}
+
+// update records the actual size of a volume which is being provisioned.
+func (b *nodeBudget) update(pvName string, bytes int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reserved[pvName] = bytes
+}
+
+// release forgets about a volume which didn't get a PV.
+func (b *nodeBudget) release(pvName string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.reserved, pvName)
+}
+
+// used returns the size of all existing and reserved volumes.
+func (b *nodeBudget) used() (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	volumes, err := b.volumes()
+	if err != nil {
+		return 0, err
+	}
+	return b.usedLocked(volumes), nil
+}
+
+// usedLocked must be called while holding the mutex. Reservations of
+// volumes which have a PV by now are not needed anymore.
+func (b *nodeBudget) usedLocked(volumes map[string]int64) int64 {
+	var used int64
+	for _, bytes := range volumes {
+		used += bytes
+	}
+	for pvName, bytes := range b.reserved {
+		if _, ok := volumes[pvName]; ok {
+			delete(b.reserved, pvName)
+			continue
+		}
+		used += bytes
+	}
+	return used
+}
+
+// localVolumeSizes returns the size of all PVs that were provisioned by the
+// driver for the local node.
+func (p *csiProvisioner) localVolumeSizes() (map[string]int64, error) {
+	volumes := map[string]int64{}
+	if p.nodeDeployment.VolumeInformer == nil {
+		return volumes, nil
+	}
+	pvs, err := p.nodeDeployment.VolumeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != p.driverName {
+			continue
+		}
+		accessible, err := VolumeIsAccessible(pv.Spec.NodeAffinity, p.localTopology())
+		if err != nil {
+			return nil, fmt.Errorf("checking affinity of PV %s failed: %v", pv.Name, err)
+		}
+		if !accessible {
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		volumes[pv.Name] = capacity.Value()
+	}
+	return volumes, nil
+}
@@ -0,0 +1,397 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestGetNodeCapacityBudget(t *testing.T) {
+	testcases := map[string]struct {
+		annotations   map[string]string
+		missingNode   bool
+		defaultBudget string
+		expectBudget  int64
+		expectErr     bool
+	}{
+		"unlimited": {},
+		"default": {
+			defaultBudget: "1Gi",
+			expectBudget:  1024 * 1024 * 1024,
+		},
+		"annotation": {
+			annotations:   map[string]string{annNodeCapacityBudget: "100"},
+			defaultBudget: "1Gi",
+			expectBudget:  100,
+		},
+		"annotation disables default": {
+			annotations:   map[string]string{annNodeCapacityBudget: ""},
+			defaultBudget: "1Gi",
+		},
+		"missing node": {
+			missingNode:   true,
+			defaultBudget: "1k",
+			expectBudget:  1000,
+		},
+		"invalid": {
+			annotations: map[string]string{annNodeCapacityBudget: "abc"},
+			expectErr:   true,
+		},
+		"negative": {
+			defaultBudget: "-1",
+			expectErr:     true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			clientSet := fakeclientset.NewSimpleClientset()
+			if !tc.missingNode {
+				clientSet = fakeclientset.NewSimpleClientset(&v1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "node-1",
+						Annotations: tc.annotations,
+					},
+				})
+			}
+			budget, err := GetNodeCapacityBudget(context.Background(), clientSet, "node-1", tc.defaultBudget)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if budget != tc.expectBudget {
+				t.Errorf("expected budget %d, got %d", tc.expectBudget, budget)
+			}
+		})
+	}
+}
+
+// TestProvisionNodeCapacityBudget checks that volumes are only provisioned
+// while they fit into the node capacity budget, including volumes that
+// already existed when the provisioner started and which get deleted by
+// someone else.
+func TestProvisionNodeCapacityBudget(t *testing.T) {
+	const (
+		nodeName     = "node-1"
+		requestBytes = 100
+	)
+
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	existingPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(requestBytes, resource.BinarySI),
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       driverName,
+					VolumeHandle: "existing-volume-id",
+				},
+			},
+		},
+	}
+	clientSet := fakeclientset.NewSimpleClientset(existingPV)
+	informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	recorder := record.NewFakeRecorder(10)
+	nodeDeployment := &NodeDeployment{
+		NodeName:       nodeName,
+		ClaimInformer:  informerFactory.Core().V1().PersistentVolumeClaims(),
+		VolumeInformer: informerFactory.Core().V1().PersistentVolumes(),
+		CapacityBudget: 2*requestBytes + requestBytes/2,
+	}
+
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nodeDeployment, true, false,
+		withEventRecorder(recorder))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+
+	provision := func(uid string) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+		claim := createFakeNamedPVC(requestBytes, "pvc-"+uid, map[string]string{annSelectedNode: nodeName})
+		claim.UID = types.UID(uid)
+		return csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+			StorageClass: &storagev1.StorageClass{},
+			PVC:          claim,
+			SelectedNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}},
+		})
+	}
+	expectCreate := func() {
+		controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				CapacityBytes: requestBytes,
+				VolumeId:      "test-volume-id",
+			},
+		}, nil).Times(1)
+	}
+
+	// Fits next to the existing volume.
+	expectCreate()
+	pv, state, err := provision("aaaaa")
+	if err != nil {
+		t.Fatalf("first volume: unexpected error: %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("first volume: expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+
+	// Exceeds the budget, no CreateVolume call.
+	_, state, err = provision("bbbbb")
+	if err == nil {
+		t.Fatal("second volume: expected error, got none")
+	}
+	if state != controller.ProvisioningReschedule {
+		t.Errorf("second volume: expected ProvisioningState %s, got %s", controller.ProvisioningReschedule, state)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "NodeCapacityBudgetExceeded") {
+			t.Errorf("second volume: unexpected event %q", event)
+		}
+	default:
+		t.Error("second volume: expected NodeCapacityBudgetExceeded event, got none")
+	}
+
+	// Deleting the first volume frees up the budget.
+	controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+	if err := csiProvisioner.Delete(context.Background(), pv); err != nil {
+		t.Fatalf("delete first volume: unexpected error: %v", err)
+	}
+	expectCreate()
+	if _, state, err = provision("bbbbb"); err != nil {
+		t.Fatalf("second volume after delete: unexpected error: %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("second volume after delete: expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+
+	// Exceeds the budget again.
+	if _, _, err = provision("ccccc"); err == nil {
+		t.Fatal("third volume: expected error, got none")
+	}
+	<-recorder.Events
+
+	// Deleting the existing PV, which never went through Delete, also
+	// frees up the budget.
+	if err := clientSet.CoreV1().PersistentVolumes().Delete(context.Background(), existingPV.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err := nodeDeployment.VolumeInformer.Lister().Get(existingPV.Name); err != nil {
+			break
+		}
+		if i >= 100 {
+			t.Fatal("existing PV not removed from informer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectCreate()
+	if _, state, err = provision("ccccc"); err != nil {
+		t.Fatalf("third volume after deleting existing PV: unexpected error: %v", err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("third volume after deleting existing PV: expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+}
+
+// TestProvisionNodeCapacityBudgetWithoutSelectedNode checks that a volume
+// which doesn't fit is ignored instead of failing when there is no node
+// to reschedule from.
+func TestProvisionNodeCapacityBudgetWithoutSelectedNode(t *testing.T) {
+	tmpdir := tempDir(t)
+	defer os.RemoveAll(tmpdir)
+	mockController, driver, _, _, csiConn, err := createMockServer(t, tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+
+	clientSet := fakeclientset.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+	nodeDeployment := &NodeDeployment{
+		NodeName:       "node-1",
+		ClaimInformer:  informerFactory.Core().V1().PersistentVolumeClaims(),
+		VolumeInformer: informerFactory.Core().V1().PersistentVolumes(),
+		CapacityBudget: 50,
+	}
+	pluginCaps, controllerCaps := provisionCapabilities()
+	csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nodeDeployment, true, false,
+		withEventRecorder(record.NewFakeRecorder(10)))
+
+	_, state, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{},
+		PVC:          createFakeNamedPVC(100, "fake-pvc", map[string]string{annSelectedNode: "node-1"}),
+	})
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		t.Errorf("expected ignored error, got %v", err)
+
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected ProvisioningState %s, got %s", controller.ProvisioningFinished, state)
+	}
+}
+
+// TestProvisionCapacityCheckBypass checks that a PVC may exceed the node
+// capacity budget only if the bypass is enabled and both the PVC and its
+// namespace are annotated.
+func TestProvisionCapacityCheckBypass(t *testing.T) {
+	const (
+		nodeName     = "node-1"
+		requestBytes = 100
+	)
+
+	testcases := map[string]struct {
+		enabled             bool
+		claimAnnotation     bool
+		namespaceAnnotation bool
+		expectBypass        bool
+	}{
+		"bypassed": {
+			enabled:             true,
+			claimAnnotation:     true,
+			namespaceAnnotation: true,
+			expectBypass:        true,
+		},
+		"disabled": {
+			claimAnnotation:     true,
+			namespaceAnnotation: true,
+		},
+		"namespace not allowed": {
+			enabled:         true,
+			claimAnnotation: true,
+		},
+		"not requested": {
+			enabled:             true,
+			namespaceAnnotation: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-ns"}}
+			if tc.namespaceAnnotation {
+				namespace.Annotations = map[string]string{annAllowCapacityCheckBypass: "true"}
+			}
+			clientSet := fakeclientset.NewSimpleClientset(namespace)
+			informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+			recorder := record.NewFakeRecorder(10)
+			nodeDeployment := &NodeDeployment{
+				NodeName:       nodeName,
+				ClaimInformer:  informerFactory.Core().V1().PersistentVolumeClaims(),
+				VolumeInformer: informerFactory.Core().V1().PersistentVolumes(),
+				CapacityBudget: requestBytes / 2,
+			}
+
+			pluginCaps, controllerCaps := provisionCapabilities()
+			provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nodeDeployment, true, false,
+				AllowCapacityCheckBypass(tc.enabled), withEventRecorder(recorder))
+
+			if tc.expectBypass {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+					Volume: &csi.Volume{
+						CapacityBytes: requestBytes,
+						VolumeId:      "test-volume-id",
+					},
+				}, nil).Times(1)
+			}
+
+			annotations := map[string]string{annSelectedNode: nodeName}
+			if tc.claimAnnotation {
+				annotations[annBypassCapacityCheck] = "true"
+			}
+			pv, _, err := provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-pv",
+				PVC:          createFakeNamedPVC(requestBytes, "fake-pvc", annotations),
+				SelectedNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}},
+			})
+
+			expectedEvent := "NodeCapacityBudgetExceeded"
+			if tc.expectBypass {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if pv == nil {
+					t.Fatal("expected PV, got none")
+				}
+				expectedEvent = "CapacityCheckBypassed"
+			} else if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, v1.EventTypeWarning+" "+expectedEvent) {
+					t.Errorf("unexpected event %q", event)
+				}
+			default:
+				t.Errorf("expected %s event, got none", expectedEvent)
+			}
+
+			if tc.expectBypass {
+				// The volume counts against the budget.
+				if used, err := provisioner.(*csiProvisioner).nodeDeployment.budget.used(); err != nil || used != requestBytes {
+					t.Errorf("expected %d bytes of the budget to be used, got %d and error %v", requestBytes, used, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	storageinformers "k8s.io/client-go/informers/storage/v1"
+	"k8s.io/utils/clock"
+)
+
+// ProvisionerOption configures optional behavior of the CSI provisioner
+// created by NewCSIProvisioner.
+type ProvisionerOption func(*csiProvisioner)
+
+// ForceRemoveFinalizer determines whether PVs annotated with
+// provisioner.k8s.io/force-remove-finalizer=true are released without
+// calling DeleteVolume. Disabled by default.
+func ForceRemoveFinalizer(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.forceRemoveFinalizer = enabled
+	}
+}
+
+// RetryOnVolumeNameConflict determines whether CreateVolume is retried once
+// with a suffix appended to the volume name when the driver reports that the
+// name is already used by an incompatible volume. The suffix is a hash of the
+// PVC UID, so later attempts for the same PVC retry with the same name.
+// Disabled by default.
+func RetryOnVolumeNameConflict(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.retryOnVolumeNameConflict = enabled
+	}
+}
+
+// HonorForceBlockVolumeMode determines whether the
+// provisioner.k8s.io/force-block-volume-mode=true annotation on a storage
+// class causes all volumes of that class to be provisioned as raw block
+// volumes. Disabled by default.
+func HonorForceBlockVolumeMode(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.honorForceBlockVolumeMode = enabled
+	}
+}
+
+// DisableDelete determines whether DeleteVolume is never called for
+// released PVs, which then have to be deleted by some other controller.
+// Disabled by default.
+func DisableDelete(disabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.disableDelete = disabled
+	}
+}
+
+// HonorPVCFSType determines whether the provisioner.k8s.io/fstype annotation
+// on a PVC selects the fstype when the storage class doesn't specify one.
+// Disabled by default.
+func HonorPVCFSType(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.honorPVCFSType = enabled
+	}
+}
+
+// SecretCacheTTL enables caching of the secrets used for CreateVolume and
+// DeleteVolume in memory for the given duration. Zero, the default,
+// disables caching.
+func SecretCacheTTL(ttl time.Duration) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		if ttl > 0 {
+			p.secretCache = newSecretCache(ttl, clock.RealClock{})
+		} else {
+			p.secretCache = nil
+		}
+	}
+}
+
+// RequireProvisioningApproval determines whether PVCs have to be approved
+// before their volume gets created. When enabled, approval is needed for
+// PVCs with the provisioner.k8s.io/approval-required=true annotation and,
+// if the threshold is positive, for PVCs which request more than threshold
+// bytes. Approvals are read from the namespace informer. Waiting PVCs get
+// queued again through the claim informer when their namespace changes.
+// Disabled by default.
+func RequireProvisioningApproval(enabled bool, threshold int64, namespaceInformer coreinformers.NamespaceInformer, claimInformer *RequeueInformer) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.approvals = nil
+		if enabled {
+			p.approvals = newApprovals(threshold, namespaceInformer, claimInformer, clock.RealClock{})
+		}
+	}
+}
+
+// WellKnownTopologyLabels maps driver topology keys to well-known labels like
+// topology.kubernetes.io/zone. The node affinity of new PVs then also
+// requires the well-known labels, with the values of the driver keys.
+func WellKnownTopologyLabels(labels map[string]string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.wellKnownTopologyLabels = labels
+	}
+}
+
+// ProvisioningConditions determines whether the current stage of
+// provisioning is published as Provisioning condition in the PVC status.
+// The condition gets removed once the volume is provisioned. Disabled by
+// default because it causes additional PVC updates.
+func ProvisioningConditions(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.provisioningConditions = enabled
+	}
+}
+
+// HonorPVCEncryptionKey determines whether the provisioner.k8s.io/encryption-key
+// annotation on a PVC gets passed to CreateVolume as
+// csi.storage.k8s.io/encryption-key parameter for storage classes with
+// csi.storage.k8s.io/encryption set to "required" or "optional". Disabled
+// by default.
+func HonorPVCEncryptionKey(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.honorPVCEncryptionKey = enabled
+	}
+}
+
+// CopyStorageClassMetadata determines which labels and annotations of a
+// storage class are copied to the PVs provisioned for it. Keys with a
+// kubernetes.io or k8s.io prefix and keys that the provisioner sets itself
+// are never copied. Nothing is copied by default.
+func CopyStorageClassMetadata(labels, annotations []string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.storageClassLabels = labels
+		p.storageClassAnnotations = annotations
+	}
+}
+
+// MaxProvisioningRetries determines how often provisioning of a PVC may fail
+// before the provisioner gives up on it and sets the ProvisioningFailed
+// condition. Changing the PVC spec resets the count. Zero, the default,
+// retries forever.
+func MaxProvisioningRetries(retries int) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.maxProvisioningRetries = retries
+		if retries > 0 {
+			p.provisioningFailures = newProvisioningFailures()
+		} else {
+			p.provisioningFailures = nil
+		}
+	}
+}
+
+// CheckClaimCapabilities enables checking PVCs against the given driver
+// capabilities in ShouldProvision. PVCs which need capabilities that the
+// driver doesn't have, like restoring snapshots or cloning, are not
+// provisioned and get an UnsupportedCapability event instead. Nil, the
+// default, disables the check.
+func CheckClaimCapabilities(capabilities *DriverCapabilities) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.driverCapabilities = capabilities
+	}
+}
+
+// PostProvisionVerification enables checking each new volume with the
+// verifier before creating its PV. Provisioning gets retried while the
+// verification fails. After maxFailures failed verifications in a row, the
+// volume gets deleted again and provisioning of the PVC stops until the PVC
+// gets updated. Nil, the default, disables verification.
+func PostProvisionVerification(verifier PostProvisionVerifier, maxFailures int) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		if verifier == nil {
+			p.postProvisionVerification = nil
+			return
+		}
+		if maxFailures < 1 {
+			maxFailures = 1
+		}
+		p.postProvisionVerification = newPostProvisionVerification(verifier, maxFailures)
+	}
+}
+
+// EnforceStorageClassParameters enables refusing to provision for a storage
+// class whose parameters have changed since the provisioner first
+// provisioned for it. A change gets accepted by setting the
+// provisioner.k8s.io/acknowledged-parameters-hash annotation on the storage
+// class to the hash of the new parameters. Off by default.
+func EnforceStorageClassParameters(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.enforceStorageClassParameters = enabled
+	}
+}
+
+// MaxPVCOperationTimeout enables overriding the CreateVolume timeout with
+// the provisioner.k8s.io/operation-timeout annotation of a PVC. Longer
+// timeouts are limited to max. Zero, the default, ignores the annotation.
+func MaxPVCOperationTimeout(max time.Duration) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.maxPVCOperationTimeout = max
+	}
+}
+
+// TranslateErrors enables prepending the given messages to the errors of
+// failed CreateVolume and DeleteVolume calls, depending on their gRPC status
+// code. Nil, the default, reports the errors of the CSI driver unchanged.
+func TranslateErrors(messages ErrorMessages) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.errorMessages = messages
+	}
+}
+
+// DisableFinalizers stops adding the cloning protection finalizer to the
+// source PVC of a clone. The source PVC then may get deleted while the
+// clone is being created. Finalizers which were added before are still
+// removed. Disabled by default.
+func DisableFinalizers(disabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.disableFinalizers = disabled
+	}
+}
+
+// RecordCreateVolumeParameters stores the parameters of the CreateVolume
+// call in the provisioner.k8s.io/create-volume-parameters annotation of the
+// new PV. Only the values of the allowlisted keys and of the benign keys
+// added by the provisioner itself are recorded, all others are redacted.
+// Keys which look like they reference secrets are always redacted.
+// Disabled by default.
+func RecordCreateVolumeParameters(enabled bool, allowlist []string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		if !enabled {
+			p.recordedParameters = nil
+			return
+		}
+		p.recordedParameters = sets.NewString(defaultRecordedParameters...).Insert(allowlist...)
+	}
+}
+
+// PreferredTopologyStrategy sets the strategy which orders the preferred
+// topology segments of CreateVolume calls with immediate binding. Nil, the
+// default, keeps the order based on the hash of the PVC name.
+func PreferredTopologyStrategy(strategy TopologyStrategy) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.topologyStrategy = strategy
+	}
+}
+
+// CheckVolumeModeAccessModes enables checking the access modes of a claim
+// against the access modes that the CSIDriver object advertises for the
+// volume mode of the claim with the provisioner.k8s.io/filesystem-access-modes
+// and provisioner.k8s.io/block-access-modes annotations, before calling
+// CreateVolume. Off by default.
+func CheckVolumeModeAccessModes(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.checkVolumeModeAccessModes = enabled
+	}
+}
+
+// AllowCapacityCheckBypass enables provisioning volumes which exceed the
+// capacity budget of the node for PVCs with the
+// provisioner.k8s.io/bypass-capacity-check annotation, if their namespace
+// has the provisioner.k8s.io/allow-capacity-check-bypass annotation. Each
+// bypass gets recorded with a CapacityCheckBypassed event. Off by default.
+func AllowCapacityCheckBypass(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.allowCapacityCheckBypass = enabled
+	}
+}
+
+// FSGroupDelegated records on new filesystem PVs with the
+// provisioner.k8s.io/fsgroup-delegated annotation that the driver applies
+// the fsGroup while mounting, because its node service has the
+// VOLUME_MOUNT_GROUP capability. Off by default.
+func FSGroupDelegated(delegated bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.fsGroupDelegated = delegated
+	}
+}
+
+// ReportProvisioningStatus mirrors the provisioning stage and result of
+// each PVC in a custom object, see ProvisioningStatusReporter. The
+// reporter must be running. Nil, the default, disables it.
+func ReportProvisioningStatus(reporter *ProvisioningStatusReporter) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.provisioningStatusReporter = reporter
+	}
+}
+
+// LowercaseParameterKeys lowercases the keys of StorageClass parameters
+// before passing them to CreateVolume, except for keys with the
+// csi.storage.k8s.io/ prefix and the deprecated secret keys. Off by
+// default.
+func LowercaseParameterKeys(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.lowercaseParameterKeys = enabled
+	}
+}
+
+// RenamedStorageClasses maps the names of storage classes that were
+// recreated under a new name to that new name. Deleting a PV which still
+// references an old name then uses the new storage class, for example for
+// its secrets. Nil, the default, uses the names as they are.
+func RenamedStorageClasses(renamed map[string]string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.renamedStorageClasses = renamed
+	}
+}
+
+// RequireTopology fails provisioning with a TopologyUnavailable event
+// instead of passing on incomplete accessibility requirements when the
+// topology of a volume cannot be determined. If the selected node has no
+// topology for the driver, the scheduler is asked to pick a node again.
+// Off by default.
+func RequireTopology(required bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.requireTopology = required
+	}
+}
+
+// VolumeHandlePrefix passes the prefix to CreateVolume as the
+// csi.storage.k8s.io/volume-handle-prefix parameter. It must pass
+// ValidateVolumeHandlePrefix. Empty, the default, passes nothing.
+func VolumeHandlePrefix(prefix string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.volumeHandlePrefix = prefix
+	}
+}
+
+// SnapshotBeforeDeletion enables the provisioner.k8s.io/snapshot-before-deletion
+// annotation on storage classes: volumes of those classes are only deleted
+// after CreateSnapshot returned a snapshot that is ready to use. Off by
+// default.
+func SnapshotBeforeDeletion(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.snapshotBeforeDeletion = enabled
+	}
+}
+
+// WithGlobalPause makes ShouldProvision and ShouldDelete skip all PVCs and
+// PVs while the pause ConfigMap pauses provisioning and deletion. Nil, the
+// default, never pauses.
+func WithGlobalPause(pause *GlobalPause) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.globalPause = pause
+	}
+}
+
+// WatchStorageClassPauses queues the PVCs and PVs of a StorageClass again
+// right away when its provisioner.k8s.io/paused or
+// provisioner.k8s.io/deletion-paused annotation gets removed. Without it,
+// they get checked again after the next resync.
+func WatchStorageClassPauses(scInformer storageinformers.StorageClassInformer, claimInformer, volumeInformer *RequeueInformer) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.watchStorageClassPauses(scInformer, claimInformer, volumeInformer)
+	}
+}
+
+// NodeLabelTopologyKeys adds the values of these node labels to the
+// topology segments which get passed to CreateVolume, in addition to the
+// topology keys from the CSINode objects. Empty by default.
+func NodeLabelTopologyKeys(keys []string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.nodeLabelTopologyKeys = keys
+	}
+}
+
+// ThroughputRange limits the throughput in MB/s that PVCs and storage
+// classes may request. Zero disables the minimum or maximum, which is the
+// default.
+func ThroughputRange(min, max int64) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.minThroughput = min
+		p.maxThroughput = max
+	}
+}
+
+// WithTerminalErrorCodes stops retrying CreateVolume and DeleteVolume
+// after errors with one of these status codes. The PVC or PV gets a
+// Warning event instead. Nil, the default, retries all errors.
+func WithTerminalErrorCodes(terminal TerminalErrorCodes) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.terminalErrorCodes = terminal
+	}
+}
+
+// MaxImmediateTopologySegments limits the number of topology segments in
+// CreateVolume calls with immediate binding to the first max preferred
+// segments, as ordered by the PreferredTopologyStrategy. Zero, the
+// default, passes all segments.
+func MaxImmediateTopologySegments(max int) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.maxImmediateTopologySegments = max
+	}
+}
+
+// DriverVersion is the vendor version of the CSI driver, which gets
+// recorded in the provisioner.k8s.io/driver-version annotation of each
+// provisioned PV. Empty, the default, doesn't annotate PVs.
+func DriverVersion(version string) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.driverVersion = version
+	}
+}
+
+// CheckVolumeBindingMode enables checking the volume binding mode of each
+// storage class against the topology support of the driver when the class
+// is used for the first time. Mismatches get logged and reported with a
+// Warning event for the class. Off by default.
+func CheckVolumeBindingMode(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		if enabled {
+			p.checkedBindingModes = newCheckedBindingModes()
+		} else {
+			p.checkedBindingModes = nil
+		}
+	}
+}
+
+// MaxParametersSize warns about CreateVolume calls whose parameters,
+// counting the bytes of keys and values, are larger than max. With trim,
+// the parameters of --extra-create-metadata get removed until the
+// parameters fit. Zero, the default, disables the check.
+func MaxParametersSize(max int, trim bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.maxParametersSize = max
+		p.trimExtraCreateMetadata = trim
+	}
+}
+
+// PassIdempotencyToken adds a token derived from the PVC to the
+// CreateVolume parameters, for drivers which choose the names of their
+// volumes themselves. The token is the same for all attempts and gets
+// recorded in the PV. Off by default.
+func PassIdempotencyToken(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.passIdempotencyToken = enabled
+	}
+}
+
+// RoutineEvents reduces the Normal events which get emitted each time a
+// PVC is requeued while it waits, for example for a snapshot. With
+// suppress, they are not emitted at all. Otherwise a positive interval
+// emits them at most once per interval for the same PVC and reason.
+// Warning events are not affected. By default, all events are emitted.
+func RoutineEvents(suppress bool, interval time.Duration) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		switch {
+		case suppress:
+			p.routineEvents = newRoutineEventFilter(0, clock.RealClock{})
+		case interval > 0:
+			p.routineEvents = newRoutineEventFilter(interval, clock.RealClock{})
+		default:
+			p.routineEvents = nil
+		}
+	}
+}
+
+// WithVolumeHandles makes Delete look up other PVs with the same volume
+// handle and refuse to call DeleteVolume while any of them is neither being
+// deleted nor released or failed. Without it, there is no such check.
+func WithVolumeHandles(volumeHandles *VolumeHandles) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.volumeHandles = volumeHandles
+	}
+}
+
+// HonorRetryAfter passes the retry delays that the CSI driver returns in
+// RetryInfo details of CreateVolume errors to the rate limiter, which
+// must be the one of the claim queue. Nil, the default, ignores them.
+func HonorRetryAfter(rateLimiter *RetryAfterRateLimiter) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.retryAfter = rateLimiter
+	}
+}
+
+// RecordTopology sets the provisioner.k8s.io/topology annotation of PVCs to
+// the accessibility requirements that get passed to CreateVolume, as a
+// debugging aid. Off by default.
+func RecordTopology(enabled bool) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.recordTopology = enabled
+	}
+}
+
+// WithProjectMapping passes the backend project of the PVC namespace to
+// CreateVolume as csi.storage.k8s.io/project parameter. Nil, the default,
+// disables it.
+func WithProjectMapping(mapping *ProjectMapping) ProvisionerOption {
+	return func(p *csiProvisioner) {
+		p.projectMapping = mapping
+	}
+}
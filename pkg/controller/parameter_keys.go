@@ -0,0 +1,73 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ParameterKeyCasePreserve passes StorageClass parameter keys to
+	// CreateVolume as they are.
+	ParameterKeyCasePreserve = "preserve"
+	// ParameterKeyCaseLower lowercases StorageClass parameter keys,
+	// except for reserved keys.
+	ParameterKeyCaseLower = "lower"
+)
+
+// ParameterKeyCases lists all supported parameter key cases.
+var ParameterKeyCases = []string{ParameterKeyCasePreserve, ParameterKeyCaseLower}
+
+// reservedParameterKey returns true for keys which are interpreted by the
+// external-provisioner or the CSI driver with their exact spelling.
+func reservedParameterKey(key string) bool {
+	if strings.HasPrefix(key, csiParameterPrefix) {
+		return true
+	}
+	switch key {
+	case provisionerSecretNameKey, provisionerSecretNamespaceKey,
+		controllerPublishSecretNameKey, controllerPublishSecretNamespaceKey,
+		nodeStageSecretNameKey, nodeStageSecretNamespaceKey,
+		nodePublishSecretNameKey, nodePublishSecretNamespaceKey:
+		return true
+	}
+	return false
+}
+
+// lowercaseParameterKeys lowercases all keys which are not reserved. Values
+// are never changed. Keys which only differ in their case are ambiguous
+// and cause an error.
+func lowercaseParameterKeys(parameters map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(parameters))
+	original := make(map[string]string, len(parameters))
+	for key, value := range parameters {
+		normalizedKey := key
+		if !reservedParameterKey(key) {
+			normalizedKey = strings.ToLower(key)
+		}
+		if other, ok := original[normalizedKey]; ok {
+			if other > key {
+				other, key = key, other
+			}
+			return nil, fmt.Errorf("parameters %q and %q are the same after lowercasing", other, key)
+		}
+		original[normalizedKey] = key
+		normalized[normalizedKey] = value
+	}
+	return normalized, nil
+}
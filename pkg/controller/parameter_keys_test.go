@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestLowercaseParameterKeys(t *testing.T) {
+	testcases := map[string]struct {
+		parameters map[string]string
+		expected   map[string]string
+		expectErr  bool
+	}{
+		"non-reserved keys": {
+			parameters: map[string]string{"Type": "SSD", "replicaCount": "3", "zone": "A"},
+			expected:   map[string]string{"type": "SSD", "replicacount": "3", "zone": "A"},
+		},
+		"reserved keys": {
+			parameters: map[string]string{
+				pvcNameKey:                    "My-PVC",
+				encryptionKeyKey:              "Key",
+				provisionerSecretNameKey:      "Secret",
+				provisionerSecretNamespaceKey: "Namespace",
+				"IOPS":                        "100",
+			},
+			expected: map[string]string{
+				pvcNameKey:                    "My-PVC",
+				encryptionKeyKey:              "Key",
+				provisionerSecretNameKey:      "Secret",
+				provisionerSecretNamespaceKey: "Namespace",
+				"iops":                        "100",
+			},
+		},
+		"conflict": {
+			parameters: map[string]string{"Type": "SSD", "type": "HDD"},
+			expectErr:  true,
+		},
+		"empty": {
+			parameters: map[string]string{},
+			expected:   map[string]string{},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			normalized, err := lowercaseParameterKeys(tc.parameters)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", normalized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(normalized, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, normalized)
+			}
+		})
+	}
+}
+
+func TestProvisionParameterKeyCase(t *testing.T) {
+	const requestBytes = 100
+	scParameters := map[string]string{
+		"Type":            "SSD",
+		prefixedFsTypeKey: "ext4",
+	}
+
+	testcases := map[string]struct {
+		lowercase bool
+		expected  map[string]string
+	}{
+		"preserve": {
+			expected: map[string]string{
+				"Type":          "SSD",
+				pvcNameKey:      "fake-pvc",
+				pvcNamespaceKey: "fake-ns",
+				pvNameKey:       "test-testi",
+			},
+		},
+		"lower": {
+			lowercase: true,
+			expected: map[string]string{
+				"type":          "SSD",
+				pvcNameKey:      "fake-pvc",
+				pvcNamespaceKey: "fake-ns",
+				pvNameKey:       "test-testi",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil, withExtraCreateMetadata(), LowercaseParameterKeys(tc.lowercase))
+			pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+				if !reflect.DeepEqual(req.Parameters, tc.expected) {
+					t.Errorf("expected parameters %v, got %v", tc.expected, req.Parameters)
+				}
+			})
+
+			if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: scParameters},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
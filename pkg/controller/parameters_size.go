@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+// extraCreateMetadataKeys are the parameters of --extra-create-metadata,
+// least important first. The PV name is also the name of the volume in
+// CreateVolume, so it can be dropped before the PVC namespace and name.
+var extraCreateMetadataKeys = []string{pvNameKey, pvcNamespaceKey, pvcNameKey}
+
+// parametersSize is the size of the keys and values of the parameters in
+// bytes.
+func parametersSize(parameters map[string]string) int {
+	size := 0
+	for key, value := range parameters {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// checkParametersSize warns with an event for the claim when the
+// CreateVolume parameters are larger than the configured maximum. If
+// enabled, extra create metadata gets removed from the parameters until
+// they fit. Provisioning continues in any case, it is up to the driver to
+// reject the parameters.
+func (p *csiProvisioner) checkParametersSize(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass, parameters map[string]string) {
+	if p.maxParametersSize <= 0 {
+		return
+	}
+	size := parametersSize(parameters)
+	if size <= p.maxParametersSize {
+		return
+	}
+	CreateVolumeParametersOversizedTotal.WithLabelValues(sc.Name).Inc()
+
+	if p.trimExtraCreateMetadata && p.extraCreateMetadata {
+		var removed []string
+		for _, key := range extraCreateMetadataKeys {
+			if size <= p.maxParametersSize {
+				break
+			}
+			if value, ok := parameters[key]; ok {
+				size -= len(key) + len(value)
+				delete(parameters, key)
+				removed = append(removed, key)
+			}
+		}
+		if size <= p.maxParametersSize {
+			klog.V(2).Infof("removed %s from the CreateVolume parameters of PVC %s/%s to stay within %d bytes", strings.Join(removed, ", "), claim.Namespace, claim.Name, p.maxParametersSize)
+			p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "ParametersTrimmed", "CreateVolume parameters of StorageClass %s exceed %d bytes, removed %s", sc.Name, p.maxParametersSize, strings.Join(removed, ", "))
+			return
+		}
+	}
+	p.eventRecorder.Eventf(claim, v1.EventTypeWarning, "ParametersTooLarge", "CreateVolume parameters of StorageClass %s have %d bytes, more than the maximum of %d bytes", sc.Name, size, p.maxParametersSize)
+}
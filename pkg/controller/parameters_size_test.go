@@ -0,0 +1,129 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionParametersSize(t *testing.T) {
+	const requestBytes = 100
+
+	// The class parameter has 10 bytes. The extra create metadata for
+	// the claim "fake-pvc" in "fake-ns" and the PV "test-testi" adds
+	// 35, 39 and 36 bytes, 120 bytes in total.
+	parameters := map[string]string{"class": "fast1"}
+	metadata := map[string]string{
+		pvcNameKey:      "fake-pvc",
+		pvcNamespaceKey: "fake-ns",
+		pvNameKey:       "test-testi",
+	}
+	withMetadata := func(keys ...string) map[string]string {
+		result := map[string]string{"class": "fast1"}
+		for _, key := range keys {
+			result[key] = metadata[key]
+		}
+		return result
+	}
+
+	testcases := map[string]struct {
+		maxSize            int
+		trim               bool
+		expectedParameters map[string]string
+		expectEvent        string
+	}{
+		"disabled": {
+			expectedParameters: withMetadata(pvcNameKey, pvcNamespaceKey, pvNameKey),
+		},
+		"under threshold": {
+			maxSize:            120,
+			trim:               true,
+			expectedParameters: withMetadata(pvcNameKey, pvcNamespaceKey, pvNameKey),
+		},
+		"over threshold, warn": {
+			maxSize:            100,
+			expectedParameters: withMetadata(pvcNameKey, pvcNamespaceKey, pvNameKey),
+			expectEvent:        "ParametersTooLarge",
+		},
+		"over threshold, trim PV name": {
+			maxSize:            100,
+			trim:               true,
+			expectedParameters: withMetadata(pvcNameKey, pvcNamespaceKey),
+			expectEvent:        "ParametersTrimmed",
+		},
+		"over threshold, trim PV name and namespace": {
+			maxSize:            50,
+			trim:               true,
+			expectedParameters: withMetadata(pvcNameKey),
+			expectEvent:        "ParametersTrimmed",
+		},
+		"over threshold, trimming not enough": {
+			maxSize:            5,
+			trim:               true,
+			expectedParameters: withMetadata(),
+			expectEvent:        "ParametersTooLarge",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil, withExtraCreateMetadata(), MaxParametersSize(tc.maxSize, tc.trim))
+			pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+				if !reflect.DeepEqual(req.Parameters, tc.expectedParameters) {
+					t.Errorf("expected parameters %v, got %v", tc.expectedParameters, req.Parameters)
+				}
+			})
+			CreateVolumeParametersOversizedTotal.Reset()
+
+			if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta: metav1.ObjectMeta{Name: "fast"},
+					Parameters: parameters,
+				},
+				PVName: "test-testi",
+				PVC:    createFakePVC(requestBytes),
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expectedCount := 0.0
+			if tc.expectEvent != "" {
+				expectedCount = 1
+			}
+			if count := testutil.ToFloat64(CreateVolumeParametersOversizedTotal.WithLabelValues("fast")); count != expectedCount {
+				t.Errorf("expected oversized count %v, got %v", expectedCount, count)
+			}
+			events := pt.events()
+			if tc.expectEvent == "" && len(events) != 0 {
+				t.Errorf("expected no events, got %q", events)
+			}
+			if tc.expectEvent != "" && (len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" "+tc.expectEvent)) {
+				t.Errorf("expected %s event, got %q", tc.expectEvent, events)
+			}
+		})
+	}
+}
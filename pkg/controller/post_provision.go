@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// PostProvisionVerifier checks a volume after CreateVolume succeeded and
+// before the PV gets created for it, for example whether the volume is
+// reachable.
+type PostProvisionVerifier interface {
+	// Verify returns an error if the volume cannot be used (yet).
+	Verify(ctx context.Context, claim *v1.PersistentVolumeClaim, volume *csi.Volume) error
+}
+
+// postProvisionVerification counts failed verifications per claim.
+type postProvisionVerification struct {
+	verifier    PostProvisionVerifier
+	maxFailures int
+
+	mutex    sync.Mutex
+	failures map[types.UID]int
+}
+
+func newPostProvisionVerification(verifier PostProvisionVerifier, maxFailures int) *postProvisionVerification {
+	return &postProvisionVerification{
+		verifier:    verifier,
+		maxFailures: maxFailures,
+		failures:    map[types.UID]int{},
+	}
+}
+
+// failed records a failed verification and returns true once the claim has
+// failed maxFailures times in a row. The count then starts again.
+func (v *postProvisionVerification) failed(claim *v1.PersistentVolumeClaim) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.failures[claim.UID]++
+	if v.failures[claim.UID] < v.maxFailures {
+		return false
+	}
+	delete(v.failures, claim.UID)
+	return true
+}
+
+func (v *postProvisionVerification) succeeded(claim *v1.PersistentVolumeClaim) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.failures, claim.UID)
+}
+
+// verifyVolume runs the post-provision verifier for a new volume. While the
+// verification fails, provisioning is retried in the background and thus
+// calls CreateVolume again for the same volume. Once it failed too often,
+// the volume gets deleted and provisioning of the claim stops.
+func (p *csiProvisioner) verifyVolume(ctx context.Context, claim *v1.PersistentVolumeClaim, volume *csi.Volume, pvName string, provisionerCredentials map[string]string) (controller.ProvisioningState, error) {
+	v := p.postProvisionVerification
+	err := v.verifier.Verify(ctx, claim, volume)
+	if err == nil {
+		v.succeeded(claim)
+		return controller.ProvisioningFinished, nil
+	}
+
+	err = fmt.Errorf("verification of volume %s failed: %v", volume.VolumeId, err)
+	if !v.failed(claim) {
+		klog.V(3).Infof("PVC %s/%s: %v, will retry", claim.Namespace, claim.Name, err)
+		return controller.ProvisioningInBackground, err
+	}
+
+	delReq := &csi.DeleteVolumeRequest{
+		VolumeId: volume.VolumeId,
+	}
+	if cleanupErr := cleanupVolume(ctx, p, delReq, provisionerCredentials); cleanupErr != nil {
+		// Retrying calls CreateVolume, which hopefully returns the same
+		// volume again, so cleanup can be tried once more.
+		return controller.ProvisioningInBackground, fmt.Errorf("%v. Cleanup of volume %s failed, volume is orphaned: %v", err, pvName, cleanupErr)
+	}
+	// Retrying would create and delete the volume again and again. The
+	// provisioner ignores the claim from now on, but it still is a
+	// failure.
+	observeFailure(operationProvision, err)
+	message := fmt.Sprintf("deleted volume %s after %d failed verifications, not retrying: %v", volume.VolumeId, v.maxFailures, err)
+	p.eventRecorder.Event(claim, v1.EventTypeWarning, "VolumeVerificationFailed", message)
+	return controller.ProvisioningFinished, &controller.IgnoredError{Reason: message}
+}
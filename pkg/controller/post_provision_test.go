@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// fakeVerifier fails as often as specified by its results.
+type fakeVerifier struct {
+	results []error
+	calls   int
+}
+
+func (f *fakeVerifier) Verify(ctx context.Context, claim *v1.PersistentVolumeClaim, volume *csi.Volume) error {
+	f.calls++
+	if len(f.results) == 0 {
+		return nil
+	}
+	err := f.results[0]
+	f.results = f.results[1:]
+	return err
+}
+
+func TestPostProvisionVerification(t *testing.T) {
+	const (
+		requestBytes = 100
+		maxFailures  = 2
+	)
+	unreachable := errors.New("volume unreachable")
+
+	testcases := map[string]struct {
+		results        []error
+		expectedStates []controller.ProvisioningState
+		expectDelete   bool
+	}{
+		"success": {
+			expectedStates: []controller.ProvisioningState{controller.ProvisioningFinished},
+		},
+		"transient failure": {
+			results: []error{unreachable},
+			expectedStates: []controller.ProvisioningState{
+				controller.ProvisioningInBackground,
+				controller.ProvisioningFinished,
+			},
+		},
+		"permanent failure": {
+			results: []error{unreachable, unreachable},
+			expectedStates: []controller.ProvisioningState{
+				controller.ProvisioningInBackground,
+				controller.ProvisioningFinished,
+			},
+			expectDelete: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			verifier := &fakeVerifier{results: tc.results}
+			pt := newProvisionerTest(t, nil, PostProvisionVerification(verifier, maxFailures))
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(&csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: requestBytes,
+					VolumeId:      "test-volume-id",
+				},
+			}, nil).Times(len(tc.expectedStates))
+			if tc.expectDelete {
+				pt.controllerServer.EXPECT().DeleteVolume(gomock.Any(), &csi.DeleteVolumeRequest{VolumeId: "test-volume-id"}).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+			}
+
+			var pv *v1.PersistentVolume
+			var err error
+			for i, expectedState := range tc.expectedStates {
+				var state controller.ProvisioningState
+				pv, state, err = pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{},
+					PVC:          createFakePVC(requestBytes),
+				})
+				if state != expectedState {
+					t.Fatalf("attempt #%d: expected ProvisioningState %s, got %s: %v", i, expectedState, state, err)
+				}
+			}
+			if verifier.calls != len(tc.expectedStates) {
+				t.Errorf("expected %d verifications, got %d", len(tc.expectedStates), verifier.calls)
+			}
+
+			events := pt.events()
+			if tc.expectDelete {
+				if _, ok := err.(*controller.IgnoredError); !ok || pv != nil {
+					t.Errorf("expected IgnoredError and no PV, got PV %v and error %v", pv, err)
+				}
+				if len(events) != 1 || !strings.Contains(events[0], "VolumeVerificationFailed") {
+					t.Errorf("expected VolumeVerificationFailed event, got %q", events)
+				}
+			} else {
+				if err != nil || pv == nil {
+					t.Errorf("expected PV, got error %v", err)
+				}
+				if len(events) != 0 {
+					t.Errorf("expected no events, got %q", events)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// projectKey is the CreateVolume parameter with the backend project
+	// of the PVC namespace.
+	projectKey = "csi.storage.k8s.io/project"
+
+	// annProject on a Namespace sets the backend project of its PVCs.
+	// It takes precedence over the project mapping. Namespaces are
+	// controlled by the cluster admin, PVCs by their users, so there is
+	// no such annotation for PVCs.
+	annProject = "provisioner.k8s.io/project"
+)
+
+// ProjectMapping maps namespaces to backend projects.
+type ProjectMapping struct {
+	// Projects contains the project of each mapped namespace.
+	Projects map[string]string
+	// Default is the project of unmapped namespaces. When empty,
+	// provisioning fails for them.
+	Default string
+}
+
+// LoadProjectMapping returns the mapping in the ConfigMap, whose keys are
+// namespaces and values are projects, with the given default project.
+func LoadProjectMapping(ctx context.Context, client kubernetes.Interface, namespace, name, defaultProject string) (*ProjectMapping, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get ConfigMap %s/%s: %v", namespace, name, err)
+	}
+	for key, project := range configMap.Data {
+		if project == "" {
+			return nil, fmt.Errorf("empty project for namespace %q", key)
+		}
+	}
+	return &ProjectMapping{
+		Projects: configMap.Data,
+		Default:  defaultProject,
+	}, nil
+}
+
+// getProject returns the project for the namespace of the claim.
+func (p *csiProvisioner) getProject(ctx context.Context, claim *v1.PersistentVolumeClaim) (string, error) {
+	namespace, err := p.client.CoreV1().Namespaces().Get(ctx, claim.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get namespace %s: %v", claim.Namespace, err)
+	}
+	if project := namespace.Annotations[annProject]; project != "" {
+		return project, nil
+	}
+	if project := p.projectMapping.Projects[claim.Namespace]; project != "" {
+		return project, nil
+	}
+	if p.projectMapping.Default != "" {
+		return p.projectMapping.Default, nil
+	}
+	return "", fmt.Errorf("namespace %s is not mapped to a project and has no %s annotation", claim.Namespace, annProject)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionProject(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		projects           map[string]string
+		defaultProject     string
+		annotations        map[string]string
+		expectedProject    string
+		expectErrorMessage string
+	}{
+		"mapped": {
+			projects:        map[string]string{"fake-ns": "team-a", "other-ns": "team-b"},
+			defaultProject:  "shared",
+			expectedProject: "team-a",
+		},
+		"namespace annotation": {
+			projects:        map[string]string{"fake-ns": "team-a"},
+			annotations:     map[string]string{annProject: "team-c"},
+			expectedProject: "team-c",
+		},
+		"unmapped with default": {
+			projects:        map[string]string{"other-ns": "team-b"},
+			defaultProject:  "shared",
+			expectedProject: "shared",
+		},
+		"unmapped without default": {
+			projects:           map[string]string{"other-ns": "team-b"},
+			expectErrorMessage: "namespace fake-ns is not mapped to a project",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			configMap := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "projects", Namespace: "kube-system"}, Data: tc.projects}
+			mapping, err := LoadProjectMapping(context.Background(), fakeclientset.NewSimpleClientset(configMap), "kube-system", "projects", tc.defaultProject)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-ns", Annotations: tc.annotations}}
+			pt := newProvisionerTest(t, []runtime.Object{namespace}, WithProjectMapping(mapping))
+			if tc.expectErrorMessage == "" {
+				pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+					if project := req.Parameters[projectKey]; project != tc.expectedProject {
+						t.Errorf("expected project %q, got %q", tc.expectedProject, project)
+					}
+				})
+			}
+
+			_, state, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if tc.expectErrorMessage == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectErrorMessage) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectErrorMessage, err)
+			}
+			if state != controller.ProvisioningFinished {
+				t.Errorf("expected ProvisioningFinished, got %s", state)
+			}
+		})
+	}
+}
+
+func TestLoadProjectMappingEmptyProject(t *testing.T) {
+	configMap := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "projects", Namespace: "kube-system"}, Data: map[string]string{"fake-ns": ""}}
+	if _, err := LoadProjectMapping(context.Background(), fakeclientset.NewSimpleClientset(configMap), "kube-system", "projects", ""); err == nil {
+		t.Error("expected error for empty project, got none")
+	}
+}
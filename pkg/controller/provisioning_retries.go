@@ -0,0 +1,169 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// conditionProvisioningFailed is the PVC condition which is set once the
+// provisioner has given up on a claim.
+const conditionProvisioningFailed v1.PersistentVolumeClaimConditionType = "ProvisioningFailed"
+
+// provisioningFailures counts failed provisioning attempts per claim. The
+// count starts again when the spec of the claim changes. Like the retry
+// count of the work queue it is only kept in memory.
+type provisioningFailures struct {
+	mutex  sync.Mutex
+	claims map[types.UID]*claimFailures
+}
+
+type claimFailures struct {
+	namespace, name string
+	specHash        string
+	count           int
+}
+
+func newProvisioningFailures() *provisioningFailures {
+	return &provisioningFailures{
+		claims: map[types.UID]*claimFailures{},
+	}
+}
+
+// checkProvisioningRetries returns an IgnoredError for claims which already
+// failed too often. A claim whose spec changed since then gets another
+// chance.
+func (p *csiProvisioner) checkProvisioningRetries(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	f := p.provisioningFailures
+	specHash, err := claimSpecHash(claim)
+	if err != nil {
+		return nil
+	}
+
+	f.mutex.Lock()
+	failures := f.claims[claim.UID]
+	exceeded := failures != nil && failures.count >= p.maxProvisioningRetries
+	if failures != nil && failures.specHash != specHash {
+		delete(f.claims, claim.UID)
+	} else if exceeded {
+		f.mutex.Unlock()
+		return &controller.IgnoredError{
+			Reason: fmt.Sprintf("provisioning of PVC %s/%s failed %d times, not trying again", claim.Namespace, claim.Name, failures.count),
+		}
+	}
+	f.mutex.Unlock()
+
+	if exceeded {
+		klog.V(2).Infof("spec of PVC %s/%s changed, retrying provisioning", claim.Namespace, claim.Name)
+		if err := p.updateClaimCondition(ctx, claim, conditionProvisioningFailed, nil); err != nil {
+			klog.Warningf("failed to remove %s condition from PVC %s/%s: %v", conditionProvisioningFailed, claim.Namespace, claim.Name, err)
+		}
+	}
+	return nil
+}
+
+// countProvisioningFailure records the outcome of a provisioning attempt.
+// Once the claim failed maxProvisioningRetries times, the user is told about
+// it with an event and a ProvisioningFailed condition and the error is
+// replaced with an IgnoredError, which stops further retries.
+//
+// Waiting for a snapshot is not a failure. Neither is
+// rescheduling nor provisioning which still goes on in the background,
+// because giving up then could leak a volume.
+func (p *csiProvisioner) countProvisioningFailure(ctx context.Context, claim *v1.PersistentVolumeClaim, state controller.ProvisioningState, err error) error {
+	f := p.provisioningFailures
+	if err == nil {
+		f.mutex.Lock()
+		delete(f.claims, claim.UID)
+		f.mutex.Unlock()
+		return nil
+	}
+	var notReady *snapshotNotReadyError
+	if state == controller.ProvisioningInBackground || state == controller.ProvisioningReschedule ||
+		errors.As(err, &notReady) {
+		return err
+	}
+	specHash, hashErr := claimSpecHash(claim)
+	if hashErr != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.pruneLocked(p)
+	failures := f.claims[claim.UID]
+	if failures == nil || failures.specHash != specHash {
+		failures = &claimFailures{
+			namespace: claim.Namespace,
+			name:      claim.Name,
+			specHash:  specHash,
+		}
+		f.claims[claim.UID] = failures
+	}
+	failures.count++
+	count := failures.count
+	f.mutex.Unlock()
+
+	if count < p.maxProvisioningRetries {
+		return err
+	}
+	message := fmt.Sprintf("giving up after %d failed attempts, delete and recreate the PVC or change its spec to try again: %v", count, err)
+	p.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningRetriesExceeded", message)
+	if err := p.updateClaimCondition(ctx, claim, conditionProvisioningFailed, &v1.PersistentVolumeClaimCondition{
+		Status:  v1.ConditionTrue,
+		Reason:  "RetriesExceeded",
+		Message: message,
+	}); err != nil {
+		klog.Warningf("failed to update %s condition of PVC %s/%s: %v", conditionProvisioningFailed, claim.Namespace, claim.Name, err)
+	}
+	return &controller.IgnoredError{Reason: message}
+}
+
+// pruneLocked forgets about claims which no longer exist. Must be called
+// while holding the mutex.
+func (f *provisioningFailures) pruneLocked(p *csiProvisioner) {
+	if p.claimLister == nil {
+		return
+	}
+	for uid, failures := range f.claims {
+		claim, err := p.claimLister.PersistentVolumeClaims(failures.namespace).Get(failures.name)
+		if apierrors.IsNotFound(err) || (err == nil && claim.UID != uid) {
+			delete(f.claims, uid)
+		}
+	}
+}
+
+// claimSpecHash returns the hex-encoded SHA-256 hash of the claim spec.
+func claimSpecHash(claim *v1.PersistentVolumeClaim) (string, error) {
+	spec, err := json.Marshal(claim.Spec)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(spec)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// TestMaxProvisioningRetries checks that provisioning stops after the
+// configured number of failures and starts again when the PVC spec changes.
+func TestMaxProvisioningRetries(t *testing.T) {
+	const (
+		requestBytes = 100
+		maxRetries   = 2
+	)
+
+	ctx := context.Background()
+	claim := createFakePVC(requestBytes)
+	pt := newProvisionerTest(t, []runtime.Object{claim}, MaxProvisioningRetries(maxRetries))
+
+	condition := func() *v1.PersistentVolumeClaimCondition {
+		claim, err := pt.clientSet.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := range claim.Status.Conditions {
+			if claim.Status.Conditions[i].Type == conditionProvisioningFailed {
+				return &claim.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+	provision := func(what string, claim *v1.PersistentVolumeClaim, expectIgnored bool) {
+		t.Helper()
+		_, _, err := pt.provisioner.Provision(ctx, controller.ProvisionOptions{
+			StorageClass: &storagev1.StorageClass{},
+			PVC:          claim,
+		})
+		if err == nil {
+			if expectIgnored {
+				t.Fatalf("%s: expected IgnoredError, got none", what)
+			}
+			return
+		}
+		if _, ignored := err.(*controller.IgnoredError); ignored != expectIgnored {
+			t.Fatalf("%s: expected IgnoredError %v, got %T: %v", what, expectIgnored, err, err)
+		}
+	}
+	createVolume := func(times int, err error) {
+		var rsp *csi.CreateVolumeResponse
+		if err == nil {
+			rsp = &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					CapacityBytes: 2 * requestBytes,
+					VolumeId:      "test-volume-id",
+				},
+			}
+		}
+		pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(rsp, err).Times(times)
+	}
+	invalid := status.Error(codes.InvalidArgument, "invalid parameters")
+
+	// A timeout is not counted because the volume may still get created.
+	createVolume(1, status.Error(codes.DeadlineExceeded, "timeout"))
+	provision("timeout", claim, false)
+
+	createVolume(maxRetries, invalid)
+	provision("first failure", claim, false)
+	if c := condition(); c != nil {
+		t.Fatalf("expected no %s condition before the limit, got %+v", conditionProvisioningFailed, *c)
+	}
+	provision("last failure", claim, true)
+	if c := condition(); c == nil || c.Status != v1.ConditionTrue {
+		t.Fatalf("expected %s condition with status True, got %+v", conditionProvisioningFailed, c)
+	}
+	var found bool
+	for _, event := range pt.events() {
+		found = found || strings.Contains(event, "ProvisioningRetriesExceeded")
+	}
+	if !found {
+		t.Error("expected ProvisioningRetriesExceeded event")
+	}
+
+	// No more CreateVolume calls for the same spec.
+	provision("after limit", claim, true)
+
+	// A different spec gets provisioned again.
+	claim = claim.DeepCopy()
+	claim.Spec.Resources.Requests[v1.ResourceStorage] = *resource.NewQuantity(2*requestBytes, resource.BinarySI)
+	createVolume(1, nil)
+	provision("changed spec", claim, false)
+	if c := condition(); c != nil {
+		t.Errorf("expected %s condition to be removed, got %+v", conditionProvisioningFailed, *c)
+	}
+}
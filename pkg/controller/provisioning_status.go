@@ -0,0 +1,185 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	// provisioningStageProvisioned is the final stage of a successfully
+	// provisioned PVC. The other stages are the reasons of the
+	// provisioning condition.
+	provisioningStageProvisioned = "Provisioned"
+
+	// provisioningStatusQueueLength limits how many updates may be
+	// pending. Further updates are dropped.
+	provisioningStatusQueueLength = 1000
+)
+
+// provisioningStatus is the content of a provisioning status object.
+type provisioningStatus struct {
+	namespace  string
+	claimName  string
+	claimUID   string
+	stage      string
+	message    string
+	volumeName string
+}
+
+// ProvisioningStatusReporter mirrors the provisioning stage and result of
+// each PVC in a custom object with the same name and namespace as the
+// PVC. The PVC owns that object, so it gets garbage-collected together with
+// the PVC. Reporting is best-effort: updates are applied in the background
+// by Run and failures are only logged.
+type ProvisioningStatusReporter struct {
+	client   dynamic.Interface
+	resource schema.GroupVersionResource
+	kind     schema.GroupVersionKind
+	timeout  time.Duration
+	updates  chan provisioningStatus
+}
+
+// NewProvisioningStatusReporter creates a reporter for objects of the given
+// kind. The resource is derived from the kind.
+func NewProvisioningStatusReporter(client dynamic.Interface, kind schema.GroupVersionKind, timeout time.Duration) *ProvisioningStatusReporter {
+	resource, _ := meta.UnsafeGuessKindToResource(kind)
+	return &ProvisioningStatusReporter{
+		client:   client,
+		resource: resource,
+		kind:     kind,
+		timeout:  timeout,
+		updates:  make(chan provisioningStatus, provisioningStatusQueueLength),
+	}
+}
+
+// Run applies the reported updates in the order in which they were
+// reported until the context is done.
+func (r *ProvisioningStatusReporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case status := <-r.updates:
+			applyCtx, cancel := context.WithTimeout(ctx, r.timeout)
+			if err := r.apply(applyCtx, status); err != nil {
+				klog.Warningf("failed to update provisioning status %s of PVC %s/%s: %v", r.resource.Resource, status.namespace, status.claimName, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// report queues an update without blocking.
+func (r *ProvisioningStatusReporter) report(status provisioningStatus) {
+	select {
+	case r.updates <- status:
+	default:
+		klog.Warningf("dropping provisioning status %s of PVC %s/%s: too many pending updates", status.stage, status.namespace, status.claimName)
+	}
+}
+
+// apply creates or updates the object of the PVC.
+func (r *ProvisioningStatusReporter) apply(ctx context.Context, status provisioningStatus) error {
+	client := r.client.Resource(r.resource).Namespace(status.namespace)
+	obj, err := client.Get(ctx, status.claimName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(r.kind)
+		obj.SetNamespace(status.namespace)
+		obj.SetName(status.claimName)
+		obj.SetOwnerReferences([]metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Name:       status.claimName,
+			UID:        types.UID(status.claimUID),
+		}})
+		setProvisioningStatusFields(obj, status)
+		_, err = client.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if owners := obj.GetOwnerReferences(); len(owners) > 0 && string(owners[0].UID) != status.claimUID {
+		// Left behind by a deleted PVC with the same name and not
+		// garbage-collected yet.
+		if err := client.Delete(ctx, status.claimName, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+		return r.apply(ctx, status)
+	}
+	setProvisioningStatusFields(obj, status)
+	_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func setProvisioningStatusFields(obj *unstructured.Unstructured, status provisioningStatus) {
+	fields := map[string]interface{}{
+		"stage":              status.stage,
+		"lastTransitionTime": metav1.Now().UTC().Format(time.RFC3339),
+	}
+	if status.message != "" {
+		fields["message"] = status.message
+	}
+	if status.volumeName != "" {
+		fields["volumeName"] = status.volumeName
+	}
+	obj.Object["status"] = fields
+}
+
+// reportProvisioningStatus reports the provisioning stage of the claim, if
+// enabled.
+func (p *csiProvisioner) reportProvisioningStatus(claim *v1.PersistentVolumeClaim, stage, message, volumeName string) {
+	if p.provisioningStatusReporter == nil {
+		return
+	}
+	p.provisioningStatusReporter.report(provisioningStatus{
+		namespace:  claim.Namespace,
+		claimName:  claim.Name,
+		claimUID:   string(claim.UID),
+		stage:      stage,
+		message:    message,
+		volumeName: volumeName,
+	})
+}
+
+// reportProvisioningResult reports the outcome of Provision.
+func (p *csiProvisioner) reportProvisioningResult(options controller.ProvisionOptions, pv *v1.PersistentVolume, state controller.ProvisioningState, err error) {
+	if err == nil {
+		volumeName := ""
+		if pv != nil {
+			volumeName = pv.Name
+		}
+		p.reportProvisioningStatus(options.PVC, provisioningStageProvisioned, "", volumeName)
+		return
+	}
+	condition := provisioningResultCondition(options, state, err)
+	p.reportProvisioningStatus(options.PVC, condition.Reason, condition.Message, "")
+}
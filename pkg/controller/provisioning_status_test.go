@@ -0,0 +1,244 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// fakeDynamicClient stores objects of all resources in memory. Only the
+// methods used by ProvisioningStatusReporter are implemented.
+type fakeDynamicClient struct {
+	dynamic.Interface
+
+	mutex   sync.Mutex
+	objects map[string]*unstructured.Unstructured
+	creates int
+	updates int
+	// err, if set, is returned by all calls.
+	err error
+}
+
+type fakeDynamicResource struct {
+	dynamic.NamespaceableResourceInterface
+
+	client    *fakeDynamicClient
+	resource  schema.GroupVersionResource
+	namespace string
+}
+
+func (c *fakeDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeDynamicResource{client: c, resource: resource}
+}
+
+func (c *fakeDynamicClient) get(resource schema.GroupVersionResource, namespace, name string) *unstructured.Unstructured {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.objects[fmt.Sprintf("%s/%s/%s", resource, namespace, name)]
+}
+
+func (r *fakeDynamicResource) Namespace(namespace string) dynamic.ResourceInterface {
+	return &fakeDynamicResource{client: r.client, resource: r.resource, namespace: namespace}
+}
+
+func (r *fakeDynamicResource) key(name string) string {
+	return fmt.Sprintf("%s/%s/%s", r.resource, r.namespace, name)
+}
+
+func (r *fakeDynamicResource) Get(ctx context.Context, name string, options metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+	if r.client.err != nil {
+		return nil, r.client.err
+	}
+	obj, ok := r.client.objects[r.key(name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(r.resource.GroupResource(), name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (r *fakeDynamicResource) Create(ctx context.Context, obj *unstructured.Unstructured, options metav1.CreateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+	if _, ok := r.client.objects[r.key(obj.GetName())]; ok {
+		return nil, apierrors.NewAlreadyExists(r.resource.GroupResource(), obj.GetName())
+	}
+	r.client.objects[r.key(obj.GetName())] = obj.DeepCopy()
+	r.client.creates++
+	return obj, nil
+}
+
+func (r *fakeDynamicResource) Update(ctx context.Context, obj *unstructured.Unstructured, options metav1.UpdateOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+	if _, ok := r.client.objects[r.key(obj.GetName())]; !ok {
+		return nil, apierrors.NewNotFound(r.resource.GroupResource(), obj.GetName())
+	}
+	r.client.objects[r.key(obj.GetName())] = obj.DeepCopy()
+	r.client.updates++
+	return obj, nil
+}
+
+func (r *fakeDynamicResource) Delete(ctx context.Context, name string, options metav1.DeleteOptions, subresources ...string) error {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+	delete(r.client.objects, r.key(name))
+	return nil
+}
+
+func TestProvisioningStatus(t *testing.T) {
+	const requestBytes = 100
+	kind := schema.GroupVersionKind{Group: "example.com", Version: "v1alpha1", Kind: "ProvisioningStatus"}
+	resource := schema.GroupVersionResource{Group: "example.com", Version: "v1alpha1", Resource: "provisioningstatuses"}
+
+	testcases := map[string]struct {
+		createVolumeErr error
+		clientErr       error
+		existing        *unstructured.Unstructured
+		expectStage     string
+		expectMessage   string
+		expectCreates   int
+		expectUpdates   int
+	}{
+		"provisioned": {
+			expectStage:   provisioningStageProvisioned,
+			expectCreates: 1,
+			expectUpdates: 1,
+		},
+		"failed": {
+			createVolumeErr: errors.New("backend down"),
+			expectStage:     provisioningReasonFailed,
+			expectMessage:   "rpc error: code = Unknown desc = backend down",
+			expectCreates:   1,
+			expectUpdates:   1,
+		},
+		"left behind by other PVC": {
+			existing: func() *unstructured.Unstructured {
+				obj := &unstructured.Unstructured{}
+				obj.SetGroupVersionKind(kind)
+				obj.SetNamespace("fake-ns")
+				obj.SetName("fake-pvc")
+				obj.SetOwnerReferences([]metav1.OwnerReference{{UID: "other-uid"}})
+				return obj
+			}(),
+			expectStage:   provisioningStageProvisioned,
+			expectCreates: 1,
+			expectUpdates: 1,
+		},
+		"client failure": {
+			clientErr: errors.New("no such resource"),
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var rsp *csi.CreateVolumeResponse
+			if tc.createVolumeErr == nil {
+				rsp = &csi.CreateVolumeResponse{
+					Volume: &csi.Volume{
+						CapacityBytes: requestBytes,
+						VolumeId:      "test-volume-id",
+					},
+				}
+			}
+			dynamicClient := &fakeDynamicClient{
+				objects: map[string]*unstructured.Unstructured{},
+				err:     tc.clientErr,
+			}
+			if tc.existing != nil {
+				dynamicClient.objects[fmt.Sprintf("%s/%s/%s", resource, tc.existing.GetNamespace(), tc.existing.GetName())] = tc.existing
+			}
+			reporter := NewProvisioningStatusReporter(dynamicClient, kind, 5*time.Second)
+			go reporter.Run(ctx)
+
+			pt := newProvisionerTest(t, nil, ReportProvisioningStatus(reporter))
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(rsp, tc.createVolumeErr).Times(1)
+
+			claim := createFakePVC(requestBytes)
+			pv, _, err := pt.provisioner.Provision(ctx, controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if tc.createVolumeErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.createVolumeErr != nil && err == nil {
+				t.Fatal("expected error, got none")
+			}
+
+			if tc.clientErr != nil {
+				// Failures of the reporter must not affect provisioning.
+				if pv == nil {
+					t.Error("expected PV, got none")
+				}
+				return
+			}
+
+			if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				obj := dynamicClient.get(resource, claim.Namespace, claim.Name)
+				if obj == nil {
+					return false, nil
+				}
+				stage, _, _ := unstructured.NestedString(obj.Object, "status", "stage")
+				return stage == tc.expectStage, nil
+			}); err != nil {
+				t.Fatalf("provisioning status with stage %s not observed: %v", tc.expectStage, err)
+			}
+
+			obj := dynamicClient.get(resource, claim.Namespace, claim.Name)
+			if obj.GroupVersionKind() != kind {
+				t.Errorf("expected kind %s, got %s", kind, obj.GroupVersionKind())
+			}
+			if owners := obj.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != claim.UID || owners[0].Kind != "PersistentVolumeClaim" {
+				t.Errorf("expected the PVC as owner, got %+v", owners)
+			}
+			message, _, _ := unstructured.NestedString(obj.Object, "status", "message")
+			if message != tc.expectMessage {
+				t.Errorf("expected message %q, got %q", tc.expectMessage, message)
+			}
+			volumeName, _, _ := unstructured.NestedString(obj.Object, "status", "volumeName")
+			if tc.createVolumeErr == nil && volumeName != pv.Name {
+				t.Errorf("expected volume name %q, got %q", pv.Name, volumeName)
+			}
+			dynamicClient.mutex.Lock()
+			defer dynamicClient.mutex.Unlock()
+			if dynamicClient.creates != tc.expectCreates || dynamicClient.updates != tc.expectUpdates {
+				t.Errorf("expected %d creates and %d updates, got %d and %d", tc.expectCreates, tc.expectUpdates, dynamicClient.creates, dynamicClient.updates)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annCreateVolumeParameters on a PV contains the parameters of the
+	// CreateVolume call for it as JSON object, with redacted values for
+	// keys which are not allowlisted.
+	annCreateVolumeParameters = "provisioner.k8s.io/create-volume-parameters"
+
+	redactedParameter = "REDACTED"
+)
+
+// defaultRecordedParameters are the parameters that the provisioner itself
+// adds to CreateVolume and which are safe to record.
+var defaultRecordedParameters = []string{
+	pvcNameKey,
+	pvcNamespaceKey,
+	pvNameKey,
+	fsBlockSizeKey,
+	storagePoolKey,
+	transferProtocolKey,
+	transferSourceDriverKey,
+}
+
+// isSensitiveParameter returns true for parameters whose values are never
+// recorded, even when allowlisted.
+func isSensitiveParameter(key string) bool {
+	if key == encryptionKeyKey {
+		return true
+	}
+	key = strings.ToLower(key)
+	for _, word := range []string{"secret", "password", "token", "credential"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordCreateVolumeParameters stores the parameters in an annotation of
+// the PV.
+func (p *csiProvisioner) recordCreateVolumeParameters(pv *v1.PersistentVolume, parameters map[string]string) {
+	recorded := make(map[string]string, len(parameters))
+	for key, value := range parameters {
+		if !p.recordedParameters.Has(key) || isSensitiveParameter(key) {
+			value = redactedParameter
+		}
+		recorded[key] = value
+	}
+	data, err := json.Marshal(recorded)
+	if err != nil {
+		// Cannot happen for a map of strings.
+		klog.Warningf("encoding CreateVolume parameters of PV %s failed: %v", pv.Name, err)
+		return
+	}
+	metav1.SetMetaDataAnnotation(&pv.ObjectMeta, annCreateVolumeParameters, string(data))
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestRecordCreateVolumeParameters(t *testing.T) {
+	const requestBytes = 100
+	parameters := map[string]string{
+		"type":                                "ssd",
+		"replicas":                            "3",
+		"backendSecretName":                   "backend-credentials",
+		"apiToken":                            "1234",
+		prefixedProvisionerSecretNameKey:      "provisioner-secret",
+		prefixedProvisionerSecretNamespaceKey: "default",
+	}
+
+	testcases := map[string]struct {
+		enabled   bool
+		allowlist []string
+		expected  map[string]string
+	}{
+		"disabled": {},
+		"enabled": {
+			enabled:   true,
+			allowlist: []string{"type", "backendSecretName", "apiToken"},
+			expected: map[string]string{
+				"type":              "ssd",
+				"replicas":          redactedParameter,
+				"backendSecretName": redactedParameter,
+				"apiToken":          redactedParameter,
+				pvcNameKey:          "fake-pvc",
+				pvcNamespaceKey:     "fake-ns",
+				pvNameKey:           "test-testi",
+			},
+		},
+		"no allowlist": {
+			enabled: true,
+			expected: map[string]string{
+				"type":              redactedParameter,
+				"replicas":          redactedParameter,
+				"backendSecretName": redactedParameter,
+				"apiToken":          redactedParameter,
+				pvcNameKey:          "fake-pvc",
+				pvcNamespaceKey:     "fake-ns",
+				pvNameKey:           "test-testi",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			claim := createFakePVC(requestBytes)
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "provisioner-secret", Namespace: "default"},
+				Data:       map[string][]byte{"password": []byte("secret")},
+			}
+			pt := newProvisionerTest(t, []runtime.Object{claim, secret}, withExtraCreateMetadata(), RecordCreateVolumeParameters(tc.enabled, tc.allowlist))
+			pt.expectCreateVolume(requestBytes, nil)
+
+			pv, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: parameters},
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			value, ok := pv.Annotations[annCreateVolumeParameters]
+			if tc.expected == nil {
+				if ok {
+					t.Fatalf("expected no %s annotation, got %q", annCreateVolumeParameters, value)
+				}
+				return
+			}
+			var recorded map[string]string
+			if err := json.Unmarshal([]byte(value), &recorded); err != nil {
+				t.Fatalf("annotation %q: %v", value, err)
+			}
+			if !reflect.DeepEqual(recorded, tc.expected) {
+				t.Errorf("expected recorded parameters %v, got %v", tc.expected, recorded)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// currentRequestedBytes returns the size that the claim requests right now
+// according to the claim informer. Users may expand a claim while it waits
+// for provisioning, in which case the volume should get created with the
+// new size instead of needing an expansion right away. volSizeBytes is
+// returned when there is no claim lister, the claim cannot be read or
+// doesn't request more.
+func (p *csiProvisioner) currentRequestedBytes(claim *v1.PersistentVolumeClaim, volSizeBytes int64) int64 {
+	if p.claimLister == nil {
+		return volSizeBytes
+	}
+	current, err := p.claimLister.PersistentVolumeClaims(claim.Namespace).Get(claim.Name)
+	if err != nil {
+		klog.V(4).Infof("checking the current size of PVC %s/%s failed, using %d bytes: %v", claim.Namespace, claim.Name, volSizeBytes, err)
+		return volSizeBytes
+	}
+	if current.UID != claim.UID {
+		return volSizeBytes
+	}
+	capacity := current.Spec.Resources.Requests[v1.ResourceStorage]
+	if capacity.Value() <= volSizeBytes {
+		return volSizeBytes
+	}
+	klog.V(2).Infof("PVC %s/%s was expanded from %d to %d bytes before provisioning, creating the volume with the new size", claim.Namespace, claim.Name, volSizeBytes, capacity.Value())
+	return capacity.Value()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionCurrentRequestedSize(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		// currentBytes is the size of the PVC in the API server,
+		// zero if it doesn't exist there.
+		currentBytes  int64
+		recreated     bool
+		noLister      bool
+		expectedBytes int64
+	}{
+		"expanded": {
+			currentBytes:  200,
+			expectedBytes: 200,
+		},
+		"unchanged": {
+			currentBytes:  requestBytes,
+			expectedBytes: requestBytes,
+		},
+		"smaller": {
+			currentBytes:  50,
+			expectedBytes: requestBytes,
+		},
+		"recreated": {
+			currentBytes:  200,
+			recreated:     true,
+			expectedBytes: requestBytes,
+		},
+		"no claim lister": {
+			currentBytes:  200,
+			noLister:      true,
+			expectedBytes: requestBytes,
+		},
+		"not found": {
+			expectedBytes: requestBytes,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.currentBytes > 0 {
+				current := createFakePVC(tc.currentBytes)
+				if tc.recreated {
+					current.UID = types.UID("other-uid")
+				}
+				objects = append(objects, current)
+			}
+			pt := newProvisionerTest(t, objects)
+			if tc.noLister {
+				pt.provisioner.claimLister = nil
+			}
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					if required := req.CapacityRange.RequiredBytes; required != tc.expectedBytes {
+						t.Errorf("expected %d required bytes, got %d", tc.expectedBytes, required)
+					}
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							VolumeId: "test-volume-id",
+						},
+					}, nil
+				}).Times(1)
+
+			pv, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != tc.expectedBytes {
+				t.Errorf("expected PV capacity %d, got %d", tc.expectedBytes, capacity.Value())
+			}
+		})
+	}
+}
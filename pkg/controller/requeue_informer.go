@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// RequeueInformer remembers the event handlers that the provisioner library
+// adds to an informer, so that objects from the informer cache can be put
+// into the work queues of the library again, for example after a pause
+// ended. Handlers added with AddEventHandler are not remembered.
+type RequeueInformer struct {
+	cache.SharedIndexInformer
+
+	mutex    sync.Mutex
+	handlers []cache.ResourceEventHandler
+}
+
+// NewRequeueInformer wraps the informer. The wrapper has to be passed to
+// the provisioner library instead of the informer.
+func NewRequeueInformer(informer cache.SharedIndexInformer) *RequeueInformer {
+	return &RequeueInformer{SharedIndexInformer: informer}
+}
+
+func (i *RequeueInformer) AddEventHandlerWithResyncPeriod(handler cache.ResourceEventHandler, resyncPeriod time.Duration) (cache.ResourceEventHandlerRegistration, error) {
+	i.mutex.Lock()
+	i.handlers = append(i.handlers, handler)
+	i.mutex.Unlock()
+	return i.SharedIndexInformer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+}
+
+// requeue passes all cached objects for which match returns true to the
+// remembered handlers as if they had been updated. A nil match selects
+// all objects.
+func (i *RequeueInformer) requeue(match func(obj interface{}) bool) {
+	i.mutex.Lock()
+	handlers := append([]cache.ResourceEventHandler(nil), i.handlers...)
+	i.mutex.Unlock()
+
+	for _, obj := range i.GetStore().List() {
+		if match != nil && !match(obj) {
+			continue
+		}
+		for _, handler := range handlers {
+			handler.OnUpdate(obj, obj)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// prefixedRestoreParametersKey in a StorageClass lists key=value
+	// pairs, separated by commas, which replace or extend the
+	// CreateVolume parameters when restoring a snapshot.
+	prefixedRestoreParametersKey = csiParameterPrefix + "restore-parameters"
+
+	// annRestoreParameter is the prefix of PVC annotations which
+	// override the value of one of the restore parameters of the
+	// StorageClass, for example provisioner.k8s.io/restore-parameter.qos.
+	annRestoreParameter = "provisioner.k8s.io/restore-parameter."
+
+	// annRestoreParametersSupported on a CSIDriver object confirms that
+	// the driver honors CreateVolume parameters when restoring a
+	// snapshot. Some drivers ignore them and only use the parameters
+	// of the snapshot.
+	annRestoreParametersSupported = "provisioner.k8s.io/restore-parameters-supported"
+)
+
+// restoreParameters returns the parameter overrides for restoring a
+// snapshot, from the StorageClass and the PVC annotations.
+func restoreParameters(sc *storagev1.StorageClass, claim *v1.PersistentVolumeClaim) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range strings.Split(sc.Parameters[prefixedRestoreParametersKey], ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid %s parameter in StorageClass %s: %q is not a key=value pair", prefixedRestoreParametersKey, sc.Name, pair)
+		}
+		if strings.HasPrefix(key, csiParameterPrefix) {
+			return nil, fmt.Errorf("invalid %s parameter in StorageClass %s: %s is a reserved key", prefixedRestoreParametersKey, sc.Name, key)
+		}
+		overrides[key] = strings.TrimSpace(parts[1])
+	}
+	for annotation, value := range claim.Annotations {
+		if !strings.HasPrefix(annotation, annRestoreParameter) {
+			continue
+		}
+		key := strings.TrimPrefix(annotation, annRestoreParameter)
+		if _, ok := overrides[key]; !ok {
+			return nil, fmt.Errorf("annotation %s: StorageClass %s does not allow overriding parameter %q when restoring a snapshot, only those listed in %s", annotation, sc.Name, key, prefixedRestoreParametersKey)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// checkRestoreParametersSupported returns an error unless the CSIDriver
+// object of the driver has the provisioner.k8s.io/restore-parameters-supported
+// annotation.
+func (p *csiProvisioner) checkRestoreParametersSupported(ctx context.Context) error {
+	csiDriver, err := p.client.StorageV1().CSIDrivers().Get(ctx, p.driverName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting CSIDriver %s: %v", p.driverName, err)
+	}
+	if err != nil || csiDriver.Annotations[annRestoreParametersSupported] != "true" {
+		return &restoreParametersNotSupportedError{driverName: p.driverName}
+	}
+	return nil
+}
+
+// restoreParametersNotSupportedError is returned when parameters are
+// overridden for restoring a snapshot with a driver that doesn't confirm
+// that it honors them.
+type restoreParametersNotSupportedError struct {
+	driverName string
+}
+
+func (e *restoreParametersNotSupportedError) Error() string {
+	return fmt.Sprintf("CSI driver %s does not support parameter overrides when restoring a snapshot, its CSIDriver object lacks the %s: \"true\" annotation", e.driverName, annRestoreParametersSupported)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-snapshotter/client/v6/clientset/versioned/fake"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionFromSnapshotRestoreParameters(t *testing.T) {
+	const (
+		requestedBytes = 1000
+		snapName       = "test-snapshot"
+		snapClassName  = "test-snapclass"
+	)
+	apiGrp := "snapshot.storage.k8s.io"
+
+	testcases := map[string]struct {
+		scParameters     map[string]string
+		annotations      map[string]string
+		driverSupported  bool
+		noSnapshot       bool
+		expectParameters map[string]string
+		expectEvent      string
+	}{
+		"no overrides": {
+			scParameters:     map[string]string{"qos": "silver"},
+			expectParameters: map[string]string{"qos": "silver"},
+		},
+		"StorageClass overrides": {
+			scParameters: map[string]string{
+				"qos":                        "silver",
+				prefixedRestoreParametersKey: "qos=gold, iops=1000",
+			},
+			driverSupported:  true,
+			expectParameters: map[string]string{"qos": "gold", "iops": "1000"},
+		},
+		"PVC overrides": {
+			scParameters: map[string]string{
+				"qos":                        "silver",
+				prefixedRestoreParametersKey: "qos=gold",
+			},
+			annotations:      map[string]string{annRestoreParameter + "qos": "platinum"},
+			driverSupported:  true,
+			expectParameters: map[string]string{"qos": "platinum"},
+		},
+		"PVC override not allowed": {
+			scParameters: map[string]string{
+				"qos":                        "silver",
+				prefixedRestoreParametersKey: "qos=gold",
+			},
+			annotations:     map[string]string{annRestoreParameter + "iops": "1000"},
+			driverSupported: true,
+			expectEvent:     "Warning InvalidRestoreParameters",
+		},
+		"reserved key": {
+			scParameters: map[string]string{
+				prefixedRestoreParametersKey: prefixedFsTypeKey + "=xfs",
+			},
+			driverSupported: true,
+			expectEvent:     "Warning InvalidRestoreParameters",
+		},
+		"driver does not support overrides": {
+			scParameters: map[string]string{
+				"qos":                        "silver",
+				prefixedRestoreParametersKey: "qos=gold",
+			},
+			expectEvent: "Warning RestoreParametersNotSupported",
+		},
+		"no snapshot": {
+			scParameters: map[string]string{
+				"qos":                        "silver",
+				prefixedRestoreParametersKey: "qos=gold",
+			},
+			noSnapshot:       true,
+			expectParameters: map[string]string{"qos": "silver"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			client := &fake.Clientset{}
+			client.AddReactor("get", "volumesnapshots", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				return true, newSnapshot(snapName, "default", snapClassName, "snapcontent-snapuid", "snapuid", "claim", true, nil, nil, resource.NewQuantity(requestedBytes, resource.BinarySI)), nil
+			})
+			client.AddReactor("get", "volumesnapshotcontents", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				size := int64(requestedBytes)
+				return true, newContent("snapcontent-snapuid", "default", snapClassName, "sid", "pv-uid", "volume", "snapuid", snapName, &size, nil), nil
+			})
+
+			var objects []runtime.Object
+			if tc.driverSupported {
+				objects = append(objects, &storagev1.CSIDriver{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        driverName,
+						Annotations: map[string]string{annRestoreParametersSupported: "true"},
+					},
+				})
+			}
+			if tc.expectEvent == "" {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if !reflect.DeepEqual(req.Parameters, tc.expectParameters) {
+							t.Errorf("expected parameters %v, got %v", tc.expectParameters, req.Parameters)
+						}
+						if (req.VolumeContentSource.GetSnapshot() == nil) != tc.noSnapshot {
+							t.Errorf("unexpected content source %v", req.VolumeContentSource)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestedBytes,
+								VolumeId:      "test-volume-id",
+								ContentSource: req.VolumeContentSource,
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionFromSnapshotCapabilities()
+			csiProvisioner := NewCSIProvisioner(fakeclientset.NewSimpleClientset(objects...), 5*time.Second, "test-provisioner", "test", 5, csiConn.conn,
+				client, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder))
+
+			claim := createFakeNamedPVC(requestedBytes, "fake-pvc", tc.annotations)
+			if !tc.noSnapshot {
+				claim.Spec.DataSource = &v1.TypedLocalObjectReference{
+					Name:     snapName,
+					Kind:     "VolumeSnapshot",
+					APIGroup: &apiGrp,
+				}
+			}
+			_, _, err = csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					ObjectMeta:  metav1.ObjectMeta{Name: "test-sc"},
+					Parameters:  tc.scParameters,
+					Provisioner: driverName,
+				},
+				PVName: "test-testi",
+				PVC:    claim,
+			})
+			if tc.expectEvent == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, tc.expectEvent) {
+					t.Errorf("expected %s event, got %q", tc.expectEvent, event)
+				}
+			default:
+				t.Errorf("expected %s event, got none", tc.expectEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// isDeletedRetainedVolume checks whether the PV of the driver has the
+// Retain reclaim policy, is being deleted and still has the finalizer of
+// the provisioner library, which then only blocks its removal.
+func isDeletedRetainedVolume(volume *v1.PersistentVolume, driverName string) bool {
+	return volume.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain &&
+		volume.DeletionTimestamp != nil &&
+		volume.Spec.CSI != nil && volume.Spec.CSI.Driver == driverName &&
+		checkFinalizer(volume, pvFinalizer)
+}
+
+// RetainedVolumeController removes the finalizer of the provisioner library
+// from PVs of the driver with the Retain reclaim policy once they get
+// deleted. The provisioner library doesn't call Delete for such PVs, so
+// without this the finalizer may block their removal.
+type RetainedVolumeController struct {
+	client       kubernetes.Interface
+	driverName   string
+	timeout      time.Duration
+	volumeLister corelisters.PersistentVolumeLister
+	volumeQueue  workqueue.RateLimitingInterface
+}
+
+// NewRetainedVolumeController creates the controller and adds its event
+// handler to the PV informer.
+func NewRetainedVolumeController(
+	client kubernetes.Interface,
+	driverName string,
+	timeout time.Duration,
+	volumeInformer cache.SharedIndexInformer,
+	volumeQueue workqueue.RateLimitingInterface,
+) *RetainedVolumeController {
+	c := &RetainedVolumeController{
+		client:       client,
+		driverName:   driverName,
+		timeout:      timeout,
+		volumeLister: corelisters.NewPersistentVolumeLister(volumeInformer.GetIndexer()),
+		volumeQueue:  volumeQueue,
+	}
+	volumeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueVolume,
+		UpdateFunc: func(_ interface{}, newObj interface{}) { c.enqueueVolume(newObj) },
+	})
+	return c
+}
+
+// Run processes the queued PVs until the context is done.
+func (c *RetainedVolumeController) Run(ctx context.Context, threadiness int) {
+	klog.Info("Starting RetainedVolume controller")
+	defer utilruntime.HandleCrash()
+	defer c.volumeQueue.ShutDown()
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(func() {
+			for c.processNextVolumeWorkItem(ctx) {
+			}
+		}, time.Second, ctx.Done())
+	}
+
+	<-ctx.Done()
+	klog.Info("Shutting down RetainedVolume controller")
+}
+
+func (c *RetainedVolumeController) enqueueVolume(obj interface{}) {
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok || !isDeletedRetainedVolume(volume, c.driverName) {
+		return
+	}
+	c.volumeQueue.Add(volume.Name)
+}
+
+// processNextVolumeWorkItem releases one PV. Failed PVs, for example
+// because of a conflict with another update, get retried with backoff.
+func (c *RetainedVolumeController) processNextVolumeWorkItem(ctx context.Context) bool {
+	obj, shutdown := c.volumeQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.volumeQueue.Done(obj)
+
+	name, ok := obj.(string)
+	if !ok {
+		c.volumeQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+		return true
+	}
+	if err := c.syncVolume(ctx, name); err != nil {
+		klog.Warningf("Retrying releasing retained PV %s after %v failures: %v", name, c.volumeQueue.NumRequeues(obj), err)
+		c.volumeQueue.AddRateLimited(obj)
+	} else {
+		c.volumeQueue.Forget(obj)
+	}
+	return true
+}
+
+func (c *RetainedVolumeController) syncVolume(ctx context.Context, name string) error {
+	volume, err := c.volumeLister.Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !isDeletedRetainedVolume(volume, c.driverName) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	klog.V(2).Infof("PV %s has the Retain reclaim policy and is being deleted, removing finalizer %s", volume.Name, pvFinalizer)
+	return removeVolumeFinalizer(ctx, c.client, volume)
+}
+
+// removeVolumeFinalizer removes the finalizer of the provisioner library
+// from the PV, if it has it.
+func removeVolumeFinalizer(ctx context.Context, client kubernetes.Interface, volume *v1.PersistentVolume) error {
+	if !checkFinalizer(volume, pvFinalizer) {
+		return nil
+	}
+	// The volume passed in may have been translated from an in-tree PV,
+	// so work on the current object instead.
+	current, err := client.CoreV1().PersistentVolumes().Get(ctx, volume.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get PV %s: %v", volume.Name, err)
+	}
+	var finalizers []string
+	for _, f := range current.Finalizers {
+		if f != pvFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	current.Finalizers = finalizers
+	if _, err := client.CoreV1().PersistentVolumes().Update(ctx, current, metav1.UpdateOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to remove finalizer %s from PV %s: %v", pvFinalizer, volume.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func retainedVolume(driver string, deleted bool) *v1.PersistentVolume {
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test-pv",
+			Finalizers: []string{pvFinalizer, "kubernetes.io/pv-protection"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       driver,
+					VolumeHandle: "test-volume-id",
+				},
+			},
+		},
+	}
+	if deleted {
+		now := metav1.Now()
+		volume.DeletionTimestamp = &now
+	}
+	return volume
+}
+
+func TestRetainedVolumeController(t *testing.T) {
+	testcases := map[string]struct {
+		volume           *v1.PersistentVolume
+		conflicts        int
+		expectFinalizers []string
+	}{
+		"deleted retained volume": {
+			volume:           retainedVolume(driverName, true),
+			expectFinalizers: []string{"kubernetes.io/pv-protection"},
+		},
+		"deleted retained volume with conflict": {
+			volume:           retainedVolume(driverName, true),
+			conflicts:        2,
+			expectFinalizers: []string{"kubernetes.io/pv-protection"},
+		},
+		"retained volume": {
+			volume:           retainedVolume(driverName, false),
+			expectFinalizers: []string{pvFinalizer, "kubernetes.io/pv-protection"},
+		},
+		"other driver": {
+			volume:           retainedVolume("other-driver", true),
+			expectFinalizers: []string{pvFinalizer, "kubernetes.io/pv-protection"},
+		},
+		"deleted volume with delete policy": {
+			volume: func() *v1.PersistentVolume {
+				volume := retainedVolume(driverName, true)
+				volume.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+				return volume
+			}(),
+			expectFinalizers: []string{pvFinalizer, "kubernetes.io/pv-protection"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			clientSet := fakeclientset.NewSimpleClientset(tc.volume)
+			conflicts := tc.conflicts
+			clientSet.PrependReactor("update", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if conflicts == 0 {
+					return false, nil, nil
+				}
+				conflicts--
+				return true, nil, apierrors.NewConflict(v1.Resource("persistentvolumes"), tc.volume.Name, errors.New("changed"))
+			})
+			factory := informers.NewSharedInformerFactory(clientSet, 0)
+			queue := workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second))
+			c := NewRetainedVolumeController(clientSet, driverName, time.Second, factory.Core().V1().PersistentVolumes().Informer(), queue)
+			factory.Start(ctx.Done())
+			factory.WaitForCacheSync(ctx.Done())
+
+			if isDeletedRetainedVolume(tc.volume, driverName) {
+				// Failed attempts get requeued, Get waits for them.
+				for i := 0; i <= tc.conflicts; i++ {
+					c.processNextVolumeWorkItem(ctx)
+				}
+			} else {
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			current, err := clientSet.CoreV1().PersistentVolumes().Get(ctx, tc.volume.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(current.Finalizers, tc.expectFinalizers) {
+				t.Errorf("expected finalizers %v, got %v", tc.expectFinalizers, current.Finalizers)
+			}
+			if queue.Len() != 0 {
+				t.Errorf("expected empty queue, got %d PVs", queue.Len())
+			}
+		})
+	}
+}
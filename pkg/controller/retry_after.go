@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// RetryAfterRateLimiter delays the next attempt for a PVC by the time that
+// the CSI driver asked for in a RetryInfo detail of its last error. PVCs
+// without such a hint get delayed by the wrapped rate limiter.
+type RetryAfterRateLimiter struct {
+	workqueue.RateLimiter
+	max time.Duration
+
+	mutex sync.Mutex
+	// hints are indexed by the PVC UID, which is also the key of the
+	// PVC in the work queue of the provisioner library.
+	hints map[string]time.Duration
+}
+
+var _ workqueue.RateLimiter = &RetryAfterRateLimiter{}
+
+// NewRetryAfterRateLimiter honors hints of up to max, longer ones get
+// shortened to max.
+func NewRetryAfterRateLimiter(rateLimiter workqueue.RateLimiter, max time.Duration) *RetryAfterRateLimiter {
+	return &RetryAfterRateLimiter{
+		RateLimiter: rateLimiter,
+		max:         max,
+		hints:       map[string]time.Duration{},
+	}
+}
+
+func (r *RetryAfterRateLimiter) When(item interface{}) time.Duration {
+	if key, ok := item.(string); ok {
+		r.mutex.Lock()
+		delay, ok := r.hints[key]
+		delete(r.hints, key)
+		r.mutex.Unlock()
+		if ok {
+			return delay
+		}
+	}
+	return r.RateLimiter.When(item)
+}
+
+func (r *RetryAfterRateLimiter) Forget(item interface{}) {
+	if key, ok := item.(string); ok {
+		r.mutex.Lock()
+		delete(r.hints, key)
+		r.mutex.Unlock()
+	}
+	r.RateLimiter.Forget(item)
+}
+
+// set remembers the hint for the next attempt of the PVC.
+func (r *RetryAfterRateLimiter) set(uid types.UID, delay time.Duration) {
+	if delay > r.max {
+		delay = r.max
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hints[string(uid)] = delay
+}
+
+// retryAfter returns the delay of the RetryInfo detail of a gRPC error,
+// zero if the error has none or an invalid one.
+func retryAfter(err error) time.Duration {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0
+	}
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.RetryInfo)
+		if !ok || info.RetryDelay == nil {
+			continue
+		}
+		if err := info.RetryDelay.CheckValid(); err != nil {
+			continue
+		}
+		if delay := info.RetryDelay.AsDuration(); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
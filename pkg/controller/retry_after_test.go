@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// retryInfoError returns a ResourceExhausted error with a RetryInfo detail.
+func retryInfoError(t *testing.T, delay *durationpb.Duration) error {
+	st, err := status.New(codes.ResourceExhausted, "out of capacity").WithDetails(&errdetails.RetryInfo{RetryDelay: delay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Err()
+}
+
+func TestProvisionRetryAfter(t *testing.T) {
+	const (
+		requestBytes = 100
+		baseDelay    = time.Millisecond
+		maxDelay     = 5 * time.Minute
+	)
+
+	testcases := map[string]struct {
+		err         func(t *testing.T) error
+		expectDelay time.Duration
+	}{
+		"hint": {
+			err:         func(t *testing.T) error { return retryInfoError(t, durationpb.New(30*time.Second)) },
+			expectDelay: 30 * time.Second,
+		},
+		"long hint": {
+			err:         func(t *testing.T) error { return retryInfoError(t, durationpb.New(time.Hour)) },
+			expectDelay: maxDelay,
+		},
+		"no hint": {
+			err:         func(t *testing.T) error { return status.Error(codes.ResourceExhausted, "out of capacity") },
+			expectDelay: baseDelay,
+		},
+		"empty hint": {
+			err:         func(t *testing.T) error { return retryInfoError(t, nil) },
+			expectDelay: baseDelay,
+		},
+		"negative hint": {
+			err:         func(t *testing.T) error { return retryInfoError(t, durationpb.New(-time.Second)) },
+			expectDelay: baseDelay,
+		},
+		"malformed hint": {
+			err:         func(t *testing.T) error { return retryInfoError(t, &durationpb.Duration{Seconds: 1, Nanos: -1}) },
+			expectDelay: baseDelay,
+		},
+		"no gRPC error": {
+			err:         func(t *testing.T) error { return errors.New("out of capacity") },
+			expectDelay: baseDelay,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			rateLimiter := NewRetryAfterRateLimiter(workqueue.NewItemExponentialFailureRateLimiter(baseDelay, time.Second), maxDelay)
+			pt := newProvisionerTest(t, nil, HonorRetryAfter(rateLimiter))
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(nil, tc.err(t)).Times(1)
+
+			claim := createFakePVC(requestBytes)
+			if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          claim,
+			}); err == nil {
+				t.Fatal("expected error, got none")
+			}
+
+			if delay := rateLimiter.When(string(claim.UID)); delay != tc.expectDelay {
+				t.Errorf("expected delay %v, got %v", tc.expectDelay, delay)
+			}
+			// The hint only applies once, the next failure gets
+			// delayed by the rate limiter.
+			if delay := rateLimiter.When(string(claim.UID)); delay == tc.expectDelay && tc.expectDelay != baseDelay {
+				t.Errorf("hint %v was used again", delay)
+			}
+		})
+	}
+}
+
+func TestRetryAfterRateLimiterForget(t *testing.T) {
+	const baseDelay = time.Millisecond
+	rateLimiter := NewRetryAfterRateLimiter(workqueue.NewItemExponentialFailureRateLimiter(baseDelay, time.Second), time.Minute)
+	rateLimiter.set("claim-uid", 30*time.Second)
+	rateLimiter.Forget("claim-uid")
+	if delay := rateLimiter.When("claim-uid"); delay != baseDelay {
+		t.Errorf("expected delay %v after Forget, got %v", baseDelay, delay)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+)
+
+// routineEventReasons are the reasons of Normal events which get emitted
+// again each time a PVC is requeued while it waits for something.
+var routineEventReasons = map[string]bool{
+	"Provisioning":                 true,
+	"WaitingForSnapshot":           true,
+	"ProvisioningApprovalRequired": true,
+	"ProvisioningPaused":           true,
+}
+
+// routineEventFilter passes on all events to the embedded recorder except
+// routine ones. Those get dropped, or with an interval, passed on at most
+// once per interval for the same object and reason.
+type routineEventFilter struct {
+	record.EventRecorder
+	interval time.Duration
+	emitted  *cache.Expiring
+}
+
+type routineEventKey struct {
+	uid    types.UID
+	reason string
+}
+
+func newRoutineEventFilter(interval time.Duration, clock clock.Clock) *routineEventFilter {
+	return &routineEventFilter{
+		interval: interval,
+		emitted:  cache.NewExpiringWithClock(clock),
+	}
+}
+
+// pass checks whether the event may be emitted.
+func (f *routineEventFilter) pass(object runtime.Object, eventtype, reason string) bool {
+	if eventtype != v1.EventTypeNormal || !routineEventReasons[reason] {
+		return true
+	}
+	if f.interval <= 0 {
+		return false
+	}
+	accessor, err := meta.Accessor(object)
+	if err != nil {
+		return true
+	}
+	key := routineEventKey{uid: accessor.GetUID(), reason: reason}
+	if _, ok := f.emitted.Get(key); ok {
+		return false
+	}
+	f.emitted.Set(key, true, f.interval)
+	return true
+}
+
+func (f *routineEventFilter) Event(object runtime.Object, eventtype, reason, message string) {
+	if f.pass(object, eventtype, reason) {
+		f.EventRecorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (f *routineEventFilter) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if f.pass(object, eventtype, reason) {
+		f.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+func (f *routineEventFilter) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	if f.pass(object, eventtype, reason) {
+		f.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	}
+}
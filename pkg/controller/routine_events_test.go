@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionRoutineEvents(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		options        []ProvisionerOption
+		expectedEvents []string
+	}{
+		"all events": {
+			expectedEvents: []string{
+				"Normal ProvisioningApprovalRequired",
+				"Warning ProvisioningApprovalDenied",
+				"Normal ProvisioningApprovalRequired",
+			},
+		},
+		"suppressed": {
+			options: []ProvisionerOption{RoutineEvents(true, 0)},
+			expectedEvents: []string{
+				"Warning ProvisioningApprovalDenied",
+			},
+		},
+		"interval": {
+			options: []ProvisionerOption{RoutineEvents(false, time.Hour)},
+			expectedEvents: []string{
+				"Normal ProvisioningApprovalRequired",
+				"Warning ProvisioningApprovalDenied",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			claim := createFakeNamedPVC(requestBytes, "fake-pvc", map[string]string{annApprovalRequired: "true"})
+			clientSet := fakeclientset.NewSimpleClientset(claim, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: claim.Namespace}})
+			namespaceInformer, claimInformer, stopCh := startApprovalInformers(clientSet)
+			defer close(stopCh)
+			pt := newProvisionerTestWithClient(t, clientSet, append([]ProvisionerOption{RequireProvisioningApproval(true, 0, namespaceInformer, claimInformer)}, tc.options...)...)
+
+			// Waiting for approval gets reported again after a denial
+			// was withdrawn.
+			for _, approval := range []string{"", "", approvalDenied, ""} {
+				setNamespaceApproval(ctx, t, clientSet, namespaceInformer, claim, approval)
+				if _, _, err := pt.provisioner.Provision(ctx, controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{},
+					PVC:          claim,
+				}); err == nil {
+					t.Fatal("expected error, got none")
+				}
+			}
+
+			var events []string
+			for _, event := range pt.events() {
+				// Only the type and reason, without the message.
+				events = append(events, strings.Join(strings.SplitN(event, " ", 3)[:2], " "))
+			}
+			if !reflect.DeepEqual(events, tc.expectedEvents) {
+				t.Errorf("expected events %q, got %q", tc.expectedEvents, events)
+			}
+		})
+	}
+}
+
+func TestRoutineEventFilterInterval(t *testing.T) {
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	recorder := record.NewFakeRecorder(10)
+	filter := newRoutineEventFilter(time.Minute, fakeClock)
+	filter.EventRecorder = recorder
+	claim := createFakeNamedPVC(100, "fake-pvc", nil)
+	otherClaim := createFakeNamedPVC(100, "other-pvc", nil)
+	otherClaim.UID = "other-uid"
+
+	filter.Event(claim, v1.EventTypeNormal, "WaitingForSnapshot", "waiting")
+	filter.Event(claim, v1.EventTypeNormal, "WaitingForSnapshot", "waiting")
+	filter.Event(otherClaim, v1.EventTypeNormal, "WaitingForSnapshot", "waiting")
+	filter.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", "failed")
+	filter.Event(claim, v1.EventTypeNormal, "VolumeSizeIncreased", "increased")
+	if count := len(recorder.Events); count != 4 {
+		t.Errorf("expected 4 events within the interval, got %d", count)
+	}
+
+	fakeClock.Step(time.Minute + time.Second)
+	filter.Event(claim, v1.EventTypeNormal, "WaitingForSnapshot", "waiting")
+	if count := len(recorder.Events); count != 5 {
+		t.Errorf("expected the routine event again after the interval, got %d events", count)
+	}
+}
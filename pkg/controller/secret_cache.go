@@ -0,0 +1,86 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// secretCache keeps secrets that were retrieved from the API server in
+// memory for a limited time, to avoid getting the same secret again for
+// each volume. Only successful lookups are cached. A nil *secretCache is
+// valid and always retrieves secrets from the API server.
+type secretCache struct {
+	ttl   time.Duration
+	cache *cache.Expiring
+}
+
+func newSecretCache(ttl time.Duration, clock clock.Clock) *secretCache {
+	return &secretCache{
+		ttl:   ttl,
+		cache: cache.NewExpiringWithClock(clock),
+	}
+}
+
+// get returns the secret from the cache if it was retrieved less than the
+// TTL ago, otherwise from the API server. The returned secret must not be
+// modified.
+func (c *secretCache) get(ctx context.Context, client kubernetes.Interface, namespace, name string) (*v1.Secret, error) {
+	if c == nil {
+		return client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if secret, ok := c.cache.Get(key); ok {
+		klog.V(5).Infof("using cached secret %s", key)
+		return secret.(*v1.Secret), nil
+	}
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Set(key, secret, c.ttl)
+	return secret, nil
+}
+
+// forget removes the secret from the cache, so that the next get retrieves
+// it from the API server again. This is used when the driver rejects the
+// credentials of a secret, which may have been rotated in the meantime.
+func (c *secretCache) forget(namespace, name string) {
+	if c == nil {
+		return
+	}
+	c.cache.Delete(types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// isAuthenticationError checks whether a gRPC error indicates that the
+// driver rejected the credentials.
+func isAuthenticationError(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unauthenticated || code == codes.PermissionDenied
+}
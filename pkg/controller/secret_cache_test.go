@@ -0,0 +1,202 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestSecretCache(t *testing.T) {
+	const ttl = time.Minute
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns1"},
+			Data:       map[string][]byte{"key": []byte("ns1-value")},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns2"},
+			Data:       map[string][]byte{"key": []byte("ns2-value")},
+		},
+	)
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	secretCache := newSecretCache(ttl, fakeClock)
+
+	gets := func() int {
+		count := 0
+		for _, action := range clientSet.Actions() {
+			if action.GetVerb() == "get" && action.GetResource().Resource == "secrets" {
+				count++
+			}
+		}
+		return count
+	}
+	expect := func(namespace, value string, expectedGets int) {
+		t.Helper()
+		credentials, err := getCredentials(ctx, clientSet, secretCache, &v1.SecretReference{Name: "secret", Namespace: namespace})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if credentials["key"] != value {
+			t.Errorf("expected secret value %q for namespace %s, got %q", value, namespace, credentials["key"])
+		}
+		if actual := gets(); actual != expectedGets {
+			t.Errorf("expected %d secret lookups in the API server, got %d", expectedGets, actual)
+		}
+	}
+
+	expect("ns1", "ns1-value", 1)
+	expect("ns2", "ns2-value", 2)
+
+	// Cache hits.
+	fakeClock.Step(ttl / 2)
+	expect("ns1", "ns1-value", 2)
+	expect("ns2", "ns2-value", 2)
+
+	// Changes only become visible after expiry.
+	secret, err := clientSet.CoreV1().Secrets("ns1").Get(ctx, "secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret.Data["key"] = []byte("ns1-updated")
+	if _, err := clientSet.CoreV1().Secrets("ns1").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect("ns1", "ns1-value", 3)
+	fakeClock.Step(ttl / 2)
+	expect("ns1", "ns1-updated", 4)
+	expect("ns2", "ns2-value", 5)
+}
+
+func TestSecretCacheDisabled(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fakeclientset.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "ns"},
+	})
+	var secretCache *secretCache
+
+	for i := 0; i < 2; i++ {
+		if _, err := secretCache.get(ctx, clientSet, "ns", "secret"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if actions := len(clientSet.Actions()); actions != 2 {
+		t.Errorf("expected 2 secret lookups in the API server, got %d", actions)
+	}
+	if _, err := secretCache.get(ctx, clientSet, "ns", "no-such-secret"); err == nil {
+		t.Error("expected error for missing secret, got none")
+	}
+}
+
+// TestProvisionRefreshesSecret checks that a cached secret gets retrieved
+// again after the driver rejected its credentials.
+func TestProvisionRefreshesSecret(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		code          codes.Code
+		expectRefresh bool
+	}{
+		"unauthenticated": {
+			code:          codes.Unauthenticated,
+			expectRefresh: true,
+		},
+		"permission denied": {
+			code:          codes.PermissionDenied,
+			expectRefresh: true,
+		},
+		"other error": {
+			code: codes.Unavailable,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			secret := &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "fake-ns"},
+				Data:       map[string][]byte{"password": []byte("old")},
+			}
+			pt := newProvisionerTest(t, []runtime.Object{secret}, SecretCacheTTL(time.Hour))
+
+			expectedPassword := "new"
+			if !tc.expectRefresh {
+				expectedPassword = "old"
+			}
+			gomock.InOrder(
+				pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if password := req.Secrets["password"]; password != "old" {
+							t.Errorf("first attempt: expected password %q, got %q", "old", password)
+						}
+						return nil, status.Error(tc.code, "rejected")
+					}).Times(1),
+				pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if password := req.Secrets["password"]; password != expectedPassword {
+							t.Errorf("second attempt: expected password %q, got %q", expectedPassword, password)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1),
+			)
+
+			options := controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					Parameters: map[string]string{
+						prefixedProvisionerSecretNameKey:      secret.Name,
+						prefixedProvisionerSecretNamespaceKey: secret.Namespace,
+					},
+				},
+				PVName: "test-testi",
+				PVC:    createFakePVC(requestBytes),
+			}
+
+			if _, _, err := pt.provisioner.Provision(ctx, options); status.Code(err) != tc.code {
+				t.Fatalf("first attempt: expected %s error, got %v", tc.code, err)
+			}
+
+			// The credentials get rotated.
+			secret.Data["password"] = []byte("new")
+			if _, err := pt.clientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := pt.provisioner.Provision(ctx, options); err != nil {
+				t.Fatalf("second attempt: unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+const (
+	// annRecordedParametersHash on a StorageClass is the hash of the
+	// parameters with which the provisioner first provisioned for it.
+	annRecordedParametersHash = "provisioner.k8s.io/recorded-parameters-hash"
+
+	// annAcknowledgedParametersHash on a StorageClass accepts a change of
+	// the parameters. The value must be the hash of the new parameters.
+	annAcknowledgedParametersHash = "provisioner.k8s.io/acknowledged-parameters-hash"
+)
+
+// checkStorageClassParameters refuses to provision for a storage class whose
+// parameters have changed since the provisioner first used it, unless the
+// change was acknowledged. The hash of the parameters gets recorded in the
+// storage class the first time and after each acknowledged change.
+func (p *csiProvisioner) checkStorageClassParameters(ctx context.Context, claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) (controller.ProvisioningState, error) {
+	hash := storageClassParametersHash(sc.Parameters)
+	recorded, ok := sc.Annotations[annRecordedParametersHash]
+	switch {
+	case recorded == hash:
+		return controller.ProvisioningFinished, nil
+	case ok && sc.Annotations[annAcknowledgedParametersHash] != hash:
+		err := fmt.Errorf("parameters of StorageClass %s have changed since they were first used, set annotation %s=%s on the StorageClass to accept the change", sc.Name, annAcknowledgedParametersHash, hash)
+		p.eventRecorder.Event(claim, v1.EventTypeWarning, "StorageClassParametersChanged", err.Error())
+		return controller.ProvisioningNoChange, err
+	}
+
+	// The copy from the informer may be outdated, so the update is done
+	// with the current object. If that has different parameters,
+	// provisioning gets retried with them.
+	current, err := p.client.StorageV1().StorageClasses().Get(ctx, sc.Name, metav1.GetOptions{})
+	if err != nil {
+		return controller.ProvisioningNoChange, fmt.Errorf("get StorageClass %s: %v", sc.Name, err)
+	}
+	if storageClassParametersHash(current.Parameters) != hash {
+		return controller.ProvisioningNoChange, fmt.Errorf("parameters of StorageClass %s have changed, will retry", sc.Name)
+	}
+	current = current.DeepCopy()
+	metav1.SetMetaDataAnnotation(&current.ObjectMeta, annRecordedParametersHash, hash)
+	if _, err := p.client.StorageV1().StorageClasses().Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return controller.ProvisioningNoChange, fmt.Errorf("record parameters hash of StorageClass %s: %v", sc.Name, err)
+	}
+	klog.V(3).Infof("recorded parameters hash %s of StorageClass %s", hash, sc.Name)
+	return controller.ProvisioningFinished, nil
+}
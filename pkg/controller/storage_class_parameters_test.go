@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+func TestCheckStorageClassParameters(t *testing.T) {
+	oldParameters := map[string]string{"type": "ssd"}
+	newParameters := map[string]string{"type": "hdd"}
+	oldHash := storageClassParametersHash(oldParameters)
+	newHash := storageClassParametersHash(newParameters)
+
+	testcases := map[string]struct {
+		annotations    map[string]string
+		parameters     map[string]string
+		expectError    bool
+		expectRecorded string
+	}{
+		"first use": {
+			parameters:     oldParameters,
+			expectRecorded: oldHash,
+		},
+		"unchanged": {
+			annotations:    map[string]string{annRecordedParametersHash: oldHash},
+			parameters:     oldParameters,
+			expectRecorded: oldHash,
+		},
+		"changed": {
+			annotations:    map[string]string{annRecordedParametersHash: oldHash},
+			parameters:     newParameters,
+			expectError:    true,
+			expectRecorded: oldHash,
+		},
+		"changed, wrong acknowledgement": {
+			annotations: map[string]string{
+				annRecordedParametersHash:     oldHash,
+				annAcknowledgedParametersHash: oldHash,
+			},
+			parameters:     newParameters,
+			expectError:    true,
+			expectRecorded: oldHash,
+		},
+		"changed and acknowledged": {
+			annotations: map[string]string{
+				annRecordedParametersHash:     oldHash,
+				annAcknowledgedParametersHash: newHash,
+			},
+			parameters:     newParameters,
+			expectRecorded: newHash,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "fast",
+					Annotations: tc.annotations,
+				},
+				Provisioner: driverName,
+				Parameters:  tc.parameters,
+			}
+			clientSet := fakeclientset.NewSimpleClientset(sc)
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionCapabilities()
+			provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), nil, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+				withEventRecorder(recorder), EnforceStorageClassParameters(true))
+
+			_, err := provisioner.(*csiProvisioner).checkStorageClassParameters(ctx, createFakePVC(100), sc)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectError, err)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectError && !strings.Contains(event, "StorageClassParametersChanged") {
+				t.Errorf("expected StorageClassParametersChanged event, got %q", event)
+			}
+			if !tc.expectError && event != "" {
+				t.Errorf("expected no event, got %q", event)
+			}
+
+			sc, err = clientSet.StorageV1().StorageClasses().Get(ctx, sc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if recorded := sc.Annotations[annRecordedParametersHash]; recorded != tc.expectRecorded {
+				t.Errorf("expected recorded hash %q, got %q", tc.expectRecorded, recorded)
+			}
+		})
+	}
+}
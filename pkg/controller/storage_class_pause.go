@@ -0,0 +1,182 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/types"
+	storageinformers "k8s.io/client-go/informers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annPaused on a StorageClass with value "true" pauses provisioning
+	// of PVCs of that class, for example during backend maintenance.
+	annPaused = "provisioner.k8s.io/paused"
+
+	// annDeletionPaused on a StorageClass with value "true" pauses
+	// deletion of PVs of that class.
+	annDeletionPaused = "provisioner.k8s.io/deletion-paused"
+)
+
+// pausedClaims remembers the claims that got an event about a paused storage
+// class, so that each claim gets it only once per pause.
+type pausedClaims struct {
+	mutex  sync.Mutex
+	claims map[string]map[types.UID]bool
+}
+
+func newPausedClaims() *pausedClaims {
+	return &pausedClaims{
+		claims: map[string]map[types.UID]bool{},
+	}
+}
+
+// add returns true if the claim wasn't known yet.
+func (c *pausedClaims) add(className string, uid types.UID) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.claims[className] == nil {
+		c.claims[className] = map[types.UID]bool{}
+	}
+	if c.claims[className][uid] {
+		return false
+	}
+	c.claims[className][uid] = true
+	return true
+}
+
+// resume forgets the claims of a storage class that is no longer paused.
+func (c *pausedClaims) resume(className string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.claims, className)
+}
+
+// forget forgets a claim which got bound or deleted.
+func (c *pausedClaims) forget(uid types.UID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for className, claims := range c.claims {
+		delete(claims, uid)
+		if len(claims) == 0 {
+			delete(c.claims, className)
+		}
+	}
+}
+
+// watchStorageClassPauses queues the claims and volumes of a storage class
+// again when provisioning or deletion gets resumed for it, and forgets
+// paused claims once they got bound or deleted.
+func (p *csiProvisioner) watchStorageClassPauses(scInformer storageinformers.StorageClassInformer, claimInformer, volumeInformer *RequeueInformer) {
+	scInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldClass, ok := oldObj.(*storagev1.StorageClass)
+			class, ok2 := newObj.(*storagev1.StorageClass)
+			if !ok || !ok2 {
+				return
+			}
+			if oldClass.Annotations[annPaused] == "true" && class.Annotations[annPaused] != "true" {
+				klog.V(3).Infof("provisioning resumed for StorageClass %s", class.Name)
+				p.pausedClaims.resume(class.Name)
+				claimInformer.requeue(func(obj interface{}) bool {
+					claim, ok := obj.(*v1.PersistentVolumeClaim)
+					return ok && claim.Spec.VolumeName == "" &&
+						claim.Spec.StorageClassName != nil && *claim.Spec.StorageClassName == class.Name
+				})
+			}
+			if oldClass.Annotations[annDeletionPaused] == "true" && class.Annotations[annDeletionPaused] != "true" {
+				klog.V(3).Infof("deletion resumed for StorageClass %s", class.Name)
+				volumeInformer.requeue(func(obj interface{}) bool {
+					volume, ok := obj.(*v1.PersistentVolume)
+					return ok && p.storageClassOfVolume(volume) == class.Name
+				})
+			}
+		},
+	})
+	claimInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if claim, ok := newObj.(*v1.PersistentVolumeClaim); ok && claim.Spec.VolumeName != "" {
+				p.pausedClaims.forget(claim.UID)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok && unknown.Obj != nil {
+				obj = unknown.Obj
+			}
+			if claim, ok := obj.(*v1.PersistentVolumeClaim); ok {
+				p.pausedClaims.forget(claim.UID)
+			}
+		},
+	})
+}
+
+// isProvisioningPaused checks whether the storage class of the claim is
+// paused. Paused claims are not retried, they get queued again once the
+// annotation is removed.
+func (p *csiProvisioner) isProvisioningPaused(claim *v1.PersistentVolumeClaim) bool {
+	if p.scLister == nil || claim.Spec.StorageClassName == nil {
+		return false
+	}
+	className := *claim.Spec.StorageClassName
+	sc, err := p.scLister.Get(className)
+	if err != nil {
+		// Provisioning reports the missing class.
+		return false
+	}
+	if sc.Annotations[annPaused] != "true" {
+		p.pausedClaims.resume(className)
+		return false
+	}
+	klog.V(4).Infof("not provisioning PVC %s/%s: StorageClass %s is paused", claim.Namespace, claim.Name, className)
+	if p.pausedClaims.add(className, claim.UID) {
+		p.eventRecorder.Eventf(claim, v1.EventTypeNormal, "ProvisioningPaused", "Provisioning is paused for StorageClass %s, it resumes when the %s annotation is removed", className, annPaused)
+	}
+	return true
+}
+
+// ShouldDelete skips all PVs while the global pause is on and PVs whose
+// storage class has deletion paused. Both get queued again when the pause
+// ends.
+func (p *csiProvisioner) ShouldDelete(ctx context.Context, volume *v1.PersistentVolume) bool {
+	if p.globalPause.isPaused() {
+		// The volume gets queued again when the pause ends.
+		klog.V(4).Infof("not deleting PV %s: deletion is paused", volume.Name)
+		return false
+	}
+	className := p.storageClassOfVolume(volume)
+	if p.scLister == nil || className == "" {
+		return true
+	}
+	sc, err := p.scLister.Get(className)
+	if err != nil {
+		return true
+	}
+	if sc.Annotations[annDeletionPaused] == "true" {
+		klog.V(4).Infof("not deleting PV %s: deletion is paused for StorageClass %s", volume.Name, sc.Name)
+		return false
+	}
+	return true
+}
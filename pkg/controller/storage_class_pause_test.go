@@ -0,0 +1,227 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+// TestShouldProvisionPausedStorageClass checks that PVCs of a paused storage
+// class are skipped with one event and provisioned again after resuming.
+func TestShouldProvisionPausedStorageClass(t *testing.T) {
+	ctx := context.Background()
+	className := "paused"
+	sc := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        className,
+			Annotations: map[string]string{annPaused: "true"},
+		},
+		Provisioner: driverName,
+	}
+	claim := createFakePVC(100)
+	claim.Spec.StorageClassName = &className
+
+	clientSet := fakeclientset.NewSimpleClientset(sc)
+	scLister, _, _, _, _, stopChan := listers(clientSet)
+	defer close(stopChan)
+	recorder := record.NewFakeRecorder(10)
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		withEventRecorder(recorder)).(*csiProvisioner)
+
+	for i := 0; i < 2; i++ {
+		if provisioner.ShouldProvision(ctx, claim) {
+			t.Fatalf("attempt #%d: expected paused PVC to be skipped", i)
+		}
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "ProvisioningPaused") {
+		t.Errorf("expected ProvisioningPaused event, got %q", event)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected only one event, got %q", event)
+	default:
+	}
+
+	sc = sc.DeepCopy()
+	delete(sc.Annotations, annPaused)
+	if _, err := clientSet.StorageV1().StorageClasses().Update(ctx, sc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		sc, err := scLister.Get(className)
+		return err == nil && sc.Annotations[annPaused] == "", nil
+	}); err != nil {
+		t.Fatalf("StorageClass update not observed: %v", err)
+	}
+	if !provisioner.ShouldProvision(ctx, claim) {
+		t.Error("expected PVC to be provisioned after resuming")
+	}
+}
+
+func TestShouldDeletePausedStorageClass(t *testing.T) {
+	classes := []*storagev1.StorageClass{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "provisioning-paused", Annotations: map[string]string{annPaused: "true"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "deletion-paused", Annotations: map[string]string{annDeletionPaused: "true"}},
+		},
+	}
+	clientSet := fakeclientset.NewSimpleClientset(classes[0], classes[1])
+	scLister, _, _, _, _, stopChan := listers(clientSet)
+	defer close(stopChan)
+	pluginCaps, controllerCaps := provisionCapabilities()
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, pluginCaps, controllerCaps, "", false, true, csitrans.New(), scLister, nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		RenamedStorageClasses(map[string]string{"renamed": "deletion-paused"})).(*csiProvisioner)
+
+	for className, expected := range map[string]bool{
+		"provisioning-paused": true,
+		"deletion-paused":     false,
+		"renamed":             false,
+		"unknown":             true,
+	} {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-" + className},
+			Spec:       v1.PersistentVolumeSpec{StorageClassName: className},
+		}
+		if actual := provisioner.ShouldDelete(context.Background(), pv); actual != expected {
+			t.Errorf("%s: expected ShouldDelete %v, got %v", className, expected, actual)
+		}
+	}
+}
+
+// TestWatchStorageClassPauses checks that claims and volumes get queued again
+// when their storage class resumes and that paused claims are forgotten once
+// they got bound or deleted.
+func TestWatchStorageClassPauses(t *testing.T) {
+	ctx := context.Background()
+	className := "paused"
+	sc := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        className,
+			Annotations: map[string]string{annPaused: "true", annDeletionPaused: "true"},
+		},
+		Provisioner: driverName,
+	}
+	claim := createFakeNamedPVC(100, "paused-pvc", nil)
+	claim.Spec.StorageClassName = &className
+	boundClaim := createFakeNamedPVC(100, "bound-pvc", nil)
+	boundClaim.UID = "bound-uid"
+	boundClaim.Spec.StorageClassName = &className
+	deletedClaim := createFakeNamedPVC(100, "deleted-pvc", nil)
+	deletedClaim.UID = "deleted-uid"
+	deletedClaim.Spec.StorageClassName = &className
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pv"},
+		Spec:       v1.PersistentVolumeSpec{StorageClassName: className},
+	}
+
+	clientSet := fakeclientset.NewSimpleClientset(sc, claim, boundClaim, deletedClaim, volume)
+	factory := informers.NewSharedInformerFactory(clientSet, 0)
+	scInformer := factory.Storage().V1().StorageClasses()
+	claimInformer := NewRequeueInformer(factory.Core().V1().PersistentVolumeClaims().Informer())
+	volumeInformer := NewRequeueInformer(factory.Core().V1().PersistentVolumes().Informer())
+	queued := make(chan string, 10)
+	for _, informer := range []*RequeueInformer{claimInformer, volumeInformer} {
+		if _, err := informer.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				queued <- newObj.(metav1.Object).GetName()
+			},
+		}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+		nil, nil, driverName, nil, nil, "", false, true, csitrans.New(), scInformer.Lister(), nil, nil, nil, nil, nil, false, defaultfsType, nil, true, false,
+		withEventRecorder(record.NewFakeRecorder(10)), WatchStorageClassPauses(scInformer, claimInformer, volumeInformer)).(*csiProvisioner)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	for _, claim := range []*v1.PersistentVolumeClaim{claim, boundClaim, deletedClaim} {
+		if provisioner.ShouldProvision(ctx, claim) {
+			t.Fatalf("expected PVC %s to be paused", claim.Name)
+		}
+	}
+
+	// Bound and deleted claims are forgotten.
+	boundClaim = boundClaim.DeepCopy()
+	boundClaim.Spec.VolumeName = "other-pv"
+	if _, err := clientSet.CoreV1().PersistentVolumeClaims(boundClaim.Namespace).Update(ctx, boundClaim, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSet.CoreV1().PersistentVolumeClaims(deletedClaim.Namespace).Delete(ctx, deletedClaim.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		provisioner.pausedClaims.mutex.Lock()
+		defer provisioner.pausedClaims.mutex.Unlock()
+		claims := provisioner.pausedClaims.claims[className]
+		return len(claims) == 1 && claims[claim.UID], nil
+	}); err != nil {
+		t.Fatalf("bound and deleted PVCs not forgotten: %v", err)
+	}
+	// Drain the update of the bound claim.
+	<-queued
+
+	// Resuming queues the waiting claim and the volume.
+	sc = sc.DeepCopy()
+	sc.Annotations = nil
+	if _, err := clientSet.StorageV1().StorageClasses().Update(ctx, sc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for len(names) < 2 {
+		select {
+		case name := <-queued:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected PVC and PV to be queued, got %q", names)
+		}
+	}
+	sort.Strings(names)
+	if expected := []string{claim.Name, volume.Name}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %q to be queued, got %q", expected, names)
+	}
+	select {
+	case name := <-queued:
+		t.Errorf("unexpected queued object %s", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(provisioner.pausedClaims.claims) != 0 {
+		t.Errorf("expected no paused claims after resuming, got %v", provisioner.pausedClaims.claims)
+	}
+}
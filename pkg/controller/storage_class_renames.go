@@ -0,0 +1,35 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/util"
+)
+
+// storageClassOfVolume returns the name of the storage class of the PV,
+// after mapping renamed storage classes to their new name. PVs keep the
+// name of the class that they were provisioned with.
+func (p *csiProvisioner) storageClassOfVolume(volume *v1.PersistentVolume) string {
+	name := util.GetPersistentVolumeClass(volume)
+	if newName, ok := p.renamedStorageClasses[name]; name != "" && ok {
+		klog.V(5).Infof("PV %s: using StorageClass %s instead of renamed StorageClass %s", volume.Name, newName, name)
+		return newName
+	}
+	return name
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// prefixedStoragePoolsKey in a StorageClass lists the candidate
+	// storage pools, separated by commas. The pool with the most
+	// available capacity gets passed to GetCapacity and CreateVolume as
+	// storagePoolKey.
+	prefixedStoragePoolsKey = csiParameterPrefix + "storage-pools"
+	storagePoolKey          = "csi.storage.k8s.io/storage-pool"
+
+	// annStoragePool on a PVC records the storage pool that was selected
+	// for it, so that all CreateVolume calls for the PVC use the same
+	// pool.
+	annStoragePool = "provisioner.k8s.io/storage-pool"
+)
+
+// parseStoragePools returns the candidate pools in the order in which
+// they were listed, without empty entries and duplicates.
+func parseStoragePools(value string) []string {
+	var pools []string
+	seen := map[string]bool{}
+	for _, pool := range strings.Split(value, ",") {
+		pool = strings.TrimSpace(pool)
+		if pool == "" || seen[pool] {
+			continue
+		}
+		seen[pool] = true
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// claimStoragePool returns the storage pool recorded in the claim if it
+// is one of the pools, otherwise it selects a pool and records it in the
+// claim before returning it.
+func (p *csiProvisioner) claimStoragePool(ctx context.Context, claim *v1.PersistentVolumeClaim, pools []string, req *csi.CreateVolumeRequest) (string, error) {
+	if len(pools) == 1 {
+		return pools[0], nil
+	}
+	if pool := claim.Annotations[annStoragePool]; containsStoragePool(pools, pool) {
+		return pool, nil
+	}
+	// The claim from the informer may not have the annotation yet.
+	current, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pool := current.Annotations[annStoragePool]; containsStoragePool(pools, pool) {
+		return pool, nil
+	}
+	pool := p.selectStoragePool(ctx, pools, req)
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	current.Annotations[annStoragePool] = pool
+	if _, err := p.client.CoreV1().PersistentVolumeClaims(current.Namespace).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return "", err
+	}
+	return pool, nil
+}
+
+func containsStoragePool(pools []string, pool string) bool {
+	for _, candidate := range pools {
+		if candidate == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// selectStoragePool asks the driver for the available capacity of each
+// pool and returns the one with the most capacity. Ties are broken by the
+// order of the pools. The first pool is the default, which is used when
+// the driver reports the capacity of none of the pools.
+func (p *csiProvisioner) selectStoragePool(ctx context.Context, pools []string, req *csi.CreateVolumeRequest) string {
+	selected := pools[0]
+	if len(pools) == 1 || !p.controllerCapabilities[csi.ControllerServiceCapability_RPC_GET_CAPACITY] {
+		return selected
+	}
+
+	var topology *csi.Topology
+	if preferred := req.GetAccessibilityRequirements().GetPreferred(); len(preferred) > 0 {
+		topology = preferred[0]
+	}
+	var maxCapacity int64 = -1
+	for _, pool := range pools {
+		parameters := make(map[string]string, len(req.Parameters)+1)
+		for key, value := range req.Parameters {
+			parameters[key] = value
+		}
+		parameters[storagePoolKey] = pool
+		capacityCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		resp, err := p.csiClient.GetCapacity(capacityCtx, &csi.GetCapacityRequest{
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         parameters,
+			AccessibleTopology: topology,
+		})
+		cancel()
+		if err != nil {
+			klog.Warningf("GetCapacity for storage pool %s failed, skipping it: %v", pool, err)
+			continue
+		}
+		klog.V(5).Infof("storage pool %s has %d bytes available", pool, resp.AvailableCapacity)
+		if resp.AvailableCapacity > maxCapacity {
+			maxCapacity = resp.AvailableCapacity
+			selected = pool
+		}
+	}
+	return selected
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionStoragePools(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		pools string
+		// capacity is the available capacity per pool, pools without
+		// an entry fail GetCapacity.
+		capacity      map[string]int64
+		noGetCapacity bool
+		// annotatedPool is recorded in the PVC before provisioning.
+		annotatedPool string
+		expectedPool  string
+		expectErr     bool
+	}{
+		"most capacity": {
+			pools:        "pool-a,pool-b,pool-c",
+			capacity:     map[string]int64{"pool-a": 10, "pool-b": 30, "pool-c": 20},
+			expectedPool: "pool-b",
+		},
+		"tie": {
+			pools:        "pool-a,pool-b,pool-c",
+			capacity:     map[string]int64{"pool-a": 10, "pool-b": 30, "pool-c": 30},
+			expectedPool: "pool-b",
+		},
+		"no capacity anywhere": {
+			pools:        "pool-a,pool-b",
+			capacity:     map[string]int64{"pool-a": 0, "pool-b": 0},
+			expectedPool: "pool-a",
+		},
+		"some pools fail": {
+			pools:        "pool-a,pool-b,pool-c",
+			capacity:     map[string]int64{"pool-c": 5},
+			expectedPool: "pool-c",
+		},
+		"all pools fail": {
+			pools:        "pool-a,pool-b",
+			expectedPool: "pool-a",
+		},
+		"no GetCapacity": {
+			pools:         "pool-a,pool-b",
+			noGetCapacity: true,
+			expectedPool:  "pool-a",
+		},
+		"single pool": {
+			pools:        " pool-b ",
+			expectedPool: "pool-b",
+		},
+		"recorded pool": {
+			pools:         "pool-a,pool-b,pool-c",
+			annotatedPool: "pool-c",
+			expectedPool:  "pool-c",
+		},
+		"recorded pool no longer listed": {
+			pools:         "pool-a,pool-b",
+			capacity:      map[string]int64{"pool-a": 10, "pool-b": 30},
+			annotatedPool: "pool-c",
+			expectedPool:  "pool-b",
+		},
+		"no pool": {
+			pools:     " , ",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pluginCaps, controllerCaps := provisionCapabilities()
+			controllerCaps[csi.ControllerServiceCapability_RPC_GET_CAPACITY] = !tc.noGetCapacity
+			pvc := createFakePVC(requestBytes)
+			if tc.annotatedPool != "" {
+				pvc.Annotations[annStoragePool] = tc.annotatedPool
+			}
+			pt := newProvisionerTest(t, []runtime.Object{pvc}, withCapabilities(pluginCaps, controllerCaps))
+
+			pools := parseStoragePools(tc.pools)
+			if !tc.noGetCapacity && len(pools) > 1 && !containsStoragePool(pools, tc.annotatedPool) {
+				pt.controllerServer.EXPECT().GetCapacity(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+						if _, ok := req.Parameters[prefixedStoragePoolsKey]; ok {
+							t.Errorf("%s was passed to the driver", prefixedStoragePoolsKey)
+						}
+						capacity, ok := tc.capacity[req.Parameters[storagePoolKey]]
+						if !ok {
+							return nil, errors.New("no such pool")
+						}
+						return &csi.GetCapacityResponse{AvailableCapacity: capacity}, nil
+					}).Times(len(pools))
+			}
+			if !tc.expectErr {
+				pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if pool := req.Parameters[storagePoolKey]; pool != tc.expectedPool {
+							t.Errorf("expected storage pool %q, got %q", tc.expectedPool, pool)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			_, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					Parameters: map[string]string{prefixedStoragePoolsKey: tc.pools},
+				},
+				PVName: "test-testi",
+				PVC:    pvc,
+			})
+			if tc.expectErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectErr || len(pools) == 1 {
+				return
+			}
+			current, err := pt.clientSet.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(context.Background(), pvc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pool := current.Annotations[annStoragePool]; pool != tc.expectedPool {
+				t.Errorf("expected annotation %s=%q, got %q", annStoragePool, tc.expectedPool, pool)
+			}
+		})
+	}
+}
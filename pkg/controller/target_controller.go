@@ -0,0 +1,55 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// prefixedTargetControllerKey in a StorageClass names the instance of
+	// an HA storage backend with several controller endpoints on which
+	// volumes must be created. The external-provisioner doesn't interpret
+	// it, it gets passed to CreateVolume as targetControllerKey.
+	prefixedTargetControllerKey = csiParameterPrefix + "target-controller"
+	targetControllerKey         = "csi.storage.k8s.io/target-controller"
+
+	// prefixedTargetControllerRequiredKey=true in a StorageClass refuses
+	// to provision without a target controller.
+	prefixedTargetControllerRequiredKey = csiParameterPrefix + "target-controller-required"
+)
+
+// getTargetController returns the target controller of the storage class,
+// empty if it has none.
+func getTargetController(sc *storagev1.StorageClass) (string, error) {
+	value := strings.TrimSpace(sc.Parameters[prefixedTargetControllerKey])
+	required := sc.Parameters[prefixedTargetControllerRequiredKey]
+	switch required {
+	case "", "false":
+		return value, nil
+	case "true":
+		if value == "" {
+			return "", fmt.Errorf("%s parameter in StorageClass %s is empty, but %s is true", prefixedTargetControllerKey, sc.Name, prefixedTargetControllerRequiredKey)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid %s parameter in StorageClass %s: %q must be true or false", prefixedTargetControllerRequiredKey, sc.Name, required)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionTargetController(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		parameters      map[string]string
+		expectParameter string
+		expectRejected  bool
+	}{
+		"no parameter": {},
+		"target controller": {
+			parameters:      map[string]string{prefixedTargetControllerKey: "controller-2"},
+			expectParameter: "controller-2",
+		},
+		"required": {
+			parameters: map[string]string{
+				prefixedTargetControllerKey:         "controller-2",
+				prefixedTargetControllerRequiredKey: "true",
+			},
+			expectParameter: "controller-2",
+		},
+		"empty": {
+			parameters: map[string]string{prefixedTargetControllerKey: " "},
+		},
+		"empty but required": {
+			parameters: map[string]string{
+				prefixedTargetControllerKey:         " ",
+				prefixedTargetControllerRequiredKey: "true",
+			},
+			expectRejected: true,
+		},
+		"missing but required": {
+			parameters:     map[string]string{prefixedTargetControllerRequiredKey: "true"},
+			expectRejected: true,
+		},
+		"invalid required": {
+			parameters: map[string]string{
+				prefixedTargetControllerKey:         "controller-2",
+				prefixedTargetControllerRequiredKey: "yes",
+			},
+			expectRejected: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil)
+			if !tc.expectRejected {
+				pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+					value, ok := req.Parameters[targetControllerKey]
+					if ok != (tc.expectParameter != "") || value != tc.expectParameter {
+						t.Errorf("expected %s parameter %q, got %q", targetControllerKey, tc.expectParameter, value)
+					}
+					if _, ok := req.Parameters[prefixedTargetControllerRequiredKey]; ok {
+						t.Errorf("unexpected %s parameter", prefixedTargetControllerRequiredKey)
+					}
+				})
+			}
+
+			_, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: tc.parameters},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if !tc.expectRejected {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			if events := pt.events(); len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" InvalidTargetController") {
+				t.Errorf("expected InvalidTargetController event, got %q", events)
+			}
+		})
+	}
+}
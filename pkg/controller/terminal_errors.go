@@ -0,0 +1,79 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// DefaultTerminalErrorCodes are the status codes of CreateVolume and
+// DeleteVolume errors which usually don't go away by retrying.
+var DefaultTerminalErrorCodes = []string{codes.InvalidArgument.String(), codes.FailedPrecondition.String()}
+
+// TerminalErrorCodes is the set of status codes for which failed
+// CreateVolume and DeleteVolume calls are not retried.
+type TerminalErrorCodes map[codes.Code]bool
+
+// ParseTerminalErrorCodes turns status code names like InvalidArgument into
+// TerminalErrorCodes. Codes which indicate that the operation may still be
+// in progress are rejected, because giving up on them could leak volumes.
+func ParseTerminalErrorCodes(names []string) (TerminalErrorCodes, error) {
+	known := map[string]codes.Code{}
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		known[code.String()] = code
+	}
+
+	terminal := TerminalErrorCodes{}
+	for _, name := range names {
+		code, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown status code %q", name)
+		}
+		switch code {
+		case codes.OK, codes.Canceled, codes.DeadlineExceeded, codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+			return nil, fmt.Errorf("status code %s cannot be terminal", name)
+		}
+		terminal[code] = true
+	}
+	return terminal, nil
+}
+
+// terminalError returns an IgnoredError, which stops retries, if err has
+// one of the terminal status codes. The object gets a Warning event with
+// the given reason. Other errors are returned unchanged.
+func (p *csiProvisioner) terminalError(object runtime.Object, reason string, err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil || !p.terminalErrorCodes[st.Code()] {
+		return err
+	}
+	// The provisioner ignores the error from now on, but it still is a
+	// failure.
+	operation := operationProvision
+	if _, ok := object.(*v1.PersistentVolume); ok {
+		operation = operationDelete
+	}
+	observeFailure(operation, err)
+	message := fmt.Sprintf("not retrying after error with status code %s: %v", st.Code(), err)
+	p.eventRecorder.Event(object, v1.EventTypeWarning, reason, message)
+	return &controller.IgnoredError{Reason: message}
+}
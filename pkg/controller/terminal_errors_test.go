@@ -0,0 +1,186 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestParseTerminalErrorCodes(t *testing.T) {
+	testcases := map[string]struct {
+		names     []string
+		expected  TerminalErrorCodes
+		expectErr bool
+	}{
+		"defaults": {
+			names:    DefaultTerminalErrorCodes,
+			expected: TerminalErrorCodes{codes.InvalidArgument: true, codes.FailedPrecondition: true},
+		},
+		"empty": {
+			expected: TerminalErrorCodes{},
+		},
+		"unknown": {
+			names:     []string{"InvalidArgument", "NoSuchCode"},
+			expectErr: true,
+		},
+		"in progress": {
+			names:     []string{"Unavailable"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			terminal, err := ParseTerminalErrorCodes(tc.names)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(terminal, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, terminal)
+			}
+		})
+	}
+}
+
+func TestProvisionTerminalErrors(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		code           codes.Code
+		expectState    controller.ProvisioningState
+		expectTerminal bool
+	}{
+		"InvalidArgument": {
+			code:           codes.InvalidArgument,
+			expectState:    controller.ProvisioningFinished,
+			expectTerminal: true,
+		},
+		"Unavailable": {
+			code:        codes.Unavailable,
+			expectState: controller.ProvisioningInBackground,
+		},
+		"NotFound": {
+			code:        codes.NotFound,
+			expectState: controller.ProvisioningFinished,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			terminal, err := ParseTerminalErrorCodes(DefaultTerminalErrorCodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt := newProvisionerTest(t, nil, WithTerminalErrorCodes(terminal))
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).Return(nil, status.Error(tc.code, "mock error")).Times(1)
+
+			_, state, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if state != tc.expectState {
+				t.Errorf("expected state %s, got %s", tc.expectState, state)
+			}
+			if _, ok := err.(*controller.IgnoredError); ok != tc.expectTerminal {
+				t.Errorf("expected terminal error %v, got %T: %v", tc.expectTerminal, err, err)
+			}
+
+			events := pt.events()
+			if tc.expectTerminal && (len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" TerminalProvisioningFailure")) {
+				t.Errorf("expected TerminalProvisioningFailure event, got %q", events)
+			}
+			if !tc.expectTerminal && len(events) != 0 {
+				t.Errorf("expected no events, got %q", events)
+			}
+		})
+	}
+}
+
+func TestDeleteTerminalErrors(t *testing.T) {
+	testcases := map[string]struct {
+		code           codes.Code
+		expectTerminal bool
+	}{
+		"FailedPrecondition": {
+			code:           codes.FailedPrecondition,
+			expectTerminal: true,
+		},
+		"Unavailable": {
+			code: codes.Unavailable,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pv"},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							Driver:       driverName,
+							VolumeHandle: "test-volume-id",
+						},
+					},
+				},
+			}
+			terminal, err := ParseTerminalErrorCodes(DefaultTerminalErrorCodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt := newProvisionerTest(t, []runtime.Object{pv}, WithTerminalErrorCodes(terminal))
+			pt.controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(nil, status.Error(tc.code, "mock error")).Times(1)
+
+			err = pt.provisioner.Delete(context.Background(), pv)
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if _, ok := err.(*controller.IgnoredError); ok != tc.expectTerminal {
+				t.Errorf("expected terminal error %v, got %T: %v", tc.expectTerminal, err, err)
+			}
+
+			events := pt.events()
+			if tc.expectTerminal && (len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" TerminalDeletionFailure")) {
+				t.Errorf("expected TerminalDeletionFailure event, got %q", events)
+			}
+			if !tc.expectTerminal && len(events) != 0 {
+				t.Errorf("expected no events, got %q", events)
+			}
+		})
+	}
+}
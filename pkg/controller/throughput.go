@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// prefixedThroughputKey in a StorageClass is the throughput in MB/s
+	// for volumes of that class. It gets validated and then passed to
+	// CreateVolume as throughputKey.
+	prefixedThroughputKey = csiParameterPrefix + "throughput"
+	throughputKey         = "csi.storage.k8s.io/throughput"
+
+	// annThroughput on a PVC requests a throughput in MB/s for its
+	// volume. It takes precedence over prefixedThroughputKey.
+	annThroughput = "provisioner.k8s.io/throughput"
+)
+
+// getThroughput returns the requested throughput of the claim, from its
+// annotation or from the storage class, and where it came from. The value
+// is empty when neither requests a throughput.
+func getThroughput(claim *v1.PersistentVolumeClaim, sc *storagev1.StorageClass) (value, source string) {
+	if value, ok := claim.Annotations[annThroughput]; ok {
+		return value, fmt.Sprintf("%s annotation", annThroughput)
+	}
+	if value, ok := sc.Parameters[prefixedThroughputKey]; ok {
+		return value, fmt.Sprintf("%s parameter in StorageClass %s", prefixedThroughputKey, sc.Name)
+	}
+	return "", ""
+}
+
+// validateThroughput checks that the throughput is a positive number of
+// MB/s within the configured range. Zero disables the minimum or maximum.
+func (p *csiProvisioner) validateThroughput(value string) error {
+	throughput, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || throughput <= 0 {
+		return fmt.Errorf("%q must be a positive number of MB/s", value)
+	}
+	if p.minThroughput > 0 && throughput < p.minThroughput {
+		return fmt.Errorf("%d MB/s is less than the minimum of %d MB/s", throughput, p.minThroughput)
+	}
+	if p.maxThroughput > 0 && throughput > p.maxThroughput {
+		return fmt.Errorf("%d MB/s is more than the maximum of %d MB/s", throughput, p.maxThroughput)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionThroughput(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		annotations        map[string]string
+		parameters         map[string]string
+		expectedThroughput string
+		expectRejected     bool
+	}{
+		"none": {},
+		"storage class in range": {
+			parameters:         map[string]string{prefixedThroughputKey: "250"},
+			expectedThroughput: "250",
+		},
+		"annotation in range": {
+			annotations:        map[string]string{annThroughput: "100"},
+			expectedThroughput: "100",
+		},
+		"annotation wins": {
+			annotations:        map[string]string{annThroughput: "500"},
+			parameters:         map[string]string{prefixedThroughputKey: "250"},
+			expectedThroughput: "500",
+		},
+		"minimum": {
+			parameters:         map[string]string{prefixedThroughputKey: "100"},
+			expectedThroughput: "100",
+		},
+		"maximum": {
+			parameters:         map[string]string{prefixedThroughputKey: "1000"},
+			expectedThroughput: "1000",
+		},
+		"below minimum": {
+			annotations:    map[string]string{annThroughput: "99"},
+			expectRejected: true,
+		},
+		"above maximum": {
+			parameters:     map[string]string{prefixedThroughputKey: "1001"},
+			expectRejected: true,
+		},
+		"invalid": {
+			annotations:    map[string]string{annThroughput: "fast"},
+			expectRejected: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil, ThroughputRange(100, 1000))
+			if !tc.expectRejected {
+				pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+					if throughput := req.Parameters[throughputKey]; throughput != tc.expectedThroughput {
+						t.Errorf("expected throughput %q, got %q", tc.expectedThroughput, throughput)
+					}
+				})
+			}
+
+			claim := createFakePVC(requestBytes)
+			for key, value := range tc.annotations {
+				claim.Annotations[key] = value
+			}
+			_, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: tc.parameters},
+				PVName:       "test-testi",
+				PVC:          claim,
+			})
+			if !tc.expectRejected {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if _, ok := err.(*controller.IgnoredError); !ok {
+				t.Fatalf("expected IgnoredError, got %T: %v", err, err)
+			}
+			if events := pt.events(); len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeWarning+" InvalidThroughput") {
+				t.Errorf("expected InvalidThroughput event, got %q", events)
+			}
+		})
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/kubernetes-csi/external-provisioner/pkg/features"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
@@ -42,6 +43,17 @@ import (
 // topologyTerm represents a single term where its topology key value pairs are AND'd together.
 type topologyTerm map[string]string
 
+// nodeTopologyError is returned when the topology of the selected node
+// cannot be determined for the driver, for example because the driver is
+// not running on that node.
+type nodeTopologyError struct {
+	message string
+}
+
+func (e *nodeTopologyError) Error() string {
+	return e.message
+}
+
 func GenerateVolumeNodeAffinity(accessibleTopology []*csi.Topology) *v1.VolumeNodeAffinity {
 	if len(accessibleTopology) == 0 {
 		return nil
@@ -73,6 +85,29 @@ func GenerateVolumeNodeAffinity(accessibleTopology []*csi.Topology) *v1.VolumeNo
 	}
 }
 
+// addWellKnownTopology returns the topology with additional segments for the
+// well-known labels that the driver topology keys are mapped to. Segments
+// that are already present are not overwritten.
+func addWellKnownTopology(topology *csi.Topology, wellKnownLabels map[string]string) *csi.Topology {
+	if topology == nil || len(wellKnownLabels) == 0 {
+		return topology
+	}
+	segments := make(map[string]string, len(topology.Segments))
+	for k, v := range topology.Segments {
+		segments[k] = v
+	}
+	for k, v := range topology.Segments {
+		label, ok := wellKnownLabels[k]
+		if !ok {
+			continue
+		}
+		if _, ok := segments[label]; !ok {
+			segments[label] = v
+		}
+	}
+	return &csi.Topology{Segments: segments}
+}
+
 // VolumeIsAccessible checks whether the generated volume affinity is satisfied by
 // a the node topology that a CSI driver reported in GetNodeInfoResponse.
 func VolumeIsAccessible(affinity *v1.VolumeNodeAffinity, nodeTopology *csi.Topology) (bool, error) {
@@ -168,12 +203,12 @@ func GenerateAccessibilityRequirements(
 			//
 			// Returning an error in provisioning will cause the scheduler to retry and potentially
 			// (but not guaranteed) pick a different node.
-			return nil, fmt.Errorf("no topology key found on CSINode %s", selectedCSINode.Name)
+			return nil, &nodeTopologyError{message: fmt.Sprintf("no topology key found on CSINode %s", selectedCSINode.Name)}
 		}
 		var isMissingKey bool
 		selectedTopology, isMissingKey = getTopologyFromNode(selectedNode, topologyKeys)
 		if isMissingKey {
-			return nil, fmt.Errorf("topology labels from selected node %v does not match topology keys from CSINode %v", selectedNode.Labels, topologyKeys)
+			return nil, &nodeTopologyError{message: fmt.Sprintf("topology labels from selected node %v does not match topology keys from CSINode %v", selectedNode.Labels, topologyKeys)}
 		}
 
 		if strictTopology {
@@ -265,12 +300,66 @@ func GenerateAccessibilityRequirements(
 	return requirement, nil
 }
 
+// applyTopologySpread narrows the requirement down to spread distinct
+// topology segments, for drivers which replicate a volume across all
+// requisite segments. Segments are distinct if they differ in the value of
+// spreadKey or, if spreadKey is empty, in any value. Segments are chosen in
+// the order of preference. An error is returned if there are not enough
+// distinct segments.
+func applyTopologySpread(requirement *csi.TopologyRequirement, spread int, spreadKey string) (*csi.TopologyRequirement, error) {
+	if spread <= 1 {
+		return requirement, nil
+	}
+	if requirement == nil {
+		return nil, fmt.Errorf("topology spread of %d requires topology information, but none is available", spread)
+	}
+
+	// Preferred usually contains all requisite segments, just in a
+	// different order. Requisite segments are added just in case.
+	candidates := append(append([]*csi.Topology{}, requirement.Preferred...), requirement.Requisite...)
+	seen := map[string]bool{}
+	var selected []*csi.Topology
+	for _, topology := range candidates {
+		if len(selected) == spread {
+			break
+		}
+		var id string
+		if spreadKey != "" {
+			value, ok := topology.Segments[spreadKey]
+			if !ok {
+				continue
+			}
+			id = value
+		} else {
+			id = topologyTerm(topology.Segments).hash()
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		selected = append(selected, topology)
+	}
+	if len(selected) < spread {
+		if spreadKey != "" {
+			return nil, fmt.Errorf("topology spread of %d requires that many distinct values of %s, only %d are available", spread, spreadKey, len(selected))
+		}
+		return nil, fmt.Errorf("topology spread of %d requires that many distinct topology segments, only %d are available", spread, len(selected))
+	}
+	return &csi.TopologyRequirement{
+		Requisite: selected,
+		Preferred: selected,
+	}, nil
+}
+
 // getSelectedCSINode returns the CSINode object for the given selectedNode.
 func getSelectedCSINode(
 	csiNodeLister storagelistersv1.CSINodeLister,
 	selectedNode *v1.Node) (*storagev1.CSINode, error) {
 
 	selectedCSINode, err := csiNodeLister.Get(selectedNode.Name)
+	if apierrors.IsNotFound(err) {
+		return nil, &nodeTopologyError{message: fmt.Sprintf("CSINode for selected node %q not found", selectedNode.Name)}
+	}
 	if err != nil {
 		// We don't want to fallback and provision in the wrong topology if there's some temporary
 		// error with the API server.
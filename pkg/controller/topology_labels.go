@@ -0,0 +1,100 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// addNodeLabelTopology extends the requisite and preferred segments with
+// the node labels configured with NodeLabelTopologyKeys. Each segment gets
+// replaced by one segment per combination of label values on the nodes in
+// that segment. Labels which are missing on a node are skipped for that
+// node, segments without any nodes are kept as they are. With strict
+// topology, only the selected node is considered.
+func (p *csiProvisioner) addNodeLabelTopology(requirement *csi.TopologyRequirement, selectedNode *v1.Node) (*csi.TopologyRequirement, error) {
+	if len(p.nodeLabelTopologyKeys) == 0 || requirement == nil {
+		return requirement, nil
+	}
+	var nodes []*v1.Node
+	switch {
+	case selectedNode != nil && p.strictTopology:
+		nodes = []*v1.Node{selectedNode}
+	case p.nodeLister != nil:
+		var err error
+		nodes, err = p.nodeLister.List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("error listing nodes: %v", err)
+		}
+	default:
+		return requirement, nil
+	}
+
+	extend := func(segments []*csi.Topology) []*csi.Topology {
+		var extended []*csi.Topology
+		seen := map[string]bool{}
+		for _, segment := range segments {
+			term := topologyTerm(segment.Segments)
+			var terms []topologyTerm
+			for _, node := range nodes {
+				if !term.subset(node.Labels) {
+					continue
+				}
+				nodeTerm := term.clone()
+				for _, key := range p.nodeLabelTopologyKeys {
+					if value, ok := node.Labels[key]; ok {
+						nodeTerm[key] = value
+					}
+				}
+				terms = append(terms, nodeTerm)
+			}
+			if len(terms) == 0 {
+				terms = append(terms, term)
+			}
+			sort.Slice(terms, func(i, j int) bool {
+				return terms[i].less(terms[j])
+			})
+			for _, t := range terms {
+				if !seen[t.hash()] {
+					seen[t.hash()] = true
+					extended = append(extended, &csi.Topology{Segments: t})
+				}
+			}
+		}
+		return extended
+	}
+
+	preferred := extend(requirement.Preferred)
+	if selectedNode != nil {
+		// The segment of the selected node remains the most preferred one.
+		for i, segment := range preferred {
+			if topologyTerm(segment.Segments).subset(selectedNode.Labels) {
+				preferred = append(append([]*csi.Topology{segment}, preferred[:i]...), preferred[i+1:]...)
+				break
+			}
+		}
+	}
+	return &csi.TopologyRequirement{
+		Requisite: extend(requirement.Requisite),
+		Preferred: preferred,
+	}, nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestProvisionNodeLabelTopology(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+		rackKey      = "example.com/rack"
+	)
+	// node-2 has no rack label.
+	nodeLabels := []map[string]string{
+		{zoneKey: "zone1", rackKey: "rack-a"},
+		{zoneKey: "zone1", rackKey: "rack-b"},
+		{zoneKey: "zone2"},
+	}
+	var objects []runtime.Object
+	var nodes []*v1.Node
+	for i, labels := range nodeLabels {
+		name := fmt.Sprintf("node-%d", i)
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+		nodes = append(nodes, node)
+		objects = append(objects, node, &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{
+					{Name: driverName, NodeID: name, TopologyKeys: []string{zoneKey}},
+				},
+			},
+		})
+	}
+
+	testcases := map[string]struct {
+		keys           []string
+		selectedNode   *v1.Node
+		strict         bool
+		expectedTerms  []string
+		firstPreferred string
+	}{
+		"no extra labels": {
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1",
+				"com.example.csi/zone#zone2",
+			},
+		},
+		"immediate binding": {
+			keys: []string{rackKey},
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1,example.com/rack#rack-a",
+				"com.example.csi/zone#zone1,example.com/rack#rack-b",
+				"com.example.csi/zone#zone2",
+			},
+		},
+		"selected node": {
+			keys:         []string{rackKey},
+			selectedNode: nodes[1],
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1,example.com/rack#rack-a",
+				"com.example.csi/zone#zone1,example.com/rack#rack-b",
+				"com.example.csi/zone#zone2",
+			},
+			firstPreferred: "com.example.csi/zone#zone1,example.com/rack#rack-b",
+		},
+		"selected node without label": {
+			keys:         []string{rackKey},
+			selectedNode: nodes[2],
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1,example.com/rack#rack-a",
+				"com.example.csi/zone#zone1,example.com/rack#rack-b",
+				"com.example.csi/zone#zone2",
+			},
+			firstPreferred: "com.example.csi/zone#zone2",
+		},
+		"strict topology": {
+			keys:         []string{rackKey},
+			selectedNode: nodes[0],
+			strict:       true,
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1,example.com/rack#rack-a",
+			},
+			firstPreferred: "com.example.csi/zone#zone1,example.com/rack#rack-a",
+		},
+		"label on no node": {
+			keys: []string{"example.com/missing"},
+			expectedTerms: []string{
+				"com.example.csi/zone#zone1",
+				"com.example.csi/zone#zone2",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			var requirement *csi.TopologyRequirement
+			controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					requirement = req.AccessibilityRequirements
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: requestBytes,
+							VolumeId:      "test-volume-id",
+						},
+					}, nil
+				}).Times(1)
+
+			clientSet := fakeclientset.NewSimpleClientset(objects...)
+			scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+			defer close(stopChan)
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", tc.strict, true, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+				NodeLabelTopologyKeys(tc.keys))
+
+			if _, _, err := csiProvisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+				SelectedNode: tc.selectedNode,
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			requisite := topologyHashes(requirement.GetRequisite())
+			sort.Strings(requisite)
+			if !reflect.DeepEqual(requisite, tc.expectedTerms) {
+				t.Errorf("expected requisite %v, got %v", tc.expectedTerms, requisite)
+			}
+			preferred := topologyHashes(requirement.GetPreferred())
+			if tc.firstPreferred != "" && (len(preferred) == 0 || preferred[0] != tc.firstPreferred) {
+				t.Errorf("expected %s to be preferred first, got %v", tc.firstPreferred, preferred)
+			}
+			sort.Strings(preferred)
+			if !reflect.DeepEqual(preferred, tc.expectedTerms) {
+				t.Errorf("expected preferred %v, got %v", tc.expectedTerms, preferred)
+			}
+		})
+	}
+}
+
+func topologyHashes(segments []*csi.Topology) []string {
+	var hashes []string
+	for _, segment := range segments {
+		hashes = append(hashes, topologyTerm(segment.Segments).hash())
+	}
+	return hashes
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// TopologyStrategyDefault keeps the preferred segments in the order
+	// chosen by GenerateAccessibilityRequirements.
+	TopologyStrategyDefault = "default"
+	// TopologyStrategyRoundRobin prefers the segments one after the other.
+	TopologyStrategyRoundRobin = "round-robin"
+	// TopologyStrategyLeastRecentlyUsed prefers the segment which was
+	// preferred the longest time ago.
+	TopologyStrategyLeastRecentlyUsed = "least-recently-used"
+	// TopologyStrategyRandom prefers the segments in random order.
+	TopologyStrategyRandom = "random"
+)
+
+// TopologyStrategies lists all strategies supported by NewTopologyStrategy.
+var TopologyStrategies = []string{
+	TopologyStrategyDefault,
+	TopologyStrategyRoundRobin,
+	TopologyStrategyLeastRecentlyUsed,
+	TopologyStrategyRandom,
+}
+
+// TopologyStrategy orders the preferred topology segments of a
+// CreateVolume call with immediate binding. Implementations must be
+// safe for concurrent use.
+type TopologyStrategy interface {
+	// Order returns the segments in the order in which they should be
+	// preferred. It must not modify the slice that is passed in.
+	Order(preferred []*csi.Topology) []*csi.Topology
+}
+
+// NewTopologyStrategy returns the strategy with the given name. The
+// default strategy is nil.
+func NewTopologyStrategy(name string) (TopologyStrategy, error) {
+	switch name {
+	case TopologyStrategyDefault, "":
+		return nil, nil
+	case TopologyStrategyRoundRobin:
+		return &roundRobinStrategy{next: map[string]int{}}, nil
+	case TopologyStrategyLeastRecentlyUsed:
+		return &leastRecentlyUsedStrategy{lastUsed: map[string]uint64{}}, nil
+	case TopologyStrategyRandom:
+		return randomStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown topology strategy %q, supported are %s", name, strings.Join(TopologyStrategies, ", "))
+	}
+}
+
+// sortedSegments returns a sorted copy of the segments and the hashes of
+// the sorted segments.
+func sortedSegments(preferred []*csi.Topology) ([]*csi.Topology, []string) {
+	sorted := append([]*csi.Topology{}, preferred...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return topologyTerm(sorted[i].Segments).less(topologyTerm(sorted[j].Segments))
+	})
+	hashes := make([]string, 0, len(sorted))
+	for _, topology := range sorted {
+		hashes = append(hashes, topologyTerm(topology.Segments).hash())
+	}
+	return sorted, hashes
+}
+
+// roundRobinStrategy rotates the sorted segments by one for each call.
+// Each set of segments has its own position, so storage classes with
+// different allowed topologies don't influence each other.
+type roundRobinStrategy struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+func (s *roundRobinStrategy) Order(preferred []*csi.Topology) []*csi.Topology {
+	if len(preferred) <= 1 {
+		return preferred
+	}
+	sorted, hashes := sortedSegments(preferred)
+	key := strings.Join(hashes, ";")
+
+	s.mutex.Lock()
+	i := s.next[key] % len(sorted)
+	s.next[key] = i + 1
+	s.mutex.Unlock()
+
+	return append(sorted[i:], sorted[:i]...)
+}
+
+// leastRecentlyUsedStrategy orders the segments by the time when they were
+// preferred last, segments which were never preferred come first. Ties
+// are broken by the natural order of the segments.
+type leastRecentlyUsedStrategy struct {
+	mutex    sync.Mutex
+	counter  uint64
+	lastUsed map[string]uint64
+}
+
+func (s *leastRecentlyUsedStrategy) Order(preferred []*csi.Topology) []*csi.Topology {
+	if len(preferred) <= 1 {
+		return preferred
+	}
+	sorted, hashes := sortedSegments(preferred)
+	order := make([]int, len(sorted))
+	for i := range order {
+		order[i] = i
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.lastUsed[hashes[order[i]]] < s.lastUsed[hashes[order[j]]]
+	})
+	s.counter++
+	s.lastUsed[hashes[order[0]]] = s.counter
+
+	result := make([]*csi.Topology, 0, len(sorted))
+	for _, i := range order {
+		result = append(result, sorted[i])
+	}
+	return result
+}
+
+// randomStrategy shuffles the segments.
+type randomStrategy struct{}
+
+func (randomStrategy) Order(preferred []*csi.Topology) []*csi.Topology {
+	result := append([]*csi.Topology{}, preferred...)
+	rand.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+	return result
+}
+
+// limitTopologySegments reduces the requirement to the first max preferred
+// segments, which then are also the only requisite segments. Because the
+// preferred segments are a reordering of the requisite segments, the
+// result is still within the allowed topologies. The strategy which
+// ordered the preferred segments determines how the segments are sampled.
+// A max of zero or less keeps all segments.
+func limitTopologySegments(requirement *csi.TopologyRequirement, max int) *csi.TopologyRequirement {
+	if max <= 0 || requirement == nil || len(requirement.Requisite) <= max {
+		return requirement
+	}
+
+	requisite := map[string]bool{}
+	for _, topology := range requirement.Requisite {
+		requisite[topologyTerm(topology.Segments).hash()] = true
+	}
+	// Preferred usually contains all requisite segments, just in a
+	// different order. Requisite segments are added just in case.
+	candidates := append(append([]*csi.Topology{}, requirement.Preferred...), requirement.Requisite...)
+	seen := map[string]bool{}
+	selected := make([]*csi.Topology, 0, max)
+	for _, topology := range candidates {
+		if len(selected) == max {
+			break
+		}
+		id := topologyTerm(topology.Segments).hash()
+		if !requisite[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		selected = append(selected, topology)
+	}
+	return &csi.TopologyRequirement{
+		Requisite: selected,
+		Preferred: selected,
+	}
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+// TestPreferredTopologyStrategy provisions several volumes with immediate
+// binding and checks the order of the preferred zones of each
+// CreateVolume call.
+func TestPreferredTopologyStrategy(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+	)
+	// The allowed zones of the storage class for each provisioning call.
+	allowedZones := [][]string{
+		{"zone1", "zone2", "zone3"},
+		{"zone1", "zone2", "zone3"},
+		{"zone2", "zone3"},
+		{"zone1", "zone2", "zone3"},
+	}
+
+	testcases := map[string]struct {
+		strategy string
+		// expected is nil if the order is random.
+		expected [][]string
+	}{
+		TopologyStrategyDefault: {
+			strategy: TopologyStrategyDefault,
+		},
+		TopologyStrategyRoundRobin: {
+			strategy: TopologyStrategyRoundRobin,
+			expected: [][]string{
+				{"zone1", "zone2", "zone3"},
+				{"zone2", "zone3", "zone1"},
+				{"zone2", "zone3"},
+				{"zone3", "zone1", "zone2"},
+			},
+		},
+		TopologyStrategyLeastRecentlyUsed: {
+			strategy: TopologyStrategyLeastRecentlyUsed,
+			expected: [][]string{
+				{"zone1", "zone2", "zone3"},
+				{"zone2", "zone3", "zone1"},
+				{"zone3", "zone2"},
+				{"zone1", "zone2", "zone3"},
+			},
+		},
+		TopologyStrategyRandom: {
+			strategy: TopologyStrategyRandom,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := NewTopologyStrategy(tc.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			pt := newProvisionerTest(t, nil, withCapabilities(pluginCaps, controllerCaps), PreferredTopologyStrategy(strategy))
+
+			var preferred [][]string
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					var zones []string
+					for _, topology := range req.GetAccessibilityRequirements().GetPreferred() {
+						zones = append(zones, topology.Segments[zoneKey])
+					}
+					preferred = append(preferred, zones)
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: requestBytes,
+							VolumeId:      "test-volume-id",
+						},
+					}, nil
+				}).Times(len(allowedZones))
+
+			var defaultOrders [][]string
+			for i, zones := range allowedZones {
+				allowedTopologies := []v1.TopologySelectorTerm{
+					{
+						MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+							{Key: zoneKey, Values: zones},
+						},
+					},
+				}
+				claim := createFakePVC(requestBytes)
+				if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{AllowedTopologies: allowedTopologies},
+					PVName:       fmt.Sprintf("test-pv-%d", i),
+					PVC:          claim,
+				}); err != nil {
+					t.Fatalf("provisioning #%d: %v", i, err)
+				}
+
+				requirements, err := GenerateAccessibilityRequirements(pt.clientSet, driverName, claim.Name, allowedTopologies, nil, false, true, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var order []string
+				for _, topology := range requirements.Preferred {
+					order = append(order, topology.Segments[zoneKey])
+				}
+				defaultOrders = append(defaultOrders, order)
+			}
+
+			switch {
+			case tc.strategy == TopologyStrategyDefault:
+				if !reflect.DeepEqual(preferred, defaultOrders) {
+					t.Errorf("expected the default order %v, got %v", defaultOrders, preferred)
+				}
+			case tc.expected != nil:
+				if !reflect.DeepEqual(preferred, tc.expected) {
+					t.Errorf("expected preferred zones %v, got %v", tc.expected, preferred)
+				}
+			default:
+				for i, zones := range preferred {
+					sorted := append([]string{}, zones...)
+					sort.Strings(sorted)
+					if !reflect.DeepEqual(sorted, allowedZones[i]) {
+						t.Errorf("provisioning #%d: expected the preferred zones to be a permutation of %v, got %v", i, allowedZones[i], zones)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNewTopologyStrategy(t *testing.T) {
+	for _, name := range TopologyStrategies {
+		if _, err := NewTopologyStrategy(name); err != nil {
+			t.Errorf("strategy %s: %v", name, err)
+		}
+	}
+	if _, err := NewTopologyStrategy("most-recently-used"); err == nil {
+		t.Error("expected error for unknown strategy, got none")
+	}
+}
+
+// TestMaxImmediateTopologySegments provisions several volumes with
+// immediate binding and checks that the requisite zones of each
+// CreateVolume call are limited and allowed by the storage class. The
+// zones are recorded in the order of preference.
+func TestMaxImmediateTopologySegments(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+		volumes      = 4
+	)
+	allowedZones := []string{"zone1", "zone2", "zone3", "zone4"}
+
+	testcases := map[string]struct {
+		max      int
+		strategy string
+		// expected is nil if the zones are random.
+		expected [][]string
+	}{
+		"unlimited": {
+			strategy: TopologyStrategyRoundRobin,
+			expected: [][]string{
+				{"zone1", "zone2", "zone3", "zone4"},
+				{"zone2", "zone3", "zone4", "zone1"},
+				{"zone3", "zone4", "zone1", "zone2"},
+				{"zone4", "zone1", "zone2", "zone3"},
+			},
+		},
+		"more than allowed": {
+			max:      10,
+			strategy: TopologyStrategyRoundRobin,
+			expected: [][]string{
+				{"zone1", "zone2", "zone3", "zone4"},
+				{"zone2", "zone3", "zone4", "zone1"},
+				{"zone3", "zone4", "zone1", "zone2"},
+				{"zone4", "zone1", "zone2", "zone3"},
+			},
+		},
+		"round-robin": {
+			max:      2,
+			strategy: TopologyStrategyRoundRobin,
+			expected: [][]string{
+				{"zone1", "zone2"},
+				{"zone2", "zone3"},
+				{"zone3", "zone4"},
+				{"zone4", "zone1"},
+			},
+		},
+		"random": {
+			max:      2,
+			strategy: TopologyStrategyRandom,
+		},
+		"default": {
+			max:      1,
+			strategy: TopologyStrategyDefault,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := NewTopologyStrategy(tc.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			pt := newProvisionerTest(t, nil, withCapabilities(pluginCaps, controllerCaps), PreferredTopologyStrategy(strategy), MaxImmediateTopologySegments(tc.max))
+
+			var requisite [][]string
+			pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+					var zones, preferred []string
+					for _, topology := range req.GetAccessibilityRequirements().GetRequisite() {
+						zones = append(zones, topology.Segments[zoneKey])
+					}
+					for _, topology := range req.GetAccessibilityRequirements().GetPreferred() {
+						preferred = append(preferred, topology.Segments[zoneKey])
+					}
+					sortedPreferred := append([]string{}, preferred...)
+					sort.Strings(sortedPreferred)
+					sortedZones := append([]string{}, zones...)
+					sort.Strings(sortedZones)
+					if !reflect.DeepEqual(sortedPreferred, sortedZones) {
+						t.Errorf("expected preferred zones %v to match the requisite zones, got %v", zones, preferred)
+					}
+					requisite = append(requisite, preferred)
+					return &csi.CreateVolumeResponse{
+						Volume: &csi.Volume{
+							CapacityBytes: requestBytes,
+							VolumeId:      "test-volume-id",
+						},
+					}, nil
+				}).Times(volumes)
+
+			allowedTopologies := []v1.TopologySelectorTerm{
+				{
+					MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+						{Key: zoneKey, Values: allowedZones},
+					},
+				},
+			}
+			for i := 0; i < volumes; i++ {
+				if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+					StorageClass: &storagev1.StorageClass{AllowedTopologies: allowedTopologies},
+					PVName:       fmt.Sprintf("test-pv-%d", i),
+					PVC:          createFakePVC(requestBytes),
+				}); err != nil {
+					t.Fatalf("provisioning #%d: %v", i, err)
+				}
+			}
+
+			if tc.expected != nil && !reflect.DeepEqual(requisite, tc.expected) {
+				t.Errorf("expected preferred requisite zones %v, got %v", tc.expected, requisite)
+			}
+			allowed := map[string]bool{}
+			for _, zone := range allowedZones {
+				allowed[zone] = true
+			}
+			for i, zones := range requisite {
+				if tc.max > 0 && len(zones) > tc.max {
+					t.Errorf("provisioning #%d: expected at most %d requisite zones, got %v", i, tc.max, zones)
+				}
+				seen := map[string]bool{}
+				for _, zone := range zones {
+					if !allowed[zone] || seen[zone] {
+						t.Errorf("provisioning #%d: expected distinct zones from %v, got %v", i, allowedZones, zones)
+					}
+					seen[zone] = true
+				}
+			}
+		})
+	}
+}
+
+// TestMaxImmediateTopologySegmentsWithSpread checks that the limit gets
+// applied after the topology spread of the storage class and does not drop
+// segments chosen by the spread.
+func TestMaxImmediateTopologySegmentsWithSpread(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+	)
+
+	testcases := map[string]struct {
+		max      int
+		spread   string
+		expected []string
+	}{
+		"limit below spread": {
+			max:      1,
+			spread:   "2",
+			expected: []string{"zone1", "zone2"},
+		},
+		"limit above spread": {
+			max:      3,
+			spread:   "2",
+			expected: []string{"zone1", "zone2"},
+		},
+		"no spread": {
+			max:      3,
+			expected: []string{"zone1", "zone2", "zone3"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := NewTopologyStrategy(TopologyStrategyRoundRobin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			pt := newProvisionerTest(t, nil, withCapabilities(pluginCaps, controllerCaps), PreferredTopologyStrategy(strategy), MaxImmediateTopologySegments(tc.max))
+
+			var requisite []string
+			pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+				for _, topology := range req.GetAccessibilityRequirements().GetRequisite() {
+					requisite = append(requisite, topology.Segments[zoneKey])
+				}
+			})
+
+			parameters := map[string]string{prefixedTopologySpreadKey: zoneKey}
+			if tc.spread != "" {
+				parameters[prefixedTopologySpread] = tc.spread
+			}
+			if _, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{
+					Parameters: parameters,
+					AllowedTopologies: []v1.TopologySelectorTerm{
+						{
+							MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{
+								{Key: zoneKey, Values: []string{"zone1", "zone2", "zone3", "zone4"}},
+							},
+						},
+					},
+				},
+				PVName: "test-pv",
+				PVC:    createFakePVC(requestBytes),
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(requisite, tc.expected) {
+				t.Errorf("expected requisite zones %v, got %v", tc.expected, requisite)
+			}
+		})
+	}
+}
+
+func TestLimitTopologySegments(t *testing.T) {
+	zone := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"zone": name}}
+	}
+	requirement := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{zone("a"), zone("b"), zone("c")},
+		Preferred: []*csi.Topology{zone("c"), zone("x"), zone("a"), zone("b")},
+	}
+
+	if limited := limitTopologySegments(requirement, 0); limited != requirement {
+		t.Errorf("expected the requirement to be unchanged without a limit, got %v", limited)
+	}
+	if limited := limitTopologySegments(requirement, 3); limited != requirement {
+		t.Errorf("expected the requirement to be unchanged with a limit of all segments, got %v", limited)
+	}
+	if limited := limitTopologySegments(nil, 2); limited != nil {
+		t.Errorf("expected nil, got %v", limited)
+	}
+
+	// Preferred segments which are not requisite must be skipped.
+	expected := []*csi.Topology{zone("c"), zone("a")}
+	limited := limitTopologySegments(requirement, 2)
+	if !reflect.DeepEqual(limited.Requisite, expected) || !reflect.DeepEqual(limited.Preferred, expected) {
+		t.Errorf("expected requisite and preferred %v, got %v", expected, limited)
+	}
+}
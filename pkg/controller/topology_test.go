@@ -17,19 +17,31 @@ limitations under the License.
 package controller
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/external-provisioner/pkg/features"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	"k8s.io/client-go/informers"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/record"
+	utilfeaturetesting "k8s.io/component-base/featuregate/testing"
+	csitrans "k8s.io/csi-translation-lib"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
 )
 
 const (
@@ -154,6 +166,77 @@ func TestGenerateVolumeNodeAffinity(t *testing.T) {
 	}
 }
 
+func TestAddWellKnownTopology(t *testing.T) {
+	wellKnownLabels := map[string]string{
+		"com.example.csi/zone":   v1.LabelTopologyZone,
+		"com.example.csi/region": v1.LabelTopologyRegion,
+	}
+	testcases := map[string]struct {
+		topology         *csi.Topology
+		wellKnownLabels  map[string]string
+		expectedSegments map[string]string
+	}{
+		"nil topology": {
+			wellKnownLabels: wellKnownLabels,
+		},
+		"no mapping": {
+			topology:         &csi.Topology{Segments: map[string]string{"com.example.csi/zone": "zone1"}},
+			expectedSegments: map[string]string{"com.example.csi/zone": "zone1"},
+		},
+		"mapped": {
+			topology: &csi.Topology{Segments: map[string]string{
+				"com.example.csi/zone":   "zone1",
+				"com.example.csi/region": "region1",
+				"com.example.csi/rack":   "rack1",
+			}},
+			wellKnownLabels: wellKnownLabels,
+			expectedSegments: map[string]string{
+				"com.example.csi/zone":   "zone1",
+				"com.example.csi/region": "region1",
+				"com.example.csi/rack":   "rack1",
+				v1.LabelTopologyZone:     "zone1",
+				v1.LabelTopologyRegion:   "region1",
+			},
+		},
+		"driver already uses well-known label": {
+			topology: &csi.Topology{Segments: map[string]string{
+				"com.example.csi/zone": "zone1",
+				v1.LabelTopologyZone:   "zone2",
+			}},
+			wellKnownLabels: wellKnownLabels,
+			expectedSegments: map[string]string{
+				"com.example.csi/zone": "zone1",
+				v1.LabelTopologyZone:   "zone2",
+			},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var original map[string]string
+			if tc.topology != nil {
+				original = make(map[string]string)
+				for k, v := range tc.topology.Segments {
+					original[k] = v
+				}
+			}
+			topology := addWellKnownTopology(tc.topology, tc.wellKnownLabels)
+			if tc.topology == nil {
+				if topology != nil {
+					t.Fatalf("expected nil topology, got %v", topology)
+				}
+				return
+			}
+			if !equality.Semantic.DeepEqual(topology.Segments, tc.expectedSegments) {
+				t.Errorf("expected segments %v, got %v", tc.expectedSegments, topology.Segments)
+			}
+			if !equality.Semantic.DeepEqual(tc.topology.Segments, original) {
+				t.Errorf("input topology was modified: %v", tc.topology.Segments)
+			}
+		})
+	}
+}
+
 func TestStatefulSetSpreading(t *testing.T) {
 	nodeLabels := []map[string]string{
 		{"com.example.csi/zone": "zone1", "com.example.csi/rack": "rackA"},
@@ -1453,6 +1536,173 @@ func TestPreferredTopologies(t *testing.T) {
 	}
 }
 
+// TestProvisionRequireTopology checks how Provision handles a selected
+// node whose topology is unknown, with and without RequireTopology.
+func TestProvisionRequireTopology(t *testing.T) {
+	defer utilfeaturetesting.SetFeatureGateDuringTest(t, utilfeature.DefaultFeatureGate, features.Topology, true)()
+
+	const (
+		requestBytes = 100
+		zoneKey      = "com.example.csi/zone"
+	)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-0",
+			Labels: map[string]string{zoneKey: "zone1"},
+		},
+	}
+	csiNode := func(topologyKeys ...string) *storagev1.CSINode {
+		return &storagev1.CSINode{
+			ObjectMeta: metav1.ObjectMeta{Name: node.Name},
+			Spec: storagev1.CSINodeSpec{
+				Drivers: []storagev1.CSINodeDriver{
+					{
+						Name:         driverName,
+						NodeID:       node.Name,
+						TopologyKeys: topologyKeys,
+					},
+				},
+			},
+		}
+	}
+
+	testcases := map[string]struct {
+		csiNode          *storagev1.CSINode
+		noSelectedNode   bool
+		noImmediate      bool
+		requireTopology  bool
+		expectState      controller.ProvisioningState
+		expectErr        bool
+		expectEvent      bool
+		expectRequisite  bool
+		expectIgnoredErr bool
+	}{
+		"node with topology": {
+			csiNode:         csiNode(zoneKey),
+			requireTopology: true,
+			expectState:     controller.ProvisioningFinished,
+			expectRequisite: true,
+		},
+		"node without topology, lenient": {
+			csiNode:     csiNode(),
+			expectState: controller.ProvisioningNoChange,
+			expectErr:   true,
+		},
+		"node without topology, strict": {
+			csiNode:         csiNode(),
+			requireTopology: true,
+			expectState:     controller.ProvisioningReschedule,
+			expectErr:       true,
+			expectEvent:     true,
+		},
+		"node without CSINode, strict": {
+			requireTopology: true,
+			expectState:     controller.ProvisioningReschedule,
+			expectErr:       true,
+			expectEvent:     true,
+		},
+		"no node and no allowed topologies, lenient": {
+			noSelectedNode: true,
+			noImmediate:    true,
+			expectState:    controller.ProvisioningFinished,
+		},
+		"no node and no allowed topologies, strict": {
+			noSelectedNode:   true,
+			noImmediate:      true,
+			requireTopology:  true,
+			expectState:      controller.ProvisioningFinished,
+			expectErr:        true,
+			expectEvent:      true,
+			expectIgnoredErr: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			if !tc.expectErr {
+				controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						requisite := req.GetAccessibilityRequirements().GetRequisite()
+						if tc.expectRequisite && len(requisite) == 0 {
+							t.Error("expected requisite topology, got none")
+						}
+						if !tc.expectRequisite && len(requisite) != 0 {
+							t.Errorf("expected no requisite topology, got %v", requisite)
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestBytes,
+								VolumeId:      "test-volume-id",
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			objects := []runtime.Object{node}
+			if tc.csiNode != nil {
+				objects = append(objects, tc.csiNode)
+			}
+			clientSet := fakeclientset.NewSimpleClientset(objects...)
+			scLister, csiNodeLister, nodeLister, claimLister, vaLister, stopChan := listers(clientSet)
+			defer close(stopChan)
+			recorder := record.NewFakeRecorder(10)
+			pluginCaps, controllerCaps := provisionWithTopologyCapabilities()
+			csiProvisioner := NewCSIProvisioner(clientSet, 5*time.Second, "test-provisioner", "test", 5,
+				csiConn.conn, nil, driverName, pluginCaps, controllerCaps, "", false, !tc.noImmediate, csitrans.New(), scLister, csiNodeLister, nodeLister, claimLister, vaLister, nil, false, defaultfsType, nil, true, false,
+				RequireTopology(tc.requireTopology), withEventRecorder(recorder))
+
+			options := controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			}
+			if !tc.noSelectedNode {
+				options.SelectedNode = node
+			}
+			pv, state, err := csiProvisioner.Provision(context.Background(), options)
+			if state != tc.expectState {
+				t.Errorf("expected ProvisioningState %s, got %s", tc.expectState, state)
+			}
+			if !tc.expectErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if pv == nil {
+					t.Fatal("expected PV, got none")
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if _, ok := err.(*controller.IgnoredError); ok != tc.expectIgnoredErr {
+				t.Errorf("expected IgnoredError %v, got %T: %v", tc.expectIgnoredErr, err, err)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !tc.expectEvent {
+					t.Errorf("unexpected event: %s", event)
+				} else if !strings.HasPrefix(event, v1.EventTypeWarning+" TopologyUnavailable") {
+					t.Errorf("unexpected event: %s", event)
+				}
+			default:
+				if tc.expectEvent {
+					t.Error("expected TopologyUnavailable event, got none")
+				}
+			}
+		})
+	}
+}
+
 func buildNodes(nodeLabels []map[string]string) *v1.NodeList {
 	list := &v1.NodeList{}
 	i := 0
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// annTransferProtocols on a CSIDriver object lists the protocols,
+	// separated by commas, that the driver supports for copying volume
+	// content from or to volumes of a different CSI driver.
+	annTransferProtocols = "provisioner.k8s.io/transfer-protocols"
+
+	// Parameters passed to CreateVolume instead of a VolumeContentSource
+	// when cloning a volume of a different CSI driver.
+	transferProtocolKey     = "csi.storage.k8s.io/transfer-protocol"
+	transferSourceDriverKey = "csi.storage.k8s.io/transfer-source-driver"
+	transferSourceHandleKey = "csi.storage.k8s.io/transfer-source-handle"
+)
+
+// transferSource describes a volume of a different CSI driver that the
+// new volume gets copied from.
+type transferSource struct {
+	protocol string
+	driver   string
+	handle   string
+}
+
+func (t *transferSource) parameters() map[string]string {
+	return map[string]string{
+		transferProtocolKey:     t.protocol,
+		transferSourceDriverKey: t.driver,
+		transferSourceHandleKey: t.handle,
+	}
+}
+
+// noTransferProtocolError is returned when a volume cannot be cloned
+// because its driver and the provisioner's driver have no transfer
+// protocol in common.
+type noTransferProtocolError struct {
+	message string
+}
+
+func (e *noTransferProtocolError) Error() string {
+	return e.message
+}
+
+// transferProtocols returns the transfer protocols advertised by the
+// CSIDriver object of a driver. A missing object advertises none.
+func (p *csiProvisioner) transferProtocols(ctx context.Context, driver string) (sets.String, error) {
+	csiDriver, err := p.client.StorageV1().CSIDrivers().Get(ctx, driver, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return sets.NewString(), nil
+		}
+		return nil, fmt.Errorf("error getting CSIDriver %s: %v", driver, err)
+	}
+	protocols := sets.NewString()
+	for _, protocol := range strings.Split(csiDriver.Annotations[annTransferProtocols], ",") {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			protocols.Insert(protocol)
+		}
+	}
+	return protocols, nil
+}
+
+// getTransferSource picks a transfer protocol that both the driver of
+// the source volume and the provisioner's driver support. The first one
+// in alphabetical order is used if there is more than one.
+func (p *csiProvisioner) getTransferSource(ctx context.Context, sourceDriver, sourceHandle string) (*transferSource, error) {
+	sourceProtocols, err := p.transferProtocols(ctx, sourceDriver)
+	if err != nil {
+		return nil, err
+	}
+	protocols, err := p.transferProtocols(ctx, p.driverName)
+	if err != nil {
+		return nil, err
+	}
+	common := sourceProtocols.Intersection(protocols)
+	if common.Len() == 0 {
+		return nil, &noTransferProtocolError{
+			message: fmt.Sprintf("the source volume is handled by CSI driver %s, which has no transfer protocol in common with CSI driver %s (%s: %q vs. %q)",
+				sourceDriver, p.driverName, annTransferProtocols, strings.Join(sourceProtocols.List(), ","), strings.Join(protocols.List(), ",")),
+		}
+	}
+	return &transferSource{
+		protocol: common.List()[0],
+		driver:   sourceDriver,
+		handle:   sourceHandle,
+	}, nil
+}
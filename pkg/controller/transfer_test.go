@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestProvisionFromPVCOfOtherDriver(t *testing.T) {
+	const (
+		requestedBytes = 1000
+		srcName        = "source-pvc"
+		srcNamespace   = "default"
+		srcPVName      = "source-pv"
+		otherDriver    = "other.example.com"
+	)
+	csiDriver := func(name, protocols string) *storagev1.CSIDriver {
+		return &storagev1.CSIDriver{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{annTransferProtocols: protocols},
+			},
+		}
+	}
+
+	testcases := map[string]struct {
+		sourceDriver         string
+		csiDrivers           []runtime.Object
+		expectContentSource  bool
+		expectTransferParams map[string]string
+		expectEvent          string
+	}{
+		"same driver": {
+			sourceDriver:        driverName,
+			expectContentSource: true,
+		},
+		"other driver with common protocol": {
+			sourceDriver: otherDriver,
+			csiDrivers: []runtime.Object{
+				csiDriver(otherDriver, "rsync, nbd"),
+				csiDriver(driverName, "nbd,s3"),
+			},
+			expectTransferParams: map[string]string{
+				transferProtocolKey:     "nbd",
+				transferSourceDriverKey: otherDriver,
+				transferSourceHandleKey: "source-volume-id",
+			},
+		},
+		"other driver without common protocol": {
+			sourceDriver: otherDriver,
+			csiDrivers: []runtime.Object{
+				csiDriver(otherDriver, "rsync"),
+				csiDriver(driverName, "s3"),
+			},
+			expectEvent: "NoCommonTransferProtocol",
+		},
+		"other driver without CSIDriver objects": {
+			sourceDriver: otherDriver,
+			expectEvent:  "NoCommonTransferProtocol",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			class := "fake-sc"
+			sourceClaim := fakeClaim(srcName, srcNamespace, "source-uid", requestedBytes, srcPVName, v1.ClaimBound, &class, "")
+			sourcePV := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: srcPVName},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							Driver:       tc.sourceDriver,
+							VolumeHandle: "source-volume-id",
+						},
+					},
+					ClaimRef: &v1.ObjectReference{
+						Kind:      "PersistentVolumeClaim",
+						Namespace: srcNamespace,
+						Name:      srcName,
+						UID:       "source-uid",
+					},
+					StorageClassName: class,
+				},
+				Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+			}
+			pluginCaps, controllerCaps := provisionFromPVCCapabilities()
+			pt := newProvisionerTest(t, append([]runtime.Object{sourceClaim, sourcePV}, tc.csiDrivers...), withCapabilities(pluginCaps, controllerCaps))
+
+			if tc.expectEvent == "" {
+				pt.controllerServer.EXPECT().CreateVolume(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+						if tc.expectContentSource && req.VolumeContentSource.GetVolume().GetVolumeId() != "source-volume-id" {
+							t.Errorf("expected content source with volume source-volume-id, got %v", req.VolumeContentSource)
+						}
+						if !tc.expectContentSource && req.VolumeContentSource != nil {
+							t.Errorf("expected no content source, got %v", req.VolumeContentSource)
+						}
+						for _, key := range []string{transferProtocolKey, transferSourceDriverKey, transferSourceHandleKey} {
+							if req.Parameters[key] != tc.expectTransferParams[key] {
+								t.Errorf("expected parameter %s=%q, got %q", key, tc.expectTransferParams[key], req.Parameters[key])
+							}
+						}
+						return &csi.CreateVolumeResponse{
+							Volume: &csi.Volume{
+								CapacityBytes: requestedBytes,
+								VolumeId:      "test-volume-id",
+								ContentSource: req.VolumeContentSource,
+							},
+						}, nil
+					}).Times(1)
+			}
+
+			pv, _, err := pt.provisioner.Provision(context.Background(), generatePVCForProvisionFromPVC(srcNamespace, srcName, class, requestedBytes, ""))
+			events := pt.events()
+			if tc.expectEvent != "" {
+				if err == nil {
+					t.Fatalf("expected error, got PV %v", pv)
+				}
+				if len(events) != 1 || !strings.Contains(events[0], tc.expectEvent) {
+					t.Errorf("expected %s event, got %q", tc.expectEvent, events)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if pv == nil {
+				t.Fatal("expected PV, got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/rpc"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// VolumeCapacityReconciler periodically compares the capacity of provisioned
+// volumes as reported by the CSI driver with the capacity recorded in their
+// PVs and updates PVs of volumes that were resized directly on the storage
+// backend.
+type VolumeCapacityReconciler struct {
+	client        kubernetes.Interface
+	csiClient     csi.ControllerClient
+	driverName    string
+	pvLister      corelisters.PersistentVolumeLister
+	claimLister   corelisters.PersistentVolumeClaimLister
+	eventRecorder record.EventRecorder
+	listVolumes   bool
+	interval      time.Duration
+	timeout       time.Duration
+}
+
+// NewVolumeCapacityReconciler creates a reconciler which checks volumes at
+// the given interval. It returns nil if the driver supports neither
+// ListVolumes nor ControllerGetVolume.
+func NewVolumeCapacityReconciler(
+	client kubernetes.Interface,
+	csiClient csi.ControllerClient,
+	driverName string,
+	pvLister corelisters.PersistentVolumeLister,
+	claimLister corelisters.PersistentVolumeClaimLister,
+	controllerCapabilities rpc.ControllerCapabilitySet,
+	interval time.Duration,
+	timeout time.Duration,
+) *VolumeCapacityReconciler {
+	listVolumes := controllerCapabilities[csi.ControllerServiceCapability_RPC_LIST_VOLUMES]
+	if !listVolumes && !controllerCapabilities[csi.ControllerServiceCapability_RPC_GET_VOLUME] {
+		return nil
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "external-provisioner"})
+
+	return &VolumeCapacityReconciler{
+		client:        client,
+		csiClient:     csiClient,
+		driverName:    driverName,
+		pvLister:      pvLister,
+		claimLister:   claimLister,
+		eventRecorder: eventRecorder,
+		listVolumes:   listVolumes,
+		interval:      interval,
+		timeout:       timeout,
+	}
+}
+
+// Run checks volumes until the context is canceled.
+func (r *VolumeCapacityReconciler) Run(ctx context.Context) {
+	klog.Infof("Starting volume capacity reconciler with interval %s", r.interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.reconcile(ctx); err != nil {
+			klog.Errorf("Reconciling volume capacity failed: %v", err)
+		}
+	}, r.interval)
+	klog.Info("Shutting down volume capacity reconciler")
+}
+
+func (r *VolumeCapacityReconciler) reconcile(ctx context.Context) error {
+	pvs, err := r.pvLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var capacities map[string]int64
+	if r.listVolumes {
+		capacities, err = r.listCapacities(ctx)
+		if err != nil {
+			return fmt.Errorf("list volumes: %v", err)
+		}
+	}
+
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != r.driverName ||
+			pv.Status.Phase != v1.VolumeBound || pv.DeletionTimestamp != nil {
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		var capacity int64
+		if r.listVolumes {
+			capacity = capacities[volumeID]
+		} else {
+			capacity, err = r.getCapacity(ctx, volumeID)
+			if err != nil {
+				klog.Warningf("Getting capacity of volume %s for PV %s failed: %v", volumeID, pv.Name, err)
+				continue
+			}
+		}
+		if err := r.reconcilePV(ctx, pv, capacity); err != nil {
+			klog.Warningf("Updating capacity of PV %s failed: %v", pv.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcilePV updates the capacity of the PV unless the driver didn't report
+// a capacity or the PVC is getting expanded.
+func (r *VolumeCapacityReconciler) reconcilePV(ctx context.Context, pv *v1.PersistentVolume, capacity int64) error {
+	if capacity <= 0 {
+		return nil
+	}
+	pvCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	if pvCapacity.Value() == capacity {
+		return nil
+	}
+	if r.expansionInProgress(pv) {
+		klog.V(4).Infof("Not updating capacity of PV %s while its PVC is getting expanded", pv.Name)
+		return nil
+	}
+
+	newCapacity := resource.NewQuantity(capacity, resource.BinarySI)
+	pv = pv.DeepCopy()
+	pv.Spec.Capacity[v1.ResourceStorage] = *newCapacity
+	if _, err := r.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Updated capacity of PV %s from %s to %s", pv.Name, pvCapacity.String(), newCapacity.String())
+	r.eventRecorder.Eventf(pv, v1.EventTypeNormal, "CapacityReconciled", "Capacity changed from %s to %s on the storage backend", pvCapacity.String(), newCapacity.String())
+	return nil
+}
+
+// expansionInProgress checks whether the PVC of the PV asks for more than the
+// PV has or is being resized. In both cases the resizer is responsible for
+// updating the PV.
+func (r *VolumeCapacityReconciler) expansionInProgress(pv *v1.PersistentVolume) bool {
+	if pv.Spec.ClaimRef == nil {
+		return false
+	}
+	claim, err := r.claimLister.PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Get(pv.Spec.ClaimRef.Name)
+	if err != nil {
+		// Better be safe and not touch the PV.
+		return true
+	}
+	for _, condition := range claim.Status.Conditions {
+		if condition.Type == v1.PersistentVolumeClaimResizing ||
+			condition.Type == v1.PersistentVolumeClaimFileSystemResizePending {
+			return true
+		}
+	}
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	pvCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	return requested.Cmp(pvCapacity) > 0
+}
+
+// listCapacities returns the capacity of all volumes by volume ID.
+func (r *VolumeCapacityReconciler) listCapacities(ctx context.Context) (map[string]int64, error) {
+	capacities := map[string]int64{}
+	req := &csi.ListVolumesRequest{}
+	for {
+		listCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		rsp, err := r.csiClient.ListVolumes(listCtx, req)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range rsp.Entries {
+			if entry.Volume != nil {
+				capacities[entry.Volume.VolumeId] = entry.Volume.CapacityBytes
+			}
+		}
+		if rsp.NextToken == "" {
+			return capacities, nil
+		}
+		req.StartingToken = rsp.NextToken
+	}
+}
+
+func (r *VolumeCapacityReconciler) getCapacity(ctx context.Context, volumeID string) (int64, error) {
+	getCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	rsp, err := r.csiClient.ControllerGetVolume(getCtx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		return 0, err
+	}
+	if rsp.Volume == nil {
+		return 0, nil
+	}
+	return rsp.Volume.CapacityBytes, nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestVolumeCapacityReconciler(t *testing.T) {
+	const (
+		pvCapacity = 1024 * 1024 * 1024
+		volumeID   = "test-volume-id"
+	)
+
+	testcases := map[string]struct {
+		backendCapacity  int64
+		claimRequest     int64
+		claimConditions  []v1.PersistentVolumeClaimConditionType
+		getVolume        bool
+		expectedCapacity int64
+	}{
+		"drift": {
+			backendCapacity:  2 * pvCapacity,
+			expectedCapacity: 2 * pvCapacity,
+		},
+		"drift with ControllerGetVolume": {
+			backendCapacity:  2 * pvCapacity,
+			getVolume:        true,
+			expectedCapacity: 2 * pvCapacity,
+		},
+		"same capacity": {
+			backendCapacity:  pvCapacity,
+			expectedCapacity: pvCapacity,
+		},
+		"unknown capacity": {
+			expectedCapacity: pvCapacity,
+		},
+		"expansion requested": {
+			backendCapacity:  2 * pvCapacity,
+			claimRequest:     2 * pvCapacity,
+			expectedCapacity: pvCapacity,
+		},
+		"resizing": {
+			backendCapacity:  2 * pvCapacity,
+			claimConditions:  []v1.PersistentVolumeClaimConditionType{v1.PersistentVolumeClaimResizing},
+			expectedCapacity: pvCapacity,
+		},
+		"file system resize pending": {
+			backendCapacity:  2 * pvCapacity,
+			claimConditions:  []v1.PersistentVolumeClaimConditionType{v1.PersistentVolumeClaimFileSystemResizePending},
+			expectedCapacity: pvCapacity,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			tmpdir := tempDir(t)
+			defer os.RemoveAll(tmpdir)
+			mockController, driver, _, controllerServer, csiConn, err := createMockServer(t, tmpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockController.Finish()
+			defer driver.Stop()
+
+			volume := &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: tc.backendCapacity,
+			}
+			if tc.getVolume {
+				controllerServer.EXPECT().ControllerGetVolume(gomock.Any(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID}).Return(&csi.ControllerGetVolumeResponse{
+					Volume: volume,
+					Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+				}, nil).Times(1)
+			} else {
+				controllerServer.EXPECT().ListVolumes(gomock.Any(), gomock.Any()).Return(&csi.ListVolumesResponse{
+					Entries: []*csi.ListVolumesResponse_Entry{{Volume: volume}},
+				}, nil).Times(1)
+			}
+
+			claimRequest := tc.claimRequest
+			if claimRequest == 0 {
+				claimRequest = pvCapacity
+			}
+			claim := createFakePVC(claimRequest)
+			for _, conditionType := range tc.claimConditions {
+				claim.Status.Conditions = append(claim.Status.Conditions, v1.PersistentVolumeClaimCondition{
+					Type:   conditionType,
+					Status: v1.ConditionTrue,
+				})
+			}
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pv"},
+				Spec: v1.PersistentVolumeSpec{
+					Capacity: v1.ResourceList{
+						v1.ResourceStorage: *resource.NewQuantity(pvCapacity, resource.BinarySI),
+					},
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							Driver:       driverName,
+							VolumeHandle: volumeID,
+						},
+					},
+					ClaimRef: &v1.ObjectReference{
+						Namespace: claim.Namespace,
+						Name:      claim.Name,
+					},
+				},
+				Status: v1.PersistentVolumeStatus{
+					Phase: v1.VolumeBound,
+				},
+			}
+
+			ctx := context.Background()
+			clientSet := fakeclientset.NewSimpleClientset(pv, claim)
+			informerFactory := informers.NewSharedInformerFactory(clientSet, 0)
+			pvInformer := informerFactory.Core().V1().PersistentVolumes()
+			claimInformer := informerFactory.Core().V1().PersistentVolumeClaims()
+			pvInformer.Informer().GetStore().Add(pv)
+			claimInformer.Informer().GetStore().Add(claim)
+
+			controllerCapabilities := map[csi.ControllerServiceCapability_RPC_Type]bool{
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES: !tc.getVolume,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME:   tc.getVolume,
+			}
+			reconciler := NewVolumeCapacityReconciler(clientSet, csi.NewControllerClient(csiConn.conn), driverName,
+				pvInformer.Lister(), claimInformer.Lister(), controllerCapabilities, time.Minute, 5*time.Second)
+			recorder := record.NewFakeRecorder(10)
+			reconciler.eventRecorder = recorder
+
+			if err := reconciler.reconcile(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			updatedPV, err := clientSet.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			capacity := updatedPV.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != tc.expectedCapacity {
+				t.Errorf("expected PV capacity %d, got %d", tc.expectedCapacity, capacity.Value())
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if tc.expectedCapacity != pvCapacity {
+				if !strings.Contains(event, "CapacityReconciled") {
+					t.Errorf("expected CapacityReconciled event, got %q", event)
+				}
+			} else if event != "" {
+				t.Errorf("expected no event, got %q", event)
+			}
+		})
+	}
+}
+
+func TestNewVolumeCapacityReconcilerUnsupported(t *testing.T) {
+	reconciler := NewVolumeCapacityReconciler(fakeclientset.NewSimpleClientset(), nil, driverName, nil, nil,
+		map[csi.ControllerServiceCapability_RPC_Type]bool{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: true,
+		}, time.Minute, 5*time.Second)
+	if reconciler != nil {
+		t.Error("expected no reconciler for a driver without ListVolumes and ControllerGetVolume")
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// volumeHandleIndex is the name of the PV informer index by CSI driver and
+// volume handle.
+const volumeHandleIndex = "csi-volume-handle"
+
+// volumeHandleKey is the key of a volume in volumeHandleIndex. Driver
+// names cannot contain a slash.
+func volumeHandleKey(driverName, volumeHandle string) string {
+	return driverName + "/" + volumeHandle
+}
+
+func volumeHandleIndexFunc(obj interface{}) ([]string, error) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok || pv.Spec.CSI == nil {
+		return nil, nil
+	}
+	return []string{volumeHandleKey(pv.Spec.CSI.Driver, pv.Spec.CSI.VolumeHandle)}, nil
+}
+
+// AddVolumeHandleIndex indexes the PVs of the informer by CSI driver and
+// volume handle. The informer keeps the index up-to-date when PVs get
+// added, updated and deleted. It must be called before the informer gets
+// started.
+func AddVolumeHandleIndex(informer cache.SharedIndexInformer) error {
+	return informer.AddIndexers(cache.Indexers{volumeHandleIndex: volumeHandleIndexFunc})
+}
+
+// VolumeHandles maps volume handles back to PVs with the index of
+// AddVolumeHandleIndex.
+type VolumeHandles struct {
+	indexer cache.Indexer
+}
+
+// NewVolumeHandles uses the index of the informer, which must have been
+// added with AddVolumeHandleIndex.
+func NewVolumeHandles(informer cache.SharedIndexInformer) *VolumeHandles {
+	return &VolumeHandles{indexer: informer.GetIndexer()}
+}
+
+// PVs returns the PVs of the driver with the volume handle, in no
+// particular order. They must not be modified.
+func (h *VolumeHandles) PVs(driverName, volumeHandle string) ([]*v1.PersistentVolume, error) {
+	objs, err := h.indexer.ByIndex(volumeHandleIndex, volumeHandleKey(driverName, volumeHandle))
+	if err != nil {
+		return nil, err
+	}
+	pvs := make([]*v1.PersistentVolume, 0, len(objs))
+	for _, obj := range objs {
+		pvs = append(pvs, obj.(*v1.PersistentVolume))
+	}
+	return pvs, nil
+}
+
+// checkVolumeHandleUnshared returns an error if some other PV still uses the
+// volume handle of the PV. DeleteVolume would remove the data of that PV.
+// Released and failed PVs don't count, otherwise several of them with the
+// same volume handle would wait for each other forever.
+func (p *csiProvisioner) checkVolumeHandleUnshared(volume *v1.PersistentVolume) error {
+	pvs, err := p.volumeHandles.PVs(volume.Spec.CSI.Driver, volume.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return fmt.Errorf("failed to look up PVs of volume %s: %v", volume.Spec.CSI.VolumeHandle, err)
+	}
+	for _, pv := range pvs {
+		if pv.Status.Phase == v1.VolumeReleased || pv.Status.Phase == v1.VolumeFailed {
+			continue
+		}
+		if pv.Name != volume.Name && pv.DeletionTimestamp == nil {
+			return fmt.Errorf("volume %s of persistentvolume %s is still used by persistentvolume %s", volume.Spec.CSI.VolumeHandle, volume.Name, pv.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func volumeHandlePV(name, driver, volumeHandle string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       driver,
+					VolumeHandle: volumeHandle,
+				},
+			},
+		},
+	}
+}
+
+func volumeHandlePVInPhase(name string, phase v1.PersistentVolumePhase) *v1.PersistentVolume {
+	pv := volumeHandlePV(name, driverName, "test-volume-id")
+	pv.Status.Phase = phase
+	return pv
+}
+
+func TestVolumeHandleIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nonCSI := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-nfs"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Server: "nfs.example.com", Path: "/volume-1"},
+			},
+		},
+	}
+	clientSet := fakeclientset.NewSimpleClientset(volumeHandlePV("pv-1", driverName, "volume-1"), nonCSI)
+	factory := informers.NewSharedInformerFactory(clientSet, 0)
+	informer := factory.Core().V1().PersistentVolumes().Informer()
+	if err := AddVolumeHandleIndex(informer); err != nil {
+		t.Fatal(err)
+	}
+	volumeHandles := NewVolumeHandles(informer)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	expectPVs := func(driver, volumeHandle string, expected ...string) {
+		t.Helper()
+		var names []string
+		if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+			pvs, err := volumeHandles.PVs(driver, volumeHandle)
+			if err != nil {
+				return false, err
+			}
+			names = nil
+			for _, pv := range pvs {
+				names = append(names, pv.Name)
+			}
+			sort.Strings(names)
+			return reflect.DeepEqual(names, expected), nil
+		}); err != nil {
+			t.Fatalf("expected PVs %v for volume %s of driver %s, got %v: %v", expected, volumeHandle, driver, names, err)
+		}
+	}
+
+	// Initial list.
+	expectPVs(driverName, "volume-1", "pv-1")
+	expectPVs("other-driver", "volume-1")
+
+	// Added PVs.
+	for _, pv := range []*v1.PersistentVolume{
+		volumeHandlePV("pv-2", driverName, "volume-2"),
+		volumeHandlePV("pv-3", "other-driver", "volume-1"),
+	} {
+		if _, err := clientSet.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectPVs(driverName, "volume-1", "pv-1")
+	expectPVs(driverName, "volume-2", "pv-2")
+	expectPVs("other-driver", "volume-1", "pv-3")
+
+	// Updated PV.
+	if _, err := clientSet.CoreV1().PersistentVolumes().Update(ctx, volumeHandlePV("pv-2", driverName, "volume-1"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectPVs(driverName, "volume-1", "pv-1", "pv-2")
+	expectPVs(driverName, "volume-2")
+
+	// Deleted PV.
+	if err := clientSet.CoreV1().PersistentVolumes().Delete(ctx, "pv-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectPVs(driverName, "volume-1", "pv-2")
+}
+
+func TestDeleteSharedVolumeHandle(t *testing.T) {
+	const volumeHandle = "test-volume-id"
+
+	testcases := map[string]struct {
+		otherPVs     []*v1.PersistentVolume
+		expectDelete bool
+	}{
+		"not shared": {
+			otherPVs:     []*v1.PersistentVolume{volumeHandlePV("other-pv", driverName, "other-volume-id")},
+			expectDelete: true,
+		},
+		"other driver": {
+			otherPVs:     []*v1.PersistentVolume{volumeHandlePV("other-pv", "other-driver", volumeHandle)},
+			expectDelete: true,
+		},
+		"shared": {
+			otherPVs: []*v1.PersistentVolume{volumeHandlePV("other-pv", driverName, volumeHandle)},
+		},
+		"shared with deleted PV": {
+			otherPVs: []*v1.PersistentVolume{func() *v1.PersistentVolume {
+				pv := volumeHandlePV("other-pv", driverName, volumeHandle)
+				pv.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+				return pv
+			}()},
+			expectDelete: true,
+		},
+		"shared with released PV": {
+			otherPVs:     []*v1.PersistentVolume{volumeHandlePVInPhase("other-pv", v1.VolumeReleased)},
+			expectDelete: true,
+		},
+		"shared with failed PV": {
+			otherPVs:     []*v1.PersistentVolume{volumeHandlePVInPhase("other-pv", v1.VolumeFailed)},
+			expectDelete: true,
+		},
+		"shared with bound PV": {
+			otherPVs: []*v1.PersistentVolume{volumeHandlePVInPhase("other-pv", v1.VolumeBound)},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pv := volumeHandlePV("test-pv", driverName, volumeHandle)
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{volumeHandleIndex: volumeHandleIndexFunc})
+			for _, obj := range append(tc.otherPVs, pv) {
+				if err := indexer.Add(obj); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pt := newProvisionerTest(t, []runtime.Object{pv}, WithVolumeHandles(&VolumeHandles{indexer: indexer}))
+			if tc.expectDelete {
+				pt.controllerServer.EXPECT().DeleteVolume(gomock.Any(), gomock.Any()).Return(&csi.DeleteVolumeResponse{}, nil).Times(1)
+			}
+
+			err := pt.provisioner.Delete(context.Background(), pv)
+			if tc.expectDelete && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.expectDelete && err == nil {
+				t.Fatal("expected deletion to be refused, got no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// volumeHandlePrefixKey is the CreateVolume parameter with the prefix
+// configured with VolumeHandlePrefix. Drivers which support it can use it
+// to keep the volume handles of several clusters apart on a shared backend.
+const volumeHandlePrefixKey = "csi.storage.k8s.io/volume-handle-prefix"
+
+// ValidateVolumeHandlePrefix checks that the prefix is a DNS-1123 label,
+// which is safe to use in the volume names of most storage backends.
+func ValidateVolumeHandlePrefix(prefix string) error {
+	if errs := validation.IsDNS1123Label(prefix); len(errs) > 0 {
+		return fmt.Errorf("invalid volume handle prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	return nil
+}
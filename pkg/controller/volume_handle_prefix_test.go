@@ -0,0 +1,109 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v9/controller"
+)
+
+func TestValidateVolumeHandlePrefix(t *testing.T) {
+	testcases := map[string]bool{
+		"cluster-a": true,
+		"c1":        true,
+		"":          false,
+		"Cluster-A": false,
+		"cluster_a": false,
+		"cluster.a": false,
+		"-cluster":  false,
+		"cluster-":  false,
+		"cluster/a": false,
+		"cluster a": false,
+		"a123456789a123456789a123456789a123456789a123456789a123456789abcd": false,
+	}
+
+	for prefix, valid := range testcases {
+		err := ValidateVolumeHandlePrefix(prefix)
+		if valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", prefix, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q: expected error, got none", prefix)
+		}
+	}
+}
+
+func TestProvisionVolumeHandlePrefix(t *testing.T) {
+	const requestBytes = 100
+
+	testcases := map[string]struct {
+		prefix     string
+		parameters map[string]string
+		expectErr  bool
+	}{
+		"no prefix": {},
+		"prefix": {
+			prefix: "cluster-a",
+		},
+		"prefix with parameters": {
+			prefix:     "cluster-a",
+			parameters: map[string]string{"fstype": "ext4"},
+		},
+		"prefix in storage class": {
+			parameters: map[string]string{volumeHandlePrefixKey: "cluster-b"},
+			expectErr:  true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			pt := newProvisionerTest(t, nil, VolumeHandlePrefix(tc.prefix))
+			if !tc.expectErr {
+				pt.expectCreateVolume(requestBytes, func(req *csi.CreateVolumeRequest) {
+					prefix, ok := req.Parameters[volumeHandlePrefixKey]
+					if tc.prefix == "" && ok {
+						t.Errorf("expected no %s parameter, got %q", volumeHandlePrefixKey, prefix)
+					}
+					if tc.prefix != "" && prefix != tc.prefix {
+						t.Errorf("expected %s parameter %q, got %q", volumeHandlePrefixKey, tc.prefix, prefix)
+					}
+					for key, value := range tc.parameters {
+						if req.Parameters[key] != value {
+							t.Errorf("expected parameter %s=%q, got %q", key, value, req.Parameters[key])
+						}
+					}
+				})
+			}
+
+			_, _, err := pt.provisioner.Provision(context.Background(), controller.ProvisionOptions{
+				StorageClass: &storagev1.StorageClass{Parameters: tc.parameters},
+				PVName:       "test-testi",
+				PVC:          createFakePVC(requestBytes),
+			})
+			if tc.expectErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
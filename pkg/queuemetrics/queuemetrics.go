@@ -0,0 +1,294 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package queuemetrics sets the workqueue metrics provider to produce
+// Prometheus metrics in the default legacy registry. To use this
+// package, you just have to import it.
+//
+// It produces the same metrics as
+// k8s.io/component-base/metrics/prometheus/workqueue, which must not be
+// imported together with it because only the first metrics provider
+// gets used by client-go. In addition, it exports how long the oldest
+// item in each queue has been waiting to be processed.
+package queuemetrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	k8smetrics "k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/utils/clock"
+)
+
+// Metrics subsystem and keys used by the workqueue.
+const (
+	WorkQueueSubsystem         = "workqueue"
+	DepthKey                   = "depth"
+	AddsKey                    = "adds_total"
+	QueueLatencyKey            = "queue_duration_seconds"
+	WorkDurationKey            = "work_duration_seconds"
+	UnfinishedWorkKey          = "unfinished_work_seconds"
+	LongestRunningProcessorKey = "longest_running_processor_seconds"
+	RetriesKey                 = "retries_total"
+	OldestItemAgeKey           = "oldest_item_age_seconds"
+)
+
+var (
+	depth = k8smetrics.NewGaugeVec(&k8smetrics.GaugeOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           DepthKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help:           "Current depth of workqueue",
+	}, []string{"name"})
+
+	adds = k8smetrics.NewCounterVec(&k8smetrics.CounterOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           AddsKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help:           "Total number of adds handled by workqueue",
+	}, []string{"name"})
+
+	latency = k8smetrics.NewHistogramVec(&k8smetrics.HistogramOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           QueueLatencyKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help:           "How long in seconds an item stays in workqueue before being requested.",
+		Buckets:        k8smetrics.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+
+	workDuration = k8smetrics.NewHistogramVec(&k8smetrics.HistogramOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           WorkDurationKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help:           "How long in seconds processing an item from workqueue takes.",
+		Buckets:        k8smetrics.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+
+	unfinished = k8smetrics.NewGaugeVec(&k8smetrics.GaugeOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           UnfinishedWorkKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help: "How many seconds of work has done that " +
+			"is in progress and hasn't been observed by work_duration. Large " +
+			"values indicate stuck threads. One can deduce the number of stuck " +
+			"threads by observing the rate at which this increases.",
+	}, []string{"name"})
+
+	longestRunningProcessor = k8smetrics.NewGaugeVec(&k8smetrics.GaugeOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           LongestRunningProcessorKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help: "How many seconds has the longest running " +
+			"processor for workqueue been running.",
+	}, []string{"name"})
+
+	retries = k8smetrics.NewCounterVec(&k8smetrics.CounterOpts{
+		Subsystem:      WorkQueueSubsystem,
+		Name:           RetriesKey,
+		StabilityLevel: k8smetrics.ALPHA,
+		Help:           "Total number of retries handled by workqueue",
+	}, []string{"name"})
+
+	oldestItemAgeDesc = k8smetrics.NewDesc(
+		WorkQueueSubsystem+"_"+OldestItemAgeKey,
+		"How many seconds the oldest item in workqueue has been waiting to be requested, zero if the workqueue is empty.",
+		[]string{"name"}, nil,
+		k8smetrics.ALPHA,
+		"",
+	)
+
+	metrics = []k8smetrics.Registerable{
+		depth, adds, latency, workDuration, unfinished, longestRunningProcessor, retries,
+	}
+)
+
+func init() {
+	for _, m := range metrics {
+		legacyregistry.MustRegister(m)
+	}
+	provider := NewProvider(clock.RealClock{})
+	legacyregistry.CustomMustRegister(provider)
+	workqueue.SetProvider(provider)
+}
+
+// Provider implements workqueue.MetricsProvider with the standard
+// workqueue metrics. It also remembers when the items that are
+// currently in a queue were added, which is exported by
+// implementing metrics.StableCollector.
+type Provider struct {
+	k8smetrics.BaseStableCollector
+
+	clock clock.PassiveClock
+
+	mutex  sync.Mutex
+	queues map[string]*queueAge
+}
+
+var _ workqueue.MetricsProvider = &Provider{}
+var _ k8smetrics.StableCollector = &Provider{}
+
+// NewProvider creates a provider which uses the clock to determine the
+// age of items. It must be the same clock that the queues use.
+func NewProvider(clock clock.PassiveClock) *Provider {
+	return &Provider{
+		clock:  clock,
+		queues: map[string]*queueAge{},
+	}
+}
+
+// queueAge tracks the add times of all items in queues with the same
+// name, sorted from oldest to newest.
+type queueAge struct {
+	mutex    sync.Mutex
+	addTimes []time.Time
+}
+
+func (a *queueAge) add(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.addTimes = append(a.addTimes, now)
+}
+
+// remove drops the add time of an item which has been in the queue for
+// the given duration. The queue doesn't tell us which item it was, but
+// the add time closest to now - waited must belong to it or an item
+// that was added at the same time.
+func (a *queueAge) remove(now time.Time, waited time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.addTimes) == 0 {
+		return
+	}
+	addTime := now.Add(-waited)
+	i := sort.Search(len(a.addTimes), func(i int) bool { return !a.addTimes[i].Before(addTime) })
+	if i == len(a.addTimes) || i > 0 && addTime.Sub(a.addTimes[i-1]) < a.addTimes[i].Sub(addTime) {
+		i--
+	}
+	a.addTimes = append(a.addTimes[:i], a.addTimes[i+1:]...)
+}
+
+func (a *queueAge) oldest(now time.Time) time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.addTimes) == 0 {
+		return 0
+	}
+	return now.Sub(a.addTimes[0])
+}
+
+func (p *Provider) queueAge(name string) *queueAge {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	age := p.queues[name]
+	if age == nil {
+		age = &queueAge{}
+		p.queues[name] = age
+	}
+	return age
+}
+
+// depthMetric records the add time whenever the queue gets deeper.
+type depthMetric struct {
+	workqueue.GaugeMetric
+	clock clock.PassiveClock
+	age   *queueAge
+}
+
+func (d depthMetric) Inc() {
+	d.GaugeMetric.Inc()
+	d.age.add(d.clock.Now())
+}
+
+// latencyMetric gets called with the time that an item spent in the
+// queue when it is handed out for processing, which is when its add
+// time can be forgotten.
+type latencyMetric struct {
+	workqueue.HistogramMetric
+	clock clock.PassiveClock
+	age   *queueAge
+}
+
+func (l latencyMetric) Observe(seconds float64) {
+	l.HistogramMetric.Observe(seconds)
+	l.age.remove(l.clock.Now(), time.Duration(seconds*float64(time.Second)))
+}
+
+// NewDepthMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return depthMetric{
+		GaugeMetric: depth.WithLabelValues(name),
+		clock:       p.clock,
+		age:         p.queueAge(name),
+	}
+}
+
+// NewAddsMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return adds.WithLabelValues(name)
+}
+
+// NewLatencyMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return latencyMetric{
+		HistogramMetric: latency.WithLabelValues(name),
+		clock:           p.clock,
+		age:             p.queueAge(name),
+	}
+}
+
+// NewWorkDurationMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workDuration.WithLabelValues(name)
+}
+
+// NewUnfinishedWorkSecondsMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return unfinished.WithLabelValues(name)
+}
+
+// NewLongestRunningProcessorSecondsMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return longestRunningProcessor.WithLabelValues(name)
+}
+
+// NewRetriesMetric implements the workqueue.MetricsProvider interface.
+func (p *Provider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return retries.WithLabelValues(name)
+}
+
+// DescribeWithStability implements the metrics.StableCollector interface.
+func (p *Provider) DescribeWithStability(ch chan<- *k8smetrics.Desc) {
+	ch <- oldestItemAgeDesc
+}
+
+// CollectWithStability implements the metrics.StableCollector interface.
+func (p *Provider) CollectWithStability(ch chan<- k8smetrics.Metric) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	for name, age := range p.queues {
+		ch <- k8smetrics.NewLazyConstMetric(oldestItemAgeDesc,
+			k8smetrics.GaugeValue,
+			math.Max(0, age.oldest(now).Seconds()),
+			name,
+		)
+	}
+}
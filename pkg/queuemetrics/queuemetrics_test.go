@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queuemetrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	k8smetrics "k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	const name = "test-queue"
+	fakeClock := testingclock.NewFakeClock(time.Now())
+	provider := NewProvider(fakeClock)
+	registry := k8smetrics.NewKubeRegistry()
+	registry.CustomMustRegister(provider)
+	queue := workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(),
+		workqueue.RateLimitingQueueConfig{
+			Name:            name,
+			MetricsProvider: provider,
+			Clock:           fakeClock,
+		})
+	defer queue.ShutDown()
+
+	expect := func(what string, depth int, age time.Duration) {
+		t.Helper()
+		expected := fmt.Sprintf(`# HELP workqueue_depth [ALPHA] Current depth of workqueue
+# TYPE workqueue_depth gauge
+workqueue_depth{name="%s"} %d
+`, name, depth)
+		if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected), "workqueue_depth"); err != nil {
+			t.Errorf("%s: %v", what, err)
+		}
+		expected = fmt.Sprintf(`# HELP workqueue_oldest_item_age_seconds [ALPHA] How many seconds the oldest item in workqueue has been waiting to be requested, zero if the workqueue is empty.
+# TYPE workqueue_oldest_item_age_seconds gauge
+workqueue_oldest_item_age_seconds{name="%s"} %g
+`, name, age.Seconds())
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "workqueue_oldest_item_age_seconds"); err != nil {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+	get := func(expectedItem string) {
+		t.Helper()
+		item, _ := queue.Get()
+		if item != expectedItem {
+			t.Fatalf("expected item %q, got %q", expectedItem, item)
+		}
+	}
+
+	expect("empty", 0, 0)
+
+	queue.Add("a")
+	fakeClock.Step(10 * time.Second)
+	queue.Add("b")
+	fakeClock.Step(5 * time.Second)
+	expect("two items", 2, 15*time.Second)
+
+	get("a")
+	expect("a in progress", 1, 5*time.Second)
+
+	// Added again while in progress, waits behind b.
+	queue.Add("a")
+	fakeClock.Step(time.Second)
+	expect("a added again", 2, 6*time.Second)
+	queue.Done("a")
+
+	get("b")
+	queue.Done("b")
+	expect("b done", 1, time.Second)
+
+	get("a")
+	queue.Done("a")
+	expect("all done", 0, 0)
+}